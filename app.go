@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/unbxd/go-base/kit/transport/http"
@@ -12,6 +13,9 @@ import (
 	"github.com/unbxd/go-base/utils/notifier"
 )
 
+// shutdownTimeout bounds the time spent releasing resources on shutdown
+const shutdownTimeout = 30 * time.Second
+
 type App struct {
 	logger        log.Logger        // for logging
 	metrics       metrics.Metrics   // for publishing metrics to datadog
@@ -19,9 +23,19 @@ type App struct {
 	httpTransport *http.Transport   // for serving http traffic
 
 	binders []Binder
+	servers []Server
 }
 
 func (s *App) Listen(errch chan error) {
+	for _, sr := range s.servers {
+		go func(sr Server) {
+			err := sr.Open()
+			if err != nil {
+				errch <- errors.Wrap(err, "failed to start server")
+			}
+		}(sr)
+	}
+
 	err := s.httpTransport.Open()
 	if err != nil {
 		errch <- errors.Wrap(err, "failed to start transport")
@@ -33,7 +47,7 @@ func (s *App) Open(cx context.Context) (err error) {
 
 	// define channels
 	intch := make(chan os.Signal, 1)
-	errch := make(chan error)
+	errch := make(chan error, len(s.servers)+1)
 
 	go s.Listen(errch)
 	go signal.Notify(intch, os.Interrupt)
@@ -53,6 +67,8 @@ func (s *App) Open(cx context.Context) (err error) {
 				panic(err)
 			}
 
+			s.closeServers()
+			s.closeBinders()
 			return err
 		case er := <-errch:
 			s.logger.Error(
@@ -60,11 +76,58 @@ func (s *App) Open(cx context.Context) (err error) {
 				log.String("error_message", er.Error()),
 				log.Error(er),
 			)
+
+			// release what started before the failure
+			if err := s.httpTransport.Close(); err != nil {
+				s.logger.Error(
+					"failed to close http transport",
+					log.String("error_message", err.Error()),
+					log.Error(err),
+				)
+			}
+
+			s.closeServers()
+			s.closeBinders()
 			return er
 		}
 	}
 }
 
+// closeServers stops the servers running alongside the http transport
+func (s *App) closeServers() {
+	for _, sr := range s.servers {
+		if err := sr.Close(); err != nil {
+			s.logger.Error(
+				"failed to close server",
+				log.String("error_message", err.Error()),
+				log.Error(err),
+			)
+		}
+	}
+}
+
+// closeBinders releases the binders which hold resources, once no
+// more requests are being served
+func (s *App) closeBinders() {
+	cx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, b := range s.binders {
+		c, ok := b.(Closer)
+		if !ok {
+			continue
+		}
+
+		if err := c.Close(cx); err != nil {
+			s.logger.Error(
+				"failed to close binder",
+				log.String("error_message", err.Error()),
+				log.Error(err),
+			)
+		}
+	}
+}
+
 func (s *App) Logger() log.Logger { return s.logger }
 
 func NewApp(options ...Option) (*App, error) {
@@ -84,6 +147,7 @@ func NewApp(options ...Option) (*App, error) {
 		notifier:      notifeir,
 		httpTransport: transport,
 		binders:       []Binder{},
+		servers:       []Server{},
 	}
 
 	for _, fn := range options {
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 
@@ -11,6 +12,12 @@ type Binder interface {
 	Bind(tt *http.Transport, opts ...http.HandlerOption)
 }
 
+// Closer is implemented by binders which hold resources that have to be
+// released once the http transport stops serving
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
 func WithHTTPBinder(binder Binder) Option {
 	fmt.Println(">> Initialising -- ", reflect.TypeOf(binder))
 	return func(a *App) (err error) {
@@ -1,6 +1,10 @@
 package main
 
-import "github.com/urfave/cli/v2"
+import (
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
 
 var (
 	logflags = []cli.Flag{
@@ -74,6 +78,45 @@ var (
 		},
 	}
 
+	storageFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "storage",
+			Value:   "mongo",
+			Usage:   "storage backend for logs. [mongo, memory, disk, sqlite]",
+			EnvVars: []string{"APP_STORAGE"},
+		},
+	}
+
+	diskFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "disk.path",
+			Value:   "data",
+			Usage:   "directory the disk storage keeps its segments in",
+			EnvVars: []string{"APP_DISK_PATH"},
+		},
+		&cli.Int64Flag{
+			Name:    "disk.segment.size",
+			Value:   64 << 20,
+			Usage:   "size in bytes at which the active segment is sealed",
+			EnvVars: []string{"APP_DISK_SEGMENT_SIZE"},
+		},
+		&cli.DurationFlag{
+			Name:    "disk.segment.age",
+			Value:   time.Hour,
+			Usage:   "age at which the active segment is sealed",
+			EnvVars: []string{"APP_DISK_SEGMENT_AGE"},
+		},
+	}
+
+	sqliteFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "sqlite.path",
+			Value:   "klg.db",
+			Usage:   "database file of the sqlite storage",
+			EnvVars: []string{"APP_SQLITE_PATH"},
+		},
+	}
+
 	mongoFlags = []cli.Flag{
 		&cli.StringFlag{
 			Name:    "mongo.uri",
@@ -87,6 +130,201 @@ var (
 			Usage:   "MongoDB database name",
 			EnvVars: []string{"APP_MONGO_DATABASE"},
 		},
+		&cli.BoolFlag{
+			Name:    "mongo.index.sync",
+			Value:   true,
+			Usage:   "create and update the declared indexes on start",
+			EnvVars: []string{"APP_MONGO_INDEX_SYNC"},
+		},
+		&cli.StringFlag{
+			Name:    "mongo.partition",
+			Value:   "none",
+			Usage:   "partition logs into daily or hourly collections: none, daily or hourly",
+			EnvVars: []string{"APP_MONGO_PARTITION"},
+		},
+	}
+
+	ingestFlags = []cli.Flag{
+		&cli.IntFlag{
+			Name:    "ingest.queue.depth",
+			Value:   0,
+			Usage:   "size of the in-process ingestion queue, 0 writes synchronously",
+			EnvVars: []string{"APP_INGEST_QUEUE_DEPTH"},
+		},
+		&cli.IntFlag{
+			Name:    "ingest.writers",
+			Value:   4,
+			Usage:   "number of writers draining the ingestion queue",
+			EnvVars: []string{"APP_INGEST_WRITERS"},
+		},
+		&cli.IntFlag{
+			Name:    "ingest.flush.size",
+			Value:   500,
+			Usage:   "number of entries a writer flushes in one batch",
+			EnvVars: []string{"APP_INGEST_FLUSH_SIZE"},
+		},
+		&cli.DurationFlag{
+			Name:    "ingest.flush.interval",
+			Value:   time.Second,
+			Usage:   "maximum time an entry waits in a writer before it is flushed",
+			EnvVars: []string{"APP_INGEST_FLUSH_INTERVAL"},
+		},
+		&cli.DurationFlag{
+			Name:    "ingest.idempotency.window",
+			Value:   24 * time.Hour,
+			Usage:   "time an event ID is remembered to drop resent entries, 0 disables deduplication",
+			EnvVars: []string{"APP_INGEST_IDEMPOTENCY_WINDOW"},
+		},
+	}
+
+	retentionFlags = []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:    "retention",
+			Usage:   "retention rule [service:]level=ttl, level * for any, e.g. debug=3d, api:*=30d",
+			EnvVars: []string{"APP_RETENTION"},
+		},
+		&cli.DurationFlag{
+			Name:    "retention.interval",
+			Value:   time.Hour,
+			Usage:   "time between two runs of the retention worker",
+			EnvVars: []string{"APP_RETENTION_INTERVAL"},
+		},
+	}
+
+	archiveFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "archive.path",
+			Usage:   "directory to archive old logs into, archiving is disabled when empty",
+			EnvVars: []string{"APP_ARCHIVE_PATH"},
+		},
+		&cli.StringFlag{
+			Name:    "archive.age",
+			Value:   "30d",
+			Usage:   "age after which logs are moved into the archive, e.g. 30d",
+			EnvVars: []string{"APP_ARCHIVE_AGE"},
+		},
+		&cli.DurationFlag{
+			Name:    "archive.interval",
+			Value:   time.Hour,
+			Usage:   "time between two runs of the archiver",
+			EnvVars: []string{"APP_ARCHIVE_INTERVAL"},
+		},
+		&cli.StringFlag{
+			Name:    "archive.restore.ttl",
+			Value:   "7d",
+			Usage:   "time restored logs are kept before they are archived again",
+			EnvVars: []string{"APP_ARCHIVE_RESTORE_TTL"},
+		},
+	}
+
+	streamFlags = []cli.Flag{
+		&cli.IntFlag{
+			Name:    "stream.backlog",
+			Value:   10000,
+			Usage:   "number of recent entries kept for tail streams to resume from",
+			EnvVars: []string{"APP_STREAM_BACKLOG"},
+		},
+		&cli.DurationFlag{
+			Name:    "stream.heartbeat",
+			Value:   15 * time.Second,
+			Usage:   "time after which an idle tail stream sends a heartbeat",
+			EnvVars: []string{"APP_STREAM_HEARTBEAT"},
+		},
+		&cli.BoolFlag{
+			Name:    "stream.changestream",
+			Usage:   "stream the entries stored by every replica from MongoDB change streams, needs a replica set",
+			EnvVars: []string{"APP_STREAM_CHANGESTREAM"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "stream.origins",
+			Usage:   "origins besides the server's own allowed to open a WebSocket tail stream, e.g. https://grafana.example.com, * for any",
+			EnvVars: []string{"APP_STREAM_ORIGINS"},
+		},
+	}
+
+	syslogFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "syslog.udp",
+			Usage:   "enable syslog receiver on the given udp address, e.g. 0.0.0.0:5514",
+			EnvVars: []string{"APP_SYSLOG_UDP"},
+		},
+		&cli.StringFlag{
+			Name:    "syslog.tcp",
+			Usage:   "enable syslog receiver on the given tcp address, e.g. 0.0.0.0:5514",
+			EnvVars: []string{"APP_SYSLOG_TCP"},
+		},
+	}
+
+	gelfFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "gelf.udp",
+			Usage:   "enable gelf receiver on the given udp address, e.g. 0.0.0.0:12201",
+			EnvVars: []string{"APP_GELF_UDP"},
+		},
+		&cli.StringFlag{
+			Name:    "gelf.tcp",
+			Usage:   "enable gelf receiver on the given tcp address, e.g. 0.0.0.0:12201",
+			EnvVars: []string{"APP_GELF_TCP"},
+		},
+		&cli.DurationFlag{
+			Name:    "gelf.chunk.timeout",
+			Value:   5 * time.Second,
+			Usage:   "time to wait for all chunks of a chunked gelf message",
+			EnvVars: []string{"APP_GELF_CHUNK_TIMEOUT"},
+		},
+	}
+
+	forwardFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "forward.tcp",
+			Usage:   "enable fluent forward receiver on the given tcp address, e.g. 0.0.0.0:24224",
+			EnvVars: []string{"APP_FORWARD_TCP"},
+		},
+		&cli.StringFlag{
+			Name:    "forward.level.key",
+			Value:   "level",
+			Usage:   "record key the level of forwarded records is read from",
+			EnvVars: []string{"APP_FORWARD_LEVEL_KEY"},
+		},
+	}
+
+	// tailFlags are the flags of the tail command
+	tailFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "tail.server",
+			Value:   "http://localhost:6060",
+			Usage:   "base url of the klg server lines are shipped to",
+			EnvVars: []string{"APP_TAIL_SERVER"},
+		},
+		&cli.StringFlag{
+			Name:    "tail.state",
+			Value:   "klg-tail.json",
+			Usage:   "file the shipped offsets are persisted in",
+			EnvVars: []string{"APP_TAIL_STATE"},
+		},
+		&cli.StringFlag{
+			Name:    "tail.level",
+			Value:   "info",
+			Usage:   "level the shipped lines are stored with",
+			EnvVars: []string{"APP_TAIL_LEVEL"},
+		},
+		&cli.IntFlag{
+			Name:    "tail.batch.size",
+			Value:   500,
+			Usage:   "maximum number of lines shipped in a single request",
+			EnvVars: []string{"APP_TAIL_BATCH_SIZE"},
+		},
+		&cli.DurationFlag{
+			Name:    "tail.poll",
+			Value:   time.Second,
+			Usage:   "interval the files are checked for new lines",
+			EnvVars: []string{"APP_TAIL_POLL"},
+		},
+		&cli.BoolFlag{
+			Name:    "tail.from.start",
+			Usage:   "ship existing files from the start instead of only new lines",
+			EnvVars: []string{"APP_TAIL_FROM_START"},
+		},
 	}
 )
 
@@ -96,6 +334,16 @@ func flags() []cli.Flag {
 	flags = append(flags, httpflags...)
 	flags = append(flags, proxyFlags...)
 	flags = append(flags, crudFlags...)
+	flags = append(flags, storageFlags...)
 	flags = append(flags, mongoFlags...)
+	flags = append(flags, diskFlags...)
+	flags = append(flags, sqliteFlags...)
+	flags = append(flags, ingestFlags...)
+	flags = append(flags, retentionFlags...)
+	flags = append(flags, archiveFlags...)
+	flags = append(flags, streamFlags...)
+	flags = append(flags, syslogFlags...)
+	flags = append(flags, gelfFlags...)
+	flags = append(flags, forwardFlags...)
 	return flags
 }
@@ -2,15 +2,26 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	liblog "log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 
 	app "github.com/bhuvankumar123/klg"
 	"github.com/bhuvankumar123/klg/cmd/ldflags"
 	"github.com/bhuvankumar123/klg/crud"
+	"github.com/bhuvankumar123/klg/elastic"
+	"github.com/bhuvankumar123/klg/forward"
+	"github.com/bhuvankumar123/klg/gelf"
+	"github.com/bhuvankumar123/klg/loki"
+	"github.com/bhuvankumar123/klg/otlp"
 	"github.com/bhuvankumar123/klg/proxy"
+	"github.com/bhuvankumar123/klg/shipper"
+	"github.com/bhuvankumar123/klg/syslog"
 	"github.com/pkg/errors"
 	"github.com/unbxd/go-base/utils/log"
 	"github.com/urfave/cli/v2"
@@ -57,6 +68,51 @@ func errorstack(errorstr string) string {
 	return buff.String()
 }
 
+// newService returns the storage backend selected with --storage
+func newService(cx *cli.Context) (crud.Service, error) {
+	window := cx.Duration("ingest.idempotency.window")
+
+	switch storage := cx.String("storage"); storage {
+	case "mongo":
+		service, err := crud.NewMongoService(
+			cx.String("mongo.uri"),
+			cx.String("mongo.database"),
+			cx.Bool("mongo.index.sync"),
+			cx.String("mongo.partition"),
+			window,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to initialize MongoDB service")
+		}
+		return service, nil
+	case "memory":
+		service, err := crud.NewService(window)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to initialize memory service")
+		}
+		return service, nil
+	case "disk":
+		service, err := crud.NewDiskService(
+			cx.String("disk.path"),
+			cx.Int64("disk.segment.size"),
+			cx.Duration("disk.segment.age"),
+			window,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to initialize disk service")
+		}
+		return service, nil
+	case "sqlite":
+		service, err := crud.NewSQLiteService(cx.String("sqlite.path"), window)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to initialize sqlite service")
+		}
+		return service, nil
+	default:
+		return nil, errors.New("unknown storage " + storage + ", expected mongo, memory, disk or sqlite")
+	}
+}
+
 // Command Start
 func beforeStart(cx *cli.Context) (ax *app.App, err error) {
 	logger, err := log.NewZapLogger(
@@ -76,17 +132,106 @@ func beforeStart(cx *cli.Context) (ax *app.App, err error) {
 		return nil, errors.Wrap(err, "failed to create proxy binder")
 	}
 
+	service, err := newService(cx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the archiver writes around the ingestion queue, so that a restore
+	// reports what was stored, and around tail streams, which only carry
+	// new entries
+	store := service
+
+	tailer, err := crud.NewTailer(logger, cx.Int("stream.backlog"), cx.Duration("stream.heartbeat"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create tailer")
+	}
+
+	// tail streams follow the change streams of MongoDB, which carry the
+	// writes of every replica, or else the entries stored by this one
+	var watcher *crud.MongoWatcher
+	if cx.Bool("stream.changestream") {
+		if cx.String("storage") != "mongo" {
+			return nil, errors.New("stream.changestream needs the mongo storage")
+		}
+
+		watcher, err = crud.NewMongoWatcher(
+			logger,
+			cx.String("mongo.uri"),
+			cx.String("mongo.database"),
+			tailer,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create mongo watcher")
+		}
+	} else {
+		service, err = crud.NewTailService(service, tailer)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create tail service")
+		}
+	}
+
+	if depth := cx.Int("ingest.queue.depth"); depth > 0 {
+		service, err = crud.NewBufferedService(
+			service,
+			logger,
+			depth,
+			cx.Int("ingest.writers"),
+			cx.Int("ingest.flush.size"),
+			cx.Duration("ingest.flush.interval"),
+			cx.Duration("ingest.idempotency.window"),
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create ingestion queue")
+		}
+	}
+
 	// Create log binder
-	mb, err := crud.NewHTTPBinder(
-		logger,
-		cx.String("mongo.uri"),
-		cx.String("mongo.database"),
-	)
+	mb, err := crud.NewHTTPBinder(logger, service)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create log binder")
 	}
 
-	ax, err = app.NewApp(
+	// OTLP receiver stores logs through the same service
+	ob, err := otlp.NewOTLPBinder(service)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create otlp binder")
+	}
+
+	// Loki push and query API on top of the same service
+	lb, err := loki.NewLokiBinder(logger, service)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create loki binder")
+	}
+
+	// Elasticsearch bulk API for Beats and Logstash
+	eb, err := elastic.NewElasticBinder(logger, service)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create elastic binder")
+	}
+
+	rules, err := crud.ParseRetentionRules(cx.StringSlice("retention"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Retention worker purges entries which outlived their rule
+	rw, err := crud.NewRetentionWorker(logger, service, rules, cx.Duration("retention.interval"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create retention worker")
+	}
+
+	rb, err := crud.NewRetentionBinder(logger, rw)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create retention binder")
+	}
+
+	tb, err := crud.NewTailBinder(logger, tailer, cx.StringSlice("stream.origins"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create tail binder")
+	}
+
+	options := []app.Option{
 		app.WithCustomLogger(logger),
 		app.WithHTTPTransport(
 			cx.String("http.host"),
@@ -95,7 +240,100 @@ func beforeStart(cx *cli.Context) (ax *app.App, err error) {
 		),
 		app.WithHTTPBinder(pb),
 		app.WithHTTPBinder(mb),
-	)
+		app.WithHTTPBinder(ob),
+		app.WithHTTPBinder(lb),
+		app.WithHTTPBinder(eb),
+		app.WithHTTPBinder(rb),
+		app.WithHTTPBinder(tb),
+	}
+
+	if watcher != nil {
+		options = append(options, app.WithServer(watcher))
+	}
+
+	if len(rules) > 0 {
+		options = append(options, app.WithServer(rw))
+	}
+
+	// archiver moves old entries into the archive directory
+	if cx.String("archive.path") != "" {
+		age, err := crud.ParseTTL(cx.String("archive.age"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid archive age")
+		}
+
+		ttl, err := crud.ParseTTL(cx.String("archive.restore.ttl"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid archive restore ttl")
+		}
+
+		av, err := crud.NewArchiver(
+			logger,
+			store,
+			cx.String("archive.path"),
+			age,
+			cx.Duration("archive.interval"),
+			ttl,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create archiver")
+		}
+
+		ab, err := crud.NewArchiveBinder(logger, av)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create archive binder")
+		}
+
+		options = append(options, app.WithHTTPBinder(ab), app.WithServer(av))
+	}
+
+	// syslog receiver shares the service with the log binder
+	if cx.String("syslog.udp") != "" || cx.String("syslog.tcp") != "" {
+		ss, err := syslog.NewServer(
+			logger,
+			service,
+			cx.String("syslog.udp"),
+			cx.String("syslog.tcp"),
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create syslog server")
+		}
+
+		options = append(options, app.WithServer(ss))
+	}
+
+	// gelf receiver shares the service with the log binder
+	if cx.String("gelf.udp") != "" || cx.String("gelf.tcp") != "" {
+		gs, err := gelf.NewServer(
+			logger,
+			service,
+			cx.String("gelf.udp"),
+			cx.String("gelf.tcp"),
+			cx.Duration("gelf.chunk.timeout"),
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create gelf server")
+		}
+
+		options = append(options, app.WithServer(gs))
+	}
+
+	// forward receiver shares the service with the log binder
+	if cx.String("forward.tcp") != "" {
+		fs, err := forward.NewServer(
+			logger,
+			service,
+			cx.String("forward.tcp"),
+			cx.String("forward.level.key"),
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create forward server")
+		}
+
+		options = append(options, app.WithServer(fs))
+	}
+
+	ax, err = app.NewApp(options...)
 	return
 }
 
@@ -103,6 +341,101 @@ func actionStart(cx *cli.Context, ax *app.App) (err error) {
 	return ax.Open(cx.Context)
 }
 
+// Command Tail
+func actionTail(cx *cli.Context) (err error) {
+	logger, err := log.NewZapLogger(
+		log.ZapWithLevel(cx.String("log.level")),
+		log.ZapWithEncoding(cx.String("log.encoding")),
+		log.ZapWithOutput([]string{cx.String("log.output")}),
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to initliase logging")
+	}
+
+	agent, err := shipper.NewAgent(
+		logger,
+		cx.String("tail.server"),
+		cx.Args().Slice(),
+		cx.String("tail.state"),
+		cx.String("tail.level"),
+		cx.Int("tail.batch.size"),
+		cx.Duration("tail.poll"),
+		cx.Bool("tail.from.start"),
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to create tail agent")
+	}
+
+	ctx, stop := signal.NotifyContext(cx.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return agent.Run(ctx)
+}
+
+// Command Index
+func actionIndex(action func(context.Context, *crud.IndexManager) error) cli.ActionFunc {
+	return func(cx *cli.Context) error {
+		im, err := crud.NewIndexManager(
+			cx.String("mongo.uri"),
+			cx.String("mongo.database"),
+			cx.String("mongo.partition"),
+		)
+		if err != nil {
+			return errors.Wrap(err, "failed to initialize index manager")
+		}
+		defer im.Close(context.Background())
+
+		return action(cx.Context, im)
+	}
+}
+
+func printIndexes(statuses []crud.IndexStatus) (drift int) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLLECTION\tNAME\tSTATE\tKEYS")
+	for _, st := range statuses {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", st.Collection, st.Name, st.State, st.Keys)
+		if st.Drift() {
+			drift++
+		}
+	}
+	tw.Flush()
+	return drift
+}
+
+func indexList(ctx context.Context, im *crud.IndexManager) error {
+	statuses, err := im.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	if drift := printIndexes(statuses); drift > 0 {
+		return errors.Errorf("%d indexes differ from the declared set, run index sync", drift)
+	}
+	return nil
+}
+
+func indexSync(ctx context.Context, im *crud.IndexManager) error {
+	statuses, err := im.Sync(ctx)
+	if err != nil {
+		return err
+	}
+
+	if drift := printIndexes(statuses); drift > 0 {
+		fmt.Printf("\nsynced %d indexes\n", drift)
+	} else {
+		fmt.Println("\nindexes are in sync")
+	}
+	return nil
+}
+
+func indexDrop(ctx context.Context, im *crud.IndexManager) error {
+	dropped, err := im.Drop(ctx)
+	for _, name := range dropped {
+		fmt.Println("dropped", name)
+	}
+	return err
+}
+
 // main function
 func main() {
 	var ax *app.App
@@ -126,6 +459,35 @@ func main() {
 					return actionStart(cx, ax)
 				},
 			},
+			{
+				Name:  "index",
+				Usage: "manages the MongoDB indexes of the logs collection or its partitions",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "lists indexes and their drift from the declared set",
+						Action: actionIndex(indexList),
+					},
+					{
+						Name:   "sync",
+						Usage:  "creates missing and updates changed indexes",
+						Action: actionIndex(indexSync),
+					},
+					{
+						Name:   "drop",
+						Usage:  "drops the indexes managed by klg",
+						Action: actionIndex(indexDrop),
+					},
+				},
+			},
+			{
+				Name:      "tail",
+				Aliases:   []string{"t"},
+				Usage:     "follows log files and ships their lines to a klg server",
+				ArgsUsage: "<glob> [<glob>...]",
+				Flags:     tailFlags,
+				Action:    actionTail,
+			},
 			{
 				Name:    "version",
 				Aliases: []string{"v"},
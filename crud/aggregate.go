@@ -0,0 +1,260 @@
+package crud
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// aggregateIntervals are the bucket widths Aggregate accepts
+var aggregateIntervals = map[string]time.Duration{
+	"1m": time.Minute,
+	"5m": 5 * time.Minute,
+	"1h": time.Hour,
+	"1d": 24 * time.Hour,
+}
+
+const (
+	// defaultAggregateInterval and defaultAggregateRange apply when the
+	// filter has no interval or no starttime
+	defaultAggregateInterval = "1h"
+	defaultAggregateRange    = 24 * time.Hour
+
+	// maxAggregateBuckets caps the buckets of a range, a week of minutes
+	maxAggregateBuckets = 7 * 24 * 60
+
+	// maxAggregateGroups caps the fields of group_by
+	maxAggregateGroups = 4
+)
+
+// Aggregation counts the entries of a time range per bucket and group.
+// Buckets are aligned on the interval since the epoch, in UTC, and cover
+// the range without gaps.
+type Aggregation struct {
+	Interval string            `json:"interval"`
+	Start    int64             `json:"starttime"`
+	End      int64             `json:"endtime"`
+	GroupBy  []string          `json:"group_by"`
+	Total    int64             `json:"total"`
+	Buckets  []AggregateBucket `json:"buckets"`
+}
+
+// AggregateBucket counts the entries from Timestamp until the next bucket
+type AggregateBucket struct {
+	Timestamp int64            `json:"timestamp"`
+	Count     int64            `json:"count"`
+	Groups    []AggregateGroup `json:"groups"`
+}
+
+// AggregateGroup counts the entries of a bucket with the values of Key for
+// the group_by fields, a missing metadata field is null
+type AggregateGroup struct {
+	Key   map[string]interface{} `json:"key"`
+	Count int64                  `json:"count"`
+}
+
+// aggregateQuery is the filter of Aggregate, a List filter whose time
+// range is always set, with an interval and group_by fields
+type aggregateQuery struct {
+	list     *listQuery
+	name     string
+	interval int64
+	start    int64
+	end      int64
+
+	// groupBy holds level or metadata.<path> fields, paths holds the
+	// metadata path of each, nil for level
+	groupBy []string
+	paths   [][]string
+}
+
+// parseAggregateQuery reads interval and group_by on top of the List
+// filter. The range defaults to the day before now, recent and cursor
+// are ignored.
+func parseAggregateQuery(filter map[string]interface{}, now time.Time) (*aggregateQuery, error) {
+	list := make(map[string]interface{}, len(filter))
+	for key, value := range filter {
+		switch key {
+		case "recent", "cursor", "interval", "group_by":
+			continue
+		}
+		list[key] = value
+	}
+
+	lq, err := parseListQuery(list)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &aggregateQuery{list: lq, name: defaultAggregateInterval}
+	if name, ok := filter["interval"].(string); ok && name != "" {
+		q.name = name
+	}
+
+	interval, ok := aggregateIntervals[q.name]
+	if !ok {
+		return nil, errors.Wrap(ErrBadRequest, "interval must be one of 1m, 5m, 1h or 1d")
+	}
+	q.interval = int64(interval)
+
+	q.end = now.UnixNano()
+	if lq.end != nil {
+		q.end = *lq.end
+	}
+	q.start = q.end - int64(defaultAggregateRange)
+	if lq.start != nil {
+		q.start = *lq.start
+	}
+	lq.start, lq.end = &q.start, &q.end
+
+	if q.end < q.start {
+		return nil, errors.Wrap(ErrBadRequest, "endtime is before starttime")
+	}
+	if (q.bucket(q.end)-q.bucket(q.start))/q.interval >= maxAggregateBuckets {
+		return nil, errors.Wrap(ErrBadRequest, "too many buckets, use a larger interval or a shorter range")
+	}
+
+	if groupBy, ok := filter["group_by"].(string); ok && groupBy != "" {
+		for _, field := range strings.Split(groupBy, ",") {
+			switch {
+			case field == "level":
+				q.paths = append(q.paths, nil)
+			case strings.HasPrefix(field, metadataPrefix):
+				path, err := parseMetadataPath(strings.TrimPrefix(field, metadataPrefix))
+				if err != nil {
+					return nil, err
+				}
+				q.paths = append(q.paths, path)
+			default:
+				return nil, errors.Wrap(ErrBadRequest, "cannot group by "+field)
+			}
+			q.groupBy = append(q.groupBy, field)
+		}
+	}
+
+	if len(q.groupBy) > maxAggregateGroups {
+		return nil, errors.Wrap(ErrBadRequest, "too many group_by fields")
+	}
+
+	return q, nil
+}
+
+// bucket returns the start of the bucket of ts
+func (q *aggregateQuery) bucket(ts int64) int64 {
+	b := ts - ts%q.interval
+	if ts < 0 && b != ts {
+		b -= q.interval
+	}
+	return b
+}
+
+// aggregator counts entries per bucket and group for the backends which
+// aggregate in memory, and merges the counts of the others
+type aggregator struct {
+	q      *aggregateQuery
+	counts map[aggregateKey]*AggregateGroup
+}
+
+// aggregateKey is a bucket and the JSON encoded values of a group
+type aggregateKey struct {
+	bucket int64
+	group  string
+}
+
+func newAggregator(q *aggregateQuery) *aggregator {
+	return &aggregator{q: q, counts: map[aggregateKey]*AggregateGroup{}}
+}
+
+// addEntry counts a matching entry
+func (a *aggregator) addEntry(entry *LogEntry) {
+	values := make([]interface{}, len(a.q.paths))
+	for ix, path := range a.q.paths {
+		if path == nil {
+			values[ix] = entry.Level
+			continue
+		}
+
+		if value, ok := lookup(entry.Metadata, path); ok {
+			values[ix] = value
+		}
+	}
+
+	a.add(entry.Timestamp, values, 1)
+}
+
+// add counts entries at ts with the values of the group_by fields.
+// Numbers are compared as float64, whatever type they were decoded as.
+func (a *aggregator) add(ts int64, values []interface{}, count int64) {
+	for ix, value := range values {
+		if n, ok := number(value); ok {
+			values[ix] = n
+		}
+	}
+
+	// values decoded from JSON or BSON always encode
+	bt, _ := json.Marshal(values)
+
+	key := aggregateKey{bucket: a.q.bucket(ts), group: string(bt)}
+	group, ok := a.counts[key]
+	if !ok {
+		group = &AggregateGroup{Key: make(map[string]interface{}, len(values))}
+		for ix, field := range a.q.groupBy {
+			group.Key[field] = values[ix]
+		}
+		a.counts[key] = group
+	}
+	group.Count += count
+}
+
+// result returns the buckets of the range, the groups of a bucket are
+// ordered by count, largest first
+func (a *aggregator) result() *Aggregation {
+	var (
+		first   = a.q.bucket(a.q.start)
+		last    = a.q.bucket(a.q.end)
+		buckets = make([]AggregateBucket, 0, (last-first)/a.q.interval+1)
+		index   = map[int64]int{}
+	)
+
+	for ts := first; ts <= last; ts += a.q.interval {
+		index[ts] = len(buckets)
+		buckets = append(buckets, AggregateBucket{Timestamp: ts, Groups: []AggregateGroup{}})
+	}
+
+	keys := make([]aggregateKey, 0, len(a.counts))
+	for key := range a.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ci, cj := a.counts[keys[i]].Count, a.counts[keys[j]].Count
+		if ci != cj {
+			return ci > cj
+		}
+		return keys[i].group < keys[j].group
+	})
+
+	agg := &Aggregation{
+		Interval: a.q.name,
+		Start:    a.q.start,
+		End:      a.q.end,
+		GroupBy:  append([]string{}, a.q.groupBy...),
+		Buckets:  buckets,
+	}
+
+	for _, key := range keys {
+		ix, ok := index[key.bucket]
+		if !ok {
+			continue
+		}
+
+		group := a.counts[key]
+		buckets[ix].Count += group.Count
+		buckets[ix].Groups = append(buckets[ix].Groups, *group)
+		agg.Total += group.Count
+	}
+
+	return agg
+}
@@ -0,0 +1,612 @@
+package crud
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+const (
+	// archiveManifest is the manifest file in the archive directory
+	archiveManifest = "manifest.json"
+
+	// archiveDay is the layout of the directory of a UTC day
+	archiveDay = "2006-01-02"
+
+	// archiveBatch is the number of entries listed and archived at once
+	archiveBatch = 1000
+
+	// restoreBatch is the number of entries restored with one CreateMany
+	restoreBatch = 1000
+
+	day = 24 * time.Hour
+)
+
+// ArchiveFile is a part of the archive, gzip compressed NDJSON entries of
+// a level on a UTC day. A day may have several parts of a level, when
+// entries arrive late or are archived again after a restore.
+type ArchiveFile struct {
+	Day        string    `json:"day"`
+	Level      string    `json:"level"`
+	Path       string    `json:"path"`
+	Count      int       `json:"count"`
+	MinTs      int64     `json:"min_ts"`
+	MaxTs      int64     `json:"max_ts"`
+	Size       int64     `json:"size"`
+	ArchivedAt time.Time `json:"archived_at"`
+}
+
+// ArchiveRestore is a range of the archive restored into the service. The
+// archiver leaves the days it overlaps alone until Until.
+type ArchiveRestore struct {
+	From     int64     `json:"from"`
+	To       int64     `json:"to"`
+	Until    time.Time `json:"until"`
+	Files    int       `json:"files"`
+	Restored int       `json:"restored"`
+	Skipped  int       `json:"skipped"`
+}
+
+// ArchiveManifest lists the files of the archive and the active restores
+type ArchiveManifest struct {
+	Files    []ArchiveFile    `json:"files"`
+	Restores []ArchiveRestore `json:"restores"`
+}
+
+// Archiver moves the entries older than age out of the service into an
+// archive directory, once on open and then on every interval. Whole UTC
+// days are archived, oldest first. It implements the app Server.
+type Archiver struct {
+	logger     log.Logger
+	service    Service
+	dir        string
+	age        time.Duration
+	interval   time.Duration
+	restoreTTL time.Duration
+
+	// mu guards the manifest. A run holds it while it writes and deletes
+	// a page, a restore while it records itself and its result.
+	mu       sync.Mutex
+	manifest ArchiveManifest
+
+	once sync.Once
+	done chan struct{}
+}
+
+// Open runs the archiver until Close
+func (a *Archiver) Open() error {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		a.run(time.Now())
+
+		select {
+		case <-a.done:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops the archiver, a running pass completes its current day
+func (a *Archiver) Close() error {
+	a.once.Do(func() { close(a.done) })
+	return nil
+}
+
+func (a *Archiver) run(now time.Time) {
+	archived, err := a.archive(context.Background(), now)
+	if err != nil {
+		a.logger.Error("failed to archive logs", log.Error(err))
+	}
+
+	if archived > 0 {
+		a.logger.Info("archived logs", log.Int("entries", archived))
+	}
+}
+
+// archive moves the days before now - age into the archive, except those
+// of an active restore
+func (a *Archiver) archive(ctx context.Context, now time.Time) (int, error) {
+	a.mu.Lock()
+	err := a.expire(now)
+	a.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	days, err := a.days(ctx, startOfDay(now.Add(-a.age)))
+	if err != nil {
+		return 0, err
+	}
+
+	archived := 0
+	for ix := len(days) - 1; ix >= 0; ix-- {
+		select {
+		case <-a.done:
+			return archived, nil
+		default:
+		}
+
+		count, err := a.archiveDay(ctx, days[ix])
+		archived += count
+		if err != nil {
+			return archived, errors.Wrap(err, "failed to archive "+days[ix].Format(archiveDay))
+		}
+	}
+
+	return archived, nil
+}
+
+// days returns the UTC days before cutoff which hold entries, most recent
+// first. Each step jumps to the day of the next older entry, so that days
+// without entries cost nothing.
+func (a *Archiver) days(ctx context.Context, cutoff time.Time) ([]time.Time, error) {
+	days := []time.Time{}
+	for end := cutoff.UnixNano(); ; {
+		entries, err := a.service.List(ctx, map[string]interface{}{
+			"endtime": strconv.FormatInt(end-1, 10),
+			"recent":  "1",
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list logs to archive")
+		}
+
+		if len(entries) == 0 {
+			return days, nil
+		}
+
+		start := startOfDay(time.Unix(0, entries[0].Timestamp))
+		days = append(days, start)
+		end = start.UnixNano()
+	}
+}
+
+// archiveDay moves the entries of a day into the archive, a page of
+// archiveBatch entries at a time. Only the entries of a page are deleted
+// once it is written, those which arrive for the day meanwhile are left
+// for the next run. The day is left alone from the page a restore of it
+// starts.
+func (a *Archiver) archiveDay(ctx context.Context, start time.Time) (int, error) {
+	a.mu.Lock()
+	if a.restored(start, time.Now()) {
+		a.mu.Unlock()
+		return 0, nil
+	}
+	archived, err := a.archivedIDs(start)
+	a.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	filter := map[string]interface{}{
+		"starttime": strconv.FormatInt(start.UnixNano(), 10),
+		"endtime":   strconv.FormatInt(start.Add(day).UnixNano()-1, 10),
+		"recent":    strconv.Itoa(archiveBatch),
+	}
+
+	count := 0
+	for {
+		entries, err := a.service.List(ctx, filter)
+		if err != nil {
+			return count, errors.Wrap(err, "failed to list logs to archive")
+		}
+
+		if len(entries) == 0 {
+			return count, nil
+		}
+
+		written, ok, err := a.archivePage(ctx, start, archived, entries)
+		count += written
+		if err != nil || !ok {
+			return count, err
+		}
+
+		if len(entries) < archiveBatch {
+			return count, nil
+		}
+		filter["cursor"] = EncodeCursor(&entries[len(entries)-1])
+	}
+}
+
+// archivePage writes the entries of a page into one file per level, and
+// then deletes them from the service by ID at once. Entries already in a
+// file of the day, back in the service after a restore, are deleted
+// without being written again. It reports false, leaving the page alone,
+// if the day is being restored.
+func (a *Archiver) archivePage(
+	ctx context.Context,
+	start time.Time,
+	archived map[string]bool,
+	entries []LogEntry,
+) (int, bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.restored(start, time.Now()) {
+		return 0, false, nil
+	}
+
+	levels := map[string][]*LogEntry{}
+	for ix := range entries {
+		entry := &entries[ix]
+		if !archived[entry.ID] {
+			levels[entry.Level] = append(levels[entry.Level], entry)
+		}
+	}
+
+	written := 0
+	for _, level := range sortedKeys(levels) {
+		file, err := a.write(start, level, levels[level])
+		if err != nil {
+			return written, false, err
+		}
+
+		a.manifest.Files = append(a.manifest.Files, *file)
+		if err := a.save(); err != nil {
+			return written, false, err
+		}
+
+		for _, entry := range levels[level] {
+			archived[entry.ID] = true
+		}
+		written += len(levels[level])
+	}
+
+	ids := make([]string, len(entries))
+	for ix := range entries {
+		ids[ix] = entries[ix].ID
+	}
+
+	if err := a.service.Delete(ctx, map[string]interface{}{idsKey: ids}); err != nil {
+		return written, false, errors.Wrap(err, "failed to delete archived logs")
+	}
+
+	return written, true, nil
+}
+
+// archivedIDs returns the IDs of the entries in the files of the day.
+// Callers must hold the lock.
+func (a *Archiver) archivedIDs(start time.Time) (map[string]bool, error) {
+	name := start.Format(archiveDay)
+
+	archived := map[string]bool{}
+	for _, file := range a.manifest.Files {
+		if file.Day != name {
+			continue
+		}
+
+		stored, err := readArchive(filepath.Join(a.dir, file.Path))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range stored {
+			archived[entry.ID] = true
+		}
+	}
+	return archived, nil
+}
+
+// files returns the files of the day and level
+func (a *Archiver) files(start time.Time, level string) []ArchiveFile {
+	name := start.Format(archiveDay)
+
+	files := []ArchiveFile{}
+	for _, file := range a.manifest.Files {
+		if file.Day == name && file.Level == level {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// write stores the entries of a day and level as a new file, oldest first
+func (a *Archiver) write(start time.Time, level string, entries []*LogEntry) (*ArchiveFile, error) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Timestamp != entries[j].Timestamp {
+			return entries[i].Timestamp < entries[j].Timestamp
+		}
+		return entries[i].ID < entries[j].ID
+	})
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return nil, errors.Wrap(err, "failed to encode archived log entry")
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to compress archive")
+	}
+
+	var (
+		name = start.Format(archiveDay)
+		path = filepath.Join(name, fmt.Sprintf("%s.%d.ndjson.gz", level, len(a.files(start, level))))
+	)
+
+	if err := os.MkdirAll(filepath.Join(a.dir, name), 0o755); err != nil {
+		return nil, errors.Wrap(err, "failed to create archive directory")
+	}
+
+	// a file left behind by a crash before the manifest was saved is
+	// overwritten by the next run
+	if err := writeFile(filepath.Join(a.dir, path), buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return &ArchiveFile{
+		Day:        name,
+		Level:      level,
+		Path:       path,
+		Count:      len(entries),
+		MinTs:      entries[0].Timestamp,
+		MaxTs:      entries[len(entries)-1].Timestamp,
+		Size:       int64(buf.Len()),
+		ArchivedAt: time.Now().UTC(),
+	}, nil
+}
+
+// restored reports whether the day overlaps an active restore
+func (a *Archiver) restored(start time.Time, now time.Time) bool {
+	var (
+		from = start.UnixNano()
+		to   = start.Add(day).UnixNano() - 1
+	)
+
+	for _, restore := range a.manifest.Restores {
+		if restore.Until.After(now) && restore.From <= to && restore.To >= from {
+			return true
+		}
+	}
+	return false
+}
+
+// expire forgets the restores which ended, their days are archived again
+func (a *Archiver) expire(now time.Time) error {
+	restores := make([]ArchiveRestore, 0, len(a.manifest.Restores))
+	for _, restore := range a.manifest.Restores {
+		if restore.Until.After(now) {
+			restores = append(restores, restore)
+		}
+	}
+
+	if len(restores) == len(a.manifest.Restores) {
+		return nil
+	}
+
+	a.manifest.Restores = restores
+	return a.save()
+}
+
+// Restore puts the archived entries with a timestamp in the inclusive
+// range from, to back into the service. They are kept out of the archive
+// for ttl, the default restore ttl when zero. Entries still in the
+// service are skipped.
+func (a *Archiver) Restore(ctx context.Context, from, to int64, ttl time.Duration) (*ArchiveRestore, error) {
+	if ttl <= 0 {
+		ttl = a.restoreTTL
+	}
+
+	// recorded first, so that a run after a failed restore leaves the
+	// entries restored so far in the service, and so that a run leaves
+	// the days alone from its next page
+	a.mu.Lock()
+	restore := ArchiveRestore{From: from, To: to, Until: time.Now().Add(ttl).UTC()}
+	a.manifest.Restores = append(a.manifest.Restores, restore)
+	err := a.save()
+	files := append([]ArchiveFile{}, a.manifest.Files...)
+	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	batch := make([]*LogEntry, 0, restoreBatch)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		errs, err := a.service.CreateMany(ctx, batch)
+		if err != nil {
+			return errors.Wrap(err, "failed to restore log entries")
+		}
+
+		for _, er := range errs {
+			if er != nil {
+				restore.Skipped++
+				continue
+			}
+			restore.Restored++
+		}
+
+		batch = batch[:0]
+		return nil
+	}
+
+	for _, file := range files {
+		if file.MaxTs < from || file.MinTs > to {
+			continue
+		}
+
+		entries, err := readArchive(filepath.Join(a.dir, file.Path))
+		if err != nil {
+			return nil, err
+		}
+		restore.Files++
+
+		for _, entry := range entries {
+			if entry.Timestamp < from || entry.Timestamp > to {
+				continue
+			}
+
+			if batch = append(batch, entry); len(batch) == restoreBatch {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	if err := a.record(restore); err != nil {
+		return nil, err
+	}
+
+	a.logger.Info(
+		"restored archived logs",
+		log.Int("restored", restore.Restored),
+		log.Int("skipped", restore.Skipped),
+	)
+	return &restore, nil
+}
+
+// record saves the result of a restore in its entry of the manifest, if
+// it hasn't expired meanwhile
+func (a *Archiver) record(restore ArchiveRestore) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for ix, rs := range a.manifest.Restores {
+		if rs.From == restore.From && rs.To == restore.To && rs.Until.Equal(restore.Until) {
+			a.manifest.Restores[ix] = restore
+			return a.save()
+		}
+	}
+	return nil
+}
+
+// Manifest returns the files of the archive and the active restores
+func (a *Archiver) Manifest() *ArchiveManifest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return &ArchiveManifest{
+		Files:    append([]ArchiveFile{}, a.manifest.Files...),
+		Restores: append([]ArchiveRestore{}, a.manifest.Restores...),
+	}
+}
+
+func (a *Archiver) save() error {
+	bt, err := json.MarshalIndent(a.manifest, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode archive manifest")
+	}
+	return writeFile(filepath.Join(a.dir, archiveManifest), bt)
+}
+
+func (a *Archiver) load() error {
+	bt, err := os.ReadFile(filepath.Join(a.dir, archiveManifest))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read archive manifest")
+	}
+
+	return errors.Wrap(json.Unmarshal(bt, &a.manifest), "failed to decode archive manifest")
+}
+
+// readArchive decodes the entries of an archive file
+func readArchive(path string) ([]*LogEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open archive")
+	}
+	defer file.Close()
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read archive "+path)
+	}
+	defer zr.Close()
+
+	entries := []*LogEntry{}
+	dec := json.NewDecoder(zr)
+	for {
+		var entry LogEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode archive "+path)
+		}
+		entries = append(entries, &entry)
+	}
+}
+
+// startOfDay returns the start of the UTC day of t
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(day)
+}
+
+func sortedKeys(levels map[string][]*LogEntry) []string {
+	keys := make([]string, 0, len(levels))
+	for key := range levels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// NewArchiver returns an archiver moving the entries of service older
+// than age into dir every interval. Restored entries are kept out of the
+// archive for restoreTTL by default.
+func NewArchiver(
+	logger log.Logger,
+	service Service,
+	dir string,
+	age time.Duration,
+	interval time.Duration,
+	restoreTTL time.Duration,
+) (*Archiver, error) {
+	if service == nil {
+		return nil, errors.New("service is required for archiver")
+	}
+
+	if dir == "" {
+		return nil, errors.New("archive directory is required")
+	}
+
+	if age <= 0 || interval <= 0 || restoreTTL <= 0 {
+		return nil, errors.New("archive age, interval and restore ttl must be positive")
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.Wrap(err, "failed to create archive directory")
+	}
+
+	a := &Archiver{
+		logger:     logger,
+		service:    service,
+		dir:        dir,
+		age:        age,
+		interval:   interval,
+		restoreTTL: restoreTTL,
+		done:       make(chan struct{}),
+	}
+
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
@@ -0,0 +1,35 @@
+package crud
+
+import (
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/kit/transport/http"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+type ArchiveBinder struct {
+	archiver *Archiver
+}
+
+func (b *ArchiveBinder) Bind(ht *http.Transport, opts ...http.HandlerOption) {
+	// Get Call to list the archived files and the active restores
+	ht.GET(
+		"/v1.0/archive",
+		NewArchiveHandler(b.archiver),
+		append(opts, NewArchiveHandlerOption()...)...,
+	)
+
+	// Post Call to restore a range of the archive into the service
+	ht.POST(
+		"/v1.0/archive/restore",
+		NewRestoreHandler(b.archiver),
+		append(opts, NewRestoreHandlerOption()...)...,
+	)
+}
+
+func NewArchiveBinder(logger log.Logger, archiver *Archiver) (*ArchiveBinder, error) {
+	if archiver == nil {
+		return nil, errors.New("archiver is required for archive binder")
+	}
+
+	return &ArchiveBinder{archiver}, nil
+}
@@ -0,0 +1,358 @@
+package crud_test
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+func TestArchiver(t *testing.T) {
+	var (
+		ctx = context.Background()
+		day = 24 * time.Hour
+		now = time.Now().UTC().Truncate(day).Add(12 * time.Hour)
+		dir = t.TempDir()
+	)
+
+	svc, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	entries := []*crud.LogEntry{
+		{Timestamp: now.Add(-40 * day).UnixNano(), Level: "error", Message: "archived, error on day 40"},
+		{Timestamp: now.Add(-40 * day).Add(time.Hour).UnixNano(), Level: "info", Message: "archived, info on day 40"},
+		{Timestamp: now.Add(-40 * day).Add(2 * time.Hour).UnixNano(), Level: "info", Message: "archived, info on day 40"},
+		{Timestamp: now.Add(-45 * day).UnixNano(), Level: "info", Message: "archived, info on day 45"},
+		{Timestamp: now.Add(-2 * day).UnixNano(), Level: "info", Message: "kept, within 30d"},
+	}
+	if _, err := svc.CreateMany(ctx, entries); err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	logger, err := log.NewZapLogger(log.ZapWithLevel("error"))
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+
+	archiver, err := crud.NewArchiver(logger, svc, dir, 30*day, time.Hour, day)
+	if err != nil {
+		t.Fatalf("NewArchiver failed: %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- archiver.Open() }()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if left, err := svc.List(ctx, map[string]interface{}{}); err == nil && len(left) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("archiver didn't run")
+		}
+	}
+
+	archiver.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Open returned %v after Close", err)
+	}
+
+	// one file per day and level
+	manifest := archiver.Manifest()
+	if len(manifest.Files) != 3 {
+		t.Fatalf("archive has files %v, expected 3", manifest.Files)
+	}
+	count := 0
+	for _, file := range manifest.Files {
+		count += file.Count
+	}
+	if count != 4 {
+		t.Errorf("archive has %d entries, expected 4", count)
+	}
+
+	// a manifest survives a restart
+	reopened, err := crud.NewArchiver(logger, svc, dir, 30*day, time.Hour, time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewArchiver failed on an existing archive: %v", err)
+	}
+	if files := reopened.Manifest().Files; len(files) != 3 {
+		t.Errorf("reopened archive has files %v, expected 3", files)
+	}
+
+	var (
+		from = now.Add(-41 * day).UnixNano()
+		to   = now.Add(-39 * day).UnixNano()
+	)
+
+	restore, err := reopened.Restore(ctx, from, to, 0)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if restore.Restored != 3 || restore.Skipped != 0 || restore.Files != 2 {
+		t.Errorf("Restore returned %+v, expected 3 entries restored from 2 files", restore)
+	}
+
+	restored, err := svc.List(ctx, map[string]interface{}{
+		"starttime": strconv.FormatInt(from, 10),
+		"endtime":   strconv.FormatInt(to, 10),
+	})
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	for _, entry := range restored {
+		if entry.Message == "" || entry.ID == "" {
+			t.Errorf("restored entry %+v lost its fields", entry)
+		}
+	}
+	if len(restored) != 3 {
+		t.Errorf("List returned %d restored entries, expected 3", len(restored))
+	}
+
+	// entries restored twice are skipped
+	restore, err = reopened.Restore(ctx, from, to, 0)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if restore.Restored != 0 || restore.Skipped != 3 {
+		t.Errorf("second Restore returned %+v, expected 3 entries skipped", restore)
+	}
+
+	if restores := reopened.Manifest().Restores; len(restores) != 2 {
+		t.Errorf("archive has restores %v, expected 2", restores)
+	}
+
+	// once the restores end, their entries are deleted again without
+	// being archived twice
+	time.Sleep(10 * time.Millisecond)
+
+	done = make(chan error)
+	go func() { done <- reopened.Open() }()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if left, err := svc.List(ctx, map[string]interface{}{}); err == nil && len(left) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("archiver didn't run after the restores ended")
+		}
+	}
+
+	reopened.Close()
+	<-done
+
+	manifest = reopened.Manifest()
+	if len(manifest.Files) != 3 || len(manifest.Restores) != 0 {
+		t.Errorf("archive has files %v and restores %v, expected 3 files", manifest.Files, manifest.Restores)
+	}
+}
+
+// lateService stores entry right after the first List of a day, as an
+// entry arriving while the day is archived
+type lateService struct {
+	crud.Service
+
+	once  sync.Once
+	entry *crud.LogEntry
+}
+
+func (s *lateService) List(ctx context.Context, filter map[string]interface{}) ([]crud.LogEntry, error) {
+	entries, err := s.Service.List(ctx, filter)
+	if _, ok := filter["starttime"]; ok {
+		s.once.Do(func() { s.Service.CreateMany(ctx, []*crud.LogEntry{s.entry}) })
+	}
+	return entries, err
+}
+
+func TestArchiverPages(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		day   = 24 * time.Hour
+		start = time.Now().UTC().Truncate(day).Add(-40 * day)
+	)
+
+	store, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	entries := make([]*crud.LogEntry, 2500)
+	for ix := range entries {
+		entries[ix] = &crud.LogEntry{
+			Timestamp: start.Add(time.Duration(ix) * time.Second).UnixNano(),
+			Level:     "info",
+			Message:   "archived in pages",
+		}
+	}
+	if _, err := store.CreateMany(ctx, entries); err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	svc := &lateService{Service: store, entry: &crud.LogEntry{
+		Timestamp: start.Add(12 * time.Hour).UnixNano(),
+		Level:     "info",
+		Message:   "arrived while archiving",
+	}}
+
+	logger, err := log.NewZapLogger(log.ZapWithLevel("error"))
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+
+	archiver, err := crud.NewArchiver(logger, svc, t.TempDir(), 30*day, time.Hour, day)
+	if err != nil {
+		t.Fatalf("NewArchiver failed: %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- archiver.Open() }()
+
+	var left []crud.LogEntry
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if left, err = store.List(ctx, map[string]interface{}{}); err == nil && len(left) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("archiver didn't run")
+		}
+	}
+
+	archiver.Close()
+	<-done
+
+	// the entry which arrived while the day was archived is left for the
+	// next run rather than deleted
+	if left[0].Message != "arrived while archiving" {
+		t.Errorf("archiver left %+v", left[0])
+	}
+
+	manifest := archiver.Manifest()
+	if len(manifest.Files) != 3 {
+		t.Fatalf("archive has files %v, expected one per page", manifest.Files)
+	}
+	count := 0
+	for _, file := range manifest.Files {
+		count += file.Count
+	}
+	if count != len(entries) {
+		t.Errorf("archive has %d entries, expected %d", count, len(entries))
+	}
+}
+
+// busyService holds the first List of a day until release is closed,
+// as a run busy archiving a day
+type busyService struct {
+	crud.Service
+
+	once    sync.Once
+	listing chan struct{}
+	release chan struct{}
+}
+
+func (s *busyService) List(ctx context.Context, filter map[string]interface{}) ([]crud.LogEntry, error) {
+	if _, ok := filter["starttime"]; ok {
+		s.once.Do(func() {
+			close(s.listing)
+			<-s.release
+		})
+	}
+	return s.Service.List(ctx, filter)
+}
+
+func TestArchiverRestoreDuringRun(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		day   = 24 * time.Hour
+		start = time.Now().UTC().Truncate(day)
+	)
+
+	store, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	logger, err := log.NewZapLogger(log.ZapWithLevel("error"))
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+
+	dir := t.TempDir()
+	archived := &crud.LogEntry{Timestamp: start.Add(-40 * day).UnixNano(), Level: "info", Message: "archived first"}
+	if _, err := store.CreateMany(ctx, []*crud.LogEntry{archived}); err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	first, err := crud.NewArchiver(logger, store, dir, 30*day, time.Hour, day)
+	if err != nil {
+		t.Fatalf("NewArchiver failed: %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- first.Open() }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if left, err := store.List(ctx, map[string]interface{}{}); err == nil && len(left) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("archiver didn't run")
+		}
+	}
+	first.Close()
+	<-done
+
+	// an older day is being archived while the first one is restored
+	older := &crud.LogEntry{Timestamp: start.Add(-45 * day).UnixNano(), Level: "info", Message: "archived later"}
+	if _, err := store.CreateMany(ctx, []*crud.LogEntry{older}); err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	svc := &busyService{Service: store, listing: make(chan struct{}), release: make(chan struct{})}
+	archiver, err := crud.NewArchiver(logger, svc, dir, 30*day, time.Hour, day)
+	if err != nil {
+		t.Fatalf("NewArchiver failed: %v", err)
+	}
+
+	done = make(chan error)
+	go func() { done <- archiver.Open() }()
+	<-svc.listing
+
+	restored := make(chan error)
+	go func() {
+		_, err := archiver.Restore(ctx, archived.Timestamp, archived.Timestamp, 0)
+		restored <- err
+	}()
+
+	select {
+	case err := <-restored:
+		if err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Restore waited for the run")
+	}
+
+	close(svc.release)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if left, err := store.List(ctx, map[string]interface{}{}); err == nil && len(left) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("archiver didn't finish the older day")
+		}
+	}
+	archiver.Close()
+	<-done
+
+	// the run leaves the restored day alone
+	left, err := store.List(ctx, map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(left) != 1 || left[0].Message != archived.Message {
+		t.Errorf("service holds %+v after the run, expected the restored entry", left)
+	}
+}
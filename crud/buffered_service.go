@@ -0,0 +1,312 @@
+package crud
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+// ErrQueueFull is returned when the ingestion queue can't take any more entries
+var ErrQueueFull = errors.New("ingestion queue is full")
+
+// maxBufferedEvents caps the event IDs the queue remembers, older ones are
+// left to the underlying service to deduplicate
+const maxBufferedEvents = 1 << 18
+
+// bufferedService sits in front of another Service and decouples ingestion
+// from storage latency. Entries are put on a bounded queue and a pool of
+// writers flushes them in batches using CreateMany. Reads and deletes go
+// straight to the underlying service.
+type bufferedService struct {
+	Service
+
+	logger        log.Logger
+	flushSize     int
+	flushInterval time.Duration
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan *LogEntry
+	wg     sync.WaitGroup
+
+	// events holds the event IDs queued within the idempotency window, so
+	// that an event sent again is reported as a duplicate before it is
+	// stored. The underlying service still drops those other replicas took.
+	// pending holds the entries of the events not stored yet.
+	evmu    sync.Mutex
+	events  *eventIndex
+	pending map[string]LogEntry
+}
+
+// enqueue queues a copy of entry, so that the caller may read the entry
+// while a writer stores the copy. An entry with the event ID of one
+// queued before is not queued again, it is replaced by the first one.
+func (s *bufferedService) enqueue(ctx context.Context, entry *LogEntry) error {
+	queued := *entry
+	queued.receive()
+
+	first, err := s.claim(&queued)
+	if err == ErrDuplicate {
+		s.resolve(ctx, entry, first)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		s.release(&queued)
+		return errors.Wrap(ErrQueueFull, "service is shutting down")
+	}
+
+	select {
+	case s.queue <- &queued:
+		return nil
+	default:
+		s.release(&queued)
+		return ErrQueueFull
+	}
+}
+
+// claim records the event ID of an entry about to be queued. It returns
+// ErrDuplicate when the event was queued within the window, along with
+// the entry queued first, which has no ID while it is pending.
+func (s *bufferedService) claim(entry *LogEntry) (LogEntry, error) {
+	if entry.EventID == "" {
+		return LogEntry{}, nil
+	}
+
+	s.evmu.Lock()
+	defer s.evmu.Unlock()
+
+	if id, ok := s.events.lookup(entry.EventID, time.Now().UnixNano()); ok {
+		if first, ok := s.pending[entry.EventID]; ok {
+			return first, ErrDuplicate
+		}
+		return LogEntry{ID: id}, ErrDuplicate
+	}
+
+	s.events.add(entry)
+	s.pending[entry.EventID] = *entry
+	return LogEntry{}, nil
+}
+
+// resolve replaces a duplicate entry by the entry queued first, read back
+// from the underlying service once stored. An entry deleted since is left
+// as sent.
+func (s *bufferedService) resolve(ctx context.Context, entry *LogEntry, first LogEntry) {
+	if first.ID == "" {
+		*entry = first
+		return
+	}
+
+	if stored, err := s.Service.Get(ctx, first.ID); err == nil {
+		*entry = *stored
+	}
+}
+
+// stored records the ID of a stored entry for the duplicates sent later
+func (s *bufferedService) stored(entry *LogEntry) {
+	if entry.EventID == "" {
+		return
+	}
+
+	s.evmu.Lock()
+	defer s.evmu.Unlock()
+
+	delete(s.pending, entry.EventID)
+	s.events.add(entry)
+}
+
+// release forgets the event ID of an entry which wasn't stored, so that
+// the client may send it again
+func (s *bufferedService) release(entry *LogEntry) {
+	if entry.EventID == "" {
+		return
+	}
+
+	s.evmu.Lock()
+	defer s.evmu.Unlock()
+
+	delete(s.pending, entry.EventID)
+	s.events.remove(entry.EventID)
+}
+
+// Create queues the entry and returns it without an ID, the ID is
+// only known once a writer has flushed it
+func (s *bufferedService) Create(
+	ctx context.Context, level string, message string, metadata map[string]interface{},
+) (*LogEntry, error) {
+	if level == "" || message == "" {
+		return nil, ErrEmptyKey
+	}
+
+	entry := NewLogEntry(level, message, metadata)
+	if err := s.enqueue(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// CreateMany queues the entries, those taken by the queue are marked
+// with ErrQueued and those sent again with ErrDuplicate, the latter are
+// replaced by the entry queued first
+func (s *bufferedService) CreateMany(
+	ctx context.Context, entries []*LogEntry,
+) ([]error, error) {
+	var (
+		errs   = make([]error, len(entries))
+		queued = 0
+	)
+
+	for ix, entry := range entries {
+		switch err := s.enqueue(ctx, entry); err {
+		case nil:
+			errs[ix] = ErrQueued
+			queued++
+		case ErrDuplicate:
+			errs[ix] = err
+			queued++
+		default:
+			errs[ix] = err
+		}
+	}
+
+	if queued == 0 && len(entries) > 0 {
+		return nil, ErrQueueFull
+	}
+
+	return errs, nil
+}
+
+// Close stops accepting entries, waits for the writers to drain the
+// queue and then closes the underlying service. When ctx ends first the
+// underlying service is left open for the writers still flushing.
+func (s *bufferedService) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "timed out draining ingestion queue, %d entries pending", len(s.queue))
+	}
+
+	return s.Service.Close(ctx)
+}
+
+func (s *bufferedService) write() {
+	defer s.wg.Done()
+
+	var (
+		batch  = make([]*LogEntry, 0, s.flushSize)
+		ticker = time.NewTicker(s.flushInterval)
+	)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case entry, ok := <-s.queue:
+			if !ok {
+				s.flush(batch)
+				return
+			}
+
+			batch = append(batch, entry)
+			if len(batch) >= s.flushSize {
+				s.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				s.flush(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+func (s *bufferedService) flush(batch []*LogEntry) {
+	if len(batch) == 0 {
+		return
+	}
+
+	errs, err := s.Service.CreateMany(context.Background(), batch)
+	if err != nil {
+		s.logger.Error(
+			"failed to flush log entries",
+			log.Int("count", len(batch)),
+			log.Error(err),
+		)
+
+		for _, entry := range batch {
+			s.release(entry)
+		}
+		return
+	}
+
+	for ix, er := range errs {
+		// resent events are dropped by design, the entry is then the one
+		// stored first
+		if er != nil && errors.Cause(er) != ErrDuplicate {
+			s.logger.Error("failed to store log entry", log.Error(er))
+			s.release(batch[ix])
+			continue
+		}
+		s.stored(batch[ix])
+	}
+}
+
+// NewBufferedService wraps svc with a queue of the given depth, drained
+// by writers goroutines which flush every flushSize entries or every
+// flushInterval, whichever comes first. Entries sent again with the event
+// ID of one queued within window are reported as duplicates, a zero
+// window disables deduplication. The latest maxBufferedEvents event IDs
+// are remembered, older ones are deduplicated by svc.
+func NewBufferedService(
+	svc Service,
+	logger log.Logger,
+	depth int,
+	writers int,
+	flushSize int,
+	flushInterval time.Duration,
+	window time.Duration,
+) (Service, error) {
+	if depth <= 0 || writers <= 0 || flushSize <= 0 || flushInterval <= 0 {
+		return nil, errors.New("queue depth, writers, flush size and flush interval must be positive")
+	}
+
+	s := &bufferedService{
+		Service:       svc,
+		logger:        logger,
+		flushSize:     flushSize,
+		flushInterval: flushInterval,
+		queue:         make(chan *LogEntry, depth),
+		events:        newEventIndex(window, maxBufferedEvents),
+		pending:       map[string]LogEntry{},
+	}
+
+	for i := 0; i < writers; i++ {
+		s.wg.Add(1)
+		go s.write()
+	}
+
+	return s, nil
+}
@@ -0,0 +1,312 @@
+package crud_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	net_http "net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/kit/transport/http"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+func newBufferedService(t *testing.T, store crud.Service) crud.Service {
+	logger, err := log.NewZapLogger(log.ZapWithLevel("error"))
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+
+	svc, err := crud.NewBufferedService(store, logger, 1000, 4, 1, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create buffered service: %v", err)
+	}
+	return svc
+}
+
+// TestBufferedServiceCreate posts entries while the writers store them,
+// the responses are built from the request's entries and never race with
+// the writers
+func TestBufferedServiceCreate(t *testing.T) {
+	store, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	release := make(chan struct{})
+	close(release)
+
+	svc := newBufferedService(t, &blockingService{Service: store, release: release})
+	server := httptest.NewServer(http.NewHandler(crud.NewCreateHandler(svc), crud.NewCreateHandlerOption()...))
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			body := bytes.NewBufferString(`{"level":"info","message":"queued"}`)
+			res, err := net_http.Post(server.URL, "application/json", body)
+			if err != nil {
+				t.Errorf("failed to post entry: %v", err)
+				return
+			}
+			defer res.Body.Close()
+
+			var out struct {
+				Status string        `json:"status"`
+				Data   crud.LogEntry `json:"data"`
+			}
+			if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+				t.Errorf("failed to decode response: %v", err)
+				return
+			}
+
+			if res.StatusCode != net_http.StatusAccepted || out.Status != "accepted" || out.Data.ID != "" {
+				t.Errorf("create returned %d %+v, expected a queued entry", res.StatusCode, out)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := svc.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	entries, err := store.List(context.Background(), map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+
+	if len(entries) != 50 {
+		t.Errorf("queue stored %d entries, expected 50", len(entries))
+	}
+}
+
+func TestBufferedServiceCreateMany(t *testing.T) {
+	store, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	svc := newBufferedService(t, store)
+	entries := []*crud.LogEntry{
+		crud.NewLogEntry("info", "first", nil),
+		crud.NewLogEntry("warn", "second", nil),
+	}
+
+	errs, err := svc.CreateMany(context.Background(), entries)
+	if err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	for ix, er := range errs {
+		if errors.Cause(er) != crud.ErrQueued {
+			t.Errorf("CreateMany returned %v for entry %d, expected ErrQueued", er, ix)
+		}
+
+		// the writers store a copy
+		if entries[ix].ID != "" {
+			t.Errorf("CreateMany set the ID of entry %d", ix)
+		}
+	}
+
+	if err := svc.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if _, err := svc.CreateMany(context.Background(), entries); errors.Cause(err) != crud.ErrQueueFull {
+		t.Errorf("CreateMany after Close returned %v, expected ErrQueueFull", err)
+	}
+}
+
+// TestBufferedServiceDuplicate resends events while they are queued and
+// once they are stored, the queue reports them as duplicates right away
+func TestBufferedServiceDuplicate(t *testing.T) {
+	ctx := context.Background()
+
+	store, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	failing := &failingService{Service: store, fail: true}
+	svc := newBufferedService(t, failing)
+
+	event := func(id string) *crud.LogEntry {
+		entry := crud.NewLogEntry("info", "event "+id, nil)
+		entry.EventID = id
+		return entry
+	}
+
+	resent := event("a")
+	resent.Message = "event a again"
+
+	errs, err := svc.CreateMany(ctx, []*crud.LogEntry{event("a"), resent, event("b")})
+	if err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	for ix, want := range []error{crud.ErrQueued, crud.ErrDuplicate, crud.ErrQueued} {
+		if errors.Cause(errs[ix]) != want {
+			t.Errorf("CreateMany returned %v for entry %d, expected %v", errs[ix], ix, want)
+		}
+	}
+
+	// a duplicate of a pending event is replaced by the queued entry
+	if resent.Message != "event a" || resent.ReceivedAt == 0 {
+		t.Errorf("duplicate of a queued event is %+v", resent)
+	}
+
+	// the events which failed to be stored may be sent again
+	deadline := time.Now().Add(5 * time.Second)
+	for failing.failures() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("writers didn't flush the events")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	failing.setFail(false)
+
+	errs, err = svc.CreateMany(ctx, []*crud.LogEntry{event("a")})
+	if err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	if errors.Cause(errs[0]) != crud.ErrQueued {
+		t.Errorf("CreateMany of an event which failed to be stored returned %v", errs[0])
+	}
+
+	var entries []crud.LogEntry
+	for len(entries) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("writers didn't store the event")
+		}
+		time.Sleep(time.Millisecond)
+
+		if entries, err = store.List(ctx, map[string]interface{}{}); err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+	}
+
+	// a duplicate of a stored event is replaced by the stored entry
+	resent = event("a")
+	errs, err = svc.CreateMany(ctx, []*crud.LogEntry{resent})
+	if err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	if errors.Cause(errs[0]) != crud.ErrDuplicate || resent.ID != entries[0].ID {
+		t.Errorf("CreateMany of a stored event returned %v with %+v, expected %+v", errs[0], resent, entries[0])
+	}
+
+	if err := svc.Close(ctx); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	entries, err = store.List(ctx, map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+
+	if len(entries) != 1 || entries[0].EventID != "a" {
+		t.Errorf("queue stored %+v, expected event a once", entries)
+	}
+}
+
+// failingService fails CreateMany while fail is set
+type failingService struct {
+	crud.Service
+
+	mu     sync.Mutex
+	fail   bool
+	failed int
+}
+
+// failures returns the number of entries it failed to store
+func (s *failingService) failures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failed
+}
+
+func (s *failingService) setFail(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = fail
+}
+
+func (s *failingService) CreateMany(ctx context.Context, entries []*crud.LogEntry) ([]error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail {
+		s.failed += len(entries)
+		return nil, errors.New("storage unavailable")
+	}
+	return s.Service.CreateMany(ctx, entries)
+}
+
+func (s *failingService) Close(ctx context.Context) error {
+	return nil
+}
+
+// blockingService holds the writers in CreateMany until it is released,
+// Close keeps the entries of the memory service for the test to list
+type blockingService struct {
+	crud.Service
+
+	release chan struct{}
+	closed  bool
+}
+
+func (s *blockingService) CreateMany(ctx context.Context, entries []*crud.LogEntry) ([]error, error) {
+	<-s.release
+	return s.Service.CreateMany(ctx, entries)
+}
+
+func (s *blockingService) Close(ctx context.Context) error {
+	s.closed = true
+	return nil
+}
+
+func TestBufferedServiceCloseTimeout(t *testing.T) {
+	store, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	blocking := &blockingService{Service: store, release: make(chan struct{})}
+	svc := newBufferedService(t, blocking)
+
+	if _, err := svc.CreateMany(context.Background(), []*crud.LogEntry{crud.NewLogEntry("info", "stuck", nil)}); err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := svc.Close(ctx); errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("Close returned %v, expected a timeout", err)
+	}
+
+	// the writer is still flushing, the store must stay open
+	if blocking.closed {
+		t.Errorf("Close closed the store while a writer was flushing")
+	}
+
+	close(blocking.release)
+	if err := svc.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if !blocking.closed {
+		t.Errorf("Close left the store open once drained")
+	}
+}
@@ -1,6 +1,8 @@
 package crud
 
 import (
+	"context"
+
 	"github.com/pkg/errors"
 	"github.com/unbxd/go-base/kit/transport/http"
 	"github.com/unbxd/go-base/utils/log"
@@ -18,6 +20,20 @@ func (b *Binder) Bind(ht *http.Transport, opts ...http.HandlerOption) {
 		append(opts, NewCreateHandlerOption()...)...,
 	)
 
+	// Post Call to create logs in bulk from newline-delimited JSON
+	ht.POST(
+		"/v1.0/logs/_bulk",
+		NewBulkCreateHandler(b.service),
+		append(opts, NewBulkCreateHandlerOption()...)...,
+	)
+
+	// Get Call to count logs per time bucket and group
+	ht.GET(
+		"/v1.0/logs/_aggregate",
+		NewAggregateHandler(b.service),
+		append(opts, NewAggregateHandlerOption()...)...,
+	)
+
 	// Get Call to fetch log based on id
 	ht.GET(
 		"/v1.0/logs/:id",
@@ -41,10 +57,12 @@ func (b *Binder) Bind(ht *http.Transport, opts ...http.HandlerOption) {
 
 func (b *Binder) Service() Service { return b.service }
 
-func NewHTTPBinder(logger log.Logger, mongoURI, database string) (*Binder, error) {
-	service, err := NewMongoService(mongoURI, database)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to initialize MongoDB service")
+// Close releases the underlying service, draining any queued entries
+func (b *Binder) Close(ctx context.Context) error { return b.service.Close(ctx) }
+
+func NewHTTPBinder(logger log.Logger, service Service) (*Binder, error) {
+	if service == nil {
+		return nil, errors.New("service is required for log binder")
 	}
 
 	return &Binder{service}, nil
@@ -0,0 +1,1058 @@
+// Package crudtest provides a conformance suite for crud.Service
+// implementations, so that every storage backend behaves the same.
+package crudtest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Factory returns an empty service for a single test. The suite closes
+// the service once the test is done, anything else the factory sets up
+// must be released through t.Cleanup. Services deduplicate event IDs
+// within a window of at least a minute.
+type Factory func(t *testing.T) crud.Service
+
+// RunServiceSuite runs every behaviour expected of a crud.Service
+// against the services returned by factory
+func RunServiceSuite(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, svc crud.Service)
+	}{
+		{"CreateGet", testCreateGet},
+		{"CreateEmpty", testCreateEmpty},
+		{"CreateMany", testCreateMany},
+		{"CreateManyDuplicate", testCreateManyDuplicate},
+		{"GetNotFound", testGetNotFound},
+		{"GetInvalidID", testGetInvalidID},
+		{"ListAll", testListAll},
+		{"ListLevel", testListLevel},
+		{"ListMessage", testListMessage},
+		{"ListTimeRange", testListTimeRange},
+		{"ListTimeFormats", testListTimeFormats},
+		{"ListRecent", testListRecent},
+		{"ListCursor", testListCursor},
+		{"ListMetadata", testListMetadata},
+		{"ListMetadataOperators", testListMetadataOperators},
+		{"ListQuery", testListQuery},
+		{"ListInvalidFilter", testListInvalidFilter},
+		{"Aggregate", testAggregate},
+		{"AggregateInvalid", testAggregateInvalid},
+		{"DeleteByID", testDeleteByID},
+		{"DeleteByIDs", testDeleteByIDs},
+		{"DeleteBefore", testDeleteBefore},
+		{"DeleteBeforeNothing", testDeleteBeforeNothing},
+		{"DeleteBeforeScoped", testDeleteBeforeScoped},
+		{"DeleteBeforeExcluded", testDeleteBeforeExcluded},
+		{"Count", testCount},
+		{"DeleteRange", testDeleteRange},
+		{"DeleteWithoutFilter", testDeleteWithoutFilter},
+		{"ConcurrentWriters", testConcurrentWriters},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			svc := factory(t)
+			t.Cleanup(func() {
+				if err := svc.Close(context.Background()); err != nil {
+					t.Errorf("failed to close service: %v", err)
+				}
+			})
+
+			tt.run(t, svc)
+		})
+	}
+}
+
+// seed stores one entry per timestamp in seconds, levels and messages
+// cycle through the given ones
+func seed(t *testing.T, svc crud.Service, stamps []int64, levels []string) []*crud.LogEntry {
+	t.Helper()
+
+	entries := make([]*crud.LogEntry, len(stamps))
+	for ix, ts := range stamps {
+		entries[ix] = &crud.LogEntry{
+			Timestamp: ts * int64(time.Second),
+			Level:     levels[ix%len(levels)],
+			Message:   fmt.Sprintf("Message %d at %d", ix, ts),
+			Metadata:  map[string]interface{}{"seq": strconv.Itoa(ix)},
+		}
+	}
+
+	errs, err := svc.CreateMany(context.Background(), entries)
+	if err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	for ix, err := range errs {
+		if err != nil {
+			t.Fatalf("CreateMany rejected entry %d: %v", ix, err)
+		}
+	}
+
+	return entries
+}
+
+func list(t *testing.T, svc crud.Service, filter map[string]interface{}) []crud.LogEntry {
+	t.Helper()
+
+	entries, err := svc.List(context.Background(), filter)
+	if err != nil {
+		t.Fatalf("List(%v) failed: %v", filter, err)
+	}
+	return entries
+}
+
+// stamps returns the timestamps of entries in seconds
+func stamps(entries []crud.LogEntry) []int64 {
+	out := make([]int64, len(entries))
+	for ix, entry := range entries {
+		out[ix] = entry.Timestamp / int64(time.Second)
+	}
+	return out
+}
+
+func equal(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for ix := range a {
+		if a[ix] != b[ix] {
+			return false
+		}
+	}
+	return true
+}
+
+func testCreateGet(t *testing.T, svc crud.Service) {
+	ctx := context.Background()
+	before := time.Now().UnixNano()
+
+	created, err := svc.Create(ctx, "warn", "Disk space running low", map[string]interface{}{
+		"service": "api",
+	})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	if created.ID == "" {
+		t.Fatal("Create returned an entry without ID")
+	}
+
+	if created.Timestamp < before || created.Timestamp > time.Now().UnixNano() {
+		t.Errorf("Create set timestamp %d, expected the current time", created.Timestamp)
+	}
+
+	if created.ReceivedAt != created.Timestamp {
+		t.Errorf("Create set received_at %d, expected the timestamp %d", created.ReceivedAt, created.Timestamp)
+	}
+
+	got, err := svc.Get(ctx, created.ID)
+	if err != nil {
+		t.Fatalf("Get(%s) failed: %v", created.ID, err)
+	}
+
+	// the entry returned by Create is the one stored
+	if !reflect.DeepEqual(got, created) {
+		t.Errorf("Get returned %+v, expected %+v", got, created)
+	}
+
+	if got.Level != "warn" || got.Message != "Disk space running low" || got.Metadata["service"] != "api" {
+		t.Errorf("Get returned %+v, expected the created fields", got)
+	}
+}
+
+func testCreateEmpty(t *testing.T, svc crud.Service) {
+	if _, err := svc.Create(context.Background(), "", "message", nil); errors.Cause(err) != crud.ErrEmptyKey {
+		t.Errorf("Create without level returned %v, expected ErrEmptyKey", err)
+	}
+
+	if _, err := svc.Create(context.Background(), "info", "", nil); errors.Cause(err) != crud.ErrEmptyKey {
+		t.Errorf("Create without message returned %v, expected ErrEmptyKey", err)
+	}
+}
+
+func testCreateMany(t *testing.T, svc crud.Service) {
+	ctx := context.Background()
+	entries := []*crud.LogEntry{
+		crud.NewLogEntry("info", "first", nil),
+		crud.NewLogEntry("", "no level", nil),
+		crud.NewLogEntry("error", "third", nil),
+	}
+
+	errs, err := svc.CreateMany(ctx, entries)
+	if err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	if len(errs) != len(entries) {
+		t.Fatalf("CreateMany returned %d errors for %d entries", len(errs), len(entries))
+	}
+
+	if errs[0] != nil || errs[2] != nil {
+		t.Errorf("CreateMany rejected valid entries: %v", errs)
+	}
+
+	if errors.Cause(errs[1]) != crud.ErrEmptyKey {
+		t.Errorf("CreateMany returned %v for an entry without level, expected ErrEmptyKey", errs[1])
+	}
+
+	if entries[0].ID == "" || entries[2].ID == "" || entries[0].ID == entries[2].ID {
+		t.Errorf("CreateMany set IDs %q and %q, expected distinct IDs", entries[0].ID, entries[2].ID)
+	}
+
+	for _, ix := range []int{0, 2} {
+		got, err := svc.Get(ctx, entries[ix].ID)
+		if err != nil {
+			t.Fatalf("Get(%s) failed: %v", entries[ix].ID, err)
+		}
+
+		if got.Message != entries[ix].Message {
+			t.Errorf("Get returned message %q, expected %q", got.Message, entries[ix].Message)
+		}
+	}
+
+	if got := list(t, svc, map[string]interface{}{}); len(got) != 2 {
+		t.Errorf("List returned %d entries, expected 2", len(got))
+	}
+}
+
+// testCreateManyDuplicate sends an event ID twice within a batch and
+// again in a later one, only the first entry is stored
+func testCreateManyDuplicate(t *testing.T, svc crud.Service) {
+	ctx := context.Background()
+	now := time.Now().UnixNano()
+
+	entries := []*crud.LogEntry{
+		{Timestamp: now, Level: "info", Message: "first", EventID: "event-1"},
+		{Timestamp: now, Level: "info", Message: "first within the batch", EventID: "event-1"},
+		{Timestamp: now, Level: "info", Message: "without event ID"},
+		{Timestamp: now, Level: "info", Message: "without event ID"},
+	}
+
+	errs, err := svc.CreateMany(ctx, entries)
+	if err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	if errs[0] != nil || errs[2] != nil || errs[3] != nil {
+		t.Fatalf("CreateMany rejected valid entries: %v", errs)
+	}
+
+	if errors.Cause(errs[1]) != crud.ErrDuplicate {
+		t.Errorf("CreateMany returned %v for an event sent twice, expected ErrDuplicate", errs[1])
+	}
+
+	if entries[1].ID != entries[0].ID || entries[1].Message != "first" {
+		t.Errorf("duplicate within the batch is %+v, expected the entry stored first", entries[1])
+	}
+
+	if entries[2].ID == entries[3].ID {
+		t.Error("entries without event ID were deduplicated")
+	}
+
+	resent := []*crud.LogEntry{
+		{Timestamp: now, Level: "info", Message: "resent", EventID: "event-1"},
+		{Timestamp: now, Level: "warn", Message: "second", EventID: "event-2"},
+	}
+
+	errs, err = svc.CreateMany(ctx, resent)
+	if err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	if errors.Cause(errs[0]) != crud.ErrDuplicate || errs[1] != nil {
+		t.Fatalf("CreateMany of a resent and a new event returned %v", errs)
+	}
+
+	if resent[0].ID != entries[0].ID || resent[0].Message != "first" {
+		t.Errorf("resent entry is %+v, expected the entry stored first", resent[0])
+	}
+
+	if got := list(t, svc, map[string]interface{}{}); len(got) != 4 {
+		t.Errorf("List returned %d entries, expected 4", len(got))
+	}
+
+	got, err := svc.Get(ctx, entries[0].ID)
+	if err != nil {
+		t.Fatalf("Get(%s) failed: %v", entries[0].ID, err)
+	}
+	if got.EventID != "event-1" {
+		t.Errorf("Get returned event ID %q, expected event-1", got.EventID)
+	}
+
+	// once its entry is deleted, an event is stored again
+	if err := svc.Delete(ctx, map[string]interface{}{"id": entries[0].ID}); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	again := []*crud.LogEntry{{Timestamp: now, Level: "info", Message: "again", EventID: "event-1"}}
+	errs, err = svc.CreateMany(ctx, again)
+	if err != nil || errs[0] != nil {
+		t.Fatalf("CreateMany of an event whose entry was deleted failed: %v %v", err, errs)
+	}
+
+	if again[0].ID == "" || again[0].ID == entries[0].ID {
+		t.Errorf("CreateMany stored the event again as %q, expected a new ID", again[0].ID)
+	}
+}
+
+func testGetNotFound(t *testing.T, svc crud.Service) {
+	_, err := svc.Get(context.Background(), primitive.NewObjectID().Hex())
+	if errors.Cause(err) != crud.ErrNotFound {
+		t.Errorf("Get of a missing entry returned %v, expected ErrNotFound", err)
+	}
+}
+
+func testGetInvalidID(t *testing.T, svc crud.Service) {
+	if _, err := svc.Get(context.Background(), "not-an-id"); err == nil {
+		t.Error("Get of a malformed ID succeeded")
+	}
+}
+
+func testListAll(t *testing.T, svc crud.Service) {
+	seed(t, svc, []int64{100, 300, 200}, []string{"info"})
+
+	got := stamps(list(t, svc, map[string]interface{}{}))
+	if want := []int64{300, 200, 100}; !equal(got, want) {
+		t.Errorf("List returned timestamps %v, expected most recent first %v", got, want)
+	}
+}
+
+func testListLevel(t *testing.T, svc crud.Service) {
+	seed(t, svc, []int64{100, 200, 300, 400}, []string{"info", "error"})
+
+	got := list(t, svc, map[string]interface{}{"level": "error"})
+	if want := []int64{400, 200}; !equal(stamps(got), want) {
+		t.Errorf("List by level returned timestamps %v, expected %v", stamps(got), want)
+	}
+
+	for _, entry := range got {
+		if entry.Level != "error" {
+			t.Errorf("List by level returned an entry with level %q", entry.Level)
+		}
+	}
+}
+
+func testListMessage(t *testing.T, svc crud.Service) {
+	ctx := context.Background()
+	for _, msg := range []string{"Payment completed", "payment FAILED", "User registered"} {
+		if _, err := svc.Create(ctx, "info", msg, nil); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+	}
+
+	if got := list(t, svc, map[string]interface{}{"message": "PAYMENT"}); len(got) != 2 {
+		t.Errorf("List by message returned %d entries, expected 2 matched case insensitively", len(got))
+	}
+
+	if got := list(t, svc, map[string]interface{}{"message": "^User"}); len(got) != 1 {
+		t.Errorf("List by message pattern returned %d entries, expected 1", len(got))
+	}
+}
+
+func testListTimeRange(t *testing.T, svc crud.Service) {
+	seed(t, svc, []int64{100, 200, 300, 400, 500}, []string{"info"})
+
+	tests := []struct {
+		filter map[string]interface{}
+		want   []int64
+	}{
+		{map[string]interface{}{"starttime": "300"}, []int64{500, 400, 300}},
+		{map[string]interface{}{"endtime": "200"}, []int64{200, 100}},
+		{map[string]interface{}{"starttime": "200", "endtime": "400"}, []int64{400, 300, 200}},
+		{map[string]interface{}{"starttime": "600"}, []int64{}},
+	}
+
+	for _, tt := range tests {
+		if got := stamps(list(t, svc, tt.filter)); !equal(got, tt.want) {
+			t.Errorf("List(%v) returned timestamps %v, expected %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func testListTimeFormats(t *testing.T, svc crud.Service) {
+	// 2025-03-30T08:02:07Z, then 250ms and 1s later
+	base := int64(1743321727) * int64(time.Second)
+	entries := []*crud.LogEntry{
+		{Timestamp: base, Level: "info", Message: "first"},
+		{Timestamp: base + 250*int64(time.Millisecond), Level: "info", Message: "second"},
+		{Timestamp: base + int64(time.Second), Level: "info", Message: "third"},
+	}
+
+	if _, err := svc.CreateMany(context.Background(), entries); err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	var (
+		after  = []int64{entries[2].Timestamp, entries[1].Timestamp}
+		before = []int64{entries[1].Timestamp, entries[0].Timestamp}
+	)
+
+	tests := []struct {
+		filter map[string]interface{}
+		want   []int64
+	}{
+		{map[string]interface{}{"starttime": "2025-03-30T08:02:07.25Z"}, after},
+		{map[string]interface{}{"starttime": "2025-03-30T10:02:07.1+02:00"}, after},
+		{map[string]interface{}{"starttime": "1743321727250"}, after},
+		{map[string]interface{}{"starttime": "1743321727250000"}, after},
+		{map[string]interface{}{"starttime": "1743321727250000000"}, after},
+		{map[string]interface{}{"endtime": "1743321727.25"}, before},
+		{map[string]interface{}{"starttime": "1743321727", "endtime": "1743321727"}, []int64{base}},
+	}
+
+	for _, tt := range tests {
+		got := list(t, svc, tt.filter)
+
+		raw := make([]int64, len(got))
+		for ix, entry := range got {
+			raw[ix] = entry.Timestamp
+			if entry.ReceivedAt == 0 {
+				t.Errorf("List(%v) returned an entry without received_at", tt.filter)
+			}
+		}
+
+		if !equal(raw, tt.want) {
+			t.Errorf("List(%v) returned timestamps %v, expected %v", tt.filter, raw, tt.want)
+		}
+	}
+}
+
+func testListRecent(t *testing.T, svc crud.Service) {
+	seed(t, svc, []int64{100, 500, 200, 400, 300}, []string{"info", "warn"})
+
+	got := stamps(list(t, svc, map[string]interface{}{"recent": "3"}))
+	if want := []int64{500, 400, 300}; !equal(got, want) {
+		t.Errorf("List recent returned timestamps %v, expected %v", got, want)
+	}
+
+	got = stamps(list(t, svc, map[string]interface{}{"recent": "1", "level": "info"}))
+	if want := []int64{300}; !equal(got, want) {
+		t.Errorf("List recent by level returned timestamps %v, expected %v", got, want)
+	}
+}
+
+func testListCursor(t *testing.T, svc crud.Service) {
+	// ties on the timestamp are paged by ID
+	seed(t, svc, []int64{100, 300, 200, 300, 300, 100, 400}, []string{"info", "warn"})
+
+	var (
+		got    = []int64{}
+		ids    = map[string]bool{}
+		filter = map[string]interface{}{"recent": "2"}
+	)
+
+	for pages := 0; ; pages++ {
+		if pages > 4 {
+			t.Fatalf("List with cursor didn't end, returned timestamps %v", got)
+		}
+
+		page := list(t, svc, filter)
+		for _, entry := range page {
+			if ids[entry.ID] {
+				t.Errorf("List with cursor returned %s twice", entry.ID)
+			}
+			ids[entry.ID] = true
+		}
+		got = append(got, stamps(page)...)
+
+		if len(page) < 2 {
+			break
+		}
+		filter["cursor"] = crud.EncodeCursor(&page[len(page)-1])
+	}
+
+	if want := []int64{400, 300, 300, 300, 200, 100, 100}; !equal(got, want) {
+		t.Errorf("List with cursor returned timestamps %v, expected %v", got, want)
+	}
+
+	// a cursor composes with the other filters
+	all := list(t, svc, map[string]interface{}{"level": "warn"})
+	got = stamps(list(t, svc, map[string]interface{}{
+		"level":  "warn",
+		"cursor": crud.EncodeCursor(&all[0]),
+	}))
+	if want := stamps(all[1:]); !equal(got, want) {
+		t.Errorf("List with cursor by level returned timestamps %v, expected %v", got, want)
+	}
+}
+
+func testListMetadata(t *testing.T, svc crud.Service) {
+	ctx := context.Background()
+	for _, md := range []map[string]interface{}{
+		{"service": "api", "http": map[string]interface{}{"method": "GET"}},
+		{"service": "api", "http": map[string]interface{}{"method": "POST"}},
+		{"service": "worker"},
+	} {
+		if _, err := svc.Create(ctx, "info", "request handled", md); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		filter map[string]interface{}
+		want   int
+	}{
+		{map[string]interface{}{"metadata.service": "api"}, 2},
+		{map[string]interface{}{"metadata.service": "worker", "level": "info"}, 1},
+		{map[string]interface{}{"metadata.http.method": "POST"}, 1},
+		{map[string]interface{}{"metadata.service": "api", "metadata.http.method": "PUT"}, 0},
+		{map[string]interface{}{"metadata.missing": "api"}, 0},
+	}
+
+	for _, tt := range tests {
+		if got := list(t, svc, tt.filter); len(got) != tt.want {
+			t.Errorf("List(%v) returned %d entries, expected %d", tt.filter, len(got), tt.want)
+		}
+	}
+}
+
+func testListMetadataOperators(t *testing.T, svc crud.Service) {
+	ctx := context.Background()
+	for _, md := range []map[string]interface{}{
+		{"status": 500, "cached": true, "region": "eu-west", "user": "42"},
+		{"status": 404, "cached": false, "region": "us-east"},
+		{"status": "500", "region": "eu-central"},
+		{"other": 1},
+	} {
+		if _, err := svc.Create(ctx, "info", fmt.Sprintf("request %v", md), md); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		filter map[string]interface{}
+		want   int
+	}{
+		{map[string]interface{}{"metadata.status[gte]": "500"}, 1},
+		{map[string]interface{}{"metadata.status[lt]": "500"}, 1},
+		{map[string]interface{}{"metadata.status[gte]": "400", "metadata.status[lt]": "500"}, 1},
+		{map[string]interface{}{"metadata.status": "500"}, 1},
+		{map[string]interface{}{"metadata.status[eq:number]": "500"}, 1},
+		{map[string]interface{}{"metadata.status[ne:number]": "500"}, 3},
+		{map[string]interface{}{"metadata.status[in:number]": "404,500"}, 2},
+		{map[string]interface{}{"metadata.region[in]": "us-east,eu-central"}, 2},
+		{map[string]interface{}{"metadata.cached[eq:bool]": "true"}, 1},
+		{map[string]interface{}{"metadata.cached[eq]": "true"}, 0},
+		{map[string]interface{}{"metadata.cached[ne:bool]": "true"}, 3},
+		{map[string]interface{}{"metadata.cached[exists]": "false"}, 2},
+		{map[string]interface{}{"metadata.region[regex]": "^eu-"}, 2},
+		{map[string]interface{}{"metadata.user[eq:number]": "42"}, 0},
+	}
+
+	for _, tt := range tests {
+		if got := list(t, svc, tt.filter); len(got) != tt.want {
+			t.Errorf("List(%v) returned %d entries, expected %d", tt.filter, len(got), tt.want)
+		}
+	}
+}
+
+func testListQuery(t *testing.T, svc crud.Service) {
+	now := time.Now().UnixNano()
+
+	entries := []*crud.LogEntry{
+		{Timestamp: now, Level: "error", Message: "connection refused by db", Metadata: map[string]interface{}{
+			"service": "api", "user_id": "12345", "latency_ms": 300,
+		}},
+		{Timestamp: now, Level: "warn", Message: "slow request", Metadata: map[string]interface{}{
+			"service": "api", "user_id": 12345, "latency_ms": 120,
+		}},
+		{Timestamp: now, Level: "info", Message: "request handled", Metadata: map[string]interface{}{
+			"service": "worker", "latency_ms": 50.5, "http": map[string]interface{}{"status": 500},
+		}},
+		{Timestamp: now - int64(time.Hour), Level: "debug", Message: "Connection timeout"},
+	}
+	if _, err := svc.CreateMany(context.Background(), entries); err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	tests := []struct {
+		q    string
+		want []int
+	}{
+		{"level:error", []int{0}},
+		{"level:WARNING", []int{1}},
+		{"level:err*", []int{0}},
+		{"metadata.user_id:12345", []int{0, 1}},
+		{`metadata.user_id:"12345"`, []int{0}},
+		{"metadata.latency_ms>250", []int{0}},
+		{"metadata.latency_ms<=120", []int{1, 2}},
+		{"metadata.http.status>=500", []int{2}},
+		{"metadata.service:w?rker", []int{2}},
+		{"metadata.service:api AND NOT level:warn", []int{0}},
+		{"metadata.service:api OR level:debug", []int{0, 1, 3}},
+		{"(level:error OR level:warn) metadata.latency_ms>100", []int{0, 1}},
+		{"connection", []int{0, 3}},
+		{`"connection refused"`, []int{0}},
+		{`"refused by" level:error`, []int{0}},
+		{`"slow" OR "handled"`, []int{1, 2}},
+		{"conn*out", []int{3}},
+		{"message:req*handled", []int{2}},
+		{"NOT metadata.service:*", []int{3}},
+		{"NOT metadata.latency_ms>100", []int{2, 3}},
+		{"@timestamp>now-15m", []int{0, 1, 2}},
+		{"@timestamp<now-15m AND NOT (request OR slow)", []int{3}},
+	}
+
+	for _, tt := range tests {
+		got := map[string]bool{}
+		for _, entry := range list(t, svc, map[string]interface{}{"q": tt.q}) {
+			got[entry.Message] = true
+		}
+
+		want := map[string]bool{}
+		for _, ix := range tt.want {
+			want[entries[ix].Message] = true
+		}
+
+		if len(got) != len(want) {
+			t.Errorf("List(q=%s) returned %v, expected %v", tt.q, got, want)
+			continue
+		}
+		for message := range want {
+			if !got[message] {
+				t.Errorf("List(q=%s) returned %v, expected %v", tt.q, got, want)
+				break
+			}
+		}
+	}
+}
+
+func testListInvalidFilter(t *testing.T, svc crud.Service) {
+	for _, filter := range []map[string]interface{}{
+		{"starttime": "yesterday"},
+		{"endtime": "12:30"},
+		{"recent": "many"},
+		{"cursor": "not a cursor"},
+		{"q": "level:error AND"},
+		{"q": "(level:error"},
+		{"q": "metadata.latency_ms>fast"},
+		{"q": "host:web"},
+		{"metadata.$where": "1"},
+		{"metadata.status[between]": "1"},
+		{"metadata.status[gte]": "high"},
+		{"metadata.status[gte:string]": "1"},
+		{"metadata.cached[eq:bool]": "maybe"},
+		{"metadata.status[eq:date]": "1"},
+		{"metadata.region[regex]": "("},
+		{"metadata.region[exists]": "yes"},
+	} {
+		if _, err := svc.List(context.Background(), filter); err == nil {
+			t.Errorf("List(%v) succeeded, expected an error", filter)
+		}
+	}
+}
+
+func testAggregate(t *testing.T, svc crud.Service) {
+	// base is the start of a UTC day
+	const base = int64(1700006400)
+
+	entries := []*crud.LogEntry{
+		{Timestamp: base + 10, Level: "error", Message: "failed", Metadata: map[string]interface{}{"service": "api"}},
+		{Timestamp: base + 20, Level: "error", Message: "failed", Metadata: map[string]interface{}{"service": "api"}},
+		{Timestamp: base + 30, Level: "warn", Message: "slow"},
+		{Timestamp: base + 70, Level: "info", Message: "done", Metadata: map[string]interface{}{"service": "worker"}},
+		{Timestamp: base + 3605, Level: "error", Message: "failed", Metadata: map[string]interface{}{
+			"service": "worker", "status": 500,
+		}},
+	}
+	for _, entry := range entries {
+		entry.Timestamp *= int64(time.Second)
+	}
+	if _, err := svc.CreateMany(context.Background(), entries); err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	aggregate := func(filter map[string]interface{}) *crud.Aggregation {
+		t.Helper()
+
+		agg, err := svc.Aggregate(context.Background(), filter)
+		if err != nil {
+			t.Fatalf("Aggregate(%v) failed: %v", filter, err)
+		}
+		return agg
+	}
+
+	// counts returns the count of every group of every bucket, keyed by
+	// the bucket offset from base and the group values
+	counts := func(agg *crud.Aggregation) map[string]int64 {
+		out := map[string]int64{}
+		for _, bucket := range agg.Buckets {
+			for _, group := range bucket.Groups {
+				key := fmt.Sprint(bucket.Timestamp/int64(time.Second)-base, " ")
+				for _, field := range agg.GroupBy {
+					key += fmt.Sprint(group.Key[field], " ")
+				}
+				out[key] = group.Count
+			}
+		}
+		return out
+	}
+
+	tests := []struct {
+		filter  map[string]interface{}
+		buckets int
+		want    map[string]int64
+	}{
+		{
+			filter: map[string]interface{}{
+				"interval": "1m", "group_by": "level",
+				"starttime": strconv.FormatInt(base, 10), "endtime": strconv.FormatInt(base+179, 10),
+			},
+			buckets: 3,
+			want:    map[string]int64{"0 error ": 2, "0 warn ": 1, "60 info ": 1},
+		},
+		{
+			filter: map[string]interface{}{
+				"interval": "1h", "group_by": "level,metadata.service",
+				"starttime": strconv.FormatInt(base, 10), "endtime": strconv.FormatInt(base+7199, 10),
+			},
+			buckets: 2,
+			want: map[string]int64{
+				"0 error api ": 2, "0 warn <nil> ": 1, "0 info worker ": 1, "3600 error worker ": 1,
+			},
+		},
+		{
+			filter: map[string]interface{}{
+				"interval": "1d", "level": "error", "metadata.service": "worker",
+				"starttime": strconv.FormatInt(base, 10), "endtime": strconv.FormatInt(base+86399, 10),
+			},
+			buckets: 1,
+			want:    map[string]int64{"0 ": 1},
+		},
+		{
+			filter: map[string]interface{}{
+				"interval": "1h", "group_by": "metadata.status", "q": "metadata.status:*",
+				"starttime": strconv.FormatInt(base, 10), "endtime": strconv.FormatInt(base+7199, 10),
+			},
+			buckets: 2,
+			want:    map[string]int64{"3600 500 ": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		agg := aggregate(tt.filter)
+		if len(agg.Buckets) != tt.buckets {
+			t.Errorf("Aggregate(%v) returned %d buckets, expected %d", tt.filter, len(agg.Buckets), tt.buckets)
+		}
+
+		got := counts(agg)
+		if len(got) != len(tt.want) {
+			t.Errorf("Aggregate(%v) returned %v, expected %v", tt.filter, got, tt.want)
+			continue
+		}
+
+		total := int64(0)
+		for key, count := range tt.want {
+			if got[key] != count {
+				t.Errorf("Aggregate(%v) returned %v, expected %v", tt.filter, got, tt.want)
+				break
+			}
+			total += count
+		}
+		if agg.Total != total {
+			t.Errorf("Aggregate(%v) returned a total of %d, expected %d", tt.filter, agg.Total, total)
+		}
+	}
+}
+
+func testAggregateInvalid(t *testing.T, svc crud.Service) {
+	for _, filter := range []map[string]interface{}{
+		{"interval": "2m"},
+		{"group_by": "message"},
+		{"group_by": "metadata.$where"},
+		{"starttime": "2000", "endtime": "1000"},
+		{"interval": "1m", "starttime": "0", "endtime": "2592000"},
+		{"group_by": "level,level,level,level,level"},
+		{"q": "level:"},
+	} {
+		if _, err := svc.Aggregate(context.Background(), filter); err == nil {
+			t.Errorf("Aggregate(%v) succeeded, expected an error", filter)
+		}
+	}
+}
+
+func testDeleteByID(t *testing.T, svc crud.Service) {
+	ctx := context.Background()
+	entries := seed(t, svc, []int64{100, 200}, []string{"info"})
+
+	if err := svc.Delete(ctx, map[string]interface{}{"id": entries[0].ID}); err != nil {
+		t.Fatalf("Delete by id failed: %v", err)
+	}
+
+	if _, err := svc.Get(ctx, entries[0].ID); errors.Cause(err) != crud.ErrNotFound {
+		t.Errorf("Get of a deleted entry returned %v, expected ErrNotFound", err)
+	}
+
+	if _, err := svc.Get(ctx, entries[1].ID); err != nil {
+		t.Errorf("Delete by id removed another entry: %v", err)
+	}
+}
+
+func testDeleteByIDs(t *testing.T, svc crud.Service) {
+	ctx := context.Background()
+	entries := seed(t, svc, []int64{100, 200, 300}, []string{"info"})
+
+	// IDs which are gone already are left alone
+	ids := []string{entries[0].ID, entries[2].ID, primitive.NewObjectID().Hex()}
+	if err := svc.Delete(ctx, map[string]interface{}{"ids": ids}); err != nil {
+		t.Fatalf("Delete by ids failed: %v", err)
+	}
+
+	if got, want := stamps(list(t, svc, map[string]interface{}{})), []int64{200}; !equal(got, want) {
+		t.Errorf("List after delete by ids returned timestamps %v, expected %v", got, want)
+	}
+
+	if err := svc.Delete(ctx, map[string]interface{}{"ids": []string{"not-an-id"}}); err == nil {
+		t.Error("Delete by ids with a malformed ID succeeded, expected an error")
+	}
+}
+
+func testDeleteBefore(t *testing.T, svc crud.Service) {
+	seed(t, svc, []int64{100, 200, 300, 400}, []string{"info"})
+
+	if err := svc.Delete(context.Background(), map[string]interface{}{"before": "300"}); err != nil {
+		t.Fatalf("Delete before failed: %v", err)
+	}
+
+	// before is exclusive, the entry at 300 is kept
+	if got, want := stamps(list(t, svc, map[string]interface{}{})), []int64{400, 300}; !equal(got, want) {
+		t.Errorf("List after delete returned timestamps %v, expected %v", got, want)
+	}
+}
+
+func testDeleteBeforeNothing(t *testing.T, svc crud.Service) {
+	seed(t, svc, []int64{300}, []string{"info"})
+
+	if err := svc.Delete(context.Background(), map[string]interface{}{"before": "200"}); err == nil {
+		t.Error("Delete before with nothing to delete succeeded, expected an error")
+	}
+
+	if err := svc.Delete(context.Background(), map[string]interface{}{"before": "soon"}); err == nil {
+		t.Error("Delete before with a malformed timestamp succeeded")
+	}
+}
+
+// seedServices stores entries at timestamps 100 to 400 of each level,
+// the first two of each with metadata.service api and the rest without
+func seedServices(t *testing.T, svc crud.Service, levels []string) {
+	t.Helper()
+
+	entries := []*crud.LogEntry{}
+	for _, level := range levels {
+		for ix, ts := range []int64{100, 200, 300, 400} {
+			metadata := map[string]interface{}{"seq": strconv.Itoa(ix)}
+			if ix < 2 {
+				metadata["service"] = "api"
+			}
+			entries = append(entries, &crud.LogEntry{
+				Timestamp: ts * int64(time.Second), Level: level, Message: "Scoped " + level, Metadata: metadata,
+			})
+		}
+	}
+
+	if _, err := svc.CreateMany(context.Background(), entries); err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+}
+
+func testDeleteBeforeScoped(t *testing.T, svc crud.Service) {
+	ctx := context.Background()
+	seedServices(t, svc, []string{"debug", "error"})
+
+	err := svc.Delete(ctx, map[string]interface{}{"before": "300", "level": "debug"})
+	if err != nil {
+		t.Fatalf("Delete before with level failed: %v", err)
+	}
+
+	if got, want := stamps(list(t, svc, map[string]interface{}{"level": "debug"})), []int64{400, 300}; !equal(got, want) {
+		t.Errorf("List debug after delete returned timestamps %v, expected %v", got, want)
+	}
+	if got := list(t, svc, map[string]interface{}{"level": "error"}); len(got) != 4 {
+		t.Errorf("Delete before with level debug removed error entries, %d left", len(got))
+	}
+
+	err = svc.Delete(ctx, map[string]interface{}{"before": "500", "metadata.service": "api"})
+	if err != nil {
+		t.Fatalf("Delete before with service failed: %v", err)
+	}
+
+	if got, want := stamps(list(t, svc, map[string]interface{}{"level": "error"})), []int64{400, 300}; !equal(got, want) {
+		t.Errorf("List error after delete returned timestamps %v, expected %v", got, want)
+	}
+
+	if err := svc.Delete(ctx, map[string]interface{}{"before": "500", "metadata.service": "web"}); err == nil {
+		t.Error("Delete before with a service without entries succeeded, expected an error")
+	}
+}
+
+func testDeleteRange(t *testing.T, svc crud.Service) {
+	ctx := context.Background()
+	seed(t, svc, []int64{100, 200, 300, 400, 500}, []string{"info", "error"})
+
+	err := svc.Delete(ctx, map[string]interface{}{"starttime": "200", "before": "400", "level": "error"})
+	if err != nil {
+		t.Fatalf("Delete of a range failed: %v", err)
+	}
+
+	if got, want := stamps(list(t, svc, map[string]interface{}{})), []int64{500, 400, 300, 100}; !equal(got, want) {
+		t.Errorf("List after deleting error entries in [200, 400) returned timestamps %v, expected %v", got, want)
+	}
+
+	err = svc.Delete(ctx, map[string]interface{}{"starttime": "200", "before": "400"})
+	if err != nil {
+		t.Fatalf("Delete of a range failed: %v", err)
+	}
+
+	if got, want := stamps(list(t, svc, map[string]interface{}{})), []int64{500, 400, 100}; !equal(got, want) {
+		t.Errorf("List after deleting [200, 400) returned timestamps %v, expected %v", got, want)
+	}
+}
+
+func testDeleteBeforeExcluded(t *testing.T, svc crud.Service) {
+	seedServices(t, svc, []string{"debug", "info", "error"})
+
+	err := svc.Delete(context.Background(), map[string]interface{}{
+		"before":                   "500",
+		"exclude.level":            []string{"error"},
+		"exclude.metadata.service": []string{"api"},
+	})
+	if err != nil {
+		t.Fatalf("Delete before with exclusions failed: %v", err)
+	}
+
+	// error entries and those of api are kept, entries without a service
+	// are never excluded
+	want := map[string][]int64{"debug": {200, 100}, "info": {200, 100}, "error": {400, 300, 200, 100}}
+	for level, expected := range want {
+		if got := stamps(list(t, svc, map[string]interface{}{"level": level})); !equal(got, expected) {
+			t.Errorf("List %s after delete returned timestamps %v, expected %v", level, got, expected)
+		}
+	}
+}
+
+func testCount(t *testing.T, svc crud.Service) {
+	seedServices(t, svc, []string{"debug", "info", "error"})
+
+	tests := []struct {
+		filter map[string]interface{}
+		want   int64
+	}{
+		{map[string]interface{}{"before": "300"}, 6},
+		{map[string]interface{}{"before": "500", "level": "debug"}, 4},
+		{map[string]interface{}{"before": "300", "starttime": "200", "metadata.service": "api"}, 3},
+		{map[string]interface{}{
+			"before":                   "500",
+			"exclude.level":            []string{"error"},
+			"exclude.metadata.service": []string{"api"},
+		}, 4},
+		{map[string]interface{}{"before": "100"}, 0},
+	}
+
+	for _, tt := range tests {
+		got, err := svc.Count(context.Background(), tt.filter)
+		if err != nil {
+			t.Errorf("Count(%v) failed: %v", tt.filter, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Count(%v) returned %d, expected %d", tt.filter, got, tt.want)
+		}
+	}
+
+	if _, err := svc.Count(context.Background(), map[string]interface{}{"level": "debug"}); err == nil {
+		t.Error("Count without before succeeded, expected an error")
+	}
+
+	// counting deletes nothing
+	if got := list(t, svc, map[string]interface{}{}); len(got) != 12 {
+		t.Errorf("Count removed entries, %d left", len(got))
+	}
+}
+
+func testDeleteWithoutFilter(t *testing.T, svc crud.Service) {
+	seed(t, svc, []int64{100}, []string{"info"})
+
+	if err := svc.Delete(context.Background(), map[string]interface{}{}); err == nil {
+		t.Error("Delete without id or before succeeded, expected an error")
+	}
+
+	if got := list(t, svc, map[string]interface{}{}); len(got) != 1 {
+		t.Errorf("Delete without filter removed entries, %d left", len(got))
+	}
+}
+
+func testConcurrentWriters(t *testing.T, svc crud.Service) {
+	const (
+		writers = 8
+		perEach = 25
+	)
+
+	var (
+		ctx  = context.Background()
+		wg   sync.WaitGroup
+		errc = make(chan error, writers*2)
+	)
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			batch := make([]*crud.LogEntry, 0, perEach)
+			for ix := 0; ix < perEach; ix++ {
+				msg := fmt.Sprintf("writer %d entry %d", w, ix)
+				if _, err := svc.Create(ctx, "info", msg, nil); err != nil {
+					errc <- err
+					return
+				}
+				batch = append(batch, crud.NewLogEntry("debug", msg, nil))
+			}
+
+			errs, err := svc.CreateMany(ctx, batch)
+			if err != nil {
+				errc <- err
+				return
+			}
+
+			for _, err := range errs {
+				if err != nil {
+					errc <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(errc)
+
+	for err := range errc {
+		t.Errorf("concurrent write failed: %v", err)
+	}
+
+	entries := list(t, svc, map[string]interface{}{})
+	if len(entries) != writers*perEach*2 {
+		t.Errorf("List returned %d entries, expected %d", len(entries), writers*perEach*2)
+	}
+
+	ids := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if ids[entry.ID] {
+			t.Fatalf("ID %s was assigned twice", entry.ID)
+		}
+		ids[entry.ID] = true
+	}
+}
@@ -0,0 +1,347 @@
+package crud
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// segmentVersion 1 kept timestamps in seconds and had no received_at
+	segmentVersion = 2
+
+	// a block is compressed on its own, so that reads decompress only the
+	// blocks the sparse index points at
+	blockRecords = 1024
+	blockBytes   = 256 << 10
+
+	activeExt  = ".active"
+	sealedExt  = ".seg"
+	indexExt   = ".idx"
+	tmpExt     = ".tmp"
+	tombstones = "tombstones"
+)
+
+// bitmap is a set of record ordinals within a segment
+type bitmap []uint64
+
+func (b *bitmap) set(ix int) {
+	for len(*b) <= ix/64 {
+		*b = append(*b, 0)
+	}
+	(*b)[ix/64] |= 1 << uint(ix%64)
+}
+
+func (b bitmap) has(ix int) bool {
+	return ix/64 < len(b) && b[ix/64]&(1<<uint(ix%64)) != 0
+}
+
+// any reports whether an ordinal in [from, to) is set
+func (b bitmap) any(from, to int) bool {
+	for ix := from; ix < to; {
+		word := ix / 64
+		if word >= len(b) {
+			return false
+		}
+
+		mask := b[word] >> uint(ix%64)
+		if remaining := to - ix; remaining < 64 {
+			mask &= 1<<uint(remaining) - 1
+		}
+
+		if mask != 0 {
+			return true
+		}
+		ix += 64 - ix%64
+	}
+	return false
+}
+
+// span is the range of timestamps and IDs covered by a set of records
+type span struct {
+	Count int    `json:"count"`
+	MinTs int64  `json:"min_ts"`
+	MaxTs int64  `json:"max_ts"`
+	MinID string `json:"min_id"`
+	MaxID string `json:"max_id"`
+}
+
+func (s *span) add(entry *LogEntry) {
+	if s.Count == 0 || entry.Timestamp < s.MinTs {
+		s.MinTs = entry.Timestamp
+	}
+	if s.Count == 0 || entry.Timestamp > s.MaxTs {
+		s.MaxTs = entry.Timestamp
+	}
+	if s.Count == 0 || entry.ID < s.MinID {
+		s.MinID = entry.ID
+	}
+	if s.Count == 0 || entry.ID > s.MaxID {
+		s.MaxID = entry.ID
+	}
+	s.Count++
+}
+
+// overlaps reports whether records in the span may pass the time range
+// of the query
+func (s *span) overlaps(q *listQuery) bool {
+	if s.Count == 0 {
+		return false
+	}
+	if q.start != nil && s.MaxTs < *q.start {
+		return false
+	}
+	if q.end != nil && s.MinTs > *q.end {
+		return false
+	}
+	return true
+}
+
+func (s *span) holds(id string) bool {
+	return s.Count > 0 && s.MinID <= id && id <= s.MaxID
+}
+
+// blockIndex is the sparse index entry of a compressed block
+type blockIndex struct {
+	span
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+	First  int   `json:"first"`
+}
+
+// segmentIndex is stored next to a sealed segment. It holds the sparse
+// timestamp index, one entry per block, and a bitmap of the records of
+// each level.
+type segmentIndex struct {
+	span
+	Version int               `json:"version"`
+	Blocks  []blockIndex      `json:"blocks"`
+	Levels  map[string]bitmap `json:"levels"`
+
+	// LastEvent is the latest received_at of the records with an event
+	// ID, segments with none received within the window aren't read to
+	// rebuild the event index
+	LastEvent int64 `json:"last_event,omitempty"`
+}
+
+// segment is a sealed, compressed and immutable segment file
+type segment struct {
+	base  string
+	index *segmentIndex
+}
+
+// blocks returns the blocks which may hold records passing the query
+func (s *segment) blocks(q *listQuery) []blockIndex {
+	if !s.index.overlaps(q) {
+		return nil
+	}
+
+	var levels bitmap
+	if q.level != "" {
+		if levels = s.index.Levels[q.level]; levels == nil {
+			return nil
+		}
+	}
+
+	out := make([]blockIndex, 0, len(s.index.Blocks))
+	for _, blk := range s.index.Blocks {
+		if !blk.overlaps(q) {
+			continue
+		}
+		if levels != nil && !levels.any(blk.First, blk.First+blk.Count) {
+			continue
+		}
+		out = append(out, blk)
+	}
+	return out
+}
+
+// read decompresses a block into its records, one JSON document per line
+func (s *segment) read(blk blockIndex) ([][]byte, error) {
+	file, err := os.Open(s.base + sealedExt)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open segment")
+	}
+	defer file.Close()
+
+	rd, err := gzip.NewReader(io.NewSectionReader(file, blk.Offset, blk.Length))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read segment block")
+	}
+	defer rd.Close()
+
+	bt, err := io.ReadAll(rd)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read segment block")
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(bt, []byte("\n")), []byte("\n"))
+	if len(lines) != blk.Count {
+		return nil, errors.New("segment block is corrupt, record count mismatch")
+	}
+	return lines, nil
+}
+
+// entries decodes every record of the segment
+func (s *segment) entries() ([]*LogEntry, error) {
+	out := make([]*LogEntry, 0, s.index.Count)
+	for _, blk := range s.index.Blocks {
+		lines, err := s.read(blk)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ln := range lines {
+			var entry LogEntry
+			if err := json.Unmarshal(ln, &entry); err != nil {
+				return nil, errors.Wrap(err, "failed to decode record")
+			}
+			out = append(out, &entry)
+		}
+	}
+	return out, nil
+}
+
+func (s *segment) remove() error {
+	// the index goes first, a segment without one is discarded on open
+	if err := os.Remove(s.base + indexExt); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(s.base + sealedExt); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeSegment seals entries into a compressed segment at base. The
+// segment is written before its index, so that a crash never leaves an
+// index pointing at a partial segment.
+func writeSegment(base string, entries []*LogEntry) (*segment, error) {
+	index := &segmentIndex{Version: segmentVersion, Levels: map[string]bitmap{}}
+
+	var (
+		out   bytes.Buffer
+		block bytes.Buffer
+		blk   = blockIndex{}
+	)
+
+	flush := func() error {
+		if blk.Count == 0 {
+			return nil
+		}
+
+		blk.Offset = int64(out.Len())
+		zw := gzip.NewWriter(&out)
+		if _, err := zw.Write(block.Bytes()); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+
+		blk.Length = int64(out.Len()) - blk.Offset
+		index.Blocks = append(index.Blocks, blk)
+		block.Reset()
+		blk = blockIndex{First: index.Count}
+		return nil
+	}
+
+	for _, entry := range entries {
+		bt, err := json.Marshal(entry)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to encode record")
+		}
+
+		block.Write(bt)
+		block.WriteByte('\n')
+
+		lv := index.Levels[entry.Level]
+		lv.set(index.Count)
+		index.Levels[entry.Level] = lv
+
+		blk.add(entry)
+		index.add(entry)
+
+		if entry.EventID != "" && entry.ReceivedAt > index.LastEvent {
+			index.LastEvent = entry.ReceivedAt
+		}
+
+		if blk.Count >= blockRecords || block.Len() >= blockBytes {
+			if err := flush(); err != nil {
+				return nil, errors.Wrap(err, "failed to compress block")
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return nil, errors.Wrap(err, "failed to compress block")
+	}
+
+	if err := writeFile(base+sealedExt, out.Bytes()); err != nil {
+		return nil, err
+	}
+
+	bt, err := json.Marshal(index)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode segment index")
+	}
+
+	if err := writeFile(base+indexExt, bt); err != nil {
+		return nil, err
+	}
+
+	return &segment{base: base, index: index}, nil
+}
+
+func readSegment(base string) (*segment, error) {
+	bt, err := os.ReadFile(base + indexExt)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read segment index")
+	}
+
+	var index segmentIndex
+	if err := json.Unmarshal(bt, &index); err != nil {
+		return nil, errors.Wrap(err, "failed to decode segment index")
+	}
+
+	if index.Version != segmentVersion && index.Version != 1 {
+		return nil, errors.Errorf("unsupported segment version %d", index.Version)
+	}
+
+	return &segment{base: base, index: &index}, nil
+}
+
+// upgradeEntry converts a record of segment version 1
+func upgradeEntry(entry *LogEntry) {
+	entry.Timestamp *= int64(time.Second)
+	entry.ReceivedAt = entry.Timestamp
+}
+
+// writeFile replaces path through a synced temporary file
+func writeFile(path string, bt []byte) error {
+	file, err := os.Create(path + tmpExt)
+	if err != nil {
+		return errors.Wrap(err, "failed to create "+path)
+	}
+
+	if _, err := file.Write(bt); err != nil {
+		file.Close()
+		return errors.Wrap(err, "failed to write "+path)
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return errors.Wrap(err, "failed to write "+path)
+	}
+
+	if err := file.Close(); err != nil {
+		return errors.Wrap(err, "failed to write "+path)
+	}
+
+	return errors.Wrap(os.Rename(path+tmpExt, path), "failed to write "+path)
+}
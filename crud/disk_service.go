@@ -0,0 +1,1020 @@
+package crud
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// activeSegment is the segment being written to. Records are appended
+// to the file uncompressed and kept in memory until it is sealed.
+type activeSegment struct {
+	base    string
+	file    *os.File
+	size    int64
+	opened  time.Time
+	entries []*LogEntry
+	span    span
+}
+
+// diskService implements the Service interface on append-only segment
+// files in a local directory. Writes go to the active segment, which is
+// sealed into a compressed segment, with a sparse timestamp index and a
+// per level bitmap, once it reaches maxSize or maxAge. Deleted IDs are
+// recorded as tombstones, deletes by time drop or rewrite segments.
+type diskService struct {
+	mu      sync.RWMutex
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+
+	segments []*segment
+	active   *activeSegment
+	deleted  map[string]struct{}
+	tombs    *os.File
+	lastBase int64
+	events   *eventIndex
+
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// segmentBase returns the path of a new segment, named after the time it
+// was opened so that names sort in creation order
+func (s *diskService) segmentBase(now time.Time) string {
+	nano := now.UnixNano()
+	if nano <= s.lastBase {
+		nano = s.lastBase + 1
+	}
+	s.lastBase = nano
+	return filepath.Join(s.dir, fmt.Sprintf("seg-%020d", nano))
+}
+
+func baseTime(base string) time.Time {
+	nano, _ := strconv.ParseInt(strings.TrimPrefix(filepath.Base(base), "seg-"), 10, 64)
+	return time.Unix(0, nano)
+}
+
+// open loads the sealed segments, recovers the active one and compacts
+// the tombstones of records which no longer exist
+func (s *diskService) open() error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return errors.Wrap(err, "failed to create data directory")
+	}
+
+	names, err := filepath.Glob(filepath.Join(s.dir, "seg-*"))
+	if err != nil {
+		return errors.Wrap(err, "failed to list segments")
+	}
+	sort.Strings(names)
+
+	// new segments must sort after every existing one
+	for _, name := range names {
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+		if nano := baseTime(base).UnixNano(); nano > s.lastBase {
+			s.lastBase = nano
+		}
+	}
+
+	var (
+		sealed  = map[string]bool{}
+		actives = []string{}
+	)
+
+	for _, name := range names {
+		switch ext := filepath.Ext(name); ext {
+		case tmpExt:
+			// left behind by a crash while sealing or rewriting
+			os.Remove(name)
+		case indexExt:
+			sealed[strings.TrimSuffix(name, ext)] = true
+		case activeExt:
+			actives = append(actives, strings.TrimSuffix(name, ext))
+		}
+	}
+
+	for _, name := range names {
+		if filepath.Ext(name) != sealedExt {
+			continue
+		}
+
+		base := strings.TrimSuffix(name, sealedExt)
+		if !sealed[base] {
+			// sealing didn't complete, the active file is still there
+			os.Remove(name)
+			continue
+		}
+
+		seg, err := readSegment(base)
+		if err != nil {
+			return errors.Wrap(err, "failed to load segment "+base)
+		}
+
+		if seg.index.Version != segmentVersion {
+			if seg, err = s.upgrade(seg); err != nil {
+				return errors.Wrap(err, "failed to upgrade segment "+base)
+			}
+		}
+		s.segments = append(s.segments, seg)
+	}
+
+	for ix, base := range actives {
+		if sealed[base] {
+			// sealed, the crash happened before the active file was removed
+			os.Remove(base + activeExt)
+			continue
+		}
+
+		active, err := s.recover(base)
+		if err != nil {
+			return err
+		}
+
+		// only the most recent active segment is kept open
+		if ix < len(actives)-1 {
+			if err := s.sealActive(active); err != nil {
+				active.file.Close()
+				return err
+			}
+			continue
+		}
+		s.active = active
+	}
+
+	if s.active == nil {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.loadEvents(); err != nil {
+		return err
+	}
+
+	return s.loadTombstones()
+}
+
+// loadEvents rebuilds the event index from the records received within
+// the idempotency window
+func (s *diskService) loadEvents() error {
+	if s.events.window <= 0 {
+		return nil
+	}
+
+	cutoff := s.events.cutoff(time.Now().UnixNano())
+	add := func(entries []*LogEntry) {
+		for _, entry := range entries {
+			if entry.EventID != "" && entry.ReceivedAt >= cutoff {
+				s.events.add(entry)
+			}
+		}
+	}
+
+	for _, seg := range s.segments {
+		if seg.index.LastEvent < cutoff {
+			continue
+		}
+
+		entries, err := seg.entries()
+		if err != nil {
+			return errors.Wrap(err, "failed to load event IDs of segment "+seg.base)
+		}
+		add(entries)
+	}
+
+	add(s.active.entries)
+	return nil
+}
+
+// upgrade rewrites a segment of version 1 under a new name. The old one is
+// removed once the new one is complete, a crash in between keeps both.
+func (s *diskService) upgrade(seg *segment) (*segment, error) {
+	entries, err := seg.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		upgradeEntry(entry)
+	}
+
+	upgraded, err := writeSegment(s.segmentBase(time.Now()), entries)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := seg.remove(); err != nil {
+		return nil, err
+	}
+	return upgraded, nil
+}
+
+// recover reads the records of an active segment, a partially written
+// last record is cut off
+func (s *diskService) recover(base string) (*activeSegment, error) {
+	file, err := os.OpenFile(base+activeExt, os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open active segment")
+	}
+
+	active := &activeSegment{base: base, file: file, opened: baseTime(base)}
+
+	rd := bufio.NewReader(file)
+	for {
+		ln, err := rd.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+
+		var entry LogEntry
+		if err := json.Unmarshal(ln, &entry); err != nil {
+			break
+		}
+
+		// written before received_at, in seconds
+		if entry.ReceivedAt == 0 {
+			upgradeEntry(&entry)
+		}
+
+		active.entries = append(active.entries, &entry)
+		active.span.add(&entry)
+		active.size += int64(len(ln))
+	}
+
+	if err := file.Truncate(active.size); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "failed to truncate active segment")
+	}
+
+	if _, err := file.Seek(active.size, 0); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "failed to seek active segment")
+	}
+
+	return active, nil
+}
+
+// rotate opens a new, empty active segment
+func (s *diskService) rotate() error {
+	base := s.segmentBase(time.Now())
+
+	file, err := os.OpenFile(base+activeExt, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "failed to create active segment")
+	}
+
+	s.active = &activeSegment{base: base, file: file, opened: baseTime(base)}
+	return nil
+}
+
+// seal compresses the active segment into a sealed one and opens a new
+// active segment. Callers must hold the write lock.
+func (s *diskService) seal() error {
+	if err := s.sealActive(s.active); err != nil {
+		return err
+	}
+	return s.rotate()
+}
+
+func (s *diskService) sealActive(active *activeSegment) error {
+	if len(active.entries) > 0 {
+		seg, err := writeSegment(active.base, active.entries)
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+	}
+
+	// once sealed, a left over active file is removed on the next open
+	active.file.Close()
+	os.Remove(active.base + activeExt)
+	return nil
+}
+
+// roll seals the active segment once it's too large or too old
+func (s *diskService) roll(now time.Time) error {
+	if len(s.active.entries) == 0 {
+		return nil
+	}
+
+	if s.active.size >= s.maxSize || now.Sub(s.active.opened) >= s.maxAge {
+		return s.seal()
+	}
+	return nil
+}
+
+// roller seals the active segment by age when there are no writes
+func (s *diskService) roller() {
+	defer s.wg.Done()
+
+	interval := s.maxAge / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			// a failed roll is retried on the next tick or write
+			s.mu.Lock()
+			if !s.closed {
+				s.roll(now)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *diskService) loadTombstones() error {
+	path := filepath.Join(s.dir, tombstones)
+
+	bt, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to read tombstones")
+	}
+
+	for _, id := range strings.Fields(string(bt)) {
+		if s.holds(id) {
+			s.deleted[id] = struct{}{}
+		}
+	}
+
+	// rewrite without the tombstones of records which are gone
+	var buf bytes.Buffer
+	for id := range s.deleted {
+		buf.WriteString(id)
+		buf.WriteByte('\n')
+	}
+
+	if err := writeFile(path, buf.Bytes()); err != nil {
+		return err
+	}
+
+	s.tombs, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	return errors.Wrap(err, "failed to open tombstones")
+}
+
+// holds reports whether a record with the ID may exist
+func (s *diskService) holds(id string) bool {
+	if s.active.span.holds(id) {
+		return true
+	}
+	for _, seg := range s.segments {
+		if seg.index.holds(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// append writes entries to the active segment, assigning IDs to those
+// without one. Callers must hold the write lock.
+func (s *diskService) append(entries []*LogEntry) error {
+	if s.closed {
+		return errors.New("disk service is closed")
+	}
+
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		if entry.ID == "" {
+			entry.ID = primitive.NewObjectID().Hex()
+		}
+		entry.receive()
+
+		bt, err := json.Marshal(entry)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode log entry")
+		}
+		buf.Write(bt)
+		buf.WriteByte('\n')
+	}
+
+	if _, err := s.active.file.Write(buf.Bytes()); err != nil {
+		// cut off whatever part of the batch made it to the file
+		s.active.file.Truncate(s.active.size)
+		s.active.file.Seek(s.active.size, 0)
+		return errors.Wrap(err, "failed to write log entries")
+	}
+
+	s.active.size += int64(buf.Len())
+	for _, entry := range entries {
+		stored := *entry
+		s.active.entries = append(s.active.entries, &stored)
+		s.active.span.add(&stored)
+		s.events.add(&stored)
+	}
+
+	// the entries are stored, a failed roll is retried later
+	s.roll(time.Now())
+	return nil
+}
+
+func (s *diskService) Create(
+	ctx context.Context, level string, message string, metadata map[string]interface{},
+) (*LogEntry, error) {
+	if level == "" || message == "" {
+		return nil, ErrEmptyKey
+	}
+
+	entry := NewLogEntry(level, message, metadata)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.append([]*LogEntry{entry}); err != nil {
+		entry.ID = ""
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (s *diskService) CreateMany(
+	ctx context.Context, entries []*LogEntry,
+) ([]error, error) {
+	var (
+		errs  = make([]error, len(entries))
+		valid = make([]*LogEntry, 0, len(entries))
+		now   = time.Now().UnixNano()
+		batch = batchEvents{}
+		dups  = map[int]int{}
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ix, entry := range entries {
+		if entry.Level == "" || entry.Message == "" {
+			errs[ix] = ErrEmptyKey
+			continue
+		}
+
+		// entries restored from an archive come with their ID
+		if entry.ID != "" {
+			if _, err := s.find(entry.ID); err == nil {
+				errs[ix] = errors.Wrap(ErrBadRequest, "duplicate log ID")
+				continue
+			}
+		}
+
+		// an entry deleted since isn't a duplicate anymore
+		if id, ok := s.events.lookup(entry.EventID, now); ok {
+			original, err := s.find(id)
+			if err == nil {
+				*entry = *original
+				errs[ix] = ErrDuplicate
+				continue
+			}
+			if errors.Cause(err) != ErrNotFound {
+				errs[ix] = err
+				continue
+			}
+		}
+
+		if first := batch.first(entry, ix); first != ix {
+			dups[ix] = first
+			continue
+		}
+		valid = append(valid, entry)
+	}
+
+	if len(valid) == 0 {
+		return errs, nil
+	}
+
+	if err := s.append(valid); err != nil {
+		for _, entry := range valid {
+			entry.ID = ""
+		}
+		return nil, err
+	}
+
+	for ix, first := range dups {
+		*entries[ix] = *entries[first]
+		errs[ix] = ErrDuplicate
+	}
+	return errs, nil
+}
+
+// find looks up a live record by ID. Callers must hold the lock.
+func (s *diskService) find(id string) (*LogEntry, error) {
+	if _, ok := s.deleted[id]; ok {
+		return nil, ErrNotFound
+	}
+
+	if s.active.span.holds(id) {
+		for _, entry := range s.active.entries {
+			if entry.ID == id {
+				found := *entry
+				return &found, nil
+			}
+		}
+	}
+
+	// most recent first, IDs are mostly assigned in segment order
+	for ix := len(s.segments) - 1; ix >= 0; ix-- {
+		seg := s.segments[ix]
+		if !seg.index.holds(id) {
+			continue
+		}
+
+		for _, blk := range seg.index.Blocks {
+			if !blk.holds(id) {
+				continue
+			}
+
+			lines, err := seg.read(blk)
+			if err != nil {
+				return nil, err
+			}
+
+			// skip decoding records which can't match
+			needle := []byte(`"id":"` + id + `"`)
+			for _, ln := range lines {
+				if !bytes.Contains(ln, needle) {
+					continue
+				}
+
+				var entry LogEntry
+				if err := json.Unmarshal(ln, &entry); err != nil {
+					return nil, errors.Wrap(err, "failed to decode record")
+				}
+				if entry.ID == id {
+					return &entry, nil
+				}
+			}
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (s *diskService) Get(ctx context.Context, id string) (*LogEntry, error) {
+	if _, err := primitive.ObjectIDFromHex(id); err != nil {
+		return nil, errors.Wrap(ErrBadRequest, "invalid log ID format")
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.find(id)
+}
+
+// List returns the matching entries, most recent first. Sealed segments
+// are read only for the blocks the sparse index and level bitmaps allow,
+// most recent first, until the limit can't improve anymore.
+func (s *diskService) List(ctx context.Context, filter map[string]interface{}) ([]LogEntry, error) {
+	q, err := parseListQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := make([]LogEntry, 0)
+	for _, entry := range s.active.entries {
+		if _, ok := s.deleted[entry.ID]; !ok && q.match(entry) {
+			entries = append(entries, *entry)
+		}
+	}
+
+	type candidate struct {
+		seg *segment
+		blk blockIndex
+	}
+
+	candidates := []candidate{}
+	for _, seg := range s.segments {
+		for _, blk := range seg.blocks(q) {
+			candidates = append(candidates, candidate{seg: seg, blk: blk})
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].blk.MaxTs > candidates[j].blk.MaxTs
+	})
+
+	sortEntries(entries)
+	for _, c := range candidates {
+		// blocks are ordered by their newest record, none of the rest
+		// can make it into the limit
+		if q.limit > 0 && int64(len(entries)) >= q.limit && c.blk.MaxTs < entries[q.limit-1].Timestamp {
+			break
+		}
+
+		matched, err := s.readBlock(c.seg, c.blk, q)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, matched...)
+
+		if q.limit > 0 {
+			sortEntries(entries)
+			if int64(len(entries)) > q.limit {
+				entries = entries[:q.limit]
+			}
+		}
+	}
+
+	sortEntries(entries)
+	if q.limit > 0 && int64(len(entries)) > q.limit {
+		entries = entries[:q.limit]
+	}
+
+	return entries, nil
+}
+
+// readBlock returns the entries of a block which pass the filter and
+// weren't deleted. Callers must hold the lock.
+func (s *diskService) readBlock(seg *segment, blk blockIndex, q *listQuery) ([]LogEntry, error) {
+	lines, err := seg.read(blk)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		entries = []LogEntry{}
+		levels  = seg.index.Levels[q.level]
+	)
+
+	for ix, ln := range lines {
+		if q.level != "" && !levels.has(blk.First+ix) {
+			continue
+		}
+
+		var entry LogEntry
+		if err := json.Unmarshal(ln, &entry); err != nil {
+			return nil, errors.Wrap(err, "failed to decode record")
+		}
+
+		if _, ok := s.deleted[entry.ID]; !ok && q.match(&entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// Aggregate counts the matching entries of the active segment and of the
+// blocks of sealed segments the filter allows, one block at a time
+func (s *diskService) Aggregate(ctx context.Context, filter map[string]interface{}) (*Aggregation, error) {
+	q, err := parseAggregateQuery(filter, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	agg := newAggregator(q)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, entry := range s.active.entries {
+		if _, ok := s.deleted[entry.ID]; !ok && q.list.match(entry) {
+			agg.addEntry(entry)
+		}
+	}
+
+	for _, seg := range s.segments {
+		for _, blk := range seg.blocks(q.list) {
+			entries, err := s.readBlock(seg, blk, q.list)
+			if err != nil {
+				return nil, err
+			}
+
+			for ix := range entries {
+				agg.addEntry(&entries[ix])
+			}
+		}
+	}
+
+	return agg.result(), nil
+}
+
+// sortEntries orders entries most recent first, ObjectID hex grows with
+// insertion so ties keep the latest first
+func sortEntries(entries []LogEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Timestamp != entries[j].Timestamp {
+			return entries[i].Timestamp > entries[j].Timestamp
+		}
+		return entries[i].ID > entries[j].ID
+	})
+}
+
+// Count counts the live entries a Delete filter matches, reading only
+// the segments whose index overlaps the query
+func (s *diskService) Count(ctx context.Context, filter map[string]interface{}) (int64, error) {
+	q, err := parseCountQuery(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var count int64
+	live := func(entries []*LogEntry) {
+		for _, entry := range entries {
+			if _, gone := s.deleted[entry.ID]; !gone && q.match(entry) {
+				count++
+			}
+		}
+	}
+
+	for _, seg := range s.segments {
+		if seg.index.MinTs >= q.before || (q.start != nil && seg.index.MaxTs < *q.start) ||
+			(q.level != "" && seg.index.Levels[q.level] == nil) {
+			continue
+		}
+
+		entries, err := seg.entries()
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to count log entries")
+		}
+		live(entries)
+	}
+
+	live(s.active.entries)
+	return count, nil
+}
+
+func (s *diskService) Delete(ctx context.Context, filter map[string]interface{}) error {
+	// If ID is present, record a tombstone for it
+	if id, ok := filter["id"].(string); ok && id != "" {
+		if _, err := primitive.ObjectIDFromHex(id); err != nil {
+			return errors.Wrap(ErrBadRequest, "invalid log ID format")
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if _, err := s.find(id); err != nil {
+			if errors.Cause(err) == ErrNotFound {
+				return nil
+			}
+			return err
+		}
+
+		if _, err := s.tombs.WriteString(id + "\n"); err != nil {
+			return errors.Wrap(err, "failed to delete log entry")
+		}
+
+		s.deleted[id] = struct{}{}
+		return nil
+	}
+
+	// If IDs are present, record a tombstone for those which may exist
+	ids, err := parseDeleteIDs(filter)
+	if err != nil {
+		return err
+	}
+
+	if len(ids) > 0 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		var (
+			tombs strings.Builder
+			gone  = []string{}
+		)
+		for _, id := range ids {
+			if _, ok := s.deleted[id]; !ok && s.holds(id) {
+				tombs.WriteString(id + "\n")
+				gone = append(gone, id)
+			}
+		}
+
+		if _, err := s.tombs.WriteString(tombs.String()); err != nil {
+			return errors.Wrap(err, "failed to delete log entries")
+		}
+
+		for _, id := range gone {
+			s.deleted[id] = struct{}{}
+		}
+		return nil
+	}
+
+	// If before timestamp is present, delete all entries before that time
+	q, err := parseDeleteQuery(filter)
+	if err != nil {
+		return err
+	}
+
+	if q != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		deleted, err := s.deleteBefore(q)
+		if err != nil {
+			return errors.Wrap(err, "failed to delete log entries")
+		}
+
+		if deleted == 0 {
+			return errors.Wrap(ErrBadRequest, "no logs found before the specified timestamp")
+		}
+
+		return nil
+	}
+
+	return errors.Wrap(ErrBadRequest, "either id or before timestamp must be provided")
+}
+
+// deleteBefore drops segments whose records all match the query and
+// rewrites those which match partially under a new name. A crash before
+// the old segment is removed keeps both. Callers must hold the write lock.
+func (s *diskService) deleteBefore(q *deleteQuery) (int, error) {
+	var (
+		deleted  = 0
+		segments = make([]*segment, 0, len(s.segments))
+	)
+
+	live := func(entries []*LogEntry) ([]*LogEntry, int) {
+		kept := make([]*LogEntry, 0, len(entries))
+		dropped := 0
+		for _, entry := range entries {
+			_, gone := s.deleted[entry.ID]
+			switch {
+			case !q.match(entry):
+				kept = append(kept, entry)
+			case !gone:
+				dropped++
+			}
+		}
+		return kept, dropped
+	}
+
+	for ix, seg := range s.segments {
+		if seg.index.MinTs >= q.before || (q.start != nil && seg.index.MaxTs < *q.start) ||
+			(q.level != "" && seg.index.Levels[q.level] == nil) {
+			segments = append(segments, seg)
+			continue
+		}
+
+		entries, err := seg.entries()
+		if err != nil {
+			s.segments = append(segments, s.segments[ix:]...)
+			return deleted, err
+		}
+
+		kept, dropped := live(entries)
+		deleted += dropped
+
+		if len(kept) == len(entries) {
+			segments = append(segments, seg)
+			continue
+		}
+
+		if len(kept) == 0 {
+			if err := seg.remove(); err != nil {
+				s.segments = append(segments, s.segments[ix:]...)
+				return deleted, err
+			}
+			continue
+		}
+
+		// the kept records go to a new segment like on upgrade, rewriting
+		// in place could leave the old index pointing at the new segment
+		rewritten, err := writeSegment(s.segmentBase(time.Now()), kept)
+		if err != nil {
+			s.segments = append(segments, s.segments[ix:]...)
+			return deleted, err
+		}
+
+		if err := seg.remove(); err != nil {
+			s.segments = append(append(segments, rewritten), s.segments[ix+1:]...)
+			return deleted, err
+		}
+		segments = append(segments, rewritten)
+	}
+	s.segments = segments
+
+	if s.active.span.Count == 0 || s.active.span.MinTs >= q.before ||
+		(q.start != nil && s.active.span.MaxTs < *q.start) {
+		return deleted, nil
+	}
+
+	kept, dropped := live(s.active.entries)
+	deleted += dropped
+
+	if len(kept) == len(s.active.entries) {
+		return deleted, nil
+	}
+
+	return deleted, s.rewriteActive(kept)
+}
+
+// rewriteActive replaces the records of the active segment
+func (s *diskService) rewriteActive(entries []*LogEntry) error {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		bt, err := json.Marshal(entry)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode log entry")
+		}
+		buf.Write(bt)
+		buf.WriteByte('\n')
+	}
+
+	path := s.active.base + activeExt
+	if err := writeFile(path, buf.Bytes()); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open active segment")
+	}
+
+	s.active.file.Close()
+	s.active.file = file
+	s.active.size = int64(buf.Len())
+	s.active.entries = entries
+	s.active.span = span{}
+	for _, entry := range entries {
+		s.active.span.add(entry)
+	}
+
+	return nil
+}
+
+// Close syncs the active segment, it is recovered on the next open
+func (s *diskService) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if e := s.active.file.Sync(); e != nil {
+		err = errors.Wrap(e, "failed to sync active segment")
+	}
+	s.active.file.Close()
+	s.tombs.Close()
+	return err
+}
+
+// NewDiskService returns a Service storing entries in segment files
+// under dir. The active segment is sealed once it grows beyond maxSize
+// bytes or is older than maxAge. Entries sent again with the event ID of
+// one received within window are dropped as duplicates, a zero window
+// disables deduplication.
+func NewDiskService(dir string, maxSize int64, maxAge, window time.Duration) (Service, error) {
+	if dir == "" {
+		return nil, errors.New("data directory is required")
+	}
+
+	if maxSize <= 0 || maxAge <= 0 {
+		return nil, errors.New("segment size and age must be positive")
+	}
+
+	s := &diskService{
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		deleted: map[string]struct{}{},
+		events:  newEventIndex(window, 0),
+		done:    make(chan struct{}),
+	}
+
+	if err := s.open(); err != nil {
+		if s.active != nil {
+			s.active.file.Close()
+		}
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.roller()
+	return s, nil
+}
@@ -0,0 +1,227 @@
+package crud_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/bhuvankumar123/klg/crud/crudtest"
+	"github.com/pkg/errors"
+)
+
+func TestDiskService(t *testing.T) {
+	crudtest.RunServiceSuite(t, func(t *testing.T) crud.Service {
+		svc, err := crud.NewDiskService(t.TempDir(), 64<<20, time.Hour, time.Hour)
+		if err != nil {
+			t.Fatalf("failed to create disk service: %v", err)
+		}
+		return svc
+	})
+}
+
+// TestDiskServiceSealed seals a segment every few records, so that the
+// suite runs against compressed segments rather than the active one
+func TestDiskServiceSealed(t *testing.T) {
+	crudtest.RunServiceSuite(t, func(t *testing.T) crud.Service {
+		svc, err := crud.NewDiskService(t.TempDir(), 256, time.Hour, time.Hour)
+		if err != nil {
+			t.Fatalf("failed to create disk service: %v", err)
+		}
+		return svc
+	})
+}
+
+func TestDiskServiceReopen(t *testing.T) {
+	var (
+		ctx = context.Background()
+		dir = t.TempDir()
+	)
+
+	svc, err := crud.NewDiskService(dir, 512, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create disk service: %v", err)
+	}
+
+	ids := []string{}
+	for ix := 0; ix < 20; ix++ {
+		entry, err := svc.Create(ctx, "info", "entry to be kept across restarts", nil)
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		ids = append(ids, entry.ID)
+	}
+
+	if err := svc.Delete(ctx, map[string]interface{}{"id": ids[3]}); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	if err := svc.Close(ctx); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	svc, err = crud.NewDiskService(dir, 512, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to reopen disk service: %v", err)
+	}
+	defer svc.Close(ctx)
+
+	entries, err := svc.List(ctx, map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+
+	if len(entries) != len(ids)-1 {
+		t.Errorf("List after reopen returned %d entries, expected %d", len(entries), len(ids)-1)
+	}
+
+	if _, err := svc.Get(ctx, ids[3]); errors.Cause(err) != crud.ErrNotFound {
+		t.Errorf("Get of an entry deleted before reopen returned %v, expected ErrNotFound", err)
+	}
+
+	if _, err := svc.Get(ctx, ids[19]); err != nil {
+		t.Errorf("Get after reopen failed: %v", err)
+	}
+}
+
+// TestDiskServiceDeleteRewrite deletes some of the records of sealed
+// segments, which are rewritten under a new name before the old segment
+// is removed
+func TestDiskServiceDeleteRewrite(t *testing.T) {
+	var (
+		ctx = context.Background()
+		dir = t.TempDir()
+	)
+
+	svc, err := crud.NewDiskService(dir, 512, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create disk service: %v", err)
+	}
+
+	for ix := 0; ix < 20; ix++ {
+		level := []string{"info", "error"}[ix%2]
+		if _, err := svc.Create(ctx, level, "entry in a partially deleted segment", nil); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+	}
+
+	segments := func() map[string]bool {
+		names, err := filepath.Glob(filepath.Join(dir, "seg-*.seg"))
+		if err != nil {
+			t.Fatalf("failed to list segments: %v", err)
+		}
+
+		bases := map[string]bool{}
+		for _, name := range names {
+			bases[strings.TrimSuffix(name, ".seg")] = true
+		}
+		return bases
+	}
+	sealed := segments()
+	if len(sealed) == 0 {
+		t.Fatalf("no segment was sealed")
+	}
+
+	if err := svc.Delete(ctx, map[string]interface{}{
+		"before": time.Now().Add(time.Hour).Format(time.RFC3339),
+		"level":  "error",
+	}); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	rewritten := segments()
+	if len(rewritten) != len(sealed) {
+		t.Fatalf("Delete left %d segments of %d", len(rewritten), len(sealed))
+	}
+
+	for base := range rewritten {
+		if sealed[base] {
+			t.Errorf("segment %s was rewritten in place", base)
+		}
+
+		if matches, _ := filepath.Glob(base + ".idx"); len(matches) != 1 {
+			t.Errorf("segment %s has no index", base)
+		}
+	}
+
+	if err := svc.Close(ctx); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	svc, err = crud.NewDiskService(dir, 512, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to reopen disk service: %v", err)
+	}
+	defer svc.Close(ctx)
+
+	entries, err := svc.List(ctx, map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+
+	for _, entry := range entries {
+		if entry.Level != "info" {
+			t.Errorf("List after reopen returned a deleted %s entry", entry.Level)
+		}
+	}
+
+	if len(entries) != 10 {
+		t.Errorf("List after reopen returned %d entries, expected 10", len(entries))
+	}
+}
+
+// TestDiskServiceReopenEventIDs checks that the event IDs of sealed and
+// active segments are still deduplicated after a restart
+func TestDiskServiceReopenEventIDs(t *testing.T) {
+	var (
+		ctx = context.Background()
+		dir = t.TempDir()
+	)
+
+	svc, err := crud.NewDiskService(dir, 512, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create disk service: %v", err)
+	}
+
+	entries := []*crud.LogEntry{}
+	for ix := 0; ix < 20; ix++ {
+		entry := crud.NewLogEntry("info", "entry with an event ID", nil)
+		entry.EventID = fmt.Sprintf("event-%d", ix)
+		entries = append(entries, entry)
+	}
+
+	if _, err := svc.CreateMany(ctx, entries[:10]); err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+	if _, err := svc.CreateMany(ctx, entries[10:]); err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	if err := svc.Close(ctx); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	svc, err = crud.NewDiskService(dir, 512, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to reopen disk service: %v", err)
+	}
+	defer svc.Close(ctx)
+
+	for _, ix := range []int{0, 19} {
+		resent := crud.NewLogEntry("info", "resent after restart", nil)
+		resent.EventID = entries[ix].EventID
+
+		errs, err := svc.CreateMany(ctx, []*crud.LogEntry{resent})
+		if err != nil {
+			t.Fatalf("CreateMany failed: %v", err)
+		}
+
+		if errors.Cause(errs[0]) != crud.ErrDuplicate || resent.ID != entries[ix].ID {
+			t.Errorf("resending %s after reopen returned %v and ID %q, expected ErrDuplicate and %q",
+				resent.EventID, errs[0], resent.ID, entries[ix].ID)
+		}
+	}
+}
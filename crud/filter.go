@@ -0,0 +1,465 @@
+package crud
+
+import (
+	"encoding/base64"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// listQuery is the filter of List parsed from its string parameters. It
+// is shared by the backends, so that they agree on what a filter means.
+type listQuery struct {
+	level   string
+	pattern string
+	message *regexp.Regexp
+	start   *int64
+	end     *int64
+	limit   int64
+
+	// after is the seek key of a cursor, only entries listed after it
+	// pass the filter
+	after *listCursor
+
+	// expr is the compiled q= query
+	expr queryExpr
+
+	// metadata holds the filters on metadata paths, e.g. service or
+	// http.status for a nested document, sorted by key
+	metadata []*metadataFilter
+}
+
+// listCursor is the position of an entry in the order of List, most
+// recent first and the highest ID first among equal timestamps
+type listCursor struct {
+	timestamp int64
+	id        string
+}
+
+// EncodeCursor returns the opaque cursor of the entries List returns
+// after entry, for the cursor filter
+func EncodeCursor(entry *LogEntry) string {
+	key := strconv.FormatInt(entry.Timestamp, 10) + ":" + entry.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// decodeCursor reads a cursor returned by EncodeCursor
+func decodeCursor(cursor string) (*listCursor, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.Wrap(ErrBadRequest, "invalid cursor")
+	}
+
+	ts, id, ok := strings.Cut(string(key), ":")
+	if !ok || id == "" {
+		return nil, errors.Wrap(ErrBadRequest, "invalid cursor")
+	}
+
+	timestamp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(ErrBadRequest, "invalid cursor")
+	}
+
+	return &listCursor{timestamp: timestamp, id: id}, nil
+}
+
+// before reports whether the entry is listed after the cursor
+func (c *listCursor) before(entry *LogEntry) bool {
+	return entry.Timestamp < c.timestamp ||
+		(entry.Timestamp == c.timestamp && entry.ID < c.id)
+}
+
+// metadataPrefix marks the filter keys which are matched against metadata
+const metadataPrefix = "metadata."
+
+// parseMetadataPath splits a metadata path into its keys. Keys may not
+// be empty, start with $ or contain quotes, none of the backends could
+// address them.
+func parseMetadataPath(path string) ([]string, error) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys {
+		if key == "" || strings.HasPrefix(key, "$") || strings.ContainsAny(key, `"\`) {
+			return nil, errors.Wrap(ErrBadRequest, "invalid metadata filter "+path)
+		}
+	}
+	return keys, nil
+}
+
+// parseListQuery reads level, message, starttime, endtime, recent, cursor,
+// q and metadata.<path> from a List filter. Other keys are ignored.
+func parseListQuery(filter map[string]interface{}) (*listQuery, error) {
+	q := &listQuery{}
+
+	if level, ok := filter["level"].(string); ok {
+		q.level = level
+	}
+
+	// message is matched as a case insensitive regular expression
+	if message, ok := filter["message"].(string); ok && message != "" {
+		re, err := regexp.Compile("(?i)" + message)
+		if err != nil {
+			return nil, errors.Wrap(ErrBadRequest, "invalid message pattern")
+		}
+		q.pattern, q.message = message, re
+	}
+
+	if startTime, ok := filter["starttime"].(string); ok && startTime != "" {
+		ts, err := ParseTimestamp(startTime)
+		if err != nil {
+			return nil, errors.Wrap(ErrBadRequest, "invalid start time format")
+		}
+		q.start = &ts
+	}
+
+	if endTime, ok := filter["endtime"].(string); ok && endTime != "" {
+		ts, err := ParseTimestamp(endTime)
+		if err != nil {
+			return nil, errors.Wrap(ErrBadRequest, "invalid end time format")
+		}
+		q.end = &ts
+	}
+
+	// recent limits the result to the most recent entries
+	if recent, ok := filter["recent"].(string); ok && recent != "" {
+		limit, err := strconv.ParseInt(recent, 10, 64)
+		if err != nil || limit < 0 {
+			return nil, errors.Wrap(ErrBadRequest, "invalid recent value")
+		}
+		q.limit = limit
+	}
+
+	// a cursor also bounds the time range, so that the backends skip
+	// what was listed before
+	if cursor, ok := filter["cursor"].(string); ok && cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		q.after = after
+
+		if q.end == nil || *q.end > after.timestamp {
+			q.end = &after.timestamp
+		}
+	}
+
+	// q is a query in the language of parseQuery, relative times are
+	// resolved now
+	if query, ok := filter["q"].(string); ok && query != "" {
+		expr, err := parseQuery(query, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		q.expr = expr
+	}
+
+	// metadata.<path>[op:type] filters, see parseMetadataFilter
+	keys := []string{}
+	for key := range filter {
+		if strings.HasPrefix(key, metadataPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		str, ok := filter[key].(string)
+		if !ok {
+			return nil, errors.Wrap(ErrBadRequest, "invalid value for "+key)
+		}
+
+		mf, err := parseMetadataFilter(key, str)
+		if err != nil {
+			return nil, err
+		}
+		q.metadata = append(q.metadata, mf)
+	}
+
+	return q, nil
+}
+
+// lookup returns the metadata value at path, walking nested documents
+func lookup(metadata map[string]interface{}, path []string) (interface{}, bool) {
+	var value interface{} = metadata
+	for _, key := range path {
+		doc, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		if value, ok = doc[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// match reports whether the entry passes the filter
+func (q *listQuery) match(entry *LogEntry) bool {
+	if q.level != "" && entry.Level != q.level {
+		return false
+	}
+
+	if q.message != nil && !q.message.MatchString(entry.Message) {
+		return false
+	}
+
+	if q.start != nil && entry.Timestamp < *q.start {
+		return false
+	}
+
+	if q.end != nil && entry.Timestamp > *q.end {
+		return false
+	}
+
+	if q.after != nil && !q.after.before(entry) {
+		return false
+	}
+
+	if q.expr != nil && !q.expr.match(entry) {
+		return false
+	}
+
+	for _, mf := range q.metadata {
+		if !mf.match(entry) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// bson translates the filter into a MongoDB query
+func (q *listQuery) bson() bson.M {
+	query := bson.M{}
+
+	if q.level != "" {
+		query["level"] = q.level
+	}
+
+	if q.pattern != "" {
+		query["message"] = bson.M{"$regex": q.pattern, "$options": "i"}
+	}
+
+	if q.start != nil || q.end != nil {
+		ts := bson.M{}
+		if q.start != nil {
+			ts["$gte"] = *q.start
+		}
+		if q.end != nil {
+			ts["$lte"] = *q.end
+		}
+		query["timestamp"] = ts
+	}
+
+	// IDs are stored as ObjectIDs, unless given in another format
+	if q.after != nil {
+		var id interface{} = q.after.id
+		if oid, err := primitive.ObjectIDFromHex(q.after.id); err == nil {
+			id = oid
+		}
+
+		query["$or"] = bson.A{
+			bson.M{"timestamp": bson.M{"$lt": q.after.timestamp}},
+			bson.M{"timestamp": q.after.timestamp, "_id": bson.M{"$lt": id}},
+		}
+	}
+
+	// filters may share a path and the query may use $or and $and
+	// itself, the cursor already uses $or
+	and := bson.A{}
+	for _, mf := range q.metadata {
+		and = append(and, mf.bson())
+	}
+	if q.expr != nil {
+		and = append(and, q.expr.bson())
+
+		if search := textSearch(q.expr); search != "" {
+			query["$text"] = bson.M{"$search": search}
+		}
+	}
+	if len(and) > 0 {
+		query["$and"] = and
+	}
+
+	return query
+}
+
+// deleteQuery is the filter of a Delete by time parsed from its
+// parameters. Entries older than before are deleted, optionally narrowed
+// to those from start, a level and a metadata.service, and leaving out
+// the excluded ones.
+type deleteQuery struct {
+	before          int64
+	start           *int64
+	level           string
+	service         string
+	excludeLevels   []string
+	excludeServices []string
+}
+
+// serviceKey is the metadata key retention rules and deletes are keyed by
+const serviceKey = "service"
+
+// Delete filter keys excluding levels and services, they hold a []string
+const (
+	excludeLevelKey   = "exclude.level"
+	excludeServiceKey = "exclude." + metadataPrefix + serviceKey
+)
+
+// parseDeleteQuery reads before, starttime, level, metadata.service and
+// the exclusions from a Delete filter. It returns nil if before is
+// missing.
+func parseDeleteQuery(filter map[string]interface{}) (*deleteQuery, error) {
+	before, ok := filter["before"].(string)
+	if !ok || before == "" {
+		return nil, nil
+	}
+
+	ts, err := ParseTimestamp(before)
+	if err != nil {
+		return nil, errors.Wrap(ErrBadRequest, "invalid timestamp format")
+	}
+
+	q := &deleteQuery{before: ts}
+
+	if starttime, ok := filter["starttime"].(string); ok && starttime != "" {
+		start, err := ParseTimestamp(starttime)
+		if err != nil {
+			return nil, errors.Wrap(ErrBadRequest, "invalid start time format")
+		}
+		q.start = &start
+	}
+
+	if level, ok := filter["level"].(string); ok {
+		q.level = level
+	}
+
+	if service, ok := filter[metadataPrefix+serviceKey].(string); ok {
+		q.service = service
+	}
+
+	if levels, ok := filter[excludeLevelKey].([]string); ok {
+		q.excludeLevels = levels
+	}
+
+	if services, ok := filter[excludeServiceKey].([]string); ok {
+		q.excludeServices = services
+	}
+
+	return q, nil
+}
+
+// idsKey is the Delete filter key of several IDs, it holds a []string
+const idsKey = "ids"
+
+// parseDeleteIDs reads the IDs of a Delete filter, nil if there are none
+func parseDeleteIDs(filter map[string]interface{}) ([]string, error) {
+	ids, _ := filter[idsKey].([]string)
+	for _, id := range ids {
+		if _, err := primitive.ObjectIDFromHex(id); err != nil {
+			return nil, errors.Wrap(ErrBadRequest, "invalid log ID format")
+		}
+	}
+	return ids, nil
+}
+
+// parseCountQuery reads a Delete filter by time for Count, before is
+// required
+func parseCountQuery(filter map[string]interface{}) (*deleteQuery, error) {
+	q, err := parseDeleteQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if q == nil {
+		return nil, errors.Wrap(ErrBadRequest, "before timestamp must be provided")
+	}
+	return q, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// everything reports whether the query deletes every entry before its
+// cutoff, rather than those of a level or service
+func (q *deleteQuery) everything() bool {
+	return q.start == nil && q.level == "" && q.service == "" &&
+		len(q.excludeLevels) == 0 && len(q.excludeServices) == 0
+}
+
+// match reports whether the entry is deleted by the query
+func (q *deleteQuery) match(entry *LogEntry) bool {
+	if entry.Timestamp >= q.before {
+		return false
+	}
+
+	if q.start != nil && entry.Timestamp < *q.start {
+		return false
+	}
+
+	if q.level != "" && entry.Level != q.level {
+		return false
+	}
+
+	if contains(q.excludeLevels, entry.Level) {
+		return false
+	}
+
+	// entries without a string service are never excluded
+	service, _ := entry.Metadata[serviceKey].(string)
+	if q.service != "" && service != q.service {
+		return false
+	}
+
+	if service != "" && contains(q.excludeServices, service) {
+		return false
+	}
+
+	return true
+}
+
+// bson translates the query into a MongoDB filter
+func (q *deleteQuery) bson() bson.M {
+	timestamp := bson.M{"$lt": q.before}
+	if q.start != nil {
+		timestamp["$gte"] = *q.start
+	}
+	query := bson.M{"timestamp": timestamp}
+
+	levels := bson.M{}
+	if q.level != "" {
+		levels["$eq"] = q.level
+	}
+	if len(q.excludeLevels) > 0 {
+		levels["$nin"] = q.excludeLevels
+	}
+	if len(levels) > 0 {
+		query["level"] = levels
+	}
+
+	// $nin also matches documents without the field
+	services := bson.M{}
+	if q.service != "" {
+		services["$eq"] = q.service
+	}
+	if len(q.excludeServices) > 0 {
+		services["$nin"] = q.excludeServices
+	}
+	if len(services) > 0 {
+		query[metadataPrefix+serviceKey] = services
+	}
+
+	return query
+}
@@ -0,0 +1,116 @@
+package crud
+
+import (
+	"container/list"
+	"time"
+)
+
+// maxEventIDLength caps the event IDs accepted on ingest
+const maxEventIDLength = 256
+
+// eventRef is the entry an event ID was stored with
+type eventRef struct {
+	eventID    string
+	id         string
+	receivedAt int64
+}
+
+// eventIndex maps the event IDs received within the window onto the IDs
+// of their entries, for the backends which look them up in memory. A
+// zero window disables deduplication. Events are forgotten in the order
+// they were added, once out of the window or over max when max is set.
+type eventIndex struct {
+	window time.Duration
+	max    int
+	events map[string]*list.Element
+	order  *list.List
+}
+
+func newEventIndex(window time.Duration, max int) *eventIndex {
+	return &eventIndex{
+		window: window,
+		max:    max,
+		events: map[string]*list.Element{},
+		order:  list.New(),
+	}
+}
+
+// cutoff returns the earliest received_at still within the window
+func (x *eventIndex) cutoff(now int64) int64 {
+	return now - int64(x.window)
+}
+
+// lookup returns the ID of the entry stored with eventID within the
+// window. The entry may have been deleted since.
+func (x *eventIndex) lookup(eventID string, now int64) (string, bool) {
+	if x.window <= 0 || eventID == "" {
+		return "", false
+	}
+
+	el, ok := x.events[eventID]
+	if !ok {
+		return "", false
+	}
+
+	ref := el.Value.(eventRef)
+	if ref.receivedAt < x.cutoff(now) {
+		return "", false
+	}
+	return ref.id, true
+}
+
+// add records the event ID of a stored entry
+func (x *eventIndex) add(entry *LogEntry) {
+	if x.window <= 0 || entry.EventID == "" {
+		return
+	}
+
+	x.remove(entry.EventID)
+	x.events[entry.EventID] = x.order.PushBack(eventRef{
+		eventID:    entry.EventID,
+		id:         entry.ID,
+		receivedAt: entry.ReceivedAt,
+	})
+
+	x.prune(time.Now().UnixNano())
+}
+
+// remove forgets an event ID, so that the event may be sent again
+func (x *eventIndex) remove(eventID string) {
+	if el, ok := x.events[eventID]; ok {
+		x.order.Remove(el)
+		delete(x.events, eventID)
+	}
+}
+
+// prune forgets the oldest events while they are out of the window or
+// over max
+func (x *eventIndex) prune(now int64) {
+	cutoff := x.cutoff(now)
+	for el := x.order.Front(); el != nil; el = x.order.Front() {
+		ref := el.Value.(eventRef)
+		if ref.receivedAt >= cutoff && (x.max <= 0 || x.order.Len() <= x.max) {
+			return
+		}
+		x.remove(ref.eventID)
+	}
+}
+
+// batchEvents tracks the event IDs of a batch being stored, so that an
+// event sent twice within the batch is stored once
+type batchEvents map[string]int
+
+// first returns the index of the first entry of the batch with the event
+// ID of the entry at ix, which is ix unless the event was seen before
+func (b batchEvents) first(entry *LogEntry, ix int) int {
+	if entry.EventID == "" {
+		return ix
+	}
+
+	if first, ok := b[entry.EventID]; ok {
+		return first
+	}
+
+	b[entry.EventID] = ix
+	return ix
+}
@@ -0,0 +1,243 @@
+package crud
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// defaultService implements the Service interface using in-memory
+// storage. It follows the filter semantics of mongoService, so that klg
+// can run locally and in tests without MongoDB.
+type defaultService struct {
+	mu     sync.RWMutex
+	store  map[string]*LogEntry
+	events *eventIndex
+}
+
+// insert stores a copy of the entry under a generated ID, unless the
+// entry comes with one. Callers must hold the write lock.
+func (s *defaultService) insert(entry *LogEntry) error {
+	if entry.Level == "" || entry.Message == "" {
+		return ErrEmptyKey
+	}
+
+	// an entry deleted since isn't a duplicate anymore
+	if id, ok := s.events.lookup(entry.EventID, time.Now().UnixNano()); ok {
+		if original, ok := s.store[id]; ok {
+			*entry = *original
+			return ErrDuplicate
+		}
+	}
+
+	id := entry.ID
+	if id == "" {
+		id = primitive.NewObjectID().Hex()
+	}
+
+	if _, ok := s.store[id]; ok {
+		return errors.Wrap(ErrBadRequest, "duplicate log ID")
+	}
+
+	entry.receive()
+	stored := *entry
+	stored.ID = id
+	s.store[id] = &stored
+	s.events.add(&stored)
+	entry.ID = id
+	return nil
+}
+
+func (s *defaultService) Create(
+	ctx context.Context, level string, message string, metadata map[string]interface{},
+) (*LogEntry, error) {
+	entry := NewLogEntry(level, message, metadata)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.insert(entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (s *defaultService) CreateMany(
+	ctx context.Context, entries []*LogEntry,
+) ([]error, error) {
+	errs := make([]error, len(entries))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ix, entry := range entries {
+		errs[ix] = s.insert(entry)
+	}
+	return errs, nil
+}
+
+func (s *defaultService) Get(ctx context.Context, id string) (*LogEntry, error) {
+	if _, err := primitive.ObjectIDFromHex(id); err != nil {
+		return nil, errors.Wrap(ErrBadRequest, "invalid log ID format")
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.store[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	found := *entry
+	return &found, nil
+}
+
+// List returns the matching entries, most recent first
+func (s *defaultService) List(ctx context.Context, filter map[string]interface{}) ([]LogEntry, error) {
+	q, err := parseListQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	entries := make([]LogEntry, 0)
+	for _, entry := range s.store {
+		if q.match(entry) {
+			entries = append(entries, *entry)
+		}
+	}
+	s.mu.RUnlock()
+
+	// ObjectID hex grows with insertion, ties keep the latest first
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Timestamp != entries[j].Timestamp {
+			return entries[i].Timestamp > entries[j].Timestamp
+		}
+		return entries[i].ID > entries[j].ID
+	})
+
+	if q.limit > 0 && int64(len(entries)) > q.limit {
+		entries = entries[:q.limit]
+	}
+
+	return entries, nil
+}
+
+// Aggregate counts the matching entries in memory
+func (s *defaultService) Aggregate(ctx context.Context, filter map[string]interface{}) (*Aggregation, error) {
+	q, err := parseAggregateQuery(filter, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	agg := newAggregator(q)
+
+	s.mu.RLock()
+	for _, entry := range s.store {
+		if q.list.match(entry) {
+			agg.addEntry(entry)
+		}
+	}
+	s.mu.RUnlock()
+
+	return agg.result(), nil
+}
+
+func (s *defaultService) Close(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.store = make(map[string]*LogEntry)
+	s.events = newEventIndex(s.events.window, 0)
+	return nil
+}
+
+// Count counts the entries a Delete filter matches in memory
+func (s *defaultService) Count(ctx context.Context, filter map[string]interface{}) (int64, error) {
+	q, err := parseCountQuery(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var count int64
+	for _, entry := range s.store {
+		if q.match(entry) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *defaultService) Delete(ctx context.Context, filter map[string]interface{}) error {
+	// If ID is present, delete specific entry
+	if id, ok := filter["id"].(string); ok && id != "" {
+		if _, err := primitive.ObjectIDFromHex(id); err != nil {
+			return errors.Wrap(ErrBadRequest, "invalid log ID format")
+		}
+
+		s.mu.Lock()
+		delete(s.store, id)
+		s.mu.Unlock()
+		return nil
+	}
+
+	// If IDs are present, delete those entries
+	ids, err := parseDeleteIDs(filter)
+	if err != nil {
+		return err
+	}
+
+	if len(ids) > 0 {
+		s.mu.Lock()
+		for _, id := range ids {
+			delete(s.store, id)
+		}
+		s.mu.Unlock()
+		return nil
+	}
+
+	// If before timestamp is present, delete all entries before that time
+	q, err := parseDeleteQuery(filter)
+	if err != nil {
+		return err
+	}
+
+	if q != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		deleted := 0
+		for id, entry := range s.store {
+			if q.match(entry) {
+				delete(s.store, id)
+				deleted++
+			}
+		}
+
+		if deleted == 0 {
+			return errors.Wrap(ErrBadRequest, "no logs found before the specified timestamp")
+		}
+
+		return nil
+	}
+
+	return errors.Wrap(ErrBadRequest, "either id or before timestamp must be provided")
+}
+
+// NewService returns a Service keeping entries in memory. Entries sent
+// again with the event ID of one received within window are dropped as
+// duplicates, a zero window disables deduplication.
+func NewService(window time.Duration) (Service, error) {
+	return &defaultService{
+		store:  make(map[string]*LogEntry),
+		events: newEventIndex(window, 0),
+	}, nil
+}
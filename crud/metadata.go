@@ -0,0 +1,290 @@
+package crud
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// metadata filter operators, e.g. metadata.status[gte]=500
+const (
+	opEq     = "eq"
+	opNe     = "ne"
+	opIn     = "in"
+	opExists = "exists"
+	opRegex  = "regex"
+	opGt     = "gt"
+	opGte    = "gte"
+	opLt     = "lt"
+	opLte    = "lte"
+)
+
+// metadata filter types, values are strings unless coerced explicitly,
+// e.g. metadata.cached[eq:bool]=true
+const (
+	typeString = "string"
+	typeNumber = "number"
+	typeBool   = "bool"
+)
+
+// metadataFilter matches entries by their metadata value at path. eq
+// and in match values of the type of the filter values, ne everything
+// else including entries missing the path. gt, gte, lt and lte compare
+// numbers and regex matches strings.
+type metadataFilter struct {
+	path []string
+	op   string
+
+	// values holds a string, float64 or bool per value, one except for in
+	values []interface{}
+	re     *regexp.Regexp
+	exists bool
+}
+
+// parseMetadataFilter reads a metadata.<path>[op:type]=value filter, the
+// operator and type are optional. in takes a comma separated list.
+func parseMetadataFilter(key, value string) (*metadataFilter, error) {
+	var (
+		name     = strings.TrimPrefix(key, metadataPrefix)
+		op, kind string
+	)
+
+	if open := strings.LastIndexByte(name, '['); open >= 0 && strings.HasSuffix(name, "]") {
+		op, kind, _ = strings.Cut(name[open+1:len(name)-1], ":")
+		name = name[:open]
+	}
+
+	path, err := parseMetadataPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	mf := &metadataFilter{path: path, op: op}
+	switch op {
+	case "":
+		mf.op = opEq
+		fallthrough
+	case opEq, opNe, opIn:
+		if kind == "" {
+			kind = typeString
+		}
+
+		values := []string{value}
+		if op == opIn {
+			values = strings.Split(value, ",")
+		}
+
+		for _, v := range values {
+			typed, err := coerce(v, kind)
+			if err != nil {
+				return nil, errors.Wrap(err, key)
+			}
+			mf.values = append(mf.values, typed)
+		}
+
+	case opGt, opGte, opLt, opLte:
+		if kind != "" && kind != typeNumber {
+			return nil, errors.Wrap(ErrBadRequest, key+" compares numbers only")
+		}
+
+		n, err := coerce(value, typeNumber)
+		if err != nil {
+			return nil, errors.Wrap(err, key)
+		}
+		mf.values = []interface{}{n}
+
+	case opExists:
+		exists, err := strconv.ParseBool(value)
+		if kind != "" || err != nil {
+			return nil, errors.Wrap(ErrBadRequest, key+" takes true or false")
+		}
+		mf.exists = exists
+
+	case opRegex:
+		if kind != "" && kind != typeString {
+			return nil, errors.Wrap(ErrBadRequest, key+" matches strings only")
+		}
+
+		if mf.re, err = regexp.Compile(value); err != nil {
+			return nil, errors.Wrap(ErrBadRequest, "invalid pattern for "+key)
+		}
+
+	default:
+		return nil, errors.Wrap(ErrBadRequest, "invalid metadata operator "+op)
+	}
+
+	return mf, nil
+}
+
+// coerce converts a filter value to the given type
+func coerce(value, kind string) (interface{}, error) {
+	switch kind {
+	case typeString:
+		return value, nil
+	case typeNumber:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, errors.Wrap(ErrBadRequest, "invalid number "+value)
+		}
+		return n, nil
+	case typeBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.Wrap(ErrBadRequest, "invalid bool "+value)
+		}
+		return b, nil
+	}
+	return nil, errors.Wrap(ErrBadRequest, "invalid metadata type "+kind)
+}
+
+// key returns the path of the filter as a dotted key
+func (mf *metadataFilter) key() string {
+	return metadataPrefix + strings.Join(mf.path, ".")
+}
+
+func (mf *metadataFilter) match(entry *LogEntry) bool {
+	value, ok := lookup(entry.Metadata, mf.path)
+
+	switch mf.op {
+	case opExists:
+		return ok == mf.exists
+	case opNe:
+		return !ok || !mf.equal(value)
+	case opEq, opIn:
+		return ok && mf.equal(value)
+	case opRegex:
+		str, isStr := value.(string)
+		return ok && isStr && mf.re.MatchString(str)
+	}
+
+	n, isNum := number(value)
+	if !ok || !isNum {
+		return false
+	}
+
+	want := mf.values[0].(float64)
+	switch mf.op {
+	case opGt:
+		return n > want
+	case opGte:
+		return n >= want
+	case opLt:
+		return n < want
+	}
+	return n <= want
+}
+
+// equal reports whether value is one of the values, of the same type
+func (mf *metadataFilter) equal(value interface{}) bool {
+	for _, want := range mf.values {
+		switch want := want.(type) {
+		case string:
+			if str, ok := value.(string); ok && str == want {
+				return true
+			}
+		case float64:
+			if n, ok := number(value); ok && n == want {
+				return true
+			}
+		case bool:
+			if b, ok := value.(bool); ok && b == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bson translates the filter, MongoDB compares values of the same type
+// only like the in-memory match
+func (mf *metadataFilter) bson() bson.M {
+	switch mf.op {
+	case opExists:
+		return bson.M{mf.key(): bson.M{"$exists": mf.exists}}
+	case opEq:
+		return bson.M{mf.key(): mf.values[0]}
+	case opNe:
+		return bson.M{mf.key(): bson.M{"$ne": mf.values[0]}}
+	case opIn:
+		return bson.M{mf.key(): bson.M{"$in": bson.A(mf.values)}}
+	case opRegex:
+		return bson.M{mf.key(): bson.M{"$regex": mf.re.String()}}
+	}
+	return bson.M{mf.key(): bson.M{"$" + mf.op: mf.values[0]}}
+}
+
+// sqlNumeric checks that the value at a json path is a number
+const sqlNumeric = "json_type(metadata, ?) IN ('integer', 'real')"
+
+var sqlComparisons = map[string]string{opGt: ">", opGte: ">=", opLt: "<", opLte: "<="}
+
+// sql translates the filter into a condition which is never NULL.
+// json_extract returns numbers as numbers, which never equal text, and
+// json_type tells booleans apart from numbers.
+func (mf *metadataFilter) sql() (string, []interface{}) {
+	path := sqlitePath(mf.path)
+
+	switch mf.op {
+	case opExists:
+		if mf.exists {
+			return "(json_type(metadata, ?) IS NOT NULL)", []interface{}{path}
+		}
+		return "(json_type(metadata, ?) IS NULL)", []interface{}{path}
+
+	case opEq, opIn, opNe:
+		var (
+			conds = make([]string, len(mf.values))
+			args  = []interface{}{}
+		)
+
+		for ix, want := range mf.values {
+			switch want := want.(type) {
+			case float64:
+				conds[ix] = "(" + sqlNumeric + " AND json_extract(metadata, ?) = ?)"
+				args = append(args, path, path, want)
+			case bool:
+				conds[ix] = "json_type(metadata, ?) = ?"
+				args = append(args, path, strconv.FormatBool(want))
+			default:
+				conds[ix] = "json_extract(metadata, ?) = ?"
+				args = append(args, path, want)
+			}
+		}
+
+		cond := "IFNULL(" + strings.Join(conds, " OR ") + ", 0)"
+		if mf.op == opNe {
+			cond = "NOT " + cond
+		}
+		return cond, args
+
+	case opRegex:
+		return "IFNULL(json_extract(metadata, ?) REGEXP ?, 0)", []interface{}{path, mf.re.String()}
+	}
+
+	return "IFNULL(" + sqlNumeric + " AND json_extract(metadata, ?) " + sqlComparisons[mf.op] + " ?, 0)",
+		[]interface{}{path, path, mf.values[0]}
+}
+
+// number reads the numeric metadata values decoded from JSON or BSON
+func number(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
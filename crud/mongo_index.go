@@ -0,0 +1,355 @@
+package crud
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// managedPrefix marks the indexes klg manages, others are left alone
+const managedPrefix = "klg_"
+
+// Index states reported by IndexManager
+const (
+	IndexOK        = "ok"
+	IndexMissing   = "missing"
+	IndexChanged   = "changed"
+	IndexExtra     = "extra"
+	IndexUnmanaged = "unmanaged"
+)
+
+// indexSpec is an index klg declares on the logs collection
+type indexSpec struct {
+	name string
+	keys bson.D
+
+	// language is the default language of a text index
+	language string
+}
+
+// mongoIndexes is the declared set of indexes of the logs collection
+var mongoIndexes = []indexSpec{
+	// level filters, sorted by time and ID as List pages them
+	{name: managedPrefix + "level_timestamp", keys: bson.D{{Key: "level", Value: 1}, {Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}},
+	// time ranges, recent, cursors and delete before
+	{name: managedPrefix + "timestamp", keys: bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}},
+	// quoted phrases of q, words are split without stemming or stop words
+	// so that a phrase is found by the words it is made of
+	{name: managedPrefix + "message_text", keys: bson.D{{Key: "message", Value: "text"}}, language: "none"},
+	// any metadata.* filter
+	{name: managedPrefix + "metadata_wildcard", keys: bson.D{{Key: "metadata.$**", Value: 1}}},
+}
+
+// IndexStatus is an index of a logs collection compared against the
+// declared set
+type IndexStatus struct {
+	Collection string
+	Name       string
+	Keys       string
+	State      string
+}
+
+// Drift reports whether the index differs from the declared set
+func (s IndexStatus) Drift() bool {
+	return s.State != IndexOK && s.State != IndexUnmanaged
+}
+
+// existingIndex is an index as listed by the server
+type existingIndex struct {
+	Name     string `bson:"name"`
+	Key      bson.D `bson:"key"`
+	Weights  bson.M `bson:"weights"`
+	Language string `bson:"default_language"`
+}
+
+// keys returns the key pattern as declared, text indexes are listed by
+// the server with their internal _fts keys and the fields as weights
+func (ix existingIndex) keys() bson.D {
+	if len(ix.Key) > 0 && ix.Key[0].Key == "_fts" {
+		keys := bson.D{}
+		for field := range ix.Weights {
+			keys = append(keys, bson.E{Key: field, Value: "text"})
+		}
+		return keys
+	}
+	return ix.Key
+}
+
+func formatKeys(keys bson.D) string {
+	parts := make([]string, len(keys))
+	for ix, k := range keys {
+		parts[ix] = fmt.Sprintf("%s: %v", k.Key, k.Value)
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// sameKeys compares key patterns, numbers may come back as any type
+func sameKeys(a, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for ix := range a {
+		if a[ix].Key != b[ix].Key {
+			return false
+		}
+		if fmt.Sprint(normaliseKey(a[ix].Value)) != fmt.Sprint(normaliseKey(b[ix].Value)) {
+			return false
+		}
+	}
+	return true
+}
+
+func normaliseKey(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	}
+	return value
+}
+
+// IndexManager keeps the indexes of the logs collection, or of every
+// partition, in line with the declared set
+type IndexManager struct {
+	database   *mongo.Database
+	partitions *partitioner
+}
+
+// collections returns the logs collection or the existing partitions
+func (m *IndexManager) collections(ctx context.Context) ([]*mongo.Collection, error) {
+	if m.partitions == nil {
+		return []*mongo.Collection{m.database.Collection(logsCollection)}, nil
+	}
+
+	parts, err := m.partitions.partitions(ctx, m.database)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*mongo.Collection, len(parts))
+	for ix, part := range parts {
+		out[ix] = m.database.Collection(part.name)
+	}
+	return out, nil
+}
+
+// List compares the indexes of the collections with the declared set
+func (m *IndexManager) List(ctx context.Context) ([]IndexStatus, error) {
+	return m.each(ctx, listIndexes)
+}
+
+// Sync creates missing indexes, rebuilds changed ones and drops managed
+// indexes which are no longer declared. It returns the statuses found
+// before syncing.
+func (m *IndexManager) Sync(ctx context.Context) ([]IndexStatus, error) {
+	return m.each(ctx, syncIndexes)
+}
+
+func (m *IndexManager) each(
+	ctx context.Context, fn func(context.Context, *mongo.Collection) ([]IndexStatus, error),
+) ([]IndexStatus, error) {
+	collections, err := m.collections(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []IndexStatus{}
+	for _, coll := range collections {
+		st, err := fn(ctx, coll)
+		if err != nil {
+			return nil, errors.Wrap(err, coll.Name())
+		}
+		statuses = append(statuses, st...)
+	}
+	return statuses, nil
+}
+
+// Drop removes the managed indexes and returns them as collection.name
+func (m *IndexManager) Drop(ctx context.Context) ([]string, error) {
+	collections, err := m.collections(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dropped := []string{}
+	for _, coll := range collections {
+		names, err := dropIndexes(ctx, coll)
+		for _, name := range names {
+			dropped = append(dropped, coll.Name()+"."+name)
+		}
+		if err != nil {
+			return dropped, err
+		}
+	}
+	return dropped, nil
+}
+
+func existingIndexes(ctx context.Context, coll *mongo.Collection) ([]existingIndex, error) {
+	cursor, err := coll.Indexes().List(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list indexes")
+	}
+	defer cursor.Close(ctx)
+
+	var indexes []existingIndex
+	if err := cursor.All(ctx, &indexes); err != nil {
+		return nil, errors.Wrap(err, "failed to decode indexes")
+	}
+	return indexes, nil
+}
+
+// listIndexes compares the indexes of a collection with the declared set
+func listIndexes(ctx context.Context, coll *mongo.Collection) ([]IndexStatus, error) {
+	existing, err := existingIndexes(ctx, coll)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]existingIndex, len(existing))
+	for _, ix := range existing {
+		byName[ix.Name] = ix
+	}
+
+	statuses := make([]IndexStatus, 0, len(mongoIndexes)+len(existing))
+	declared := make(map[string]bool, len(mongoIndexes))
+
+	for _, spec := range mongoIndexes {
+		declared[spec.name] = true
+		status := IndexStatus{
+			Collection: coll.Name(), Name: spec.name, Keys: formatKeys(spec.keys), State: IndexOK,
+		}
+
+		ix, ok := byName[spec.name]
+		switch {
+		case !ok:
+			status.State = IndexMissing
+		case !sameKeys(ix.keys(), spec.keys):
+			status.State = IndexChanged
+			status.Keys = formatKeys(ix.keys()) + " -> " + status.Keys
+		case spec.language != "" && ix.Language != spec.language:
+			status.State = IndexChanged
+			status.Keys += " language: " + ix.Language + " -> " + spec.language
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	for _, ix := range existing {
+		if declared[ix.Name] || ix.Name == "_id_" {
+			continue
+		}
+
+		state := IndexUnmanaged
+		if strings.HasPrefix(ix.Name, managedPrefix) {
+			state = IndexExtra
+		}
+		statuses = append(statuses, IndexStatus{
+			Collection: coll.Name(), Name: ix.Name, Keys: formatKeys(ix.keys()), State: state,
+		})
+	}
+
+	return statuses, nil
+}
+
+// syncIndexes brings the indexes of a collection in line with the
+// declared set and returns the statuses found before syncing
+func syncIndexes(ctx context.Context, coll *mongo.Collection) ([]IndexStatus, error) {
+	statuses, err := listIndexes(ctx, coll)
+	if err != nil {
+		return nil, err
+	}
+
+	specs := make(map[string]indexSpec, len(mongoIndexes))
+	for _, spec := range mongoIndexes {
+		specs[spec.name] = spec
+	}
+
+	models := []mongo.IndexModel{}
+	for _, status := range statuses {
+		switch status.State {
+		case IndexExtra, IndexChanged:
+			if _, err := coll.Indexes().DropOne(ctx, status.Name); err != nil {
+				return nil, errors.Wrap(err, "failed to drop index "+status.Name)
+			}
+		}
+
+		switch status.State {
+		case IndexMissing, IndexChanged:
+			spec := specs[status.Name]
+			opts := options.Index().SetName(spec.name)
+			if spec.language != "" {
+				opts.SetDefaultLanguage(spec.language)
+			}
+			models = append(models, mongo.IndexModel{Keys: spec.keys, Options: opts})
+		}
+	}
+
+	if len(models) > 0 {
+		if _, err := coll.Indexes().CreateMany(ctx, models); err != nil {
+			return nil, errors.Wrap(err, "failed to create indexes")
+		}
+	}
+
+	return statuses, nil
+}
+
+// dropIndexes removes the managed indexes of a collection
+func dropIndexes(ctx context.Context, coll *mongo.Collection) ([]string, error) {
+	existing, err := existingIndexes(ctx, coll)
+	if err != nil {
+		return nil, err
+	}
+
+	dropped := []string{}
+	for _, ix := range existing {
+		if !strings.HasPrefix(ix.Name, managedPrefix) {
+			continue
+		}
+
+		if _, err := coll.Indexes().DropOne(ctx, ix.Name); err != nil {
+			return dropped, errors.Wrap(err, "failed to drop index "+ix.Name)
+		}
+		dropped = append(dropped, ix.Name)
+	}
+
+	return dropped, nil
+}
+
+// Close disconnects from MongoDB
+func (m *IndexManager) Close(ctx context.Context) error {
+	return m.database.Client().Disconnect(ctx)
+}
+
+// NewIndexManager connects to MongoDB and returns a manager for the
+// indexes of the logs collection of database, or of its partitions
+func NewIndexManager(uri, database, partition string) (*IndexManager, error) {
+	partitions, err := newPartitioner(partition)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to MongoDB")
+	}
+
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, errors.Wrap(err, "failed to ping MongoDB")
+	}
+
+	return &IndexManager{database: client.Database(database), partitions: partitions}, nil
+}
@@ -0,0 +1,104 @@
+package crud
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Partitioning of the MongoDB logs collection
+const (
+	PartitionNone   = "none"
+	PartitionDaily  = "daily"
+	PartitionHourly = "hourly"
+)
+
+// logsCollection is the collection of entries without partitioning, and
+// the prefix of the partitions
+const logsCollection = "logs"
+
+// partitioner maps timestamps to time partitioned collections, e.g.
+// logs_20261018 for a day or logs_2026101815 for an hour, in UTC
+type partitioner struct {
+	layout string
+	width  time.Duration
+}
+
+// newPartitioner returns the partitioner of mode, nil for PartitionNone
+func newPartitioner(mode string) (*partitioner, error) {
+	switch mode {
+	case PartitionNone, "":
+		return nil, nil
+	case PartitionDaily:
+		return &partitioner{layout: "20060102", width: 24 * time.Hour}, nil
+	case PartitionHourly:
+		return &partitioner{layout: "2006010215", width: time.Hour}, nil
+	default:
+		return nil, errors.New("unknown partitioning " + mode + ", expected none, daily or hourly")
+	}
+}
+
+// name returns the partition of an entry at ts, in nanoseconds
+func (p *partitioner) name(ts int64) string {
+	return logsCollection + "_" + time.Unix(0, ts).UTC().Format(p.layout)
+}
+
+// start parses the partition name into the start of its time range
+func (p *partitioner) start(name string) (int64, bool) {
+	suffix := strings.TrimPrefix(name, logsCollection+"_")
+	if suffix == name || len(suffix) != len(p.layout) {
+		return 0, false
+	}
+
+	t, err := time.ParseInLocation(p.layout, suffix, time.UTC)
+	if err != nil {
+		return 0, false
+	}
+	return t.UnixNano(), true
+}
+
+// partition is a collection covering [start, end) in nanoseconds
+type partition struct {
+	name  string
+	start int64
+	end   int64
+}
+
+// overlaps reports whether the partition may hold entries in the
+// inclusive range from, to. Nil bounds are open.
+func (p partition) overlaps(from, to *int64) bool {
+	if from != nil && p.end <= *from {
+		return false
+	}
+	if to != nil && p.start > *to {
+		return false
+	}
+	return true
+}
+
+// partitions lists the partitions of database, most recent first
+func (p *partitioner) partitions(ctx context.Context, database *mongo.Database) ([]partition, error) {
+	names, err := database.ListCollectionNames(ctx, bson.M{
+		"name": bson.M{"$regex": "^" + logsCollection + "_[0-9]+$"},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list partitions")
+	}
+
+	out := make([]partition, 0, len(names))
+	for _, name := range names {
+		start, ok := p.start(name)
+		if !ok {
+			continue
+		}
+		out = append(out, partition{name: name, start: start, end: start + int64(p.width)})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].start > out[j].start })
+	return out, nil
+}
@@ -3,6 +3,8 @@ package crud
 import (
 	"context"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -12,12 +14,83 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// eventsCollection holds the claims of the event IDs received within the
+// idempotency window
+const eventsCollection = "events"
+
 type mongoService struct {
 	client   *mongo.Client
 	database string
+
+	// partitions is nil when every entry goes into the logs collection
+	partitions  *partitioner
+	syncIndexes bool
+
+	// window is how long event IDs are claimed for, zero disables
+	// deduplication
+	window time.Duration
+
+	// indexed holds the partitions written to since start, their indexes
+	// are synced on the first write
+	mu      sync.Mutex
+	indexed map[string]bool
+
+	// parts caches the partitions listed at listedAt for reads, names
+	// holds their names so that a write to a new one drops the cache
+	parts    []partition
+	names    map[string]bool
+	listedAt time.Time
 }
 
-func NewMongoService(uri, database string) (Service, error) {
+// mongoDocument is a LogEntry of a partition, its ObjectID carries the
+// timestamp of the entry so that Get finds its partition
+type mongoDocument struct {
+	ID         primitive.ObjectID     `bson:"_id"`
+	EventID    string                 `bson:"event_id,omitempty"`
+	Timestamp  int64                  `bson:"timestamp"`
+	ReceivedAt int64                  `bson:"received_at"`
+	Level      string                 `bson:"level"`
+	Message    string                 `bson:"message"`
+	Metadata   map[string]interface{} `bson:"metadata,omitempty"`
+}
+
+// eventDocument claims an event ID for the entry stored with it. Its _id
+// is the event ID, so that a second claim fails, and a TTL index removes
+// it once it expires.
+type eventDocument struct {
+	EventID   string             `bson:"_id"`
+	LogID     primitive.ObjectID `bson:"log_id"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+
+	// LeaseUntil is set while the entry is being inserted and unset once
+	// it is stored, a claim whose entry isn't found is only taken over
+	// after its lease
+	LeaseUntil time.Time `bson:"lease_until,omitempty"`
+}
+
+const (
+	// claimLease bounds the time a claim is pending for, an entry not
+	// stored by then is taken to have failed
+	claimLease = 10 * time.Second
+
+	// claimPoll is how often pending claims of another writer are read
+	claimPoll = 100 * time.Millisecond
+)
+
+// NewMongoService connects to MongoDB. With syncIndexes the indexes of
+// the logs collection, or of every partition, are brought in line with
+// the declared set first. partition is one of PartitionNone,
+// PartitionDaily and PartitionHourly. Entries sent again with the event
+// ID of one received within window are dropped as duplicates, a zero
+// window disables deduplication.
+func NewMongoService(
+	uri, database string, syncIndexes bool, partition string, window time.Duration,
+) (Service, error) {
+	partitions, err := newPartitioner(partition)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -31,35 +104,651 @@ func NewMongoService(uri, database string) (Service, error) {
 		return nil, errors.Wrap(err, "failed to ping MongoDB")
 	}
 
+	// entries of earlier versions are migrated before anything compares
+	// their time, a large migration may take a while
+	if err := migrateTimestamps(context.Background(), client.Database(database)); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	if syncIndexes {
+		// index builds may take a while on large collections
+		im := &IndexManager{database: client.Database(database), partitions: partitions}
+		if _, err := im.Sync(context.Background()); err != nil {
+			client.Disconnect(context.Background())
+			return nil, errors.Wrap(err, "failed to sync indexes")
+		}
+	}
+
+	if window > 0 {
+		if err := createEventIndex(ctx, client.Database(database)); err != nil {
+			client.Disconnect(context.Background())
+			return nil, err
+		}
+	}
+
 	return &mongoService{
-		client:   client,
-		database: database,
+		client:      client,
+		database:    database,
+		partitions:  partitions,
+		syncIndexes: syncIndexes,
+		window:      window,
+		indexed:     map[string]bool{},
 	}, nil
 }
 
-func (s *mongoService) Create(ctx context.Context, level string, message string, metadata map[string]interface{}) error {
-	collection := s.client.Database(s.database).Collection("logs")
+// partitionsTTL is how long the list of partitions is cached, partitions
+// created by other servers are read after at most this long
+const partitionsTTL = 30 * time.Second
+
+// secondsBefore bounds the timestamps stored in epoch seconds by earlier
+// versions, in nanoseconds it is 1970-01-01T00:16:40Z
+const secondsBefore = int64(1e12)
+
+// migrateTimestamps converts the entries stored in epoch seconds, in the
+// logs collection and in every partition, to epoch nanoseconds and sets
+// their receive time, before the service compares any time. Those
+// entries have no receive time either, which keeps entries of this
+// version from before 1970-01-01T00:16:40Z out of the migration. They
+// are found with the timestamp index so that a migrated database is
+// checked quickly on every start.
+func migrateTimestamps(ctx context.Context, database *mongo.Database) error {
+	names, err := database.ListCollectionNames(ctx, bson.M{
+		"name": bson.M{"$regex": "^" + logsCollection + "(_[0-9]+)?$"},
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to list logs collections")
+	}
+
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"timestamp": bson.M{"$multiply": bson.A{"$timestamp", int64(time.Second)}}}}},
+		{{Key: "$set", Value: bson.M{"received_at": bson.M{"$ifNull": bson.A{"$received_at", "$timestamp"}}}}},
+	}
+
+	for _, name := range names {
+		_, err := database.Collection(name).UpdateMany(
+			ctx, bson.M{"timestamp": bson.M{"$lt": secondsBefore}, "received_at": bson.M{"$exists": false}}, update,
+		)
+		if err != nil {
+			return errors.Wrap(err, "failed to migrate timestamps of "+name)
+		}
+	}
+
+	return nil
+}
+
+// createEventIndex creates the TTL index of the events collection. Claims
+// carry their own expiry, so that a change of the window doesn't need
+// the index to change.
+func createEventIndex(ctx context.Context, database *mongo.Database) error {
+	_, err := database.Collection(eventsCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetName(managedPrefix + "expires_at").SetExpireAfterSeconds(0),
+	})
+	return errors.Wrap(err, "failed to create event ID index")
+}
+
+func (s *mongoService) collection(name string) *mongo.Collection {
+	return s.client.Database(s.database).Collection(name)
+}
+
+// writeCollection returns the collection an entry at ts is written to,
+// syncing the indexes of a partition on its first write
+func (s *mongoService) writeCollection(ctx context.Context, ts int64) (*mongo.Collection, error) {
+	if s.partitions == nil {
+		return s.collection(logsCollection), nil
+	}
+
+	name := s.partitions.name(ts)
+	coll := s.collection(name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.parts != nil && !s.names[name] {
+		s.parts = nil
+	}
+
+	if s.syncIndexes && !s.indexed[name] {
+		if _, err := syncIndexes(ctx, coll); err != nil {
+			return nil, errors.Wrap(err, "failed to sync indexes of "+name)
+		}
+		s.indexed[name] = true
+	}
+	return coll, nil
+}
+
+// objectID returns the ID of a new entry. In a partition, it carries the
+// timestamp of the entry.
+func (s *mongoService) objectID(entry *LogEntry) primitive.ObjectID {
+	if s.partitions == nil {
+		return primitive.NewObjectID()
+	}
+	return primitive.NewObjectIDFromTimestamp(time.Unix(0, entry.Timestamp))
+}
+
+// document returns what is inserted for entry. Entries without an ID are
+// inserted with id, or a new one when id is zero. An ID in ObjectID hex,
+// e.g. of an entry restored from an archive, is kept as an ObjectID.
+func (s *mongoService) document(entry *LogEntry, id primitive.ObjectID) interface{} {
+	entry.receive()
+	if entry.ID != "" {
+		oid, err := primitive.ObjectIDFromHex(entry.ID)
+		if err != nil {
+			return entry
+		}
+		id = oid
+
+		// an entry is looked up in the partition of the time of its ID,
+		// one carrying the time of another partition gets a new ID
+		if s.partitions != nil && s.partitions.name(oid.Timestamp().UnixNano()) != s.partitions.name(entry.Timestamp) {
+			id = primitive.NilObjectID
+		}
+	}
+
+	if id.IsZero() {
+		id = s.objectID(entry)
+	}
+
+	return &mongoDocument{
+		ID:         id,
+		EventID:    entry.EventID,
+		Timestamp:  entry.Timestamp,
+		ReceivedAt: entry.ReceivedAt,
+		Level:      entry.Level,
+		Message:    entry.Message,
+		Metadata:   entry.Metadata,
+	}
+}
+
+// partitionList returns the partitions most recent first, listing them
+// again once the cache is older than partitionsTTL or was dropped by a
+// write to a new partition or a drop. The slice must not be modified.
+func (s *mongoService) partitionList(ctx context.Context) ([]partition, error) {
+	s.mu.Lock()
+	parts := s.parts
+	if parts != nil && time.Since(s.listedAt) < partitionsTTL {
+		s.mu.Unlock()
+		return parts, nil
+	}
+	s.mu.Unlock()
+
+	parts, err := s.partitions.partitions(ctx, s.client.Database(s.database))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool, len(parts))
+	for _, part := range parts {
+		names[part.name] = true
+	}
+
+	s.mu.Lock()
+	s.parts, s.names, s.listedAt = parts, names, time.Now()
+	s.mu.Unlock()
+	return parts, nil
+}
+
+// readCollections returns the collections which may hold entries in the
+// inclusive range from, to, most recent first
+func (s *mongoService) readCollections(ctx context.Context, from, to *int64) ([]*mongo.Collection, error) {
+	if s.partitions == nil {
+		return []*mongo.Collection{s.collection(logsCollection)}, nil
+	}
+
+	parts, err := s.partitionList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*mongo.Collection, 0, len(parts))
+	for _, part := range parts {
+		if part.overlaps(from, to) {
+			out = append(out, s.collection(part.name))
+		}
+	}
+	return out, nil
+}
+
+// idCollection returns the collection holding the entry with id, in a
+// partition the one of the time its ID carries
+func (s *mongoService) idCollection(id primitive.ObjectID) *mongo.Collection {
+	if s.partitions == nil {
+		return s.collection(logsCollection)
+	}
+	return s.collection(s.partitions.name(id.Timestamp().UnixNano()))
+}
+
+func (s *mongoService) Create(ctx context.Context, level string, message string, metadata map[string]interface{}) (*LogEntry, error) {
+	if level == "" || message == "" {
+		return nil, ErrEmptyKey
+	}
 
 	entry := NewLogEntry(level, message, metadata)
 
-	_, err := collection.InsertOne(ctx, entry)
+	collection, err := s.writeCollection(ctx, entry.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := collection.InsertOne(ctx, s.document(entry, primitive.NilObjectID))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to insert log entry")
+	}
+
+	entry.ID = insertedID(result.InsertedID)
+	return entry, nil
+}
+
+// insertedID converts the _id generated by the driver into the string
+// representation used by LogEntry
+func insertedID(id interface{}) string {
+	if oid, ok := id.(primitive.ObjectID); ok {
+		return oid.Hex()
+	}
+	if str, ok := id.(string); ok {
+		return str
+	}
+	return ""
+}
+
+// CreateMany inserts the batch into the collection of each entry, one
+// unordered insert per collection. Event IDs are claimed before the
+// entries are inserted, claims of entries which fail are released.
+func (s *mongoService) CreateMany(ctx context.Context, entries []*LogEntry) ([]error, error) {
+	errs := make([]error, len(entries))
+	if len(entries) == 0 {
+		return errs, nil
+	}
+
+	var (
+		order   = []string{}
+		batches = map[string][]int{}
+		ids     = make([]primitive.ObjectID, len(entries))
+		claims  = []int{}
+		batch   = batchEvents{}
+		dups    = map[int]int{}
+	)
+
+	for ix, entry := range entries {
+		if entry.Level == "" || entry.Message == "" {
+			errs[ix] = ErrEmptyKey
+			continue
+		}
+
+		if s.window > 0 && entry.EventID != "" && entry.ID == "" {
+			if first := batch.first(entry, ix); first != ix {
+				dups[ix] = first
+				continue
+			}
+
+			ids[ix] = s.objectID(entry)
+			claims = append(claims, ix)
+		}
+	}
+
+	claimed, originals, err := s.claim(ctx, entries, ids, claims)
+	if err != nil {
+		s.release(ctx, entries, claimed)
+		return nil, err
+	}
+
+	for ix, entry := range entries {
+		if errs[ix] != nil {
+			continue
+		}
+		if _, ok := dups[ix]; ok {
+			continue
+		}
+		if original, ok := originals[ix]; ok {
+			*entry = *original
+			errs[ix] = ErrDuplicate
+			continue
+		}
+
+		name := logsCollection
+		if s.partitions != nil {
+			name = s.partitions.name(entry.Timestamp)
+		}
+
+		if _, ok := batches[name]; !ok {
+			order = append(order, name)
+		}
+		batches[name] = append(batches[name], ix)
+	}
+
+	for _, name := range order {
+		indexes := batches[name]
+
+		collection, err := s.writeCollection(ctx, entries[indexes[0]].Timestamp)
+		if err != nil {
+			s.release(ctx, entries, claimed)
+			return nil, err
+		}
+
+		if err := s.insertMany(ctx, collection, entries, ids, indexes, errs); err != nil {
+			s.release(ctx, entries, claimed)
+			return nil, err
+		}
+	}
+
+	var stored, failed []int
+	for _, ix := range claimed {
+		if errs[ix] != nil {
+			failed = append(failed, ix)
+			continue
+		}
+		stored = append(stored, ix)
+	}
+	s.release(ctx, entries, failed)
+	s.commit(ctx, entries, ids, stored)
+
+	for ix, first := range dups {
+		if errs[first] != nil && errors.Cause(errs[first]) != ErrDuplicate {
+			errs[ix] = errs[first]
+			continue
+		}
+		*entries[ix] = *entries[first]
+		errs[ix] = ErrDuplicate
+	}
+
+	return errs, nil
+}
+
+// claim records the event IDs of the entries at indexes, each for the
+// entry to be inserted with its ID in ids, with one unordered insert. It
+// returns the indexes claimed and the entries of earlier claims within
+// the window by index. A claim whose entry isn't found is waited for
+// while its lease runs, then taken over like an expired claim the TTL
+// monitor hasn't removed yet or one whose entry was deleted.
+func (s *mongoService) claim(
+	ctx context.Context, entries []*LogEntry, ids []primitive.ObjectID, indexes []int,
+) ([]int, map[int]*LogEntry, error) {
+	var (
+		claimed   = []int{}
+		originals = map[int]*LogEntry{}
+		events    = s.collection(eventsCollection)
+	)
+	if len(indexes) == 0 {
+		return claimed, originals, nil
+	}
+
+	now := time.Now()
+	docs := make([]interface{}, len(indexes))
+	for ix, eix := range indexes {
+		docs[ix] = s.eventDocument(entries[eix], ids[eix], now)
+	}
+
+	pending := []int{}
+	_, err := events.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
 	if err != nil {
-		return errors.Wrap(err, "failed to insert log entry")
+		var bwe mongo.BulkWriteException
+		if !errors.As(err, &bwe) || bwe.WriteConcernError != nil {
+			return claimed, nil, errors.Wrap(err, "failed to claim event IDs")
+		}
+
+		var (
+			failed = make(map[int]bool, len(bwe.WriteErrors))
+			other  error
+		)
+		for _, we := range bwe.WriteErrors {
+			failed[we.Index] = true
+			if !mongo.IsDuplicateKeyError(we) && other == nil {
+				other = we
+			}
+		}
+
+		for ix, eix := range indexes {
+			if failed[ix] {
+				pending = append(pending, eix)
+				continue
+			}
+			claimed = append(claimed, eix)
+		}
+
+		if other != nil {
+			return claimed, nil, errors.Wrap(other, "failed to claim event ID")
+		}
+	} else {
+		claimed = append(claimed, indexes...)
+	}
+
+	for len(pending) > 0 {
+		waiting, taken, err := s.resolveClaims(ctx, entries, ids, pending, originals)
+		claimed = append(claimed, taken...)
+		if err != nil {
+			return claimed, nil, err
+		}
+		if pending = waiting; len(pending) == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return claimed, nil, errors.Wrap(ctx.Err(), "failed to claim event IDs")
+		case <-time.After(claimPoll):
+		}
+	}
+
+	return claimed, originals, nil
+}
+
+// eventDocument returns the claim of the event ID of entry for the entry
+// inserted with id, pending until the entry is stored
+func (s *mongoService) eventDocument(entry *LogEntry, id primitive.ObjectID, now time.Time) eventDocument {
+	return eventDocument{
+		EventID:    entry.EventID,
+		LogID:      id,
+		ExpiresAt:  now.Add(s.window),
+		LeaseUntil: now.Add(claimLease),
+	}
+}
+
+// resolveClaims reads the earlier claims of the entries at indexes and
+// their entries. A found entry goes into originals, a claim still leased
+// is returned as waiting, and others are taken over and returned as
+// taken. A takeover racing another writer is waited for too.
+func (s *mongoService) resolveClaims(
+	ctx context.Context, entries []*LogEntry, ids []primitive.ObjectID, indexes []int, originals map[int]*LogEntry,
+) ([]int, []int, error) {
+	events := s.collection(eventsCollection)
+
+	eventIDs := make([]string, len(indexes))
+	for ix, eix := range indexes {
+		eventIDs[ix] = entries[eix].EventID
+	}
+
+	cursor, err := events.Find(ctx, bson.M{"_id": bson.M{"$in": eventIDs}})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to look up event IDs")
+	}
+
+	var found []eventDocument
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to look up event IDs")
+	}
+
+	var (
+		now    = time.Now()
+		prevs  = make(map[string]eventDocument, len(found))
+		logIDs = []primitive.ObjectID{}
+	)
+	for _, prev := range found {
+		prevs[prev.EventID] = prev
+		if prev.ExpiresAt.After(now) {
+			logIDs = append(logIDs, prev.LogID)
+		}
+	}
+
+	stored, err := s.getMany(ctx, logIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var waiting, taken []int
+	for _, ix := range indexes {
+		prev, ok := prevs[entries[ix].EventID]
+		if ok && prev.ExpiresAt.After(now) {
+			if original, ok := stored[prev.LogID.Hex()]; ok {
+				originals[ix] = original
+				continue
+			}
+			if prev.LeaseUntil.After(now) {
+				waiting = append(waiting, ix)
+				continue
+			}
+		}
+
+		// a concurrent takeover fails with a duplicate key, not a second claim
+		takeover := bson.M{"_id": entries[ix].EventID}
+		if ok {
+			takeover["log_id"] = prev.LogID
+		}
+
+		doc := s.eventDocument(entries[ix], ids[ix], now)
+		_, err := events.ReplaceOne(ctx, takeover, doc, options.Replace().SetUpsert(true))
+		switch {
+		case mongo.IsDuplicateKeyError(err):
+			waiting = append(waiting, ix)
+		case err != nil:
+			return nil, taken, errors.Wrap(err, "failed to claim event ID")
+		default:
+			taken = append(taken, ix)
+		}
+	}
+
+	return waiting, taken, nil
+}
+
+// getMany reads the entries with ids by ID, in one query per collection
+func (s *mongoService) getMany(ctx context.Context, ids []primitive.ObjectID) (map[string]*LogEntry, error) {
+	var (
+		out     = make(map[string]*LogEntry, len(ids))
+		order   = []string{}
+		byColl  = map[string][]primitive.ObjectID{}
+		collFor = map[string]*mongo.Collection{}
+	)
+
+	for _, id := range ids {
+		coll := s.idCollection(id)
+		if _, ok := byColl[coll.Name()]; !ok {
+			order = append(order, coll.Name())
+			collFor[coll.Name()] = coll
+		}
+		byColl[coll.Name()] = append(byColl[coll.Name()], id)
+	}
+
+	for _, name := range order {
+		cursor, err := collFor[name].Find(ctx, bson.M{"_id": bson.M{"$in": byColl[name]}})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get log entries")
+		}
+
+		var found []LogEntry
+		if err := cursor.All(ctx, &found); err != nil {
+			return nil, errors.Wrap(err, "failed to get log entries")
+		}
+
+		for ix := range found {
+			out[found[ix].ID] = &found[ix]
+		}
+	}
+
+	return out, nil
+}
+
+// commit ends the lease of the claims of the entries at indexes, which
+// were stored with their ID in ids. A lease left behind only delays a
+// resend until it ends, the entry is then found.
+func (s *mongoService) commit(ctx context.Context, entries []*LogEntry, ids []primitive.ObjectID, indexes []int) {
+	if len(indexes) == 0 {
+		return
+	}
+
+	var (
+		eventIDs = make([]string, len(indexes))
+		logIDs   = make([]primitive.ObjectID, len(indexes))
+	)
+	for ix, eix := range indexes {
+		eventIDs[ix], logIDs[ix] = entries[eix].EventID, ids[eix]
+	}
+
+	s.collection(eventsCollection).UpdateMany(
+		ctx,
+		bson.M{"_id": bson.M{"$in": eventIDs}, "log_id": bson.M{"$in": logIDs}},
+		bson.M{"$unset": bson.M{"lease_until": ""}},
+	)
+}
+
+// release removes the claims of the entries at indexes, which weren't
+// stored. A claim left behind only delays a resend until it expires.
+func (s *mongoService) release(ctx context.Context, entries []*LogEntry, indexes []int) {
+	if len(indexes) == 0 {
+		return
+	}
+
+	eventIDs := make([]string, len(indexes))
+	for ix, eix := range indexes {
+		eventIDs[ix] = entries[eix].EventID
+	}
+
+	s.collection(eventsCollection).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": eventIDs}})
+}
+
+// insertMany inserts the entries at indexes into collection, recording
+// the failure of each entry in errs. Entries without an ID are inserted
+// with the one in ids, or a new one when it is zero.
+func (s *mongoService) insertMany(
+	ctx context.Context,
+	collection *mongo.Collection,
+	entries []*LogEntry,
+	ids []primitive.ObjectID,
+	indexes []int,
+	errs []error,
+) error {
+	docs := make([]interface{}, len(indexes))
+	for ix, eix := range indexes {
+		docs[ix] = s.document(entries[eix], ids[eix])
+	}
+
+	// unordered insert, so one bad document doesn't stop the rest of the batch
+	result, err := collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if result != nil {
+		for ix, id := range result.InsertedIDs {
+			if ix < len(indexes) {
+				entries[indexes[ix]].ID = insertedID(id)
+			}
+		}
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || bwe.WriteConcernError != nil {
+		return errors.Wrap(err, "failed to insert log entries")
+	}
+
+	for _, we := range bwe.WriteErrors {
+		if we.Index >= 0 && we.Index < len(indexes) {
+			ix := indexes[we.Index]
+			errs[ix] = errors.Wrap(we, "failed to insert log entry")
+			entries[ix].ID = ""
+		}
 	}
 
 	return nil
 }
 
 func (s *mongoService) Get(ctx context.Context, id string) (*LogEntry, error) {
-	collection := s.client.Database(s.database).Collection("logs")
-
 	objectID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return nil, errors.Wrap(errBadRequest, "invalid log ID format")
+		return nil, errors.Wrap(ErrBadRequest, "invalid log ID format")
 	}
 
 	var entry LogEntry
-	err = collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&entry)
+	err = s.idCollection(objectID).FindOne(ctx, bson.M{"_id": objectID}).Decode(&entry)
 	if err == mongo.ErrNoDocuments {
 		return nil, ErrNotFound
 	}
@@ -70,110 +759,263 @@ func (s *mongoService) Get(ctx context.Context, id string) (*LogEntry, error) {
 	return &entry, nil
 }
 
+// List queries the partitions the time range overlaps, most recent first,
+// until the limit is reached
 func (s *mongoService) List(ctx context.Context, filter map[string]interface{}) ([]LogEntry, error) {
-	collection := s.client.Database(s.database).Collection("logs")
-
-	// Build query
-	query := bson.M{}
-
-	// Add level filter if present
-	if level, ok := filter["level"].(string); ok && level != "" {
-		query["level"] = level
+	q, err := parseListQuery(filter)
+	if err != nil {
+		return nil, err
 	}
 
-	// Add message filter if present
-	if message, ok := filter["message"].(string); ok && message != "" {
-		query["message"] = bson.M{"$regex": message, "$options": "i"}
+	collections, err := s.readCollections(ctx, q.start, q.end)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query logs")
 	}
 
-	// Add time range filters if present
-	if startTime, ok := filter["starttime"].(string); ok && startTime != "" {
-		startTimestamp, err := strconv.ParseInt(startTime, 10, 64)
+	logs := make([]LogEntry, 0)
+	for _, collection := range collections {
+		// Set up options for sorting and limiting
+		opts := options.Find()
+		// Sort by timestamp in descending order, the ID keeps ties in
+		// the order the cursor seeks
+		opts.SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}})
+
+		// Handle recent parameter
+		if q.limit > 0 {
+			opts.SetLimit(q.limit - int64(len(logs)))
+		}
+
+		// Execute query
+		cursor, err := collection.Find(ctx, q.bson(), opts)
 		if err != nil {
-			return nil, errors.Wrap(errBadRequest, "invalid start time format")
+			return nil, errors.Wrap(err, "failed to query logs")
 		}
-		query["timestamp"] = bson.M{"$gte": startTimestamp}
-	}
 
-	if endTime, ok := filter["endtime"].(string); ok && endTime != "" {
-		endTimestamp, err := strconv.ParseInt(endTime, 10, 64)
+		var page []LogEntry
+		err = cursor.All(ctx, &page)
+		cursor.Close(ctx)
 		if err != nil {
-			return nil, errors.Wrap(errBadRequest, "invalid end time format")
+			return nil, errors.Wrap(err, "failed to decode logs")
 		}
-		if _, exists := query["timestamp"]; exists {
-			query["timestamp"].(bson.M)["$lte"] = endTimestamp
-		} else {
-			query["timestamp"] = bson.M{"$lte": endTimestamp}
+
+		logs = append(logs, page...)
+		if q.limit > 0 && int64(len(logs)) >= q.limit {
+			break
 		}
 	}
 
-	// Set up options for sorting and limiting
-	opts := options.Find()
-	opts.SetSort(bson.D{{Key: "timestamp", Value: -1}}) // Sort by timestamp in descending order
+	return logs, nil
+}
 
-	// Handle recent parameter
-	if recent, ok := filter["recent"].(string); ok && recent != "" {
-		limit, err := strconv.ParseInt(recent, 10, 64)
-		if err != nil {
-			return nil, errors.Wrap(errBadRequest, "invalid recent value")
-		}
-		opts.SetLimit(limit)
+// Aggregate groups the matching entries of every partition the range
+// overlaps with an aggregation pipeline, and merges their counts
+func (s *mongoService) Aggregate(ctx context.Context, filter map[string]interface{}) (*Aggregation, error) {
+	q, err := parseAggregateQuery(filter, time.Now())
+	if err != nil {
+		return nil, err
 	}
 
-	// Execute query
-	cursor, err := collection.Find(ctx, query, opts)
+	collections, err := s.readCollections(ctx, &q.start, &q.end)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to query logs")
+		return nil, errors.Wrap(err, "failed to aggregate logs")
 	}
-	defer cursor.Close(ctx)
 
-	var logs []LogEntry
-	if err := cursor.All(ctx, &logs); err != nil {
-		return nil, errors.Wrap(err, "failed to decode logs")
+	// buckets are grouped on the start of their interval, missing fields
+	// are left out of _id and read back as nil
+	id := bson.D{{Key: "t", Value: bson.D{{Key: "$subtract", Value: bson.A{
+		"$timestamp", bson.D{{Key: "$mod", Value: bson.A{"$timestamp", q.interval}}},
+	}}}}}
+	for ix, path := range q.paths {
+		field := "$level"
+		if path != nil {
+			field = "$" + metadataPrefix + strings.Join(path, ".")
+		}
+		id = append(id, bson.E{Key: "g" + strconv.Itoa(ix), Value: field})
 	}
 
-	return logs, nil
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: q.list.bson()}},
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: id}, {Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}}}}},
+	}
+
+	agg := newAggregator(q)
+	for _, collection := range collections {
+		cursor, err := collection.Aggregate(ctx, pipeline)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to aggregate logs")
+		}
+
+		var groups []struct {
+			ID    bson.M `bson:"_id"`
+			Count int64  `bson:"count"`
+		}
+		err = cursor.All(ctx, &groups)
+		cursor.Close(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode aggregation")
+		}
+
+		for _, group := range groups {
+			ts, ok := group.ID["t"].(int64)
+			if !ok {
+				return nil, errors.New("failed to decode aggregation bucket")
+			}
+
+			values := make([]interface{}, len(q.paths))
+			for ix := range values {
+				values[ix] = group.ID["g"+strconv.Itoa(ix)]
+			}
+			agg.add(ts, values, group.Count)
+		}
+	}
+
+	return agg.result(), nil
 }
 
 func (s *mongoService) Close(ctx context.Context) error {
 	return s.client.Disconnect(ctx)
 }
 
-func (s *mongoService) Delete(ctx context.Context, filter map[string]interface{}) error {
-	collection := s.client.Database(s.database).Collection("logs")
+// Count counts the documents a Delete filter matches in every partition
+// the query overlaps
+func (s *mongoService) Count(ctx context.Context, filter map[string]interface{}) (int64, error) {
+	q, err := parseCountQuery(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	end := q.before - 1
+	collections, err := s.readCollections(ctx, q.start, &end)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to count log entries")
+	}
+
+	var count int64
+	for _, collection := range collections {
+		n, err := collection.CountDocuments(ctx, q.bson())
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to count log entries")
+		}
+		count += n
+	}
+	return count, nil
+}
 
+func (s *mongoService) Delete(ctx context.Context, filter map[string]interface{}) error {
 	// If ID is present, delete specific document
 	if id, ok := filter["id"].(string); ok && id != "" {
 		objectID, err := primitive.ObjectIDFromHex(id)
 		if err != nil {
-			return errors.Wrap(errBadRequest, "invalid log ID format")
+			return errors.Wrap(ErrBadRequest, "invalid log ID format")
 		}
-		_, err = collection.DeleteOne(ctx, bson.M{"_id": objectID})
-		if err != nil {
+
+		if _, err := s.idCollection(objectID).DeleteOne(ctx, bson.M{"_id": objectID}); err != nil {
 			return errors.Wrap(err, "failed to delete log entry")
 		}
 		return nil
 	}
 
-	// If before timestamp is present, delete all documents before that time
-	if beforeTime, ok := filter["before"].(string); ok && beforeTime != "" {
-		timestamp, err := strconv.ParseInt(beforeTime, 10, 64)
-		if err != nil {
-			return errors.Wrap(errBadRequest, "invalid epoch timestamp format")
+	// If IDs are present, delete those documents with one query per
+	// collection
+	ids, err := parseDeleteIDs(filter)
+	if err != nil {
+		return err
+	}
+
+	if len(ids) > 0 {
+		var (
+			order  = []*mongo.Collection{}
+			byColl = map[string][]primitive.ObjectID{}
+		)
+		for _, id := range ids {
+			objectID, _ := primitive.ObjectIDFromHex(id)
+			coll := s.idCollection(objectID)
+			if _, ok := byColl[coll.Name()]; !ok {
+				order = append(order, coll)
+			}
+			byColl[coll.Name()] = append(byColl[coll.Name()], objectID)
 		}
 
-		// Delete all documents with timestamp less than the specified time
-		result, err := collection.DeleteMany(ctx, bson.M{"timestamp": bson.M{"$lt": timestamp}})
+		for _, coll := range order {
+			if _, err := coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": byColl[coll.Name()]}}); err != nil {
+				return errors.Wrap(err, "failed to delete log entries")
+			}
+		}
+		return nil
+	}
+
+	// If before timestamp is present, delete all documents before that time
+	q, err := parseDeleteQuery(filter)
+	if err != nil {
+		return err
+	}
+
+	if q != nil {
+		deleted, err := s.deleteBefore(ctx, q)
 		if err != nil {
 			return errors.Wrap(err, "failed to delete log entries")
 		}
 
-		if result.DeletedCount == 0 {
-			return errors.Wrap(errBadRequest, "no logs found before the specified timestamp")
+		if deleted == 0 {
+			return errors.Wrap(ErrBadRequest, "no logs found before the specified timestamp")
 		}
 
 		return nil
 	}
 
-	return errors.Wrap(errBadRequest, "either id or before timestamp must be provided")
+	return errors.Wrap(ErrBadRequest, "either id or before timestamp must be provided")
+}
+
+// deleteBefore drops the partitions which end before the cutoff of an
+// unscoped query, and deletes the matching documents of the others
+func (s *mongoService) deleteBefore(ctx context.Context, q *deleteQuery) (int64, error) {
+	if s.partitions == nil {
+		// Delete all matching documents with timestamp less than the specified time
+		result, err := s.collection(logsCollection).DeleteMany(ctx, q.bson())
+		if err != nil {
+			return 0, err
+		}
+		return result.DeletedCount, nil
+	}
+
+	parts, err := s.partitionList(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	for _, part := range parts {
+		if part.start >= q.before || (q.start != nil && part.end <= *q.start) {
+			continue
+		}
+
+		collection := s.collection(part.name)
+
+		// expiring a whole partition is a collection drop
+		if part.end <= q.before && q.everything() {
+			count, err := collection.CountDocuments(ctx, bson.M{})
+			if err != nil {
+				return deleted, err
+			}
+			if err := collection.Drop(ctx); err != nil {
+				return deleted, err
+			}
+
+			s.mu.Lock()
+			delete(s.indexed, part.name)
+			s.parts = nil
+			s.mu.Unlock()
+
+			deleted += count
+			continue
+		}
+
+		result, err := collection.DeleteMany(ctx, q.bson())
+		if err != nil {
+			return deleted, err
+		}
+		deleted += result.DeletedCount
+	}
+
+	return deleted, nil
 }
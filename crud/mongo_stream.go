@@ -0,0 +1,158 @@
+package crud
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/utils/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// mongoWatchRetry is the time waited before a failed change stream is
+	// opened again
+	mongoWatchRetry = 5 * time.Second
+
+	// changeStreamHistoryLost is the code of the error resuming a change
+	// stream after a token which left the oplog
+	changeStreamHistoryLost = 286
+)
+
+// MongoWatcher publishes the entries inserted into the logs collection,
+// or any of its partitions, by every klg replica to a Tailer. Change
+// streams need MongoDB to run as a replica set.
+type MongoWatcher struct {
+	logger   log.Logger
+	client   *mongo.Client
+	database *mongo.Database
+	tailer   *Tailer
+
+	// token resumes the stream checked by NewMongoWatcher, so that the
+	// inserts until Open are published too
+	token bson.Raw
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// changeEvent is the part of a change event which is published
+type changeEvent struct {
+	FullDocument LogEntry `bson:"fullDocument"`
+}
+
+// watchPipeline keeps the inserts of logs entries, the partitions of
+// PartitionDaily and PartitionHourly included
+func watchPipeline() mongo.Pipeline {
+	return mongo.Pipeline{{{Key: "$match", Value: bson.M{
+		"operationType": "insert",
+		"ns.coll":       bson.M{"$regex": "^" + logsCollection + "(_[0-9]+)?$"},
+	}}}}
+}
+
+// Open follows the change stream until Close, resuming after the last
+// event it published when the stream fails
+func (w *MongoWatcher) Open() error {
+	token := w.token
+	for {
+		token = w.watch(token)
+
+		select {
+		case <-w.ctx.Done():
+			return nil
+		case <-time.After(mongoWatchRetry):
+		}
+	}
+}
+
+// watch publishes the events of a change stream opened after token, nil
+// for the events from now on, and returns the token to resume from: the
+// last event's, token when the stream fails before any, or nil once
+// token left the oplog
+func (w *MongoWatcher) watch(token bson.Raw) bson.Raw {
+	opts := options.ChangeStream()
+	if token != nil {
+		opts.SetResumeAfter(token)
+	}
+
+	stream, err := w.database.Watch(w.ctx, watchPipeline(), opts)
+	if err != nil {
+		if w.ctx.Err() == nil {
+			w.logger.Error("failed to open change stream", log.Error(err))
+		}
+		return resumable(token, err)
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(w.ctx) {
+		var ev changeEvent
+		if err := stream.Decode(&ev); err != nil {
+			w.logger.Error("failed to decode change event", log.Error(err))
+			continue
+		}
+
+		w.tailer.Publish([]LogEntry{ev.FullDocument})
+		token = stream.ResumeToken()
+	}
+
+	if err := stream.Err(); err != nil && w.ctx.Err() == nil {
+		w.logger.Error("change stream failed", log.Error(err))
+		return resumable(token, err)
+	}
+	return token
+}
+
+// resumable returns token unless err is the loss of its history, the
+// stream then starts over from now as the events since are gone
+func resumable(token bson.Raw, err error) bson.Raw {
+	var se mongo.ServerError
+	if errors.As(err, &se) && se.HasErrorCode(changeStreamHistoryLost) {
+		return nil
+	}
+	return token
+}
+
+// Close stops following the change stream and disconnects
+func (w *MongoWatcher) Close() error {
+	w.cancel()
+	return w.client.Disconnect(context.Background())
+}
+
+// NewMongoWatcher connects to MongoDB and checks that the database
+// supports change streams
+func NewMongoWatcher(logger log.Logger, uri, database string, tailer *Tailer) (*MongoWatcher, error) {
+	if tailer == nil {
+		return nil, errors.New("tailer is required for mongo watcher")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to MongoDB")
+	}
+
+	db := client.Database(database)
+
+	stream, err := db.Watch(ctx, watchPipeline())
+	if err != nil {
+		client.Disconnect(context.Background())
+		return nil, errors.Wrap(err, "failed to open change stream, MongoDB must run as a replica set")
+	}
+	token := stream.ResumeToken()
+	stream.Close(ctx)
+
+	wctx, wcancel := context.WithCancel(context.Background())
+	return &MongoWatcher{
+		logger:   logger,
+		client:   client,
+		database: db,
+		tailer:   tailer,
+		token:    token,
+		ctx:      wctx,
+		cancel:   wcancel,
+	}, nil
+}
@@ -0,0 +1,623 @@
+package crud
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// queryExpr is a compiled q= query, evaluated in memory by the memory and
+// disk backends and translated for MongoDB and SQLite
+type queryExpr interface {
+	match(entry *LogEntry) bool
+	bson() bson.M
+
+	// sql never evaluates to NULL, so that NOT keeps entries missing a
+	// field like the other backends do
+	sql() (string, []interface{})
+}
+
+// parseQuery compiles the query language of the q= filter:
+//
+//	query := or
+//	or    := and { OR and }
+//	and   := not { [AND] not }
+//	not   := NOT not | "(" or ")" | term
+//	term  := field op value | word | "phrase"
+//	op    := : | > | >= | < | <=
+//
+// Fields are level, message, @timestamp and metadata.<path>. Words and
+// phrases without a field search the message, * and ? are wildcards in
+// unquoted values. Times may be relative to now, e.g. now-15m.
+func parseQuery(input string, now time.Time) (queryExpr, error) {
+	p := &queryParser{input: input, now: now}
+
+	p.skipSpace()
+	if p.eof() {
+		return nil, p.fail(p.pos, "empty query")
+	}
+
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.eof() {
+		return nil, p.fail(p.pos, "unexpected "+strconv.Quote(string(p.input[p.pos])))
+	}
+	return expr, nil
+}
+
+// queryParser is a recursive descent parser over the query string, pos
+// is the byte offset of the next unread character
+type queryParser struct {
+	input string
+	pos   int
+	now   time.Time
+}
+
+// fail reports a syntax error at the 1-based position of offset
+func (p *queryParser) fail(offset int, msg string) error {
+	return errors.Wrap(ErrBadRequest, fmt.Sprintf("invalid query at position %d: %s", offset+1, msg))
+}
+
+func (p *queryParser) eof() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *queryParser) skipSpace() {
+	for !p.eof() && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// keyword consumes AND, OR or NOT when it is the next word
+func (p *queryParser) keyword(word string) bool {
+	end := p.pos + len(word)
+	if !strings.HasPrefix(p.input[p.pos:], word) {
+		return false
+	}
+	if end < len(p.input) && !strings.ContainsRune(" \t\r\n()\"", rune(p.input[end])) {
+		return false
+	}
+
+	p.pos = end
+	p.skipSpace()
+	return true
+}
+
+func (p *queryParser) parseOr() (queryExpr, error) {
+	expr, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	or := orExpr{expr}
+	for p.keyword("OR") {
+		if expr, err = p.parseAnd(); err != nil {
+			return nil, err
+		}
+		or = append(or, expr)
+	}
+
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+// parseAnd reads terms joined by AND, which may be left out
+func (p *queryParser) parseAnd() (queryExpr, error) {
+	expr, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	and := andExpr{expr}
+	for !p.eof() && p.input[p.pos] != ')' {
+		start := p.pos
+		if p.keyword("OR") {
+			p.pos = start
+			break
+		}
+		p.keyword("AND")
+
+		if expr, err = p.parseNot(); err != nil {
+			return nil, err
+		}
+		and = append(and, expr)
+	}
+
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+func (p *queryParser) parseNot() (queryExpr, error) {
+	if p.eof() {
+		return nil, p.fail(p.pos, "unexpected end of query")
+	}
+
+	if p.keyword("NOT") {
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{expr}, nil
+	}
+
+	start := p.pos
+	if p.keyword("AND") || p.keyword("OR") {
+		return nil, p.fail(start, "unexpected "+strings.TrimSpace(p.input[start:p.pos]))
+	}
+
+	switch p.input[p.pos] {
+	case '(':
+		p.pos++
+		p.skipSpace()
+
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.eof() || p.input[p.pos] != ')' {
+			return nil, p.fail(p.pos, "missing closing parenthesis of position "+strconv.Itoa(start+1))
+		}
+		p.pos++
+		p.skipSpace()
+		return expr, nil
+
+	case ')':
+		return nil, p.fail(p.pos, `unexpected ")"`)
+	}
+
+	return p.parseTerm()
+}
+
+// queryValue is the value of a term, wildcards only apply unquoted
+type queryValue struct {
+	text   string
+	quoted bool
+	pos    int
+}
+
+func (v queryValue) wildcard() bool {
+	return !v.quoted && strings.ContainsAny(v.text, "*?")
+}
+
+// pattern translates the value into a regular expression, anchored to
+// match the whole value unless it is searched for within a message
+func (v queryValue) pattern(anchored bool) string {
+	var b strings.Builder
+	for _, r := range v.text {
+		switch {
+		case r == '*' && !v.quoted:
+			b.WriteString(".*")
+		case r == '?' && !v.quoted:
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	if anchored {
+		return "^" + b.String() + "$"
+	}
+	return b.String()
+}
+
+func (p *queryParser) parseTerm() (queryExpr, error) {
+	start := p.pos
+	if p.input[p.pos] == '"' {
+		value, err := p.parsePhrase()
+		if err != nil {
+			return nil, err
+		}
+		return newMessageExpr(value), nil
+	}
+
+	word := p.scan(":<>")
+	if word == "" {
+		return nil, p.fail(p.pos, "unexpected "+strconv.Quote(string(p.input[p.pos])))
+	}
+
+	op := p.parseOp()
+	if op == "" {
+		p.skipSpace()
+		return newMessageExpr(queryValue{text: word, pos: start}), nil
+	}
+
+	var (
+		value queryValue
+		err   error
+	)
+	switch {
+	case !p.eof() && p.input[p.pos] == '"':
+		value, err = p.parsePhrase()
+	default:
+		value.pos = p.pos
+		value.text = p.scan("")
+		p.skipSpace()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if value.text == "" && !value.quoted {
+		return nil, p.fail(value.pos, "expected a value after "+word+op)
+	}
+
+	return p.field(start, word, op, value)
+}
+
+// scan reads a word up to a space, a parenthesis, a quote or one of stop
+func (p *queryParser) scan(stop string) string {
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune(" \t\r\n()\""+stop, rune(p.input[p.pos])) {
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *queryParser) parseOp() string {
+	for _, op := range []string{">=", "<=", ":", ">", "<"} {
+		if strings.HasPrefix(p.input[p.pos:], op) {
+			p.pos += len(op)
+			return op
+		}
+	}
+	return ""
+}
+
+// parsePhrase reads a double quoted string, \" and \\ are escapes
+func (p *queryParser) parsePhrase() (queryValue, error) {
+	start := p.pos
+	p.pos++
+
+	var b strings.Builder
+	for !p.eof() {
+		c := p.input[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			p.skipSpace()
+			return queryValue{text: b.String(), quoted: true, pos: start}, nil
+		case c == '\\' && p.pos+1 < len(p.input):
+			p.pos++
+			b.WriteByte(p.input[p.pos])
+		default:
+			b.WriteByte(c)
+		}
+		p.pos++
+	}
+
+	return queryValue{}, p.fail(start, "unterminated phrase")
+}
+
+// field builds the term of a field comparison
+func (p *queryParser) field(start int, name, op string, value queryValue) (queryExpr, error) {
+	switch {
+	case name == "level":
+		if op != ":" {
+			return nil, p.fail(start, "level only supports :")
+		}
+		if value.wildcard() {
+			return &levelExpr{pattern: regexp.MustCompile("(?i)" + value.pattern(true))}, nil
+		}
+
+		level := NormalizeLogLevel(value.text)
+		if level == "" {
+			level = value.text
+		}
+		return &levelExpr{level: level}, nil
+
+	case name == "message":
+		if op != ":" {
+			return nil, p.fail(start, "message only supports :")
+		}
+		return newMessageExpr(value), nil
+
+	case name == "@timestamp" || name == "timestamp":
+		ts, err := parseQueryTime(value.text, p.now)
+		if err != nil {
+			return nil, p.fail(value.pos, "invalid time "+strconv.Quote(value.text))
+		}
+		return &timeExpr{op: op, ts: ts}, nil
+
+	case strings.HasPrefix(name, metadataPrefix):
+		path, err := parseMetadataPath(strings.TrimPrefix(name, metadataPrefix))
+		if err != nil {
+			return nil, p.fail(start, "invalid field "+name)
+		}
+		return p.metadata(path, op, value)
+	}
+
+	return nil, p.fail(start, "unknown field "+name)
+}
+
+// metadata builds a metadata filter, an unquoted number matches both
+// numeric and string values
+func (p *queryParser) metadata(path []string, op string, value queryValue) (queryExpr, error) {
+	if op != ":" {
+		num, err := strconv.ParseFloat(value.text, 64)
+		if err != nil || value.quoted {
+			return nil, p.fail(value.pos, "expected a number after "+op)
+		}
+		return &metadataFilter{path: path, op: queryOps[op], values: []interface{}{num}}, nil
+	}
+
+	switch {
+	case !value.quoted && value.text == "*":
+		return &metadataFilter{path: path, op: opExists, exists: true}, nil
+	case value.wildcard():
+		return &metadataFilter{path: path, op: opRegex, re: regexp.MustCompile(value.pattern(true))}, nil
+	}
+
+	if num, err := strconv.ParseFloat(value.text, 64); err == nil && !value.quoted {
+		return &metadataFilter{path: path, op: opIn, values: []interface{}{value.text, num}}, nil
+	}
+	return &metadataFilter{path: path, op: opEq, values: []interface{}{value.text}}, nil
+}
+
+// parseQueryTime reads now, now-15m, now+1d or any format accepted by
+// ParseTimestamp
+func parseQueryTime(value string, now time.Time) (int64, error) {
+	rest := strings.TrimPrefix(value, "now")
+	if rest == value {
+		return ParseTimestamp(value)
+	}
+
+	if rest == "" {
+		return now.UnixNano(), nil
+	}
+
+	if rest[0] != '-' && rest[0] != '+' {
+		return 0, errors.New("invalid relative time")
+	}
+
+	d, err := ParseTTL(rest[1:])
+	if err != nil {
+		return 0, err
+	}
+
+	if rest[0] == '-' {
+		d = -d
+	}
+	return now.Add(d).UnixNano(), nil
+}
+
+// andExpr matches the entries which pass all of its terms
+type andExpr []queryExpr
+
+func (e andExpr) match(entry *LogEntry) bool {
+	for _, expr := range e {
+		if !expr.match(entry) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e andExpr) bson() bson.M {
+	docs := make(bson.A, len(e))
+	for ix, expr := range e {
+		docs[ix] = expr.bson()
+	}
+	return bson.M{"$and": docs}
+}
+
+func (e andExpr) sql() (string, []interface{}) {
+	return joinSQL(e, " AND ")
+}
+
+// orExpr matches the entries which pass any of its terms
+type orExpr []queryExpr
+
+func (e orExpr) match(entry *LogEntry) bool {
+	for _, expr := range e {
+		if expr.match(entry) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e orExpr) bson() bson.M {
+	docs := make(bson.A, len(e))
+	for ix, expr := range e {
+		docs[ix] = expr.bson()
+	}
+	return bson.M{"$or": docs}
+}
+
+func (e orExpr) sql() (string, []interface{}) {
+	return joinSQL(e, " OR ")
+}
+
+func joinSQL(exprs []queryExpr, op string) (string, []interface{}) {
+	var (
+		conds = make([]string, len(exprs))
+		args  = []interface{}{}
+	)
+
+	for ix, expr := range exprs {
+		cond, exprArgs := expr.sql()
+		conds[ix] = cond
+		args = append(args, exprArgs...)
+	}
+	return "(" + strings.Join(conds, op) + ")", args
+}
+
+// notExpr matches the entries which fail its term, including those
+// missing the field
+type notExpr struct {
+	expr queryExpr
+}
+
+func (e notExpr) match(entry *LogEntry) bool {
+	return !e.expr.match(entry)
+}
+
+func (e notExpr) bson() bson.M {
+	return bson.M{"$nor": bson.A{e.expr.bson()}}
+}
+
+func (e notExpr) sql() (string, []interface{}) {
+	cond, args := e.expr.sql()
+	return "NOT " + cond, args
+}
+
+// levelExpr matches a level, or the levels matching a wildcard
+type levelExpr struct {
+	level   string
+	pattern *regexp.Regexp
+}
+
+func (e *levelExpr) match(entry *LogEntry) bool {
+	if e.pattern != nil {
+		return e.pattern.MatchString(entry.Level)
+	}
+	return entry.Level == e.level
+}
+
+func (e *levelExpr) bson() bson.M {
+	if e.pattern != nil {
+		return bson.M{"level": bson.M{"$regex": e.pattern.String()}}
+	}
+	return bson.M{"level": e.level}
+}
+
+func (e *levelExpr) sql() (string, []interface{}) {
+	if e.pattern != nil {
+		return "IFNULL(level REGEXP ?, 0)", []interface{}{e.pattern.String()}
+	}
+	return "IFNULL(level = ?, 0)", []interface{}{e.level}
+}
+
+// messageExpr searches the message for a word, phrase or wildcard, case
+// insensitively like the message filter
+type messageExpr struct {
+	pattern string
+	re      *regexp.Regexp
+
+	// phrase is the text of a quoted phrase, which MongoDB looks up in
+	// the text index on message
+	phrase string
+}
+
+func newMessageExpr(value queryValue) *messageExpr {
+	pattern := value.pattern(false)
+	expr := &messageExpr{pattern: pattern, re: regexp.MustCompile("(?i)" + pattern)}
+	if value.quoted {
+		expr.phrase = value.text
+	}
+	return expr
+}
+
+func (e *messageExpr) match(entry *LogEntry) bool {
+	return e.re.MatchString(entry.Message)
+}
+
+func (e *messageExpr) bson() bson.M {
+	return bson.M{"message": bson.M{"$regex": e.pattern, "$options": "i"}}
+}
+
+func (e *messageExpr) sql() (string, []interface{}) {
+	return "IFNULL(message REGEXP ?, 0)", []interface{}{e.re.String()}
+}
+
+// textSearch returns the $text search of the quoted phrases every match
+// of expr contains, or "" when there are none. $text must be at the top
+// of a MongoDB query, so only a phrase or the phrases of a top level AND
+// are searched. The text index narrows the entries to those containing
+// the words of the phrases, which are then matched by their regexes.
+func textSearch(expr queryExpr) string {
+	var terms []queryExpr
+	switch e := expr.(type) {
+	case *messageExpr:
+		terms = []queryExpr{e}
+	case andExpr:
+		terms = e
+	}
+
+	phrases := []string{}
+	for _, term := range terms {
+		m, ok := term.(*messageExpr)
+		if !ok || !searchable(m.phrase) {
+			continue
+		}
+		phrases = append(phrases, `"`+m.phrase+`"`)
+	}
+	return strings.Join(phrases, " ")
+}
+
+// searchable reports whether a phrase can be looked up in the text
+// index, it needs a word and can't hold the quotes delimiting phrases
+func searchable(phrase string) bool {
+	if strings.Contains(phrase, `"`) {
+		return false
+	}
+	return strings.IndexFunc(phrase, func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	}) >= 0
+}
+
+// timeExpr compares the timestamp, : is an equality
+type timeExpr struct {
+	op string
+	ts int64
+}
+
+func (e *timeExpr) match(entry *LogEntry) bool {
+	c := 0
+	switch {
+	case entry.Timestamp < e.ts:
+		c = -1
+	case entry.Timestamp > e.ts:
+		c = 1
+	}
+	return holds(c, e.op)
+}
+
+func (e *timeExpr) bson() bson.M {
+	if e.op == ":" {
+		return bson.M{"timestamp": e.ts}
+	}
+	return bson.M{"timestamp": bson.M{mongoOps[e.op]: e.ts}}
+}
+
+func (e *timeExpr) sql() (string, []interface{}) {
+	return "IFNULL(timestamp " + sqlOps[e.op] + " ?, 0)", []interface{}{e.ts}
+}
+
+var (
+	mongoOps = map[string]string{">": "$gt", ">=": "$gte", "<": "$lt", "<=": "$lte"}
+	sqlOps   = map[string]string{":": "=", ">": ">", ">=": ">=", "<": "<", "<=": "<="}
+
+	// queryOps maps comparisons onto metadata filter operators
+	queryOps = map[string]string{">": opGt, ">=": opGte, "<": opLt, "<=": opLte}
+)
+
+// holds applies an operator to c, -1, 0 or 1 as the value is less than,
+// equal to or greater than the operand. : is an equality.
+func holds(c int, op string) bool {
+	switch op {
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	}
+	return c == 0
+}
@@ -0,0 +1,41 @@
+package crud_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+)
+
+func TestQuerySyntaxErrors(t *testing.T) {
+	svc, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{"  ", "position 3: empty query"},
+		{"level:error AND", "position 16: unexpected end of query"},
+		{"OR level:error", "position 1: unexpected OR"},
+		{"(level:error OR level:warn", "position 27: missing closing parenthesis of position 1"},
+		{"level:error)", `position 12: unexpected ")"`},
+		{`message:"connection refused`, "position 9: unterminated phrase"},
+		{"metadata.latency_ms>fast", "position 21: expected a number after >"},
+		{"level>error", "position 1: level only supports :"},
+		{"host:web", "position 1: unknown field host"},
+		{"@timestamp>now-soon", `position 12: invalid time "now-soon"`},
+		{"level:", "position 7: expected a value after level:"},
+	}
+
+	for _, tt := range tests {
+		_, err := svc.List(context.Background(), map[string]interface{}{"q": tt.q})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("List(q=%s) returned %v, expected an error with %q", tt.q, err, tt.want)
+		}
+	}
+}
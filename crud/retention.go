@@ -0,0 +1,342 @@
+package crud
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+// anyLevel is the level of a retention rule applying to every level
+const anyLevel = "*"
+
+// RetentionRule expires the entries of a level, or of every level, after
+// TTL. A rule with a Service only applies to entries whose
+// metadata.service is Service.
+type RetentionRule struct {
+	Service string
+	Level   string
+	TTL     time.Duration
+}
+
+func (r RetentionRule) String() string {
+	spec := r.Level + "=" + formatTTL(r.TTL)
+	if r.Service != "" {
+		spec = r.Service + ":" + spec
+	}
+	return spec
+}
+
+// ParseTTL reads a duration, accepting days (d) and weeks (w) on top of
+// the units of time.ParseDuration
+func ParseTTL(value string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n := strings.TrimSuffix(value, suffix); n != value {
+			count, err := strconv.ParseInt(n, 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+	return time.ParseDuration(value)
+}
+
+func formatTTL(ttl time.Duration) string {
+	day := 24 * time.Hour
+	if ttl%day == 0 {
+		return strconv.FormatInt(int64(ttl/day), 10) + "d"
+	}
+	return ttl.String()
+}
+
+// ParseRetentionRules reads rules of the form [service:]level=ttl, e.g.
+// debug=3d, error=90d or api:*=7d. The most specific rule applies to an
+// entry: service and level, then service, then level, then *.
+func ParseRetentionRules(specs []string) ([]RetentionRule, error) {
+	var (
+		rules = make([]RetentionRule, 0, len(specs))
+		seen  = map[string]bool{}
+	)
+
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		scope, ttl, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, errors.New("invalid retention rule " + spec + ", expected [service:]level=ttl")
+		}
+
+		rule := RetentionRule{Level: strings.TrimSpace(scope)}
+		if service, level, ok := strings.Cut(scope, ":"); ok {
+			rule.Service, rule.Level = strings.TrimSpace(service), strings.TrimSpace(level)
+			if rule.Service == "" {
+				return nil, errors.New("invalid retention rule " + spec + ", empty service")
+			}
+		}
+
+		if rule.Level != anyLevel {
+			if rule.Level = NormalizeLogLevel(rule.Level); rule.Level == "" {
+				return nil, errors.New("invalid retention rule " + spec + ", unknown level")
+			}
+		}
+
+		d, err := ParseTTL(strings.TrimSpace(ttl))
+		if err != nil || d <= 0 {
+			return nil, errors.New("invalid retention rule " + spec + ", invalid ttl")
+		}
+		rule.TTL = d
+
+		key := rule.Service + ":" + rule.Level
+		if seen[key] {
+			return nil, errors.New("duplicate retention rule " + spec)
+		}
+		seen[key] = true
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// retentionFilters returns the Delete filters, without before, covering
+// the entries the rule applies to. Entries matched by a more specific
+// rule are excluded.
+func retentionFilters(rules []RetentionRule, rule RetentionRule) []map[string]interface{} {
+	var (
+		has             = map[string]bool{}
+		services        = []string{}
+		serviceLevels   = map[string][]string{}
+		levels          = []string{}
+		servicesByLevel = map[string][]string{}
+	)
+
+	for _, r := range rules {
+		has[r.Service+":"+r.Level] = true
+		if r.Service == "" {
+			if r.Level != anyLevel {
+				levels = append(levels, r.Level)
+			}
+			continue
+		}
+
+		if !contains(services, r.Service) {
+			services = append(services, r.Service)
+		}
+		if r.Level != anyLevel {
+			serviceLevels[r.Service] = append(serviceLevels[r.Service], r.Level)
+		}
+	}
+
+	for _, svc := range services {
+		for level := range ValidLogLevels {
+			if has[svc+":"+level] || has[svc+":"+anyLevel] {
+				servicesByLevel[level] = append(servicesByLevel[level], svc)
+			}
+		}
+	}
+
+	switch {
+	case rule.Service != "" && rule.Level != anyLevel:
+		return []map[string]interface{}{
+			{"level": rule.Level, metadataPrefix + serviceKey: rule.Service},
+		}
+
+	case rule.Service != "":
+		return []map[string]interface{}{
+			{metadataPrefix + serviceKey: rule.Service, excludeLevelKey: serviceLevels[rule.Service]},
+		}
+
+	case rule.Level != anyLevel:
+		return []map[string]interface{}{
+			{"level": rule.Level, excludeServiceKey: servicesByLevel[rule.Level]},
+		}
+	}
+
+	// the catch all rule covers entries of services without rules, and
+	// the levels without rules of services which only have level rules
+	filters := []map[string]interface{}{
+		{excludeLevelKey: levels, excludeServiceKey: services},
+	}
+
+	for _, svc := range services {
+		if has[svc+":"+anyLevel] {
+			continue
+		}
+
+		excluded := append(append([]string{}, levels...), serviceLevels[svc]...)
+		filters = append(filters, map[string]interface{}{
+			metadataPrefix + serviceKey: svc, excludeLevelKey: excluded,
+		})
+	}
+
+	return filters
+}
+
+// RetentionPolicy is a rule as reported by Preview, with the entries
+// the next run of the worker will purge
+type RetentionPolicy struct {
+	Service string `json:"service,omitempty"`
+	Level   string `json:"level"`
+	TTL     string `json:"ttl"`
+
+	// Cutoff is the timestamp entries older than are purged
+	Cutoff int64 `json:"cutoff"`
+
+	// Purge counts the entries to purge
+	Purge int64 `json:"purge"`
+}
+
+// RetentionStatus is the state of the retention worker
+type RetentionStatus struct {
+	Interval string            `json:"interval"`
+	LastRun  *time.Time        `json:"last_run,omitempty"`
+	NextRun  *time.Time        `json:"next_run,omitempty"`
+	Policies []RetentionPolicy `json:"policies"`
+}
+
+// RetentionWorker purges the entries which outlived their retention rule,
+// once on open and then on every interval. It implements the app Server.
+type RetentionWorker struct {
+	logger   log.Logger
+	service  Service
+	rules    []RetentionRule
+	interval time.Duration
+
+	mu      sync.Mutex
+	lastRun time.Time
+	nextRun time.Time
+
+	once sync.Once
+	done chan struct{}
+}
+
+// Open runs the worker until Close, it doesn't run without rules
+func (w *RetentionWorker) Open() error {
+	if len(w.rules) == 0 {
+		<-w.done
+		return nil
+	}
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		w.run(time.Now())
+
+		select {
+		case <-w.done:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops the worker, a running pass completes its current delete
+func (w *RetentionWorker) Close() error {
+	w.once.Do(func() { close(w.done) })
+	return nil
+}
+
+func (w *RetentionWorker) run(now time.Time) {
+	ctx := context.Background()
+
+	for _, rule := range w.rules {
+		cutoff := now.Add(-rule.TTL).UnixNano()
+
+		for _, filter := range retentionFilters(w.rules, rule) {
+			filter["before"] = strconv.FormatInt(cutoff, 10)
+
+			// nothing to delete is reported as a bad request
+			err := w.service.Delete(ctx, filter)
+			if err != nil && errors.Cause(err) != ErrBadRequest {
+				w.logger.Error(
+					"failed to apply retention rule",
+					log.String("rule", rule.String()),
+					log.Error(err),
+				)
+			}
+		}
+	}
+
+	w.mu.Lock()
+	w.lastRun, w.nextRun = now, now.Add(w.interval)
+	w.mu.Unlock()
+
+	w.logger.Info("applied retention rules", log.Int("rules", len(w.rules)))
+}
+
+// Preview returns the rules and the entries the next run will purge
+func (w *RetentionWorker) Preview(ctx context.Context) (*RetentionStatus, error) {
+	w.mu.Lock()
+	lastRun, nextRun := w.lastRun, w.nextRun
+	w.mu.Unlock()
+
+	status := &RetentionStatus{
+		Interval: w.interval.String(),
+		Policies: make([]RetentionPolicy, 0, len(w.rules)),
+	}
+
+	at := time.Now()
+	if !lastRun.IsZero() {
+		status.LastRun, status.NextRun = &lastRun, &nextRun
+		at = nextRun
+	}
+
+	for _, rule := range w.rules {
+		policy := RetentionPolicy{
+			Service: rule.Service,
+			Level:   rule.Level,
+			TTL:     formatTTL(rule.TTL),
+			Cutoff:  at.Add(-rule.TTL).UnixNano(),
+		}
+
+		for _, filter := range retentionFilters(w.rules, rule) {
+			filter["before"] = strconv.FormatInt(policy.Cutoff, 10)
+
+			purge, err := w.service.Count(ctx, filter)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to count logs to purge")
+			}
+			policy.Purge += purge
+		}
+
+		status.Policies = append(status.Policies, policy)
+	}
+
+	sort.SliceStable(status.Policies, func(i, j int) bool {
+		return status.Policies[i].Service < status.Policies[j].Service
+	})
+
+	return status, nil
+}
+
+// NewRetentionWorker returns a worker applying rules to service every
+// interval
+func NewRetentionWorker(
+	logger log.Logger, service Service, rules []RetentionRule, interval time.Duration,
+) (*RetentionWorker, error) {
+	if service == nil {
+		return nil, errors.New("service is required for retention worker")
+	}
+
+	if interval <= 0 {
+		return nil, errors.New("retention interval must be positive")
+	}
+
+	return &RetentionWorker{
+		logger:   logger,
+		service:  service,
+		rules:    rules,
+		interval: interval,
+		done:     make(chan struct{}),
+	}, nil
+}
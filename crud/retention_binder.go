@@ -0,0 +1,28 @@
+package crud
+
+import (
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/kit/transport/http"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+type RetentionBinder struct {
+	worker *RetentionWorker
+}
+
+func (b *RetentionBinder) Bind(ht *http.Transport, opts ...http.HandlerOption) {
+	// Get Call to show the retention rules and what the next run purges
+	ht.GET(
+		"/v1.0/retention",
+		NewRetentionHandler(b.worker),
+		append(opts, NewRetentionHandlerOption()...)...,
+	)
+}
+
+func NewRetentionBinder(logger log.Logger, worker *RetentionWorker) (*RetentionBinder, error) {
+	if worker == nil {
+		return nil, errors.New("worker is required for retention binder")
+	}
+
+	return &RetentionBinder{worker}, nil
+}
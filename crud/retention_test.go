@@ -0,0 +1,140 @@
+package crud_test
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+func TestParseRetentionRules(t *testing.T) {
+	rules, err := crud.ParseRetentionRules([]string{"debug=3d", "api:*=2w", "api:WARNING=12h"})
+	if err != nil {
+		t.Fatalf("ParseRetentionRules failed: %v", err)
+	}
+
+	want := []crud.RetentionRule{
+		{Level: "debug", TTL: 72 * time.Hour},
+		{Service: "api", Level: "*", TTL: 14 * 24 * time.Hour},
+		{Service: "api", Level: "warn", TTL: 12 * time.Hour},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("ParseRetentionRules returned %v, expected %v", rules, want)
+	}
+	for ix := range want {
+		if rules[ix] != want[ix] {
+			t.Errorf("rule %d is %v, expected %v", ix, rules[ix], want[ix])
+		}
+	}
+
+	for _, specs := range [][]string{
+		{"debug"}, {"chatty=1d"}, {"debug=soon"}, {"debug=-1d"}, {":debug=1d"}, {"debug=1d", "debug=2d"},
+	} {
+		if _, err := crud.ParseRetentionRules(specs); err == nil {
+			t.Errorf("ParseRetentionRules(%v) succeeded, expected an error", specs)
+		}
+	}
+}
+
+func TestRetentionWorker(t *testing.T) {
+	var (
+		ctx = context.Background()
+		day = int64(24 * time.Hour)
+		now = time.Now().UnixNano()
+	)
+
+	svc, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	// the most specific rule applies: api keeps everything for 60 days
+	// but debug for a day, other services keep debug for 3 days and the
+	// rest for 30
+	rules, err := crud.ParseRetentionRules([]string{"debug=3d", "*=30d", "api:*=60d", "api:debug=1d"})
+	if err != nil {
+		t.Fatalf("ParseRetentionRules failed: %v", err)
+	}
+
+	entries := []*crud.LogEntry{
+		{Timestamp: now - 2*day, Level: "debug", Message: "kept, debug within 3d"},
+		{Timestamp: now - 5*day, Level: "debug", Message: "purged, debug after 3d"},
+		{Timestamp: now - 20*day, Level: "error", Message: "kept, error within 30d"},
+		{Timestamp: now - 40*day, Level: "error", Message: "purged, error after 30d"},
+		{Timestamp: now - 2*day, Level: "debug", Message: "purged, api debug after 1d"},
+		{Timestamp: now - 40*day, Level: "error", Message: "kept, api within 60d"},
+		{Timestamp: now - 70*day, Level: "info", Message: "purged, api after 60d"},
+	}
+	for ix := 4; ix < len(entries); ix++ {
+		entries[ix].Metadata = map[string]interface{}{"service": "api"}
+	}
+
+	if _, err := svc.CreateMany(ctx, entries); err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	logger, err := log.NewZapLogger(log.ZapWithLevel("error"))
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+
+	worker, err := crud.NewRetentionWorker(logger, svc, rules, time.Hour)
+	if err != nil {
+		t.Fatalf("NewRetentionWorker failed: %v", err)
+	}
+
+	status, err := worker.Preview(ctx)
+	if err != nil {
+		t.Fatalf("Preview failed: %v", err)
+	}
+
+	var purge int64
+	for _, policy := range status.Policies {
+		purge += policy.Purge
+	}
+	if purge != 4 || status.LastRun != nil {
+		t.Errorf("Preview before the first run reports %d entries to purge, expected 4", purge)
+	}
+
+	done := make(chan error)
+	go func() { done <- worker.Open() }()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if status, err = worker.Preview(ctx); err == nil && status.LastRun != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("retention worker didn't run")
+		}
+	}
+
+	worker.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Open returned %v after Close", err)
+	}
+
+	left, err := svc.List(ctx, map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+
+	got := []string{}
+	for _, entry := range left {
+		got = append(got, entry.Message)
+	}
+	sort.Strings(got)
+
+	want := []string{"kept, api within 60d", "kept, debug within 3d", "kept, error within 30d"}
+	if len(got) != len(want) {
+		t.Fatalf("retention kept %v, expected %v", got, want)
+	}
+	for ix := range want {
+		if got[ix] != want[ix] {
+			t.Errorf("retention kept %v, expected %v", got, want)
+			break
+		}
+	}
+}
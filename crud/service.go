@@ -12,6 +12,14 @@ var (
 	ErrNotFound     = errors.New("log entry not found")
 	ErrEmptyKey     = errors.New("Bad Request, required fields missing")
 	ErrInvalidLevel = errors.New("invalid log level")
+
+	// ErrDuplicate marks an entry of CreateMany whose event ID was already
+	// stored within the idempotency window
+	ErrDuplicate = errors.New("duplicate log entry")
+
+	// ErrQueued marks an entry of CreateMany which an ingestion queue
+	// took, it is stored later and its ID is left unset
+	ErrQueued = errors.New("log entry queued")
 )
 
 // Valid log levels
@@ -25,104 +33,103 @@ var ValidLogLevels = map[string]bool{
 
 // Service interface defines the contract for log operations
 type Service interface {
-	Create(ctx context.Context, level string, message string, metadata map[string]interface{}) error
+	// Create stores a new entry and returns it as persisted, with the
+	// generated ID and timestamp set
+	Create(ctx context.Context, level string, message string, metadata map[string]interface{}) (*LogEntry, error)
+	// CreateMany stores a batch of entries. The returned slice is aligned
+	// with entries, a nil element means the entry at that index was stored
+	// and has its ID set. An entry whose EventID was stored within the
+	// idempotency window is not stored again, its element is ErrDuplicate
+	// and the entry is replaced by the one stored first. An entry only
+	// queued for storage is marked with ErrQueued.
+	CreateMany(ctx context.Context, entries []*LogEntry) ([]error, error)
 	Get(ctx context.Context, id string) (*LogEntry, error)
 	List(ctx context.Context, filter map[string]interface{}) ([]LogEntry, error)
+	// Aggregate counts the entries passing a List filter per time bucket
+	// and group, see parseAggregateQuery
+	Aggregate(ctx context.Context, filter map[string]interface{}) (*Aggregation, error)
+	// Count returns the number of entries a Delete filter by time
+	// matches, without deleting them
+	Count(ctx context.Context, filter map[string]interface{}) (int64, error)
 	Delete(ctx context.Context, filter map[string]interface{}) error
 	Close(ctx context.Context) error
 }
 
-// LogEntry represents a log entry in the system
+// LogEntry represents a log entry in the system. Timestamp is the time of
+// the event and ReceivedAt the time klg received it, both in unix
+// nanoseconds. EventID is an optional client supplied identity, entries
+// sent again with the same one are deduplicated.
 type LogEntry struct {
-	ID        string                 `json:"id" bson:"_id,omitempty"`
-	Timestamp int64                  `json:"timestamp" bson:"timestamp"`
-	Level     string                 `json:"level" bson:"level"`
-	Message   string                 `json:"message" bson:"message"`
-	Metadata  map[string]interface{} `json:"metadata,omitempty" bson:"metadata,omitempty"`
+	ID         string                 `json:"id" bson:"_id,omitempty"`
+	EventID    string                 `json:"event_id,omitempty" bson:"event_id,omitempty"`
+	Timestamp  int64                  `json:"timestamp" bson:"timestamp"`
+	ReceivedAt int64                  `json:"received_at" bson:"received_at"`
+	Level      string                 `json:"level" bson:"level"`
+	Message    string                 `json:"message" bson:"message"`
+	Metadata   map[string]interface{} `json:"metadata,omitempty" bson:"metadata,omitempty"`
 }
 
 // NewLogEntry creates a new log entry with the current timestamp
 func NewLogEntry(level string, message string, metadata map[string]interface{}) *LogEntry {
+	now := time.Now().UnixNano()
 	return &LogEntry{
-		Timestamp: time.Now().Unix(),
-		Level:     level,
-		Message:   message,
-		Metadata:  metadata,
-	}
-}
-
-// ValidateLogLevel checks if the given level is valid
-func ValidateLogLevel(level string) error {
-	if !ValidLogLevels[strings.ToLower(level)] {
-		return errors.Wrapf(ErrInvalidLevel, "valid levels are: %v", getValidLevels())
+		Timestamp:  now,
+		ReceivedAt: now,
+		Level:      level,
+		Message:    message,
+		Metadata:   metadata,
 	}
-	return nil
 }
 
-// getValidLevels returns a slice of valid log levels
-func getValidLevels() []string {
-	levels := make([]string, 0, len(ValidLogLevels))
-	for level := range ValidLogLevels {
-		levels = append(levels, level)
+// receive sets ReceivedAt of entries built without NewLogEntry
+func (e *LogEntry) receive() {
+	if e.ReceivedAt == 0 {
+		e.ReceivedAt = time.Now().UnixNano()
 	}
-	return levels
 }
 
-// defaultService implements the Service interface using in-memory storage
-type defaultService struct {
-	store map[string]*LogEntry
+// levelAliases maps level names used by common log shippers onto valid levels
+var levelAliases = map[string]string{
+	"warning":  "warn",
+	"err":      "error",
+	"critical": "fatal",
+	"crit":     "fatal",
+	"emerg":    "fatal",
+	"alert":    "fatal",
+	"panic":    "fatal",
+	"trace":    "debug",
+	"notice":   "info",
 }
 
-func (s *defaultService) Create(
-	ctx context.Context, level string, message string, metadata map[string]interface{},
-) error {
-	if level == "" || message == "" {
-		return ErrEmptyKey
+// NormalizeLogLevel maps a level name, or one of its common aliases such
+// as warning or critical, onto a valid log level. It returns an empty
+// string when the name is not known.
+func NormalizeLogLevel(level string) string {
+	level = strings.ToLower(level)
+	if alias, ok := levelAliases[level]; ok {
+		return alias
 	}
 
-	entry := NewLogEntry(level, message, metadata)
-	s.store[entry.ID] = entry
-	return nil
-}
-
-func (s *defaultService) Get(ctx context.Context, id string) (*LogEntry, error) {
-	if entry, ok := s.store[id]; ok {
-		return entry, nil
+	if ValidLogLevels[level] {
+		return level
 	}
-	return nil, ErrNotFound
-}
 
-func (s *defaultService) List(ctx context.Context, filter map[string]interface{}) ([]LogEntry, error) {
-	entries := make([]LogEntry, 0)
-	for _, entry := range s.store {
-		match := true
-		for k, v := range filter {
-			if entry.Metadata[k] != v {
-				match = false
-				break
-			}
-		}
-		if match {
-			entries = append(entries, *entry)
-		}
-	}
-	return entries, nil
+	return ""
 }
 
-func (s *defaultService) Close(ctx context.Context) error {
-	s.store = make(map[string]*LogEntry)
-	return nil
-}
-
-func (s *defaultService) Delete(ctx context.Context, filter map[string]interface{}) error {
-	if id, ok := filter["id"].(string); ok && id != "" {
-		delete(s.store, id)
+// ValidateLogLevel checks if the given level is valid
+func ValidateLogLevel(level string) error {
+	if !ValidLogLevels[strings.ToLower(level)] {
+		return errors.Wrapf(ErrInvalidLevel, "valid levels are: %v", getValidLevels())
 	}
 	return nil
 }
 
-func NewService() (Service, error) {
-	return &defaultService{
-		store: make(map[string]*LogEntry),
-	}, nil
+// getValidLevels returns a slice of valid log levels
+func getValidLevels() []string {
+	levels := make([]string, 0, len(ValidLogLevels))
+	for level := range ValidLogLevels {
+		levels = append(levels, level)
+	}
+	return levels
 }
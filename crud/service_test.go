@@ -0,0 +1,133 @@
+package crud_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/bhuvankumar123/klg/crud/crudtest"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestMemoryService(t *testing.T) {
+	crudtest.RunServiceSuite(t, func(t *testing.T) crud.Service {
+		svc, err := crud.NewService(time.Hour)
+		if err != nil {
+			t.Fatalf("failed to create memory service: %v", err)
+		}
+		return svc
+	})
+}
+
+// TestMongoService runs against the MongoDB at KLG_TEST_MONGO_URI, every
+// test gets a database of its own which is dropped afterwards
+func TestMongoService(t *testing.T) {
+	crudtest.RunServiceSuite(t, mongoFactory(t, crud.PartitionNone))
+}
+
+// TestMongoServicePartitioned runs the suite on hourly partitions
+func TestMongoServicePartitioned(t *testing.T) {
+	crudtest.RunServiceSuite(t, mongoFactory(t, crud.PartitionHourly))
+}
+
+func mongoFactory(t *testing.T, partition string) crudtest.Factory {
+	uri := os.Getenv("KLG_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("KLG_TEST_MONGO_URI not set")
+	}
+
+	return func(t *testing.T) crud.Service {
+		database := "klg_test_" + primitive.NewObjectID().Hex()
+
+		svc, err := crud.NewMongoService(uri, database, true, partition, time.Hour)
+		if err != nil {
+			t.Fatalf("failed to create mongo service: %v", err)
+		}
+
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+			if err != nil {
+				t.Errorf("failed to connect to drop %s: %v", database, err)
+				return
+			}
+			defer client.Disconnect(ctx)
+
+			if err := client.Database(database).Drop(ctx); err != nil {
+				t.Errorf("failed to drop %s: %v", database, err)
+			}
+		})
+
+		return svc
+	}
+}
+
+// TestMongoMigrateTimestamps opens a database holding an entry in epoch
+// seconds twice, only that entry is migrated and only once
+func TestMongoMigrateTimestamps(t *testing.T) {
+	uri := os.Getenv("KLG_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("KLG_TEST_MONGO_URI not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Disconnect(ctx)
+
+	database := client.Database("klg_test_" + primitive.NewObjectID().Hex())
+	defer database.Drop(ctx)
+
+	var (
+		seconds = primitive.NewObjectID()
+		early   = primitive.NewObjectID()
+		stamp   = int64(1700000000)
+	)
+
+	// early is stored in nanoseconds by this version, before 1e12
+	_, err = database.Collection("logs").InsertMany(ctx, []interface{}{
+		bson.M{"_id": seconds, "timestamp": stamp, "level": "info", "message": "in seconds"},
+		bson.M{"_id": early, "timestamp": int64(100 * time.Second), "received_at": int64(100 * time.Second), "level": "info", "message": "early"},
+	})
+	if err != nil {
+		t.Fatalf("failed to insert entries: %v", err)
+	}
+
+	for run := 0; run < 2; run++ {
+		svc, err := crud.NewMongoService(uri, database.Name(), false, crud.PartitionNone, 0)
+		if err != nil {
+			t.Fatalf("run %d: failed to create mongo service: %v", run, err)
+		}
+
+		got, err := svc.Get(ctx, seconds.Hex())
+		if err != nil {
+			t.Fatalf("run %d: Get failed: %v", run, err)
+		}
+		if want := stamp * int64(time.Second); got.Timestamp != want || got.ReceivedAt != want {
+			t.Errorf("run %d: entry in seconds has timestamp %d and received_at %d, expected %d", run, got.Timestamp, got.ReceivedAt, want)
+		}
+
+		got, err = svc.Get(ctx, early.Hex())
+		if err != nil {
+			t.Fatalf("run %d: Get failed: %v", run, err)
+		}
+		if want := int64(100 * time.Second); got.Timestamp != want || got.ReceivedAt != want {
+			t.Errorf("run %d: early entry has timestamp %d and received_at %d, expected %d", run, got.Timestamp, got.ReceivedAt, want)
+		}
+
+		if err := svc.Close(ctx); err != nil {
+			t.Fatalf("run %d: Close failed: %v", run, err)
+		}
+	}
+}
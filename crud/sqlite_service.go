@@ -0,0 +1,675 @@
+package crud
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"modernc.org/sqlite"
+)
+
+// sqliteSchema creates the logs table, metadata is kept as JSON. The
+// events table holds the event IDs received within the idempotency
+// window, its primary key rejects a second entry with the same one.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS logs (
+	id          TEXT PRIMARY KEY,
+	timestamp   INTEGER NOT NULL,
+	received_at INTEGER NOT NULL DEFAULT 0,
+	level       TEXT NOT NULL,
+	message     TEXT NOT NULL,
+	metadata    TEXT,
+	event_id    TEXT
+);
+CREATE INDEX IF NOT EXISTS logs_timestamp ON logs (timestamp);
+CREATE INDEX IF NOT EXISTS logs_level_timestamp ON logs (level, timestamp);
+
+CREATE TABLE IF NOT EXISTS events (
+	event_id    TEXT PRIMARY KEY,
+	log_id      TEXT NOT NULL,
+	received_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS events_received_at ON events (received_at);
+`
+
+// sqliteVersion is the user_version of the current schema
+const sqliteVersion = 2
+
+// sqliteMigrations upgrade a database from the version at their index.
+// Version 0 kept timestamps in seconds and had no received_at, version 1
+// had no event_id.
+var sqliteMigrations = []string{
+	`
+ALTER TABLE logs ADD COLUMN received_at INTEGER NOT NULL DEFAULT 0;
+UPDATE logs SET timestamp = timestamp * 1000000000, received_at = timestamp * 1000000000;
+`,
+	`
+ALTER TABLE logs ADD COLUMN event_id TEXT;
+`,
+}
+
+// sqlitePatterns caches the patterns compiled by the regexp function
+var sqlitePatterns sync.Map
+
+func init() {
+	// X REGEXP Y calls regexp(Y, X), SQLite doesn't implement it itself
+	sqlite.MustRegisterDeterministicScalarFunction(
+		"regexp", 2,
+		func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			pattern, ok := args[0].(string)
+			if !ok {
+				return nil, errors.New("regexp pattern must be text")
+			}
+
+			value, ok := args[1].(string)
+			if !ok {
+				return false, nil
+			}
+
+			re, ok := sqlitePatterns.Load(pattern)
+			if !ok {
+				compiled, err := regexp.Compile(pattern)
+				if err != nil {
+					return nil, err
+				}
+				re, _ = sqlitePatterns.LoadOrStore(pattern, compiled)
+			}
+
+			return re.(*regexp.Regexp).MatchString(value), nil
+		},
+	)
+}
+
+// sqliteService implements the Service interface on a SQLite database
+// file, through the pure Go modernc.org/sqlite driver
+type sqliteService struct {
+	db     *sql.DB
+	window time.Duration
+}
+
+// sqlitePath quotes the keys of a metadata path for json_extract
+func sqlitePath(path []string) string {
+	return `$."` + strings.Join(path, `"."`) + `"`
+}
+
+// where translates the filter into a WHERE clause and its arguments
+func (q *listQuery) where() (string, []interface{}) {
+	var (
+		conds = []string{}
+		args  = []interface{}{}
+	)
+
+	if q.level != "" {
+		conds = append(conds, "level = ?")
+		args = append(args, q.level)
+	}
+
+	if q.message != nil {
+		conds = append(conds, "message REGEXP ?")
+		args = append(args, q.message.String())
+	}
+
+	if q.start != nil {
+		conds = append(conds, "timestamp >= ?")
+		args = append(args, *q.start)
+	}
+
+	if q.end != nil {
+		conds = append(conds, "timestamp <= ?")
+		args = append(args, *q.end)
+	}
+
+	if q.after != nil {
+		conds = append(conds, "(timestamp < ? OR (timestamp = ? AND id < ?))")
+		args = append(args, q.after.timestamp, q.after.timestamp, q.after.id)
+	}
+
+	if q.expr != nil {
+		cond, exprArgs := q.expr.sql()
+		conds = append(conds, cond)
+		args = append(args, exprArgs...)
+	}
+
+	for _, mf := range q.metadata {
+		cond, mfArgs := mf.sql()
+		conds = append(conds, cond)
+		args = append(args, mfArgs...)
+	}
+
+	if len(conds) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// where translates the query into a WHERE clause and its arguments
+func (q *deleteQuery) where() (string, []interface{}) {
+	var (
+		conds = []string{"timestamp < ?"}
+		args  = []interface{}{q.before}
+	)
+
+	if q.start != nil {
+		conds = append(conds, "timestamp >= ?")
+		args = append(args, *q.start)
+	}
+
+	if q.level != "" {
+		conds = append(conds, "level = ?")
+		args = append(args, q.level)
+	}
+
+	if len(q.excludeLevels) > 0 {
+		conds = append(conds, "level NOT IN ("+placeholders(len(q.excludeLevels))+")")
+		for _, level := range q.excludeLevels {
+			args = append(args, level)
+		}
+	}
+
+	service := "json_extract(metadata, '$." + serviceKey + "')"
+	if q.service != "" {
+		conds = append(conds, service+" = ?")
+		args = append(args, q.service)
+	}
+
+	// entries without a string service are never excluded
+	if len(q.excludeServices) > 0 {
+		conds = append(conds, "("+service+" IS NULL OR "+service+
+			" NOT IN ("+placeholders(len(q.excludeServices))+"))")
+		for _, svc := range q.excludeServices {
+			args = append(args, svc)
+		}
+	}
+
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func encodeMetadata(metadata map[string]interface{}) (interface{}, error) {
+	if metadata == nil {
+		return nil, nil
+	}
+
+	bt, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, errors.Wrap(ErrBadRequest, "failed to encode metadata")
+	}
+	return string(bt), nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEntry(row scanner) (*LogEntry, error) {
+	var (
+		entry    LogEntry
+		metadata sql.NullString
+		eventID  sql.NullString
+	)
+
+	if err := row.Scan(
+		&entry.ID, &entry.Timestamp, &entry.ReceivedAt, &entry.Level, &entry.Message, &metadata, &eventID,
+	); err != nil {
+		return nil, err
+	}
+	entry.EventID = eventID.String
+
+	if metadata.Valid {
+		if err := json.Unmarshal([]byte(metadata.String), &entry.Metadata); err != nil {
+			return nil, errors.Wrap(err, "failed to decode metadata")
+		}
+	}
+
+	return &entry, nil
+}
+
+const insertLog = `INSERT INTO logs (id, timestamp, received_at, level, message, metadata, event_id)
+VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+const selectLogs = `SELECT id, timestamp, received_at, level, message, metadata, event_id FROM logs`
+
+// insertEvent claims an event ID, a claim which expired or whose entry
+// was deleted is taken over
+const insertEvent = `INSERT INTO events (event_id, log_id, received_at) VALUES (?, ?, ?)
+ON CONFLICT (event_id) DO UPDATE SET log_id = excluded.log_id, received_at = excluded.received_at`
+
+// selectEvent returns the entry which claimed an event ID since a cutoff
+const selectEvent = selectLogs + `
+WHERE id = (SELECT log_id FROM events WHERE event_id = ? AND received_at >= ?)`
+
+// eventID is the event_id column of an entry, NULL without one
+func eventID(entry *LogEntry) sql.NullString {
+	return sql.NullString{String: entry.EventID, Valid: entry.EventID != ""}
+}
+
+func (s *sqliteService) Create(
+	ctx context.Context, level string, message string, metadata map[string]interface{},
+) (*LogEntry, error) {
+	if level == "" || message == "" {
+		return nil, ErrEmptyKey
+	}
+
+	md, err := encodeMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := NewLogEntry(level, message, metadata)
+	entry.ID = primitive.NewObjectID().Hex()
+
+	_, err = s.db.ExecContext(
+		ctx, insertLog, entry.ID, entry.Timestamp, entry.ReceivedAt, entry.Level, entry.Message, md, eventID(entry),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to insert log entry")
+	}
+
+	return entry, nil
+}
+
+// CreateMany inserts the batch in a single transaction. A failing insert
+// only rolls back its own statement, the rest of the batch is committed.
+// Event IDs are looked up within the transaction, so that an event sent
+// twice within the batch is stored once.
+func (s *sqliteService) CreateMany(ctx context.Context, entries []*LogEntry) ([]error, error) {
+	errs := make([]error, len(entries))
+	if len(entries) == 0 {
+		return errs, nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to insert log entries")
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, insertLog)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to insert log entries")
+	}
+	defer stmt.Close()
+
+	var (
+		ids    = make([]string, len(entries))
+		cutoff = time.Now().Add(-s.window).UnixNano()
+		events = false
+	)
+
+	for ix, entry := range entries {
+		if entry.Level == "" || entry.Message == "" {
+			errs[ix] = ErrEmptyKey
+			continue
+		}
+
+		dedup := s.window > 0 && entry.EventID != ""
+		if dedup {
+			original, err := scanEntry(tx.QueryRowContext(ctx, selectEvent, entry.EventID, cutoff))
+			if err == nil {
+				*entry = *original
+				errs[ix] = ErrDuplicate
+				continue
+			}
+			if err != sql.ErrNoRows {
+				return nil, errors.Wrap(err, "failed to look up event ID")
+			}
+		}
+
+		md, err := encodeMetadata(entry.Metadata)
+		if err != nil {
+			errs[ix] = err
+			continue
+		}
+
+		id := entry.ID
+		if id == "" {
+			id = primitive.NewObjectID().Hex()
+		}
+
+		entry.receive()
+		if _, err := stmt.ExecContext(
+			ctx, id, entry.Timestamp, entry.ReceivedAt, entry.Level, entry.Message, md, eventID(entry),
+		); err != nil {
+			errs[ix] = errors.Wrap(err, "failed to insert log entry")
+			continue
+		}
+
+		if dedup {
+			if _, err := tx.ExecContext(ctx, insertEvent, entry.EventID, id, entry.ReceivedAt); err != nil {
+				return nil, errors.Wrap(err, "failed to record event ID")
+			}
+			events = true
+		}
+		ids[ix] = id
+	}
+
+	// claims which left the window are of no use anymore
+	if events {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM events WHERE received_at < ?", cutoff); err != nil {
+			return nil, errors.Wrap(err, "failed to prune event IDs")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "failed to insert log entries")
+	}
+
+	// IDs are only handed out once the batch is committed
+	for ix, id := range ids {
+		if id != "" {
+			entries[ix].ID = id
+		}
+	}
+
+	return errs, nil
+}
+
+func (s *sqliteService) Get(ctx context.Context, id string) (*LogEntry, error) {
+	if _, err := primitive.ObjectIDFromHex(id); err != nil {
+		return nil, errors.Wrap(ErrBadRequest, "invalid log ID format")
+	}
+
+	entry, err := scanEntry(s.db.QueryRowContext(ctx, selectLogs+" WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get log entry")
+	}
+
+	return entry, nil
+}
+
+// List returns the matching entries, most recent first
+func (s *sqliteService) List(ctx context.Context, filter map[string]interface{}) ([]LogEntry, error) {
+	q, err := parseListQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	where, args := q.where()
+	query := selectLogs + where + " ORDER BY timestamp DESC, id DESC"
+	if q.limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query logs")
+	}
+	defer rows.Close()
+
+	logs := make([]LogEntry, 0)
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode logs")
+		}
+		logs = append(logs, *entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to query logs")
+	}
+
+	return logs, nil
+}
+
+// Aggregate groups the matching rows by bucket and fields in SQL. A
+// metadata field is selected with its json_type, so that booleans and
+// documents are read back like the other backends decode them.
+func (s *sqliteService) Aggregate(ctx context.Context, filter map[string]interface{}) (*Aggregation, error) {
+	q, err := parseAggregateQuery(filter, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		where, whereArgs = q.list.where()
+		columns          = []string{"timestamp - ((timestamp % ?) + ?) % ?"}
+		args             = []interface{}{q.interval, q.interval, q.interval}
+	)
+
+	for _, path := range q.paths {
+		if path == nil {
+			columns = append(columns, "level", "NULL")
+			continue
+		}
+
+		columns = append(columns, "json_extract(metadata, ?)", "json_type(metadata, ?)")
+		args = append(args, sqlitePath(path), sqlitePath(path))
+	}
+
+	groupBy := make([]string, len(columns))
+	for ix := range columns {
+		groupBy[ix] = strconv.Itoa(ix + 1)
+	}
+
+	query := "SELECT " + strings.Join(columns, ", ") + ", COUNT(*) FROM logs" + where +
+		" GROUP BY " + strings.Join(groupBy, ", ")
+
+	rows, err := s.db.QueryContext(ctx, query, append(args, whereArgs...)...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to aggregate logs")
+	}
+	defer rows.Close()
+
+	agg := newAggregator(q)
+	for rows.Next() {
+		var (
+			bucket int64
+			count  int64
+			fields = make([]interface{}, 2*len(q.paths))
+			dest   = []interface{}{&bucket}
+		)
+
+		for ix := range fields {
+			dest = append(dest, &fields[ix])
+		}
+		if err := rows.Scan(append(dest, &count)...); err != nil {
+			return nil, errors.Wrap(err, "failed to decode aggregation")
+		}
+
+		values := make([]interface{}, len(q.paths))
+		for ix := range values {
+			value, kind := fields[2*ix], fields[2*ix+1]
+			switch kind {
+			case "true":
+				value = true
+			case "false":
+				value = false
+			case "object", "array":
+				if text, ok := value.(string); ok {
+					if err := json.Unmarshal([]byte(text), &value); err != nil {
+						return nil, errors.Wrap(err, "failed to decode aggregation")
+					}
+				}
+			}
+			values[ix] = value
+		}
+
+		agg.add(bucket, values, count)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to aggregate logs")
+	}
+
+	return agg.result(), nil
+}
+
+func (s *sqliteService) Close(ctx context.Context) error {
+	return s.db.Close()
+}
+
+// Count counts the rows a Delete filter matches
+func (s *sqliteService) Count(ctx context.Context, filter map[string]interface{}) (int64, error) {
+	q, err := parseCountQuery(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		count       int64
+		where, args = q.where()
+	)
+	if err := s.db.QueryRowContext(ctx, "SELECT count(*) FROM logs"+where, args...).Scan(&count); err != nil {
+		return 0, errors.Wrap(err, "failed to count log entries")
+	}
+	return count, nil
+}
+
+func (s *sqliteService) Delete(ctx context.Context, filter map[string]interface{}) error {
+	// If ID is present, delete specific row
+	if id, ok := filter["id"].(string); ok && id != "" {
+		if _, err := primitive.ObjectIDFromHex(id); err != nil {
+			return errors.Wrap(ErrBadRequest, "invalid log ID format")
+		}
+
+		if _, err := s.db.ExecContext(ctx, "DELETE FROM logs WHERE id = ?", id); err != nil {
+			return errors.Wrap(err, "failed to delete log entry")
+		}
+		return nil
+	}
+
+	// If IDs are present, delete those rows
+	ids, err := parseDeleteIDs(filter)
+	if err != nil {
+		return err
+	}
+
+	if len(ids) > 0 {
+		args := make([]interface{}, len(ids))
+		for ix, id := range ids {
+			args[ix] = id
+		}
+
+		marks := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+		if _, err := s.db.ExecContext(ctx, "DELETE FROM logs WHERE id IN ("+marks+")", args...); err != nil {
+			return errors.Wrap(err, "failed to delete log entries")
+		}
+		return nil
+	}
+
+	// If before timestamp is present, delete all rows before that time
+	q, err := parseDeleteQuery(filter)
+	if err != nil {
+		return err
+	}
+
+	if q != nil {
+		where, args := q.where()
+		result, err := s.db.ExecContext(ctx, "DELETE FROM logs"+where, args...)
+		if err != nil {
+			return errors.Wrap(err, "failed to delete log entries")
+		}
+
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return errors.Wrap(err, "failed to delete log entries")
+		}
+
+		if deleted == 0 {
+			return errors.Wrap(ErrBadRequest, "no logs found before the specified timestamp")
+		}
+
+		return nil
+	}
+
+	return errors.Wrap(ErrBadRequest, "either id or before timestamp must be provided")
+}
+
+// migrateSQLite upgrades an existing database and creates the schema
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return errors.Wrap(err, "failed to read sqlite schema version")
+	}
+
+	var tables int
+	if err := db.QueryRow(
+		"SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'logs'",
+	).Scan(&tables); err != nil {
+		return errors.Wrap(err, "failed to read sqlite schema")
+	}
+
+	// a new database starts at the current version
+	if tables == 0 {
+		version = sqliteVersion
+	}
+
+	if version > sqliteVersion {
+		return errors.Errorf("unsupported sqlite schema version %d", version)
+	}
+
+	// each migration commits along with the version it leads to
+	for ; version < sqliteVersion; version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return errors.Wrap(err, "failed to migrate sqlite schema")
+		}
+
+		if _, err := tx.Exec(sqliteMigrations[version]); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "failed to migrate sqlite schema from version %d", version)
+		}
+
+		if _, err := tx.Exec("PRAGMA user_version = " + strconv.Itoa(version+1)); err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "failed to write sqlite schema version")
+		}
+
+		if err := tx.Commit(); err != nil {
+			return errors.Wrapf(err, "failed to migrate sqlite schema from version %d", version)
+		}
+	}
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		return errors.Wrap(err, "failed to create sqlite schema")
+	}
+
+	_, err := db.Exec("PRAGMA user_version = " + strconv.Itoa(sqliteVersion))
+	return errors.Wrap(err, "failed to write sqlite schema version")
+}
+
+// NewSQLiteService returns a Service storing entries in the SQLite
+// database at path, which is created if it doesn't exist. Entries sent
+// again with the event ID of one received within window are dropped as
+// duplicates, a zero window disables deduplication.
+func NewSQLiteService(path string, window time.Duration) (Service, error) {
+	if path == "" {
+		return nil, errors.New("sqlite path is required")
+	}
+
+	// WAL lets readers run alongside the single writer, writers wait
+	// for each other rather than failing with SQLITE_BUSY. Transactions
+	// take the write lock up front, a batch reads event IDs before its
+	// first write.
+	dsn := "file:" + path +
+		"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(10000)&_pragma=synchronous(NORMAL)" +
+		"&_txlock=immediate"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open sqlite database")
+	}
+
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteService{db: db, window: window}, nil
+}
@@ -0,0 +1,20 @@
+package crud_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/bhuvankumar123/klg/crud/crudtest"
+)
+
+func TestSQLiteService(t *testing.T) {
+	crudtest.RunServiceSuite(t, func(t *testing.T) crud.Service {
+		svc, err := crud.NewSQLiteService(filepath.Join(t.TempDir(), "klg.db"), time.Hour)
+		if err != nil {
+			t.Fatalf("failed to create sqlite service: %v", err)
+		}
+		return svc
+	})
+}
@@ -0,0 +1,268 @@
+package crud
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+// tailBuffer is the number of events a stream may fall behind before it
+// is dropped, its client resumes from the backlog when it reconnects
+const tailBuffer = 256
+
+// Tailer fans the entries klg stores out to the streams of the tail
+// endpoint. It keeps the most recent events as a backlog, so that a client
+// reconnecting with the ID of the last event it got resumes without a gap.
+type Tailer struct {
+	logger    log.Logger
+	heartbeat time.Duration
+
+	mu     sync.Mutex
+	closed bool
+
+	// backlog is a ring of the most recent events, next is the index of
+	// the oldest one once it is full
+	backlog []tailEvent
+	size    int
+	next    int
+
+	streams map[*tailStream]struct{}
+}
+
+// tailEvent is a stored entry and its event ID, see tailEventID
+type tailEvent struct {
+	id    string
+	entry LogEntry
+}
+
+// tailStream receives the events passing its filter
+type tailStream struct {
+	query  *listQuery
+	events chan tailEvent
+}
+
+// tailEventID identifies an entry in a stream by the time it was received
+// and its ID, so that a client resumes on any replica from the last one
+// it got
+func tailEventID(entry *LogEntry) string {
+	return strconv.FormatInt(entry.ReceivedAt, 10) + "-" + entry.ID
+}
+
+// parseTailEventID reads the receive time of an ID returned by tailEventID
+func parseTailEventID(id string) (int64, error) {
+	ts, _, ok := strings.Cut(id, "-")
+	if !ok {
+		return 0, errors.Wrap(ErrBadRequest, "invalid last event ID")
+	}
+
+	receivedAt, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(ErrBadRequest, "invalid last event ID")
+	}
+	return receivedAt, nil
+}
+
+// Publish sends stored entries to the streams they pass the filter of. A
+// stream which can't keep up is closed rather than blocking ingestion.
+func (t *Tailer) Publish(entries []LogEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return
+	}
+
+	for _, entry := range entries {
+		ev := tailEvent{id: tailEventID(&entry), entry: entry}
+		t.remember(ev)
+
+		for stream := range t.streams {
+			if !stream.query.match(&ev.entry) {
+				continue
+			}
+
+			select {
+			case stream.events <- ev:
+			default:
+				t.logger.Warn("dropped slow tail stream", log.String("event_id", ev.id))
+				delete(t.streams, stream)
+				close(stream.events)
+			}
+		}
+	}
+}
+
+// remember adds an event to the backlog, replacing the oldest one once
+// it is full
+func (t *Tailer) remember(ev tailEvent) {
+	if len(t.backlog) < t.size {
+		t.backlog = append(t.backlog, ev)
+		return
+	}
+
+	t.backlog[t.next] = ev
+	t.next = (t.next + 1) % t.size
+}
+
+// replay returns the events of the backlog published after the one with
+// id last, passing the filter of query. When last is no longer in the
+// backlog, the events received since it are sent again rather than lost.
+func (t *Tailer) replay(query *listQuery, last string, receivedAt int64) []tailEvent {
+	ordered := append(append([]tailEvent{}, t.backlog[t.next:]...), t.backlog[:t.next]...)
+
+	found := -1
+	for ix, ev := range ordered {
+		if ev.id == last {
+			found = ix
+		}
+	}
+
+	out := []tailEvent{}
+	for ix, ev := range ordered {
+		switch {
+		case found >= 0 && ix <= found:
+			continue
+		case found < 0 && ev.entry.ReceivedAt < receivedAt:
+			continue
+		}
+
+		if query.match(&ev.entry) {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+// subscribe opens a stream of the events passing the filter of query.
+// With the ID of the last event a client got, the events of the backlog
+// it missed are returned to be sent first.
+func (t *Tailer) subscribe(query *listQuery, last string) (*tailStream, []tailEvent, error) {
+	var receivedAt int64
+	if last != "" {
+		ts, err := parseTailEventID(last)
+		if err != nil {
+			return nil, nil, err
+		}
+		receivedAt = ts
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, nil, errors.Wrap(ErrInternalServer, "server is shutting down")
+	}
+
+	var replay []tailEvent
+	if last != "" {
+		replay = t.replay(query, last, receivedAt)
+	}
+
+	stream := &tailStream{query: query, events: make(chan tailEvent, tailBuffer)}
+	t.streams[stream] = struct{}{}
+	return stream, replay, nil
+}
+
+// unsubscribe closes a stream, unless it was dropped already
+func (t *Tailer) unsubscribe(stream *tailStream) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.streams[stream]; ok {
+		delete(t.streams, stream)
+		close(stream.events)
+	}
+}
+
+// Close ends every stream, so that the server doesn't wait for them to
+// shut down
+func (t *Tailer) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	for stream := range t.streams {
+		delete(t.streams, stream)
+		close(stream.events)
+	}
+	return nil
+}
+
+// NewTailer returns a Tailer keeping the last backlog events for clients
+// to resume from. Streams send a heartbeat when idle for heartbeat.
+func NewTailer(logger log.Logger, backlog int, heartbeat time.Duration) (*Tailer, error) {
+	if backlog <= 0 {
+		return nil, errors.New("tail backlog must be positive")
+	}
+
+	if heartbeat <= 0 {
+		return nil, errors.New("tail heartbeat must be positive")
+	}
+
+	return &Tailer{
+		logger:    logger,
+		heartbeat: heartbeat,
+		size:      backlog,
+		streams:   map[*tailStream]struct{}{},
+	}, nil
+}
+
+// tailService publishes the entries stored through another Service
+type tailService struct {
+	Service
+
+	tailer *Tailer
+}
+
+func (s *tailService) Create(
+	ctx context.Context, level string, message string, metadata map[string]interface{},
+) (*LogEntry, error) {
+	entry, err := s.Service.Create(ctx, level, message, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	s.tailer.Publish([]LogEntry{*entry})
+	return entry, nil
+}
+
+// CreateMany publishes the entries which were stored, duplicates were
+// published when they were first stored
+func (s *tailService) CreateMany(
+	ctx context.Context, entries []*LogEntry,
+) ([]error, error) {
+	errs, err := s.Service.CreateMany(ctx, entries)
+	if err != nil {
+		return errs, err
+	}
+
+	stored := make([]LogEntry, 0, len(entries))
+	for ix, entry := range entries {
+		if errs[ix] == nil {
+			stored = append(stored, *entry)
+		}
+	}
+
+	s.tailer.Publish(stored)
+	return errs, nil
+}
+
+// NewTailService returns service publishing the entries it stores to
+// tailer. It wraps the storage backend beneath an ingestion queue, so
+// that the entries have their ID when they are published.
+func NewTailService(service Service, tailer *Tailer) (Service, error) {
+	if service == nil {
+		return nil, errors.New("service is required for tail service")
+	}
+
+	if tailer == nil {
+		return nil, errors.New("tailer is required for tail service")
+	}
+
+	return &tailService{Service: service, tailer: tailer}, nil
+}
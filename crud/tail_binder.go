@@ -0,0 +1,214 @@
+package crud
+
+import (
+	"encoding/json"
+	net_http "net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/kit/transport/http"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+// lastEventParam resumes a stream like the Last-Event-ID header, for
+// WebSocket clients which can't set headers
+const lastEventParam = "last_event_id"
+
+type TailBinder struct {
+	logger  log.Logger
+	tailer  *Tailer
+	origins []string
+}
+
+func (b *TailBinder) Bind(ht *http.Transport, opts ...http.HandlerOption) {
+	// streams never complete, they are ended for the server to shut down
+	ht.RegisterOnShutdown(func() { b.tailer.Close() })
+
+	// Get Call to stream new logs over SSE or WebSocket
+	ht.Mux().Handler(
+		net_http.MethodGet,
+		"/v1.0/logs/tail",
+		NewTailHandler(b.logger, b.tailer, b.origins),
+	)
+}
+
+// tailMessage is an event of a WebSocket stream, SSE sends the ID in the
+// id field of the event instead
+type tailMessage struct {
+	ID   string   `json:"id"`
+	Data LogEntry `json:"data"`
+}
+
+// NewTailHandler streams the entries passing the filter of List as they
+// are stored, over WebSocket when the client asks for an upgrade and as
+// server-sent events otherwise. recent, limit and cursor are ignored.
+// WebSocket upgrades are accepted from the origin of the request host and
+// from origins.
+func NewTailHandler(logger log.Logger, tailer *Tailer, origins []string) net_http.Handler {
+	upgrader := newUpgrader(origins)
+
+	return net_http.HandlerFunc(func(w net_http.ResponseWriter, req *net_http.Request) {
+		var (
+			ctx    = req.Context()
+			query  = req.URL.Query()
+			filter = listFilter(query)
+		)
+
+		delete(filter, "cursor")
+		delete(filter, metadataPrefix+lastEventParam)
+
+		q, err := parseListQuery(filter)
+		if err != nil {
+			ErrorEncoder(ctx, err, w)
+			return
+		}
+
+		last := req.Header.Get("Last-Event-ID")
+		if last == "" {
+			last = query.Get(lastEventParam)
+		}
+
+		stream, replay, err := tailer.subscribe(q, last)
+		if err != nil {
+			ErrorEncoder(ctx, err, w)
+			return
+		}
+		defer tailer.unsubscribe(stream)
+
+		if !websocket.IsWebSocketUpgrade(req) {
+			tailer.serveSSE(w, req, stream, replay)
+			return
+		}
+
+		// the upgrader answers failed handshakes
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			logger.Debug("failed to upgrade tail stream", log.Error(err))
+			return
+		}
+		defer conn.Close()
+
+		tailer.serveWebSocket(conn, stream, replay)
+	})
+}
+
+// serveSSE writes the events as server-sent events, with a comment as
+// heartbeat
+func (t *Tailer) serveSSE(
+	w net_http.ResponseWriter, req *net_http.Request, stream *tailStream, replay []tailEvent,
+) {
+	flusher, ok := w.(net_http.Flusher)
+	if !ok {
+		ErrorEncoder(req.Context(), errors.Wrap(ErrInternalServer, "streaming is not supported"), w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(net_http.StatusOK)
+
+	write := func(ev tailEvent) error {
+		// entries always encode
+		bt, _ := json.Marshal(ev.entry)
+		_, err := w.Write([]byte("id: " + ev.id + "\ndata: " + string(bt) + "\n\n"))
+		return err
+	}
+
+	for _, ev := range replay {
+		if err := write(ev); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(t.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case ev, ok := <-stream.events:
+			if !ok {
+				return
+			}
+			if err := write(ev); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := w.Write([]byte(": ping\n\n")); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// serveWebSocket writes the events as text messages, with a ping as
+// heartbeat. The client's pings are answered and its close ends the
+// stream. Only this goroutine writes messages, control frames may be
+// written concurrently.
+func (t *Tailer) serveWebSocket(conn *websocket.Conn, stream *tailStream, replay []tailEvent) {
+	conn.SetReadLimit(wsMaxPayload)
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			// clients don't send messages, reading runs the handlers of
+			// pings and closes
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(ev tailEvent) error {
+		// entries always encode
+		bt, _ := json.Marshal(tailMessage{ID: ev.id, Data: ev.entry})
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return conn.WriteMessage(websocket.TextMessage, bt)
+	}
+
+	for _, ev := range replay {
+		if err := write(ev); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(t.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case ev, ok := <-stream.events:
+			if !ok {
+				conn.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+					time.Now().Add(wsWriteTimeout),
+				)
+				return
+			}
+			if err := write(ev); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func NewTailBinder(logger log.Logger, tailer *Tailer, origins []string) (*TailBinder, error) {
+	if tailer == nil {
+		return nil, errors.New("tailer is required for tail binder")
+	}
+
+	return &TailBinder{logger, tailer, origins}, nil
+}
@@ -0,0 +1,249 @@
+package crud_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	net_http "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/gorilla/websocket"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+func newTailServer(t *testing.T) (crud.Service, *httptest.Server) {
+	logger, err := log.NewZapLogger(log.ZapWithLevel("error"))
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+
+	tailer, err := crud.NewTailer(logger, 100, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create tailer: %v", err)
+	}
+
+	store, err := crud.NewService(0)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	svc, err := crud.NewTailService(store, tailer)
+	if err != nil {
+		t.Fatalf("failed to create tail service: %v", err)
+	}
+
+	server := httptest.NewServer(crud.NewTailHandler(logger, tailer, []string{"https://allowed.example.com"}))
+	t.Cleanup(func() {
+		tailer.Close()
+		server.Close()
+	})
+	return svc, server
+}
+
+// readEvent reads the next server-sent event, skipping heartbeats
+func readEvent(t *testing.T, r *bufio.Reader) (string, crud.LogEntry) {
+	var (
+		id    string
+		entry crud.LogEntry
+	)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event: %v", err)
+		}
+
+		switch line = strings.TrimSuffix(line, "\n"); {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &entry); err != nil {
+				t.Fatalf("failed to decode event: %v", err)
+			}
+		case line == "" && id != "":
+			return id, entry
+		}
+	}
+}
+
+func TestTailSSE(t *testing.T) {
+	ctx := context.Background()
+	svc, server := newTailServer(t)
+
+	res, err := net_http.Get(server.URL + "?level=error&service=api")
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("stream has content type %q", ct)
+	}
+
+	// the stream is subscribed once its headers are sent
+	svc.Create(ctx, "info", "skipped", map[string]interface{}{"service": "api"})
+	svc.Create(ctx, "error", "skipped", map[string]interface{}{"service": "web"})
+	first, err := svc.Create(ctx, "error", "first", map[string]interface{}{"service": "api"})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	errs, err := svc.CreateMany(ctx, []*crud.LogEntry{
+		crud.NewLogEntry("error", "second", map[string]interface{}{"service": "api"}),
+		crud.NewLogEntry("error", "third", map[string]interface{}{"service": "api"}),
+	})
+	if err != nil || errs[0] != nil || errs[1] != nil {
+		t.Fatalf("CreateMany failed: %v %v", errs, err)
+	}
+
+	r := bufio.NewReader(res.Body)
+	id, entry := readEvent(t, r)
+	if entry.ID != first.ID || entry.Message != "first" {
+		t.Fatalf("stream sent %+v, expected %+v", entry, first)
+	}
+
+	for _, want := range []string{"second", "third"} {
+		if _, entry = readEvent(t, r); entry.Message != want {
+			t.Fatalf("stream sent %q, expected %q", entry.Message, want)
+		}
+	}
+
+	// a client reconnecting after the first event gets the others again
+	req, _ := net_http.NewRequest(net_http.MethodGet, server.URL+"?level=error&service=api", nil)
+	req.Header.Set("Last-Event-ID", id)
+
+	resumed, err := net_http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to resume stream: %v", err)
+	}
+	defer resumed.Body.Close()
+
+	r = bufio.NewReader(resumed.Body)
+	for _, want := range []string{"second", "third"} {
+		if _, entry = readEvent(t, r); entry.Message != want {
+			t.Fatalf("resumed stream sent %q, expected %q", entry.Message, want)
+		}
+	}
+
+	for _, query := range []string{"?starttime=soon", "?last_event_id=soon", "?message=("} {
+		res, err := net_http.Get(server.URL + query)
+		if err != nil {
+			t.Fatalf("failed to open stream: %v", err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != net_http.StatusBadRequest {
+			t.Errorf("stream%s returned %d, expected 400", query, res.StatusCode)
+		}
+	}
+}
+
+func dialTail(server *httptest.Server, query string, header net_http.Header) (*websocket.Conn, *net_http.Response, error) {
+	dialer := websocket.Dialer{HandshakeTimeout: 5 * time.Second}
+	return dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/"+query, header)
+}
+
+func TestTailWebSocket(t *testing.T) {
+	ctx := context.Background()
+	svc, server := newTailServer(t)
+
+	conn, _, err := dialTail(server, "?level=warn", nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	svc.Create(ctx, "info", "skipped", nil)
+	created, err := svc.Create(ctx, "warn", "disk almost full", nil)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	typ, payload, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+
+	if typ != websocket.TextMessage {
+		t.Fatalf("expected a text message, got %d", typ)
+	}
+
+	var message struct {
+		ID   string        `json:"id"`
+		Data crud.LogEntry `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &message); err != nil {
+		t.Fatalf("failed to decode message %s: %v", payload, err)
+	}
+
+	if message.ID == "" || message.Data.ID != created.ID {
+		t.Fatalf("stream sent %s, expected %+v", payload, created)
+	}
+
+	// the close of the client is echoed before the stream ends
+	err = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		t.Fatalf("failed to send close: %v", err)
+	}
+
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected a normal close, got %v", err)
+	}
+}
+
+func TestTailWebSocketTooLarge(t *testing.T) {
+	_, server := newTailServer(t)
+
+	conn, _, err := dialTail(server, "", nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if err := conn.WriteMessage(websocket.TextMessage, make([]byte, 1<<17)); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("expected a close for a message too big, got %v", err)
+	}
+}
+
+func TestTailWebSocketOrigin(t *testing.T) {
+	_, server := newTailServer(t)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	for _, tc := range []struct {
+		origin string
+		status int
+	}{
+		{"", net_http.StatusSwitchingProtocols},
+		{"http://" + host, net_http.StatusSwitchingProtocols},
+		{"https://allowed.example.com", net_http.StatusSwitchingProtocols},
+		{"https://klg.example.com", net_http.StatusForbidden},
+		{"null", net_http.StatusForbidden},
+	} {
+		header := net_http.Header{}
+		if tc.origin != "" {
+			header.Set("Origin", tc.origin)
+		}
+
+		conn, res, err := dialTail(server, "", header)
+		if err == nil {
+			conn.Close()
+		}
+
+		if res == nil {
+			t.Fatalf("handshake from origin %q failed: %v", tc.origin, err)
+		}
+		if res.StatusCode != tc.status {
+			t.Errorf("handshake from origin %q returned %d, expected %d", tc.origin, res.StatusCode, tc.status)
+		}
+	}
+}
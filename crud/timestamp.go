@@ -0,0 +1,98 @@
+package crud
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxSeconds bounds epoch seconds which fit in int64 nanoseconds
+const maxSeconds = math.MaxInt64 / int64(time.Second)
+
+// ParseTimestamp reads a time into unix nanoseconds. It accepts RFC3339
+// with optional fractional seconds, and epoch seconds, milliseconds,
+// microseconds or nanoseconds, told apart by their magnitude. Epoch
+// seconds may have a fraction, e.g. 1743321727.25.
+func ParseTimestamp(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, errors.New("empty timestamp")
+	}
+
+	if strings.ContainsAny(value, "T:") {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return 0, errors.Wrap(err, "invalid RFC3339 timestamp")
+		}
+		return t.UnixNano(), nil
+	}
+
+	// fractional seconds are read as decimals, a float64 can't hold
+	// nanoseconds of current times
+	if secs, frac, ok := strings.Cut(value, "."); ok {
+		return parseFraction(value, secs, frac)
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid epoch timestamp " + value)
+	}
+
+	// seconds reach the year 5138 before they overlap milliseconds
+	abs := n
+	if abs < 0 {
+		abs = -abs
+	}
+
+	var unit int64
+	switch {
+	case abs < 1e11:
+		unit = int64(time.Second)
+	case abs < 1e14:
+		unit = int64(time.Millisecond)
+	case abs < 1e17:
+		unit = int64(time.Microsecond)
+	default:
+		unit = 1
+	}
+
+	// nanoseconds only reach the year 2262
+	if abs < 0 || abs > math.MaxInt64/unit {
+		return 0, errors.New("epoch timestamp out of range " + value)
+	}
+	return n * unit, nil
+}
+
+// parseFraction reads epoch seconds with up to nine fractional digits
+func parseFraction(value, secs, frac string) (int64, error) {
+	n, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil || frac == "" || len(frac) > 9 || strings.Trim(frac, "0123456789") != "" {
+		return 0, errors.New("invalid epoch timestamp " + value)
+	}
+
+	if n >= maxSeconds || n <= -maxSeconds {
+		return 0, errors.New("invalid epoch timestamp " + value)
+	}
+
+	nanos, _ := strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+	if strings.HasPrefix(secs, "-") {
+		nanos = -nanos
+	}
+	return n*1e9 + nanos, nil
+}
+
+// parseTimestampJSON reads a timestamp given as a JSON string or number
+func parseTimestampJSON(raw []byte) (int64, error) {
+	value := string(raw)
+
+	var str string
+	if err := json.Unmarshal(raw, &str); err == nil {
+		value = str
+	}
+
+	return ParseTimestamp(value)
+}
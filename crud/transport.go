@@ -1,9 +1,16 @@
 package crud
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"io"
 	net_http "net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	utils_err "github.com/bhuvankumar123/klg/utils/err"
 	"github.com/go-kit/kit/endpoint"
@@ -12,16 +19,43 @@ import (
 )
 
 var (
-	errBadRequest     = errors.New("bad request")
-	errInternalServer = errors.New("internal server error")
+	// ErrBadRequest and ErrInternalServer are the causes ErrorEncoder maps
+	// to 400 and 500, shared by the transports of the other receivers
+	ErrBadRequest     = errors.New("bad request")
+	ErrInternalServer = errors.New("internal server error")
+
+	// ErrForbidden is mapped to 403
+	ErrForbidden = errors.New("forbidden")
 )
 
+// idempotencyHeader sets the event ID of a create request, on a bulk
+// request it is the prefix of the event ID of each line
+const idempotencyHeader = "Idempotency-Key"
+
 type createLogRequest struct {
 	Level    string                 `json:"level"`
 	Message  string                 `json:"message"`
 	Metadata map[string]interface{} `json:"metadata,omitempty"`
+
+	// Timestamp is the optional time of the event, see ParseTimestamp
+	Timestamp json.RawMessage `json:"timestamp,omitempty"`
+
+	// EventID is the optional identity of the event, an entry sent again
+	// with the same one returns the stored entry
+	EventID string `json:"event_id,omitempty"`
+}
+
+type createResponse struct {
+	Status  string    `json:"status"`
+	Message string    `json:"message"`
+	Data    *LogEntry `json:"data"`
+
+	code int
 }
 
+// StatusCode is used by the JSON encoder to set the response status
+func (r createResponse) StatusCode() int { return r.code }
+
 // decoder, reads the http request and gets the required
 // request property for the service
 func createDecoder(
@@ -29,43 +63,110 @@ func createDecoder(
 ) (interface{}, error) {
 	var request createLogRequest
 	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
-		return nil, errors.Wrap(errBadRequest, "failed to decode request")
+		return nil, errors.Wrap(ErrBadRequest, "failed to decode request")
 	}
 
-	if request.Level == "" || request.Message == "" {
-		return nil, errors.Wrap(errBadRequest, "level and message are required")
+	if key := req.Header.Get(idempotencyHeader); key != "" {
+		if request.EventID != "" && request.EventID != key {
+			return nil, errors.Wrap(ErrBadRequest, "event_id and "+idempotencyHeader+" differ")
+		}
+		request.EventID = key
 	}
 
-	// Validate log level
-	if err := ValidateLogLevel(request.Level); err != nil {
+	if err := request.validate(); err != nil {
 		return nil, err
 	}
 
 	return request, nil
 }
 
+// validate checks the required fields, the log level, the timestamp and
+// the event ID of the request
+func (r createLogRequest) validate() error {
+	if r.Level == "" || r.Message == "" {
+		return errors.Wrap(ErrBadRequest, "level and message are required")
+	}
+
+	if len(r.EventID) > maxEventIDLength {
+		return errors.Wrap(ErrBadRequest, "event_id is too long")
+	}
+
+	if _, _, err := r.timestamp(); err != nil {
+		return err
+	}
+
+	return ValidateLogLevel(r.Level)
+}
+
+// timestamp parses the timestamp of the request, if one was given
+func (r createLogRequest) timestamp() (int64, bool, error) {
+	if len(r.Timestamp) == 0 || string(r.Timestamp) == "null" {
+		return 0, false, nil
+	}
+
+	ts, err := parseTimestampJSON(r.Timestamp)
+	if err != nil {
+		return 0, false, errors.Wrap(ErrBadRequest, "invalid timestamp")
+	}
+	return ts, true, nil
+}
+
+// entry builds the log entry of a validated request
+func (r createLogRequest) entry() *LogEntry {
+	entry := NewLogEntry(r.Level, r.Message, r.Metadata)
+	entry.EventID = r.EventID
+	if ts, ok, _ := r.timestamp(); ok {
+		entry.Timestamp = ts
+	}
+	return entry
+}
+
 // endpoint handles the call to service
 func createEndpoint(svc Service) endpoint.Endpoint {
 	return func(ctx context.Context, req interface{}) (res interface{}, err error) {
 		rq, ok := req.(createLogRequest)
 		if !ok {
-			return nil, errors.Wrap(errInternalServer, "failed to cast request")
+			return nil, errors.Wrap(ErrInternalServer, "failed to cast request")
 		}
 
-		err = svc.Create(ctx, rq.Level, rq.Message, rq.Metadata)
+		// the entry is built here rather than by Create, so that a
+		// timestamp given by the client is kept
+		entry := rq.entry()
+
+		errs, err := svc.CreateMany(ctx, []*LogEntry{entry})
 		if err != nil {
 			return nil, err
 		}
 
-		// Return success response
-		return map[string]interface{}{
-			"status":  "success",
-			"message": "Log entry created successfully",
-			"data": map[string]interface{}{
-				"level":    rq.Level,
-				"message":  rq.Message,
-				"metadata": rq.Metadata,
-			},
+		switch errors.Cause(errs[0]) {
+		case nil:
+		case ErrDuplicate:
+			// a resent event returns the entry stored the first time
+			return createResponse{
+				Status:  "duplicate",
+				Message: "Log entry already exists",
+				Data:    entry,
+				code:    net_http.StatusOK,
+			}, nil
+		case ErrQueued:
+			// entries taken by the ingestion queue are not stored yet
+			return createResponse{
+				Status:  "accepted",
+				Message: "Log entry queued for ingestion",
+				Data:    entry,
+				code:    net_http.StatusAccepted,
+			}, nil
+		default:
+			return nil, errs[0]
+		}
+
+		// Return success response with the stored entry, so that
+		// the caller learns the generated id and timestamp
+		return createResponse{
+			Status:  "success",
+			Message: "Log entry created successfully",
+			Data:    entry,
+			code:    net_http.StatusOK,
 		}, nil
 	}
 }
@@ -78,7 +179,190 @@ func NewCreateHandlerOption() []http.HandlerOption {
 	return []http.HandlerOption{
 		http.HandlerWithDecoder(createDecoder),
 		http.HandlerWithEncoder(http.NewDefaultJSONEncoder()),
-		http.HandlerWithErrorEncoder(errEncoder),
+		http.HandlerWithErrorEncoder(ErrorEncoder),
+	}
+}
+
+const (
+	// maxBulkLineSize caps the size of a single NDJSON line in a bulk request
+	maxBulkLineSize = 1 << 20
+
+	// maxBulkBodySize caps the size of a bulk request
+	maxBulkBodySize = 32 << 20
+)
+
+type bulkLine struct {
+	line  int
+	entry *LogEntry
+	err   error
+}
+
+type bulkLineResult struct {
+	Line   int    `json:"line"`
+	Status string `json:"status"`
+	ID     string `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// bulkCreateDecoder reads newline-delimited createLogRequest objects. Lines
+// which fail to decode or validate are kept as rejected lines so that the
+// response can report them alongside the accepted ones. With an
+// Idempotency-Key, lines without an event_id get the key and their line
+// number as one, so that the same request sent again is deduplicated.
+func bulkCreateDecoder(
+	ctx context.Context, req *net_http.Request,
+) (interface{}, error) {
+	var (
+		lines   = []bulkLine{}
+		body    = &io.LimitedReader{R: req.Body, N: maxBulkBodySize + 1}
+		scanner = bufio.NewScanner(body)
+		number  = 0
+		key     = req.Header.Get(idempotencyHeader)
+	)
+
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBulkLineSize)
+
+	for scanner.Scan() {
+		number++
+
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+
+		var request createLogRequest
+		if err := json.Unmarshal(raw, &request); err != nil {
+			lines = append(lines, bulkLine{
+				line: number,
+				err:  errors.Wrap(ErrBadRequest, "failed to decode line"),
+			})
+			continue
+		}
+
+		if key != "" && request.EventID == "" {
+			request.EventID = key + ":" + strconv.Itoa(number)
+		}
+
+		if err := request.validate(); err != nil {
+			lines = append(lines, bulkLine{line: number, err: err})
+			continue
+		}
+
+		lines = append(lines, bulkLine{
+			line:  number,
+			entry: request.entry(),
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(ErrBadRequest, "failed to read bulk request: "+err.Error())
+	}
+
+	if body.N == 0 {
+		return nil, errors.Wrap(ErrBadRequest, "request body too large")
+	}
+
+	if len(lines) == 0 {
+		return nil, errors.Wrap(ErrBadRequest, "bulk request is empty")
+	}
+
+	return lines, nil
+}
+
+func bulkCreateEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, req interface{}) (res interface{}, err error) {
+		lines, ok := req.([]bulkLine)
+		if !ok {
+			return nil, errors.Wrap(ErrInternalServer, "failed to cast request")
+		}
+
+		var (
+			entries = make([]*LogEntry, 0, len(lines))
+			indexes = make([]int, 0, len(lines))
+		)
+
+		for ix, ln := range lines {
+			if ln.err == nil {
+				entries = append(entries, ln.entry)
+				indexes = append(indexes, ix)
+			}
+		}
+
+		if len(entries) > 0 {
+			errs, err := svc.CreateMany(ctx, entries)
+			if err != nil {
+				return nil, err
+			}
+
+			for ix, er := range errs {
+				lines[indexes[ix]].err = er
+			}
+		}
+
+		var (
+			accepted   = 0
+			duplicates = 0
+			results    = make([]bulkLineResult, 0, len(lines))
+		)
+
+		for _, ln := range lines {
+			// dropped, the id is the one of the entry stored the first time
+			if errors.Cause(ln.err) == ErrDuplicate {
+				duplicates++
+				results = append(results, bulkLineResult{
+					Line:   ln.line,
+					Status: "duplicate",
+					ID:     ln.entry.ID,
+				})
+				continue
+			}
+
+			// taken by the ingestion queue, the id is not known yet
+			if errors.Cause(ln.err) == ErrQueued {
+				accepted++
+				results = append(results, bulkLineResult{
+					Line:   ln.line,
+					Status: "queued",
+				})
+				continue
+			}
+
+			if ln.err != nil {
+				results = append(results, bulkLineResult{
+					Line:   ln.line,
+					Status: "rejected",
+					Error:  ln.err.Error(),
+				})
+				continue
+			}
+
+			accepted++
+			results = append(results, bulkLineResult{
+				Line:   ln.line,
+				Status: "accepted",
+				ID:     ln.entry.ID,
+			})
+		}
+
+		return map[string]interface{}{
+			"status":     "success",
+			"accepted":   accepted,
+			"duplicates": duplicates,
+			"rejected":   len(lines) - accepted - duplicates,
+			"results":    results,
+		}, nil
+	}
+}
+
+func NewBulkCreateHandler(service Service) http.Handler {
+	return http.Handler(bulkCreateEndpoint(service))
+}
+
+func NewBulkCreateHandlerOption() []http.HandlerOption {
+	return []http.HandlerOption{
+		http.HandlerWithDecoder(bulkCreateDecoder),
+		http.HandlerWithEncoder(http.NewDefaultJSONEncoder()),
+		http.HandlerWithErrorEncoder(ErrorEncoder),
 	}
 }
 
@@ -93,7 +377,7 @@ func getDecoder(
 	)
 
 	if id == "" {
-		return nil, errors.Wrap(errBadRequest, "id missing from url params")
+		return nil, errors.Wrap(ErrBadRequest, "id missing from url params")
 	}
 
 	return id, nil
@@ -106,7 +390,7 @@ func getEndpoint(svc Service) endpoint.Endpoint {
 	return func(ctx context.Context, req interface{}) (res interface{}, err error) {
 		id, ok := req.(string)
 		if !ok {
-			return nil, errors.Wrap(errInternalServer, "failed to cast request")
+			return nil, errors.Wrap(ErrInternalServer, "failed to cast request")
 		}
 
 		return svc.Get(ctx, id)
@@ -121,19 +405,34 @@ func NewGetHandlerOption() []http.HandlerOption {
 	return []http.HandlerOption{
 		http.HandlerWithDecoder(getDecoder),
 		http.HandlerWithEncoder(http.NewDefaultJSONEncoder()),
-		http.HandlerWithErrorEncoder(errEncoder),
+		http.HandlerWithErrorEncoder(ErrorEncoder),
 	}
 }
 
-// unlike any of the APIs that we have, this one doesn't take any input
+// defaultPageSize and maxPageSize bound the entries of a List page, so
+// that a wide query is never loaded at once
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
 
-func listDecoder(
-	ctx context.Context, req *net_http.Request,
-) (interface{}, error) {
-	filter := make(map[string]interface{})
+// listRequest is a List filter and the size of the page to return
+type listRequest struct {
+	filter map[string]interface{}
+	size   int64
+}
 
-	// Get query parameters
-	query := req.URL.Query()
+// listResponse is a page of entries, next_cursor lists the following one
+// and is left out on the last page
+type listResponse struct {
+	Data       []LogEntry `json:"data"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// listFilter reads the List filter from query parameters, parameters
+// other than those of List are metadata filters
+func listFilter(query url.Values) map[string]interface{} {
+	filter := make(map[string]interface{})
 
 	// Add level filter if present
 	if level := query.Get("level"); level != "" {
@@ -154,28 +453,84 @@ func listDecoder(
 		filter["endtime"] = endtime
 	}
 
-	if recent := query.Get("recent"); recent != "" {
-		filter["recent"] = recent
+	// cursor continues from the next_cursor of a previous page
+	if cursor := query.Get("cursor"); cursor != "" {
+		filter["cursor"] = cursor
 	}
 
-	// Add metadata filters if present
+	// q is a search in the query language, see parseQuery
+	if q := query.Get("q"); q != "" {
+		filter["q"] = q
+	}
+
+	// Add metadata filters if present, as metadata.<path>[op] or the
+	// bare <path>[op]
 	for key, values := range query {
-		if key != "level" && key != "message" && key != "starttime" && key != "endtime" {
-			filter["metadata."+key] = values[0]
+		switch key {
+		case "level", "message", "starttime", "endtime", "recent", "limit", "cursor", "q":
+			continue
 		}
+		filter[metadataPrefix+strings.TrimPrefix(key, metadataPrefix)] = values[0]
 	}
 
-	return filter, nil
+	return filter
+}
+
+// listDecoder reads the filter and the page size, limit or recent, which
+// is capped at maxPageSize
+func listDecoder(
+	ctx context.Context, req *net_http.Request,
+) (interface{}, error) {
+	var (
+		query  = req.URL.Query()
+		filter = listFilter(query)
+	)
+
+	size := int64(defaultPageSize)
+	for _, key := range []string{"recent", "limit"} {
+		value := query.Get(key)
+		if value == "" {
+			continue
+		}
+
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, errors.Wrap(ErrBadRequest, "invalid "+key+" value")
+		}
+		size = n
+	}
+
+	if size > maxPageSize {
+		size = maxPageSize
+	}
+
+	return listRequest{filter: filter, size: size}, nil
 }
 
 func listEndpoint(svc Service) endpoint.Endpoint {
 	return func(ctx context.Context, req interface{}) (res interface{}, err error) {
-		filter, ok := req.(map[string]interface{})
+		rq, ok := req.(listRequest)
 		if !ok {
-			return nil, errors.Wrap(errInternalServer, "failed to cast filter")
+			return nil, errors.Wrap(ErrInternalServer, "failed to cast filter")
+		}
+
+		// one more entry than the page tells whether there is a next one
+		rq.filter["recent"] = strconv.FormatInt(rq.size+1, 10)
+
+		entries, err := svc.List(ctx, rq.filter)
+		if err != nil {
+			return nil, err
+		}
+
+		if int64(len(entries)) <= rq.size {
+			return listResponse{Data: entries}, nil
 		}
 
-		return svc.List(ctx, filter)
+		entries = entries[:rq.size]
+		return listResponse{
+			Data:       entries,
+			NextCursor: EncodeCursor(&entries[len(entries)-1]),
+		}, nil
 	}
 }
 
@@ -187,7 +542,49 @@ func NewListHandlerOption() []http.HandlerOption {
 	return []http.HandlerOption{
 		http.HandlerWithDecoder(listDecoder),
 		http.HandlerWithEncoder(http.NewDefaultJSONEncoder()),
-		http.HandlerWithErrorEncoder(errEncoder),
+		http.HandlerWithErrorEncoder(ErrorEncoder),
+	}
+}
+
+// aggregateDecoder reads interval and group_by on top of the List filter
+func aggregateDecoder(
+	ctx context.Context, req *net_http.Request,
+) (interface{}, error) {
+	var (
+		query    = req.URL.Query()
+		interval = query.Get("interval")
+		groupBy  = query.Get("group_by")
+	)
+
+	query.Del("interval")
+	query.Del("group_by")
+
+	filter := listFilter(query)
+	filter["interval"] = interval
+	filter["group_by"] = groupBy
+	return filter, nil
+}
+
+func aggregateEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, req interface{}) (res interface{}, err error) {
+		filter, ok := req.(map[string]interface{})
+		if !ok {
+			return nil, errors.Wrap(ErrInternalServer, "failed to cast filter")
+		}
+
+		return svc.Aggregate(ctx, filter)
+	}
+}
+
+func NewAggregateHandler(service Service) http.Handler {
+	return http.Handler(aggregateEndpoint(service))
+}
+
+func NewAggregateHandlerOption() []http.HandlerOption {
+	return []http.HandlerOption{
+		http.HandlerWithDecoder(aggregateDecoder),
+		http.HandlerWithEncoder(http.NewDefaultJSONEncoder()),
+		http.HandlerWithErrorEncoder(ErrorEncoder),
 	}
 }
 
@@ -199,7 +596,7 @@ func NewDeleteHandlerOption() []http.HandlerOption {
 	return []http.HandlerOption{
 		http.HandlerWithDecoder(deleteDecoder),
 		http.HandlerWithEncoder(http.NewDefaultJSONEncoder()),
-		http.HandlerWithErrorEncoder(errEncoder),
+		http.HandlerWithErrorEncoder(ErrorEncoder),
 	}
 }
 
@@ -216,8 +613,19 @@ func deleteDecoder(
 		filter["id"] = id
 	} else if before := query.Get("before"); before != "" {
 		filter["before"] = before
+
+		// starttime, level and service narrow a delete by time
+		if starttime := query.Get("starttime"); starttime != "" {
+			filter["starttime"] = starttime
+		}
+		if level := query.Get("level"); level != "" {
+			filter["level"] = level
+		}
+		if service := query.Get("service"); service != "" {
+			filter["metadata.service"] = service
+		}
 	} else {
-		return nil, errors.Wrap(errBadRequest, "either id or before must be provided")
+		return nil, errors.Wrap(ErrBadRequest, "either id or before must be provided")
 	}
 
 	return filter, nil
@@ -227,7 +635,7 @@ func deleteEndpoint(svc Service) endpoint.Endpoint {
 	return func(ctx context.Context, req interface{}) (res interface{}, err error) {
 		filter, ok := req.(map[string]interface{})
 		if !ok {
-			return nil, errors.Wrap(errInternalServer, "failed to cast filter")
+			return nil, errors.Wrap(ErrInternalServer, "failed to cast filter")
 		}
 		err = svc.Delete(ctx, filter)
 		if err != nil {
@@ -240,7 +648,123 @@ func deleteEndpoint(svc Service) endpoint.Endpoint {
 	}
 }
 
-func errorWriter(
+// retentionDecoder takes no input, the worker reports its own rules
+func retentionDecoder(
+	ctx context.Context, req *net_http.Request,
+) (interface{}, error) {
+	return nil, nil
+}
+
+func retentionEndpoint(worker *RetentionWorker) endpoint.Endpoint {
+	return func(ctx context.Context, req interface{}) (res interface{}, err error) {
+		return worker.Preview(ctx)
+	}
+}
+
+func NewRetentionHandler(worker *RetentionWorker) http.Handler {
+	return http.Handler(retentionEndpoint(worker))
+}
+
+func NewRetentionHandlerOption() []http.HandlerOption {
+	return []http.HandlerOption{
+		http.HandlerWithDecoder(retentionDecoder),
+		http.HandlerWithEncoder(http.NewDefaultJSONEncoder()),
+		http.HandlerWithErrorEncoder(ErrorEncoder),
+	}
+}
+
+// archiveDecoder takes no input, the archiver reports its manifest
+func archiveDecoder(
+	ctx context.Context, req *net_http.Request,
+) (interface{}, error) {
+	return nil, nil
+}
+
+func archiveEndpoint(archiver *Archiver) endpoint.Endpoint {
+	return func(ctx context.Context, req interface{}) (res interface{}, err error) {
+		return archiver.Manifest(), nil
+	}
+}
+
+func NewArchiveHandler(archiver *Archiver) http.Handler {
+	return http.Handler(archiveEndpoint(archiver))
+}
+
+func NewArchiveHandlerOption() []http.HandlerOption {
+	return []http.HandlerOption{
+		http.HandlerWithDecoder(archiveDecoder),
+		http.HandlerWithEncoder(http.NewDefaultJSONEncoder()),
+		http.HandlerWithErrorEncoder(ErrorEncoder),
+	}
+}
+
+// restoreRequest is the inclusive range of a restore, ttl overrides how
+// long the restored entries are kept out of the archive
+type restoreRequest struct {
+	from int64
+	to   int64
+	ttl  time.Duration
+}
+
+func restoreDecoder(
+	ctx context.Context, req *net_http.Request,
+) (interface{}, error) {
+	var (
+		query = req.URL.Query()
+		rr    restoreRequest
+		err   error
+	)
+
+	if query.Get("from") == "" || query.Get("to") == "" {
+		return nil, errors.Wrap(ErrBadRequest, "from and to must be provided")
+	}
+
+	if rr.from, err = ParseTimestamp(query.Get("from")); err != nil {
+		return nil, errors.Wrap(ErrBadRequest, "invalid from time format")
+	}
+
+	if rr.to, err = ParseTimestamp(query.Get("to")); err != nil {
+		return nil, errors.Wrap(ErrBadRequest, "invalid to time format")
+	}
+
+	if rr.to < rr.from {
+		return nil, errors.Wrap(ErrBadRequest, "to is before from")
+	}
+
+	if ttl := query.Get("ttl"); ttl != "" {
+		if rr.ttl, err = ParseTTL(ttl); err != nil || rr.ttl <= 0 {
+			return nil, errors.Wrap(ErrBadRequest, "invalid ttl")
+		}
+	}
+
+	return rr, nil
+}
+
+func restoreEndpoint(archiver *Archiver) endpoint.Endpoint {
+	return func(ctx context.Context, req interface{}) (res interface{}, err error) {
+		rr, ok := req.(restoreRequest)
+		if !ok {
+			return nil, errors.Wrap(ErrInternalServer, "failed to cast restore request")
+		}
+
+		return archiver.Restore(ctx, rr.from, rr.to, rr.ttl)
+	}
+}
+
+func NewRestoreHandler(archiver *Archiver) http.Handler {
+	return http.Handler(restoreEndpoint(archiver))
+}
+
+func NewRestoreHandlerOption() []http.HandlerOption {
+	return []http.HandlerOption{
+		http.HandlerWithDecoder(restoreDecoder),
+		http.HandlerWithEncoder(http.NewDefaultJSONEncoder()),
+		http.HandlerWithErrorEncoder(ErrorEncoder),
+	}
+}
+
+// WriteError writes er as JSON with its status code
+func WriteError(
 	ctx context.Context, er *utils_err.Error, w net_http.ResponseWriter,
 ) {
 	bt, err := er.JSON()
@@ -254,33 +778,46 @@ func errorWriter(
 	w.Write(bt)
 }
 
-func errEncoder(
+// ErrorEncoder writes err with the status code of its cause, 500 for an
+// unknown one
+func ErrorEncoder(
 	ctx context.Context,
 	err error,
 	w net_http.ResponseWriter,
 ) {
 	cause := errors.Cause(err)
 	switch cause {
-	case errBadRequest:
-		errorWriter(
+	case ErrBadRequest:
+		WriteError(
 			ctx,
 			utils_err.NewError(err, net_http.StatusBadRequest, "bad request"),
 			w,
 		)
+	case ErrForbidden:
+		WriteError(
+			ctx, utils_err.NewError(err, net_http.StatusForbidden, "forbidden"),
+			w,
+		)
 	case ErrNotFound:
-		errorWriter(
+		WriteError(
 			ctx, utils_err.NewError(err, net_http.StatusNotFound, "not found"),
 			w,
 		)
+	case ErrQueueFull:
+		w.Header().Set("Retry-After", "1")
+		WriteError(
+			ctx, utils_err.NewError(err, net_http.StatusTooManyRequests, "too many requests"),
+			w,
+		)
 	case ErrEmptyKey:
-		errorWriter(
+		WriteError(
 			ctx, utils_err.NewError(err, net_http.StatusBadRequest, "Bad Request, required fields missing"),
 			w,
 		)
-	case errInternalServer:
+	case ErrInternalServer:
 		fallthrough
 	default:
-		errorWriter(
+		WriteError(
 			ctx,
 			utils_err.NewError(err, net_http.StatusInternalServerError, "internal server error"),
 			w,
@@ -0,0 +1,256 @@
+package crud_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	net_http "net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/unbxd/go-base/kit/transport/http"
+)
+
+func TestCreate(t *testing.T) {
+	svc, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	server := httptest.NewServer(http.NewHandler(crud.NewCreateHandler(svc), crud.NewCreateHandlerOption()...))
+	defer server.Close()
+
+	stamp := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name string
+		body string
+		want int64
+	}{
+		{"generated timestamp", `{"level":"info","message":"started","metadata":{"service":"api"}}`, 0},
+		{"client timestamp", `{"level":"info","message":"started","timestamp":"2026-01-05T10:00:00Z"}`, stamp.UnixNano()},
+	} {
+		before := time.Now().UnixNano()
+
+		res, err := net_http.Post(server.URL, "application/json", strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatalf("failed to post entry: %v", err)
+		}
+
+		var out struct {
+			Status string        `json:"status"`
+			Data   crud.LogEntry `json:"data"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&out)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+
+		if res.StatusCode != net_http.StatusOK || out.Status != "success" || out.Data.ID == "" {
+			t.Fatalf("create with %s returned %d %+v", tc.name, res.StatusCode, out)
+		}
+
+		if tc.want == 0 && (out.Data.Timestamp < before || out.Data.Timestamp > time.Now().UnixNano()) ||
+			tc.want != 0 && out.Data.Timestamp != tc.want {
+			t.Errorf("create with %s returned timestamp %d", tc.name, out.Data.Timestamp)
+		}
+
+		// the response is the stored entry
+		stored, err := svc.Get(context.Background(), out.Data.ID)
+		if err != nil {
+			t.Fatalf("Get(%s) failed: %v", out.Data.ID, err)
+		}
+
+		if !reflect.DeepEqual(*stored, out.Data) {
+			t.Errorf("create with %s returned %+v, stored %+v", tc.name, out.Data, *stored)
+		}
+	}
+}
+
+type bulkResponse struct {
+	Accepted   int `json:"accepted"`
+	Duplicates int `json:"duplicates"`
+	Rejected   int `json:"rejected"`
+	Results    []struct {
+		Line   int    `json:"line"`
+		Status string `json:"status"`
+		ID     string `json:"id"`
+		Error  string `json:"error"`
+	} `json:"results"`
+}
+
+func newBulkServer(t *testing.T) (crud.Service, *httptest.Server) {
+	svc, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	server := httptest.NewServer(http.NewHandler(crud.NewBulkCreateHandler(svc), crud.NewBulkCreateHandlerOption()...))
+	t.Cleanup(server.Close)
+	return svc, server
+}
+
+func TestBulkCreate(t *testing.T) {
+	svc, server := newBulkServer(t)
+
+	body := strings.Join([]string{
+		`{"level":"info","message":"first"}`,
+		`{"level":"info",`,
+		`{"level":"trace","message":"unknown level"}`,
+		``,
+		`{"level":"error","message":"second","event_id":"ev-1"}`,
+		`{"level":"error","message":"second again","event_id":"ev-1"}`,
+		`{"message":"no level"}`,
+	}, "\n")
+
+	res, err := net_http.Post(server.URL, "application/x-ndjson", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to post bulk request: %v", err)
+	}
+	defer res.Body.Close()
+
+	var out bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if res.StatusCode != net_http.StatusOK || out.Accepted != 2 || out.Duplicates != 1 || out.Rejected != 3 {
+		t.Fatalf("bulk returned %d %+v", res.StatusCode, out)
+	}
+
+	// the blank line is skipped but still counted
+	want := []struct {
+		line   int
+		status string
+	}{
+		{1, "accepted"},
+		{2, "rejected"},
+		{3, "rejected"},
+		{5, "accepted"},
+		{6, "duplicate"},
+		{7, "rejected"},
+	}
+	if len(out.Results) != len(want) {
+		t.Fatalf("bulk returned %d results, expected %d", len(out.Results), len(want))
+	}
+
+	for ix, result := range out.Results {
+		if result.Line != want[ix].line || result.Status != want[ix].status {
+			t.Errorf("result %d is line %d %s, expected line %d %s",
+				ix, result.Line, result.Status, want[ix].line, want[ix].status)
+		}
+
+		if (result.Status == "rejected") != (result.Error != "") {
+			t.Errorf("result of line %d is %s with error %q", result.Line, result.Status, result.Error)
+		}
+	}
+
+	// the duplicate reports the entry stored by line 5
+	if out.Results[4].ID == "" || out.Results[4].ID != out.Results[3].ID {
+		t.Errorf("duplicate reported id %q, expected %q", out.Results[4].ID, out.Results[3].ID)
+	}
+
+	stored, err := svc.Get(context.Background(), out.Results[0].ID)
+	if err != nil || stored.Message != "first" {
+		t.Errorf("Get of an accepted line returned %+v, %v", stored, err)
+	}
+}
+
+func TestBulkCreateLimits(t *testing.T) {
+	_, server := newBulkServer(t)
+
+	line := `{"level":"info","message":"` + strings.Repeat("x", 1<<20) + `"}`
+
+	// blank lines keep the body under the line size limit
+	padding := bytes.Repeat([]byte(strings.Repeat(" ", 1023)+"\n"), 32<<10)
+
+	for _, tc := range []struct {
+		name string
+		body []byte
+	}{
+		{"empty", []byte("\n\n")},
+		{"line too long", []byte(`{"level":"info","message":"ok"}` + "\n" + line)},
+		{"body too large", append(padding, `{"level":"info","message":"ok"}`...)},
+	} {
+		res, err := net_http.Post(server.URL, "application/x-ndjson", bytes.NewReader(tc.body))
+		if err != nil {
+			t.Fatalf("failed to post bulk request: %v", err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != net_http.StatusBadRequest {
+			t.Errorf("bulk request %s returned %d, expected 400", tc.name, res.StatusCode)
+		}
+	}
+
+	// a body just under the limit is read
+	res, err := net_http.Post(server.URL, "application/x-ndjson",
+		bytes.NewReader(append(padding[:len(padding)-1024], `{"level":"info","message":"ok"}`...)))
+	if err != nil {
+		t.Fatalf("failed to post bulk request: %v", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != net_http.StatusOK {
+		t.Errorf("bulk request under the size limit returned %d", res.StatusCode)
+	}
+}
+
+func TestListMetadataFilters(t *testing.T) {
+	svc, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	entries := []*crud.LogEntry{
+		{Timestamp: 300, Level: "error", Message: "failed", Metadata: map[string]interface{}{"status": 503, "region": "eu-west"}},
+		{Timestamp: 200, Level: "warn", Message: "slow", Metadata: map[string]interface{}{"status": 200, "region": "us-east"}},
+		{Timestamp: 100, Level: "info", Message: "served", Metadata: map[string]interface{}{"status": "500", "region": "eu-north"}},
+	}
+	if _, err := svc.CreateMany(context.Background(), entries); err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	server := httptest.NewServer(http.NewHandler(crud.NewListHandler(svc), crud.NewListHandlerOption()...))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"metadata.status[gte]=500", []string{"failed"}},
+		{"status[gte]=500", []string{"failed"}},
+		{"metadata.status=500", []string{"served"}},
+		{"metadata.status[eq:number]=200", []string{"slow"}},
+		{"metadata.region[regex]=^eu-&metadata.status[lt]=600", []string{"failed"}},
+		{"metadata.region[in]=us-east,eu-north", []string{"slow", "served"}},
+		{"metadata.zone[exists]=false", []string{"failed", "slow", "served"}},
+	} {
+		res, err := net_http.Get(server.URL + "?" + tc.query)
+		if err != nil {
+			t.Fatalf("failed to list: %v", err)
+		}
+
+		var out struct {
+			Data []crud.LogEntry `json:"data"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&out)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+
+		got := []string{}
+		for _, entry := range out.Data {
+			got = append(got, entry.Message)
+		}
+		if res.StatusCode != net_http.StatusOK || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("list with %s returned %d %v, expected %v", tc.query, res.StatusCode, got, tc.want)
+		}
+	}
+}
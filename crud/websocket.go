@@ -0,0 +1,64 @@
+package crud
+
+import (
+	net_http "net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+const (
+	// wsWriteTimeout bounds the time a message takes to be written
+	wsWriteTimeout = 10 * time.Second
+
+	// wsMaxPayload bounds the messages read from clients, which only send
+	// control frames to a stream
+	wsMaxPayload = 1 << 16
+)
+
+// allowedOrigin reports whether the Origin of a request is the request
+// host or one of origins, * for any. Requests without an Origin don't come
+// from a browser and are allowed.
+func allowedOrigin(req *net_http.Request, origins []string) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, allowed := range origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host != "" && strings.EqualFold(u.Host, req.Host)
+}
+
+// newUpgrader returns the upgrader of tail streams. Browsers don't apply
+// the same origin policy to WebSocket, the Origin is checked against
+// origins instead. Failed handshakes are answered by ErrorEncoder.
+func newUpgrader(origins []string) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		HandshakeTimeout: wsWriteTimeout,
+		CheckOrigin: func(req *net_http.Request) bool {
+			return allowedOrigin(req, origins)
+		},
+		Error: func(w net_http.ResponseWriter, req *net_http.Request, status int, reason error) {
+			cause := ErrBadRequest
+			switch status {
+			case net_http.StatusForbidden:
+				cause = ErrForbidden
+			case net_http.StatusInternalServerError:
+				cause = ErrInternalServer
+			}
+			ErrorEncoder(req.Context(), errors.Wrap(cause, reason.Error()), w)
+		},
+	}
+}
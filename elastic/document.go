@@ -0,0 +1,99 @@
+package elastic
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+)
+
+// messageFields are looked up, in order, for the message of a document
+var messageFields = []string{"message", "msg", "log"}
+
+func normaliseLevel(value interface{}) string {
+	str, ok := value.(string)
+	if !ok {
+		return ""
+	}
+
+	return crud.NormalizeLogLevel(str)
+}
+
+// sanitise makes document keys usable as metadata filters, dots
+// would otherwise be read as nested documents
+func sanitise(doc map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		key := strings.ReplaceAll(strings.TrimLeft(k, "$"), ".", "_")
+		if key == "" {
+			continue
+		}
+
+		if nested, ok := v.(map[string]interface{}); ok {
+			v = sanitise(nested)
+		}
+		out[key] = v
+	}
+	return out
+}
+
+// level reads the ECS log.level, either nested or flattened, and the
+// plain level and severity fields used by non ECS shippers
+func level(doc map[string]interface{}) string {
+	if logField, ok := doc["log"].(map[string]interface{}); ok {
+		if lvl := normaliseLevel(logField["level"]); lvl != "" {
+			return lvl
+		}
+	}
+
+	for _, key := range []string{"log.level", "level", "severity"} {
+		if lvl := normaliseLevel(doc[key]); lvl != "" {
+			return lvl
+		}
+	}
+
+	return "info"
+}
+
+// toEntry maps an indexed document onto a LogEntry. The message field
+// becomes the message, everything else is kept as metadata along with
+// the index name as the stream.
+func toEntry(index string, source []byte, now time.Time) (*crud.LogEntry, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(source, &doc); err != nil {
+		return nil, err
+	}
+
+	var (
+		lvl     = level(doc)
+		message string
+		stamp   = now
+	)
+
+	for _, key := range messageFields {
+		if str, ok := doc[key].(string); ok {
+			message = str
+			delete(doc, key)
+			break
+		}
+	}
+
+	if message == "" {
+		message = string(source)
+	}
+
+	if ts, ok := doc["@timestamp"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			stamp = t
+			delete(doc, "@timestamp")
+		}
+	}
+
+	md := sanitise(doc)
+	md["stream"] = index
+
+	entry := crud.NewLogEntry(lvl, message, md)
+	entry.Timestamp = stamp.UnixNano()
+	return entry, nil
+}
@@ -0,0 +1,50 @@
+package elastic
+
+import (
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/kit/transport/http"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+// Binder exposes an Elasticsearch compatible bulk API, so Beats and
+// Logstash pipelines can ship to klg without changes
+type Binder struct {
+	logger  log.Logger
+	service crud.Service
+}
+
+// infoPath answers the version check of shippers, the root itself is
+// left to the proxy
+const infoPath = "/_es/"
+
+func (b *Binder) Bind(ht *http.Transport, opts ...http.HandlerOption) {
+	// Get Call answering the cluster version check of shippers
+	ht.GET(
+		infoPath,
+		NewInfoHandler(),
+		append(opts, NewInfoHandlerOption()...)...,
+	)
+
+	// Post Call to index documents in bulk
+	ht.POST(
+		"/_bulk",
+		NewBulkHandler(b.service),
+		append(opts, NewBulkHandlerOption()...)...,
+	)
+
+	// Post Call to index documents in bulk, defaulting to the index in the path
+	ht.POST(
+		"/:index/_bulk",
+		NewBulkHandler(b.service),
+		append(opts, NewBulkHandlerOption()...)...,
+	)
+}
+
+func NewElasticBinder(logger log.Logger, service crud.Service) (*Binder, error) {
+	if service == nil {
+		return nil, errors.New("service is required for elastic binder")
+	}
+
+	return &Binder{logger, service}, nil
+}
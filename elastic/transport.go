@@ -0,0 +1,333 @@
+package elastic
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	net_http "net/http"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/kit/transport/http"
+)
+
+// maxLineSize caps the size of a single action or source line
+const maxLineSize = 16 << 20
+
+// bulkItem is a single action of a bulk request along with the result
+// reported back for it
+type bulkItem struct {
+	action string
+	index  string
+	id     string
+	entry  *crud.LogEntry
+	status int
+	err    *itemError
+
+	// duplicate is set for an index action whose _id was stored before
+	duplicate bool
+}
+
+type itemError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+type bulkRequest struct {
+	start time.Time
+	items []*bulkItem
+}
+
+type actionMeta struct {
+	Index string `json:"_index"`
+	ID    string `json:"_id"`
+}
+
+func readLines(req *net_http.Request) (*bufio.Scanner, func(), error) {
+	var (
+		body  io.Reader = req.Body
+		close           = func() {}
+	)
+
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, nil, errors.Wrap(crud.ErrBadRequest, "invalid gzip body")
+		}
+		body, close = gz, func() { gz.Close() }
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	return scanner, close, nil
+}
+
+// bulkDecoder reads the action and source line pairs of a bulk request.
+// Actions klg can't serve are kept as failed items rather than failing
+// the whole request, the same way Elasticsearch reports them.
+func bulkDecoder(
+	ctx context.Context, req *net_http.Request,
+) (interface{}, error) {
+	var (
+		rq           = bulkRequest{start: time.Now()}
+		defaultIndex = http.Parameters(req).ByName("index")
+	)
+
+	scanner, close, err := readLines(req)
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var action map[string]actionMeta
+		if err := json.Unmarshal(line, &action); err != nil || len(action) != 1 {
+			return nil, errors.Wrap(crud.ErrBadRequest, "malformed action/metadata line")
+		}
+
+		item := &bulkItem{}
+		for name, meta := range action {
+			item.action, item.index, item.id = name, meta.Index, meta.ID
+		}
+
+		if item.index == "" {
+			item.index = defaultIndex
+		}
+
+		// every action but delete is followed by a source line
+		var source []byte
+		if item.action != "delete" {
+			if !scanner.Scan() {
+				return nil, errors.Wrap(crud.ErrBadRequest, "source line missing for action "+item.action)
+			}
+			source = append(source, bytes.TrimSpace(scanner.Bytes())...)
+		}
+
+		switch {
+		case item.action != "index" && item.action != "create":
+			item.status = net_http.StatusBadRequest
+			item.err = &itemError{
+				Type:   "illegal_argument_exception",
+				Reason: "action [" + item.action + "] is not supported",
+			}
+		case item.index == "":
+			item.status = net_http.StatusBadRequest
+			item.err = &itemError{
+				Type:   "action_request_validation_exception",
+				Reason: "index is missing",
+			}
+		default:
+			entry, err := toEntry(item.index, source, rq.start)
+			if err != nil {
+				item.status = net_http.StatusBadRequest
+				item.err = &itemError{
+					Type:   "mapper_parsing_exception",
+					Reason: "failed to parse source: " + err.Error(),
+				}
+				break
+			}
+
+			// the _id chosen by the client identifies a resent document
+			entry.EventID = item.id
+			item.entry = entry
+		}
+
+		rq.items = append(rq.items, item)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(crud.ErrBadRequest, "failed to read bulk request: "+err.Error())
+	}
+
+	if len(rq.items) == 0 {
+		return nil, errors.Wrap(crud.ErrBadRequest, "request body is required")
+	}
+
+	return rq, nil
+}
+
+func bulkEndpoint(svc crud.Service) endpoint.Endpoint {
+	return func(ctx context.Context, req interface{}) (res interface{}, err error) {
+		rq, ok := req.(bulkRequest)
+		if !ok {
+			return nil, errors.Wrap(crud.ErrInternalServer, "failed to cast request")
+		}
+
+		var (
+			entries = []*crud.LogEntry{}
+			items   = []*bulkItem{}
+		)
+
+		for _, item := range rq.items {
+			if item.err == nil {
+				entries = append(entries, item.entry)
+				items = append(items, item)
+			}
+		}
+
+		if len(entries) > 0 {
+			errs, err := svc.CreateMany(ctx, entries)
+			if err != nil {
+				return nil, err
+			}
+
+			for ix, er := range errs {
+				if er == nil || errors.Cause(er) == crud.ErrQueued {
+					items[ix].status = net_http.StatusCreated
+					continue
+				}
+
+				// create conflicts on an existing _id, index leaves it as is
+				if errors.Cause(er) == crud.ErrDuplicate {
+					if items[ix].action == "create" {
+						items[ix].status = net_http.StatusConflict
+						items[ix].err = &itemError{
+							Type:   "version_conflict_engine_exception",
+							Reason: "[" + items[ix].id + "]: document already exists",
+						}
+						continue
+					}
+
+					items[ix].status = net_http.StatusOK
+					items[ix].duplicate = true
+					continue
+				}
+
+				items[ix].status = net_http.StatusInternalServerError
+				if errors.Cause(er) == crud.ErrQueueFull {
+					items[ix].status = net_http.StatusTooManyRequests
+				}
+				items[ix].err = &itemError{Type: "exception", Reason: er.Error()}
+			}
+		}
+
+		var (
+			failed = false
+			out    = make([]map[string]interface{}, 0, len(rq.items))
+		)
+
+		for _, item := range rq.items {
+			result := map[string]interface{}{
+				"_index": item.index,
+				"status": item.status,
+			}
+
+			id := item.id
+			if item.entry != nil && item.entry.ID != "" {
+				id = item.entry.ID
+			}
+			if id != "" {
+				result["_id"] = id
+			}
+
+			switch {
+			case item.err != nil:
+				failed = true
+				result["error"] = item.err
+			case item.duplicate:
+				result["result"] = "noop"
+				result["_version"] = 1
+			default:
+				result["result"] = "created"
+				result["_version"] = 1
+			}
+
+			out = append(out, map[string]interface{}{item.action: result})
+		}
+
+		return map[string]interface{}{
+			"took":   time.Since(rq.start).Milliseconds(),
+			"errors": failed,
+			"items":  out,
+		}, nil
+	}
+}
+
+func NewBulkHandler(service crud.Service) http.Handler {
+	return http.Handler(bulkEndpoint(service))
+}
+
+func NewBulkHandlerOption() []http.HandlerOption {
+	return []http.HandlerOption{
+		http.HandlerWithDecoder(bulkDecoder),
+		http.HandlerWithEncoder(http.NewDefaultJSONEncoder()),
+		http.HandlerWithErrorEncoder(errEncoder),
+	}
+}
+
+// infoEndpoint answers the version check done by Beats and Logstash on
+// startup, klg reports itself as an OSS 7.x cluster
+func infoEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, req interface{}) (res interface{}, err error) {
+		return map[string]interface{}{
+			"name":         "klg",
+			"cluster_name": "klg",
+			"version": map[string]interface{}{
+				"number":         "7.10.2",
+				"build_flavor":   "oss",
+				"lucene_version": "8.7.0",
+			},
+			"tagline": "You Know, for Search",
+		}, nil
+	}
+}
+
+func NewInfoHandler() http.Handler {
+	return http.Handler(infoEndpoint())
+}
+
+func NewInfoHandlerOption() []http.HandlerOption {
+	return []http.HandlerOption{
+		http.HandlerWithDecoder(http.NopRequestDecoder()),
+		http.HandlerWithEncoder(http.NewDefaultJSONEncoder()),
+		http.HandlerWithErrorEncoder(errEncoder),
+	}
+}
+
+// errEncoder writes errors in the shape Elasticsearch clients expect
+func errEncoder(
+	ctx context.Context,
+	err error,
+	w net_http.ResponseWriter,
+) {
+	var (
+		code = net_http.StatusInternalServerError
+		typ  = "exception"
+	)
+
+	switch errors.Cause(err) {
+	case crud.ErrBadRequest:
+		code, typ = net_http.StatusBadRequest, "illegal_argument_exception"
+	case crud.ErrQueueFull:
+		code, typ = net_http.StatusTooManyRequests, "es_rejected_execution_exception"
+		w.Header().Set("Retry-After", "1")
+	}
+
+	reason := itemError{Type: typ, Reason: err.Error()}
+	bt, er := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"root_cause": []itemError{reason},
+			"type":       reason.Type,
+			"reason":     reason.Reason,
+		},
+		"status": code,
+	})
+	if er != nil {
+		net_http.Error(w, er.Error(), net_http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(bt)
+}
@@ -0,0 +1,298 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	net_http "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/unbxd/go-base/kit/transport/http"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+type bulkResponse struct {
+	Errors bool                                `json:"errors"`
+	Items  []map[string]map[string]interface{} `json:"items"`
+}
+
+func newBulkServer(t *testing.T) (crud.Service, *httptest.Server) {
+	svc, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	logger, err := log.NewZapLogger(log.ZapWithLevel("error"))
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+
+	binder, err := NewElasticBinder(logger, svc)
+	if err != nil {
+		t.Fatalf("failed to create binder: %v", err)
+	}
+
+	tr, err := http.NewTransport("", "")
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	binder.Bind(tr)
+
+	server := httptest.NewServer(tr.Handler)
+	t.Cleanup(server.Close)
+	return svc, server
+}
+
+func bulk(t *testing.T, url, body string) (*net_http.Response, []byte) {
+	res, err := net_http.Post(url, "application/x-ndjson", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to send bulk request: %v", err)
+	}
+	defer res.Body.Close()
+
+	bt, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	return res, bt
+}
+
+func TestBulk(t *testing.T) {
+	type item struct {
+		action string
+		index  string
+		status int
+		result string
+		error  string
+	}
+
+	for _, tc := range []struct {
+		name   string
+		path   string
+		body   string
+		errors bool
+		items  []item
+		stored int
+	}{
+		{
+			name: "index and create",
+			path: "/_bulk",
+			body: `{"index":{"_index":"app"}}` + "\n" +
+				`{"message":"first","log.level":"warn"}` + "\n" +
+				`{"create":{"_index":"app","_id":"a-1"}}` + "\n" +
+				`{"msg":"second"}` + "\n",
+			items: []item{
+				{action: "index", index: "app", status: 201, result: "created"},
+				{action: "create", index: "app", status: 201, result: "created"},
+			},
+			stored: 2,
+		},
+		{
+			name: "index from the path",
+			path: "/app/_bulk",
+			body: `{"index":{}}` + "\n" + `{"message":"first"}` + "\n",
+			items: []item{
+				{action: "index", index: "app", status: 201, result: "created"},
+			},
+			stored: 1,
+		},
+		{
+			name: "delete is not supported",
+			path: "/_bulk",
+			body: `{"delete":{"_index":"app","_id":"a-1"}}` + "\n" +
+				`{"index":{"_index":"app"}}` + "\n" +
+				`{"message":"first"}` + "\n",
+			errors: true,
+			items: []item{
+				{action: "delete", index: "app", status: 400, error: "illegal_argument_exception"},
+				{action: "index", index: "app", status: 201, result: "created"},
+			},
+			stored: 1,
+		},
+		{
+			name:   "index is missing",
+			path:   "/_bulk",
+			body:   `{"index":{}}` + "\n" + `{"message":"first"}` + "\n",
+			errors: true,
+			items: []item{
+				{action: "index", status: 400, error: "action_request_validation_exception"},
+			},
+		},
+		{
+			name: "malformed source",
+			path: "/_bulk",
+			body: `{"index":{"_index":"app"}}` + "\n" +
+				`{"message":` + "\n" +
+				`{"index":{"_index":"app"}}` + "\n" +
+				`{"message":"second"}` + "\n",
+			errors: true,
+			items: []item{
+				{action: "index", index: "app", status: 400, error: "mapper_parsing_exception"},
+				{action: "index", index: "app", status: 201, result: "created"},
+			},
+			stored: 1,
+		},
+		{
+			name: "resent documents",
+			path: "/_bulk",
+			body: `{"index":{"_index":"app","_id":"a-1"}}` + "\n" +
+				`{"message":"first"}` + "\n" +
+				`{"index":{"_index":"app","_id":"a-1"}}` + "\n" +
+				`{"message":"first"}` + "\n" +
+				`{"create":{"_index":"app","_id":"a-1"}}` + "\n" +
+				`{"message":"first"}` + "\n",
+			errors: true,
+			items: []item{
+				{action: "index", index: "app", status: 201, result: "created"},
+				{action: "index", index: "app", status: 200, result: "noop"},
+				{action: "create", index: "app", status: 409, error: "version_conflict_engine_exception"},
+			},
+			stored: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, server := newBulkServer(t)
+
+			res, bt := bulk(t, server.URL+tc.path, tc.body)
+			if res.StatusCode != net_http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", res.StatusCode, bt)
+			}
+
+			var out bulkResponse
+			if err := json.Unmarshal(bt, &out); err != nil {
+				t.Fatalf("failed to decode response %s: %v", bt, err)
+			}
+
+			if out.Errors != tc.errors {
+				t.Errorf("expected errors %v, got %v", tc.errors, out.Errors)
+			}
+			if len(out.Items) != len(tc.items) {
+				t.Fatalf("expected %d items, got %d: %s", len(tc.items), len(out.Items), bt)
+			}
+
+			for ix, want := range tc.items {
+				got, ok := out.Items[ix][want.action]
+				if !ok {
+					t.Fatalf("item %d: expected action %s, got %v", ix, want.action, out.Items[ix])
+				}
+
+				index, _ := got["_index"].(string)
+				if index != want.index {
+					t.Errorf("item %d: expected index %q, got %q", ix, want.index, index)
+				}
+				if status, _ := got["status"].(float64); int(status) != want.status {
+					t.Errorf("item %d: expected status %d, got %v", ix, want.status, got["status"])
+				}
+				if result, _ := got["result"].(string); result != want.result {
+					t.Errorf("item %d: expected result %q, got %q", ix, want.result, result)
+				}
+
+				typ := ""
+				if er, ok := got["error"].(map[string]interface{}); ok {
+					typ, _ = er["type"].(string)
+				}
+				if typ != want.error {
+					t.Errorf("item %d: expected error %q, got %q", ix, want.error, typ)
+				}
+			}
+
+			entries, err := svc.List(context.Background(), map[string]interface{}{})
+			if err != nil {
+				t.Fatalf("failed to list: %v", err)
+			}
+			if len(entries) != tc.stored {
+				t.Fatalf("expected %d stored entries, got %d", tc.stored, len(entries))
+			}
+		})
+	}
+}
+
+func TestBulkStoredEntry(t *testing.T) {
+	svc, server := newBulkServer(t)
+
+	body := `{"index":{"_index":"app","_id":"a-1"}}` + "\n" +
+		`{"@timestamp":"2024-01-02T03:04:05Z","message":"disk full","log.level":"ERROR","host":"h1"}` + "\n"
+
+	if res, bt := bulk(t, server.URL+"/_bulk", body); res.StatusCode != net_http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.StatusCode, bt)
+	}
+
+	entries, err := svc.List(context.Background(), map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("failed to list: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+
+	entry := entries[0]
+	if entry.Message != "disk full" || entry.Level != "error" || entry.EventID != "a-1" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC); entry.Timestamp != want.UnixNano() {
+		t.Errorf("expected timestamp %d, got %d", want.UnixNano(), entry.Timestamp)
+	}
+	if entry.Metadata["stream"] != "app" {
+		t.Errorf("expected stream app, got %v", entry.Metadata["stream"])
+	}
+}
+
+func TestBulkErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+	}{
+		{name: "empty body", body: ""},
+		{name: "malformed action", body: `{"index":` + "\n" + `{"message":"first"}` + "\n"},
+		{name: "several actions", body: `{"index":{},"create":{}}` + "\n" + `{"message":"first"}` + "\n"},
+		{name: "source missing", body: `{"index":{"_index":"app"}}` + "\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, server := newBulkServer(t)
+
+			res, bt := bulk(t, server.URL+"/_bulk", tc.body)
+			if res.StatusCode != net_http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d: %s", res.StatusCode, bt)
+			}
+
+			var out struct {
+				Error struct {
+					Type string `json:"type"`
+				} `json:"error"`
+				Status int `json:"status"`
+			}
+			if err := json.Unmarshal(bt, &out); err != nil {
+				t.Fatalf("failed to decode response %s: %v", bt, err)
+			}
+			if out.Error.Type != "illegal_argument_exception" || out.Status != 400 {
+				t.Errorf("unexpected error response %s", bt)
+			}
+		})
+	}
+}
+
+func TestInfo(t *testing.T) {
+	_, server := newBulkServer(t)
+
+	res, err := net_http.Get(server.URL + "/_es/")
+	if err != nil {
+		t.Fatalf("failed to get info: %v", err)
+	}
+	defer res.Body.Close()
+
+	var out struct {
+		Version struct {
+			Number string `json:"number"`
+		} `json:"version"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		t.Fatalf("failed to decode info: %v", err)
+	}
+	if res.StatusCode != net_http.StatusOK || out.Version.Number == "" {
+		t.Fatalf("unexpected info response %d %+v", res.StatusCode, out)
+	}
+}
@@ -0,0 +1,416 @@
+package forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+const (
+	// maxEntries caps the number of entries in a single forward message
+	maxEntries = 100000
+
+	// maxPackedSize caps the size of packed entries after decompression
+	maxPackedSize = 64 << 20
+
+	// eventTimeType is the msgpack extension type of EventTime
+	eventTimeType = 0
+)
+
+var errBadMessage = errors.New("invalid forward message")
+
+// messageFields are looked up, in order, for the message of a record
+var messageFields = []string{"message", "log", "msg"}
+
+// event is a single record of a forward message
+type event struct {
+	time   time.Time
+	record map[string]interface{}
+}
+
+// message is a decoded forward message in any of its modes
+type message struct {
+	tag     string
+	events  []event
+	options map[string]interface{}
+}
+
+// chunk returns the chunk id the client expects to be acknowledged, if any
+func (m *message) chunk() string {
+	chunk, _ := m.options["chunk"].(string)
+	return chunk
+}
+
+// decode reads one forward message. The mode is told apart by the
+// second element: an array of entries is Forward, a str or bin of
+// concatenated entries is PackedForward and anything else is the time
+// of a single entry in Message mode.
+func decode(dec *msgpack.Decoder, now time.Time) (*message, error) {
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+
+	if n < 2 || n > 4 {
+		return nil, errors.Wrap(errBadMessage, "unexpected array length")
+	}
+
+	tag, err := dec.DecodeString()
+	if err != nil {
+		return nil, errors.Wrap(errBadMessage, "tag must be a string")
+	}
+
+	code, err := dec.PeekCode()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &message{tag: tag}
+	rest := n - 2
+
+	switch {
+	case isArray(code):
+		if msg.events, err = decodeEntries(dec, now); err != nil {
+			return nil, err
+		}
+	case msgpcode.IsString(code) || msgpcode.IsBin(code):
+		var packed []byte
+		if packed, err = dec.DecodeBytes(); err != nil {
+			return nil, err
+		}
+
+		// options follow the entries, read them before unpacking
+		if rest > 0 {
+			if msg.options, err = decodeOptions(dec); err != nil {
+				return nil, err
+			}
+			rest = 0
+		}
+
+		if compressed, _ := msg.options["compressed"].(string); compressed == "gzip" {
+			if packed, err = gunzip(packed); err != nil {
+				return nil, err
+			}
+		} else if compressed != "" {
+			return nil, errors.Wrap(errBadMessage, "unsupported compression "+compressed)
+		}
+
+		if msg.events, err = decodePacked(packed, now); err != nil {
+			return nil, err
+		}
+	default:
+		if rest == 0 {
+			return nil, errors.Wrap(errBadMessage, "record missing")
+		}
+
+		ev, err := decodeEvent(dec, now)
+		if err != nil {
+			return nil, err
+		}
+		msg.events = []event{ev}
+		rest--
+	}
+
+	if rest > 1 {
+		return nil, errors.Wrap(errBadMessage, "unexpected array length")
+	}
+
+	if rest == 1 {
+		if msg.options, err = decodeOptions(dec); err != nil {
+			return nil, err
+		}
+	}
+
+	return msg, nil
+}
+
+func isArray(code byte) bool {
+	return msgpcode.IsFixedArray(code) || code == msgpcode.Array16 || code == msgpcode.Array32
+}
+
+// decodeEntries reads the [[time, record], ...] array of Forward mode
+func decodeEntries(dec *msgpack.Decoder, now time.Time) ([]event, error) {
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+
+	if n > maxEntries {
+		return nil, errors.Wrap(errBadMessage, "too many entries")
+	}
+
+	events := make([]event, 0, n)
+	for ix := 0; ix < n; ix++ {
+		if l, err := dec.DecodeArrayLen(); err != nil || l != 2 {
+			return nil, errors.Wrap(errBadMessage, "entry must be [time, record]")
+		}
+
+		ev, err := decodeEvent(dec, now)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+
+	return events, nil
+}
+
+// decodePacked reads the concatenated [time, record] entries of
+// PackedForward mode
+func decodePacked(packed []byte, now time.Time) ([]event, error) {
+	var (
+		rd     = bytes.NewReader(packed)
+		dec    = msgpack.NewDecoder(rd)
+		events = []event{}
+	)
+
+	for rd.Len() > 0 {
+		if len(events) >= maxEntries {
+			return nil, errors.Wrap(errBadMessage, "too many entries")
+		}
+
+		if l, err := dec.DecodeArrayLen(); err != nil || l != 2 {
+			return nil, errors.Wrap(errBadMessage, "entry must be [time, record]")
+		}
+
+		ev, err := decodeEvent(dec, now)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+
+	return events, nil
+}
+
+func decodeEvent(dec *msgpack.Decoder, now time.Time) (event, error) {
+	stamp, err := decodeTime(dec, now)
+	if err != nil {
+		return event{}, err
+	}
+
+	raw, err := dec.DecodeInterface()
+	if err != nil {
+		return event{}, err
+	}
+
+	record, ok := normalise(raw).(map[string]interface{})
+	if !ok {
+		return event{}, errors.Wrap(errBadMessage, "record must be a map")
+	}
+
+	return event{time: stamp, record: record}, nil
+}
+
+// decodeTime reads either an EventTime extension, seconds and
+// nanoseconds as big endian uint32s, or a plain number of seconds
+func decodeTime(dec *msgpack.Decoder, now time.Time) (time.Time, error) {
+	code, err := dec.PeekCode()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if code == msgpcode.FixExt8 || code == msgpcode.Ext8 {
+		raw, err := dec.DecodeRaw()
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		var payload []byte
+		switch {
+		case code == msgpcode.FixExt8 && len(raw) == 10 && raw[1] == eventTimeType:
+			payload = raw[2:]
+		case code == msgpcode.Ext8 && len(raw) == 11 && raw[1] == 8 && raw[2] == eventTimeType:
+			payload = raw[3:]
+		default:
+			return time.Time{}, errors.Wrap(errBadMessage, "unsupported time extension")
+		}
+
+		return time.Unix(
+			int64(binary.BigEndian.Uint32(payload[:4])),
+			int64(binary.BigEndian.Uint32(payload[4:])),
+		), nil
+	}
+
+	value, err := dec.DecodeInterface()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	switch v := value.(type) {
+	case int8, int16, int32, int64, uint8, uint16, uint32, uint64:
+		sec, _ := toFloat(v)
+		if sec > 0 {
+			return time.Unix(int64(sec), 0), nil
+		}
+	case float32, float64:
+		sec, _ := toFloat(v)
+		if sec > 0 {
+			return time.Unix(0, int64(sec*float64(time.Second))), nil
+		}
+	case nil:
+	default:
+		return time.Time{}, errors.Wrap(errBadMessage, "time must be a number or EventTime")
+	}
+
+	return now, nil
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func decodeOptions(dec *msgpack.Decoder) (map[string]interface{}, error) {
+	raw, err := dec.DecodeInterface()
+	if err != nil {
+		return nil, err
+	}
+
+	if raw == nil {
+		return map[string]interface{}{}, nil
+	}
+
+	options, ok := normalise(raw).(map[string]interface{})
+	if !ok {
+		return nil, errors.Wrap(errBadMessage, "option must be a map")
+	}
+
+	return options, nil
+}
+
+// normalise turns bin values into strings, fluentd sends strings as bin
+// in older versions, and makes map keys usable as metadata filters
+func normalise(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			if key = sanitise(key); key != "" {
+				out[key] = normalise(val)
+			}
+		}
+		return out
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			var name string
+			switch k := key.(type) {
+			case string:
+				name = k
+			case []byte:
+				name = string(k)
+			default:
+				continue
+			}
+
+			if name = sanitise(name); name != "" {
+				out[name] = normalise(val)
+			}
+		}
+		return out
+	case []interface{}:
+		for ix := range v {
+			v[ix] = normalise(v[ix])
+		}
+		return v
+	}
+	return value
+}
+
+func sanitise(key string) string {
+	return strings.ReplaceAll(strings.TrimLeft(key, "$"), ".", "_")
+}
+
+func gunzip(packed []byte) ([]byte, error) {
+	// gzip.Reader reads concatenated members, fluent bit sends one per chunk
+	rd, err := gzip.NewReader(bytes.NewReader(packed))
+	if err != nil {
+		return nil, errors.Wrap(errBadMessage, "failed to decompress: "+err.Error())
+	}
+	defer rd.Close()
+
+	bt, err := io.ReadAll(io.LimitReader(rd, maxPackedSize+1))
+	if err != nil {
+		return nil, errors.Wrap(errBadMessage, "failed to decompress: "+err.Error())
+	}
+
+	if len(bt) > maxPackedSize {
+		return nil, errors.Wrap(errBadMessage, "message too large")
+	}
+
+	return bt, nil
+}
+
+// toEntry maps a record onto a LogEntry. message, log or msg becomes the
+// message, the value under levelKey the level and everything else is
+// kept as metadata along with the tag.
+func toEntry(tag string, ev event, levelKey string) *crud.LogEntry {
+	var (
+		md      = make(map[string]interface{}, len(ev.record)+1)
+		message string
+		level   = "info"
+	)
+
+	for key, value := range ev.record {
+		md[key] = value
+	}
+
+	for _, key := range messageFields {
+		if str, ok := md[key].(string); ok {
+			message = str
+			delete(md, key)
+			break
+		}
+	}
+
+	if message == "" {
+		bt, _ := json.Marshal(ev.record)
+		message = string(bt)
+	}
+
+	if str, ok := md[levelKey].(string); ok {
+		if lvl := crud.NormalizeLogLevel(str); lvl != "" {
+			level = lvl
+			delete(md, levelKey)
+		}
+	}
+
+	md["tag"] = tag
+
+	entry := crud.NewLogEntry(level, message, md)
+	entry.Timestamp = ev.time.UnixNano()
+	return entry
+}
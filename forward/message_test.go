@@ -0,0 +1,160 @@
+package forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// eventTime is the EventTime extension of 2026-01-05T10:00:00.5Z
+var eventTime = msgpack.RawMessage{0xd7, 0x00, 0x69, 0x5b, 0x8b, 0xa0, 0x1d, 0xcd, 0x65, 0x00}
+
+func encode(t *testing.T, values ...interface{}) []byte {
+	var buf bytes.Buffer
+
+	enc := msgpack.NewEncoder(&buf)
+	for _, value := range values {
+		if err := enc.Encode(value); err != nil {
+			t.Fatalf("failed to encode fixture: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, bt []byte) []byte {
+	var buf bytes.Buffer
+
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(bt); err != nil {
+		t.Fatalf("failed to compress fixture: %v", err)
+	}
+	gw.Close()
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	var (
+		now     = time.Date(2026, 1, 5, 12, 0, 0, 0, time.UTC)
+		stamp   = time.Date(2026, 1, 5, 10, 0, 0, 500000000, time.UTC)
+		seconds = time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+		first   = map[string]interface{}{"log": "first", "level": "warn"}
+		second  = map[string]interface{}{"msg": "second"}
+		packed  = encode(t, []interface{}{eventTime, first}, []interface{}{seconds.Unix(), second})
+	)
+
+	for _, tc := range []struct {
+		name  string
+		raw   []byte
+		want  []event
+		chunk string
+	}{
+		{
+			name: "message with seconds",
+			raw:  encode(t, []interface{}{"app", seconds.Unix(), first}),
+			want: []event{{seconds, first}},
+		},
+		{
+			name:  "message with event time and chunk",
+			raw:   encode(t, []interface{}{"app", eventTime, first, map[string]interface{}{"chunk": "c1"}}),
+			want:  []event{{stamp, first}},
+			chunk: "c1",
+		},
+		{
+			name: "message without time",
+			raw:  encode(t, []interface{}{"app", nil, second}),
+			want: []event{{now, second}},
+		},
+		{
+			name: "forward",
+			raw: encode(t, []interface{}{"app", []interface{}{
+				[]interface{}{eventTime, first},
+				[]interface{}{float64(seconds.Unix()) + 0.5, second},
+			}, map[string]interface{}{"chunk": "c2"}}),
+			want:  []event{{stamp, first}, {stamp, second}},
+			chunk: "c2",
+		},
+		{
+			name: "packed forward as bin",
+			raw:  encode(t, []interface{}{"app", packed}),
+			want: []event{{stamp, first}, {seconds, second}},
+		},
+		{
+			name: "packed forward as str",
+			raw:  encode(t, []interface{}{"app", string(packed), map[string]interface{}{"size": 2}}),
+			want: []event{{stamp, first}, {seconds, second}},
+		},
+		{
+			name: "compressed packed forward",
+			raw: encode(t, []interface{}{"app", gzipped(t, packed), map[string]interface{}{
+				"compressed": "gzip", "chunk": "c3",
+			}}),
+			want:  []event{{stamp, first}, {seconds, second}},
+			chunk: "c3",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := decode(msgpack.NewDecoder(bytes.NewReader(tc.raw)), now)
+			if err != nil {
+				t.Fatalf("decode failed: %v", err)
+			}
+
+			if msg.tag != "app" || msg.chunk() != tc.chunk {
+				t.Errorf("decode returned tag %q and chunk %q", msg.tag, msg.chunk())
+			}
+
+			if len(msg.events) != len(tc.want) {
+				t.Fatalf("decode returned %d events, expected %d", len(msg.events), len(tc.want))
+			}
+
+			for ix, ev := range msg.events {
+				if !ev.time.Equal(tc.want[ix].time) || !reflect.DeepEqual(ev.record, tc.want[ix].record) {
+					t.Errorf("event %d is %v %v, expected %v %v",
+						ix, ev.time, ev.record, tc.want[ix].time, tc.want[ix].record)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	record := map[string]interface{}{"log": "line"}
+
+	for _, tc := range []struct {
+		name string
+		raw  []byte
+	}{
+		{"tag only", encode(t, []interface{}{"app"})},
+		{"tag not a string", encode(t, []interface{}{1, 0, record})},
+		{"record missing", encode(t, []interface{}{"app", 0})},
+		{"record not a map", encode(t, []interface{}{"app", 0, "line"})},
+		{"entry without record", encode(t, []interface{}{"app", []interface{}{[]interface{}{0}}})},
+		{"time not a number", encode(t, []interface{}{"app", []interface{}{[]interface{}{"now", record}}})},
+		{"options not a map", encode(t, []interface{}{"app", 0, record, "gzip"})},
+		{"unsupported compression", encode(t, []interface{}{"app", []byte{}, map[string]interface{}{"compressed": "zstd"}})},
+		{"invalid gzip", encode(t, []interface{}{"app", []byte{1, 2}, map[string]interface{}{"compressed": "gzip"}})},
+	} {
+		_, err := decode(msgpack.NewDecoder(bytes.NewReader(tc.raw)), time.Now())
+		if errors.Cause(err) != errBadMessage {
+			t.Errorf("decode of %s returned %v, expected errBadMessage", tc.name, err)
+		}
+	}
+}
+
+func TestToEntry(t *testing.T) {
+	stamp := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+
+	entry := toEntry("app.web", event{stamp, map[string]interface{}{
+		"log": "started", "severity": "WARNING", "pod": "web-1",
+	}}, "severity")
+
+	want := map[string]interface{}{"pod": "web-1", "tag": "app.web"}
+	if entry.Message != "started" || entry.Level != "warn" || entry.Timestamp != stamp.UnixNano() ||
+		!reflect.DeepEqual(entry.Metadata, want) {
+		t.Errorf("toEntry returned %+v", entry)
+	}
+}
@@ -0,0 +1,222 @@
+package forward
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/utils/log"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// ackTimeout bounds the time spent writing an ack to a slow client
+const ackTimeout = 10 * time.Second
+
+// Server receives Fluentd and Fluent Bit forward protocol messages over
+// TCP and stores them through crud.Service
+type Server struct {
+	logger   log.Logger
+	service  crud.Service
+	addr     string
+	levelKey string
+
+	mu     sync.Mutex
+	closed bool
+	tcp    net.Listener
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+// Open starts the listener and blocks until the server is closed
+func (s *Server) Open() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+
+	tcp, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		s.mu.Unlock()
+		return errors.Wrap(err, "failed to listen for forward on tcp")
+	}
+	s.tcp = tcp
+
+	s.logger.Info("--- Starting Forward TCP ---", log.String("addr", s.tcp.Addr().String()))
+	s.wg.Add(1)
+	go s.serveTCP()
+
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// Close stops the listener and drops open connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+
+	if s.tcp != nil {
+		s.tcp.Close()
+	}
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+			s.logger.Error("failed to accept forward connection", log.Error(err))
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn reads messages until the client disconnects. A message which
+// can't be decoded leaves the stream unusable, the connection is dropped
+// and the client reconnects and resends whatever wasn't acknowledged.
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	dec := msgpack.NewDecoder(bufio.NewReader(conn))
+
+	for {
+		msg, err := decode(dec, time.Now())
+		if err != nil {
+			if err != io.EOF && errors.Cause(err) != io.ErrUnexpectedEOF && !s.isClosed() {
+				s.logger.Error("failed to decode forward message", log.Error(err))
+			}
+			return
+		}
+
+		if !s.handle(msg) {
+			// not acknowledged, the client retries the chunk
+			continue
+		}
+
+		if chunk := msg.chunk(); chunk != "" {
+			if err := s.ack(conn, chunk); err != nil {
+				if !s.isClosed() {
+					s.logger.Error("failed to ack forward message", log.Error(err))
+				}
+				return
+			}
+		}
+	}
+}
+
+// handle stores the entries of a message and reports whether it may be
+// acknowledged. Entries rejected by the service won't be accepted on a
+// retry either, only a failure of the service itself withholds the ack.
+func (s *Server) handle(msg *message) bool {
+	if len(msg.events) == 0 {
+		return true
+	}
+
+	entries := make([]*crud.LogEntry, 0, len(msg.events))
+	for _, ev := range msg.events {
+		entries = append(entries, toEntry(msg.tag, ev, s.levelKey))
+	}
+
+	errs, err := s.service.CreateMany(context.Background(), entries)
+	if err != nil {
+		s.logger.Error(
+			"failed to store forward message",
+			log.String("tag", msg.tag),
+			log.Error(err),
+		)
+		return false
+	}
+
+	for _, err := range errs {
+		if err != nil && errors.Cause(err) != crud.ErrQueued {
+			s.logger.Error(
+				"failed to store forward entry",
+				log.String("tag", msg.tag),
+				log.Error(err),
+			)
+		}
+	}
+
+	return true
+}
+
+func (s *Server) ack(conn net.Conn, chunk string) error {
+	bt, err := msgpack.Marshal(map[string]string{"ack": chunk})
+	if err != nil {
+		return err
+	}
+
+	if err := conn.SetWriteDeadline(time.Now().Add(ackTimeout)); err != nil {
+		return err
+	}
+
+	_, err = conn.Write(bt)
+	return err
+}
+
+// NewServer returns a forward protocol server listening on the given tcp
+// address. The level of each record is read from its levelKey field.
+func NewServer(
+	logger log.Logger,
+	service crud.Service,
+	addr string,
+	levelKey string,
+) (*Server, error) {
+	if addr == "" {
+		return nil, errors.New("tcp address is required for forward")
+	}
+
+	if levelKey == "" {
+		return nil, errors.New("level key is required for forward")
+	}
+
+	return &Server{
+		logger:   logger,
+		service:  service,
+		addr:     addr,
+		levelKey: sanitise(levelKey),
+		conns:    map[net.Conn]struct{}{},
+	}, nil
+}
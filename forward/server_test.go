@@ -0,0 +1,65 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/unbxd/go-base/utils/log"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestServeConnAck(t *testing.T) {
+	logger, err := log.NewZapLogger(log.ZapWithLevel("error"))
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+
+	store, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	s, err := NewServer(logger, store, "127.0.0.1:0", "level")
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	s.wg.Add(1)
+	go s.serveConn(conn)
+
+	// a message without a chunk is stored and not acknowledged, the ack
+	// read next belongs to the second message
+	record := map[string]interface{}{"log": "line", "level": "error"}
+	client.Write(encode(t, []interface{}{"app", eventTime, record}))
+	client.Write(encode(t, []interface{}{"app", []interface{}{
+		[]interface{}{eventTime, record},
+	}, map[string]interface{}{"chunk": "p8n9gmxTQVC8/nh2wlKKeQ=="}}))
+
+	var ack map[string]string
+	if err := msgpack.NewDecoder(client).Decode(&ack); err != nil {
+		t.Fatalf("failed to read ack: %v", err)
+	}
+
+	if ack["ack"] != "p8n9gmxTQVC8/nh2wlKKeQ==" {
+		t.Errorf("server acknowledged %v", ack)
+	}
+
+	entries, err := store.List(context.Background(), map[string]interface{}{"level": "error"})
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+
+	if len(entries) != 2 {
+		t.Errorf("server stored %d entries, expected 2", len(entries))
+	}
+
+	client.Close()
+	s.wg.Wait()
+}
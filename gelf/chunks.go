@@ -0,0 +1,111 @@
+package gelf
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// chunkMagic prefixes every chunk of a chunked GELF message
+	chunkMagic0 = 0x1e
+	chunkMagic1 = 0x0f
+
+	chunkHeaderSize = 12
+	maxChunks       = 128
+)
+
+// partial is a chunked message being reassembled
+type partial struct {
+	chunks   [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// assembler reassembles chunked UDP messages. Messages which don't
+// complete within the timeout are dropped.
+type assembler struct {
+	mu       sync.Mutex
+	timeout  time.Duration
+	partials map[[8]byte]*partial
+}
+
+func isChunk(datagram []byte) bool {
+	return len(datagram) > chunkHeaderSize &&
+		datagram[0] == chunkMagic0 && datagram[1] == chunkMagic1
+}
+
+// add stores a chunk and returns the complete payload once every chunk
+// of the message has been received
+func (a *assembler) add(datagram []byte, now time.Time) ([]byte, error) {
+	var id [8]byte
+	copy(id[:], datagram[2:10])
+
+	seq, count := int(datagram[10]), int(datagram[11])
+	if count == 0 || count > maxChunks || seq >= count {
+		return nil, errors.Wrap(errBadMessage, "invalid chunk sequence")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	p, ok := a.partials[id]
+	if !ok {
+		p = &partial{chunks: make([][]byte, count), started: now}
+		a.partials[id] = p
+	}
+
+	if len(p.chunks) != count {
+		delete(a.partials, id)
+		return nil, errors.Wrap(errBadMessage, "chunk count changed within message")
+	}
+
+	if p.chunks[seq] == nil {
+		// the datagram buffer is reused by the reader
+		p.chunks[seq] = append([]byte(nil), datagram[chunkHeaderSize:]...)
+		p.received++
+		p.size += len(p.chunks[seq])
+	}
+
+	if p.size > maxMessageSize {
+		delete(a.partials, id)
+		return nil, errors.Wrap(errBadMessage, "message too large")
+	}
+
+	if p.received < count {
+		return nil, nil
+	}
+
+	delete(a.partials, id)
+
+	payload := make([]byte, 0, p.size)
+	for _, chunk := range p.chunks {
+		payload = append(payload, chunk...)
+	}
+	return payload, nil
+}
+
+// expire drops incomplete messages older than the timeout and returns
+// how many were dropped
+func (a *assembler) expire(now time.Time) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	dropped := 0
+	for id, p := range a.partials {
+		if now.Sub(p.started) > a.timeout {
+			delete(a.partials, id)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+func newAssembler(timeout time.Duration) *assembler {
+	return &assembler{
+		timeout:  timeout,
+		partials: map[[8]byte]*partial{},
+	}
+}
@@ -0,0 +1,143 @@
+package gelf
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// chunk builds the datagram of chunk seq out of count of message id
+func chunk(id byte, seq, count int, data string) []byte {
+	datagram := []byte{chunkMagic0, chunkMagic1, id, 0, 0, 0, 0, 0, 0, id, byte(seq), byte(count)}
+	return append(datagram, data...)
+}
+
+func TestAssemblerOrdering(t *testing.T) {
+	var (
+		a   = newAssembler(time.Second)
+		now = time.Now()
+	)
+
+	// chunks of two messages arrive interleaved and out of order
+	for _, tc := range []struct {
+		datagram []byte
+		want     string
+	}{
+		{chunk(1, 2, 3, `"}`), ""},
+		{chunk(2, 1, 2, `"b"}`), ""},
+		{chunk(1, 0, 3, `{"short_message":`), ""},
+		{chunk(2, 0, 2, `{"short_message":`), `{"short_message":"b"}`},
+		{chunk(1, 1, 3, `"a`), `{"short_message":"a"}`},
+	} {
+		if !isChunk(tc.datagram) {
+			t.Fatalf("isChunk(%q) is false", tc.datagram)
+		}
+
+		payload, err := a.add(tc.datagram, now)
+		if err != nil {
+			t.Fatalf("add failed: %v", err)
+		}
+
+		if string(payload) != tc.want {
+			t.Errorf("add returned %q, expected %q", payload, tc.want)
+		}
+	}
+
+	if len(a.partials) != 0 {
+		t.Errorf("assembler kept %d messages once complete", len(a.partials))
+	}
+}
+
+func TestAssemblerDuplicate(t *testing.T) {
+	var (
+		a   = newAssembler(time.Second)
+		now = time.Now()
+	)
+
+	// the datagram buffer is reused by the reader, a resent chunk neither
+	// counts twice nor replaces the first one
+	datagram := chunk(1, 0, 2, "first ")
+	if _, err := a.add(datagram, now); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	copy(datagram[chunkHeaderSize:], "wrong ")
+
+	payload, err := a.add(datagram, now)
+	if err != nil || payload != nil {
+		t.Fatalf("add of a duplicate returned %q, %v", payload, err)
+	}
+
+	if payload, err = a.add(chunk(1, 1, 2, "second"), now); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+
+	if string(payload) != "first second" {
+		t.Errorf("add returned %q, expected %q", payload, "first second")
+	}
+}
+
+func TestAssemblerTimeout(t *testing.T) {
+	var (
+		a   = newAssembler(time.Second)
+		now = time.Now()
+	)
+
+	// the second of three chunks is missing
+	for _, seq := range []int{0, 2} {
+		if payload, err := a.add(chunk(1, seq, 3, "x"), now); err != nil || payload != nil {
+			t.Fatalf("add returned %q, %v", payload, err)
+		}
+	}
+
+	if dropped := a.expire(now.Add(time.Second)); dropped != 0 {
+		t.Errorf("expire dropped %d messages within the timeout", dropped)
+	}
+
+	if dropped := a.expire(now.Add(2 * time.Second)); dropped != 1 {
+		t.Errorf("expire dropped %d messages, expected 1", dropped)
+	}
+
+	// a late chunk starts over rather than completing the message
+	if payload, err := a.add(chunk(1, 1, 3, "x"), now.Add(2*time.Second)); err != nil || payload != nil {
+		t.Errorf("add of a late chunk returned %q, %v", payload, err)
+	}
+}
+
+func TestAssemblerErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		datagrams [][]byte
+	}{
+		{"sequence out of range", [][]byte{chunk(1, 3, 3, "x")}},
+		{"no chunks", [][]byte{chunk(1, 0, 0, "x")}},
+		{"too many chunks", [][]byte{chunk(1, 0, maxChunks+1, "x")}},
+		{"count changed", [][]byte{chunk(1, 0, 3, "x"), chunk(1, 1, 2, "x")}},
+		{"too large", [][]byte{
+			chunk(1, 0, 2, string(bytes.Repeat([]byte("x"), maxMessageSize))),
+			chunk(1, 1, 2, "x"),
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				a   = newAssembler(time.Second)
+				err error
+			)
+
+			for _, datagram := range tc.datagrams {
+				if _, err = a.add(datagram, time.Now()); err != nil {
+					break
+				}
+			}
+
+			if errors.Cause(err) != errBadMessage {
+				t.Errorf("add returned %v, expected errBadMessage", err)
+			}
+
+			if len(a.partials) != 0 {
+				t.Errorf("assembler kept %d invalid messages", len(a.partials))
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/bhuvankumar123/klg/syslog"
+	"github.com/pkg/errors"
+)
+
+// maxMessageSize caps the size of a message after decompression
+const maxMessageSize = 8 << 20
+
+var errBadMessage = errors.New("invalid gelf message")
+
+// defaultLevel is the GELF default when level is not set, syslog alert
+const defaultLevel = 1
+
+// decompress detects gzip and zlib payloads by their magic bytes,
+// anything else is treated as uncompressed JSON
+func decompress(payload []byte) ([]byte, error) {
+	var (
+		rd  io.ReadCloser
+		err error
+	)
+
+	switch {
+	case len(payload) > 2 && payload[0] == 0x1f && payload[1] == 0x8b:
+		rd, err = gzip.NewReader(bytes.NewReader(payload))
+	case len(payload) > 2 && payload[0] == 0x78 && (uint16(payload[0])<<8|uint16(payload[1]))%31 == 0:
+		rd, err = zlib.NewReader(bytes.NewReader(payload))
+	default:
+		return payload, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(errBadMessage, "failed to decompress: "+err.Error())
+	}
+	defer rd.Close()
+
+	bt, err := io.ReadAll(io.LimitReader(rd, maxMessageSize+1))
+	if err != nil {
+		return nil, errors.Wrap(errBadMessage, "failed to decompress: "+err.Error())
+	}
+
+	if len(bt) > maxMessageSize {
+		return nil, errors.Wrap(errBadMessage, "message too large")
+	}
+
+	return bt, nil
+}
+
+// toEntry maps a GELF message onto a LogEntry. short_message becomes the
+// message, the syslog level is mapped onto klg levels and every other
+// field, including _additional ones without their underscore, is kept as
+// metadata.
+func toEntry(payload []byte, now time.Time) (*crud.LogEntry, error) {
+	var msg map[string]interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&msg); err != nil {
+		return nil, errors.Wrap(errBadMessage, "failed to decode: "+err.Error())
+	}
+
+	short, _ := msg["short_message"].(string)
+	if short == "" {
+		return nil, errors.Wrap(errBadMessage, "short_message is required")
+	}
+
+	var (
+		level = defaultLevel
+		stamp = now
+		md    = map[string]interface{}{}
+	)
+
+	if num, ok := msg["level"].(json.Number); ok {
+		if lvl, err := num.Int64(); err == nil {
+			level = int(lvl)
+		}
+	}
+
+	if num, ok := msg["timestamp"].(json.Number); ok {
+		if sec, err := num.Float64(); err == nil && sec > 0 {
+			whole, frac := math.Modf(sec)
+			stamp = time.Unix(int64(whole), int64(frac*float64(time.Second)))
+		}
+	}
+
+	for key, value := range msg {
+		switch key {
+		case "short_message", "level", "timestamp", "version", "_id":
+			continue
+		}
+
+		if num, ok := value.(json.Number); ok {
+			if i, err := num.Int64(); err == nil {
+				value = i
+			} else if f, err := num.Float64(); err == nil {
+				value = f
+			}
+		}
+
+		key = strings.ReplaceAll(strings.TrimLeft(key, "_$"), ".", "_")
+		if key != "" {
+			md[key] = value
+		}
+	}
+
+	entry := crud.NewLogEntry(syslog.SeverityLevel(level), short, md)
+	entry.Timestamp = stamp.UnixNano()
+	return entry, nil
+}
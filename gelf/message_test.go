@@ -0,0 +1,64 @@
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+const payload = `{"version":"1.1","host":"web","short_message":"started","level":6}`
+
+func TestDecompress(t *testing.T) {
+	var gz, zl bytes.Buffer
+
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(payload))
+	gw.Close()
+
+	zw := zlib.NewWriter(&zl)
+	zw.Write([]byte(payload))
+	zw.Close()
+
+	for _, tc := range []struct {
+		name string
+		raw  []byte
+	}{
+		{"gzip", gz.Bytes()},
+		{"zlib", zl.Bytes()},
+		{"uncompressed", []byte(payload)},
+	} {
+		bt, err := decompress(tc.raw)
+		if err != nil {
+			t.Fatalf("decompress of %s failed: %v", tc.name, err)
+		}
+
+		if string(bt) != payload {
+			t.Errorf("decompress of %s returned %q", tc.name, bt)
+		}
+	}
+}
+
+func TestDecompressErrors(t *testing.T) {
+	var gz bytes.Buffer
+
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(payload))
+	gw.Close()
+
+	for _, tc := range []struct {
+		name string
+		raw  []byte
+	}{
+		{"truncated gzip", gz.Bytes()[:gz.Len()/2]},
+		{"gzip header only", []byte{0x1f, 0x8b, 0x08}},
+		// 0x789c is the zlib header of the default compression level
+		{"invalid zlib", []byte{0x78, 0x9c, 0xff, 0xff}},
+	} {
+		if _, err := decompress(tc.raw); errors.Cause(err) != errBadMessage {
+			t.Errorf("decompress of %s returned %v, expected errBadMessage", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package gelf
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+// maxDatagramSize is the largest UDP datagram read, chunks are at most 8192
+const maxDatagramSize = 65536
+
+// Server receives GELF messages over UDP, chunked and compressed, and
+// over TCP, null byte delimited, and stores them through crud.Service
+type Server struct {
+	logger  log.Logger
+	service crud.Service
+
+	udpAddr   string
+	tcpAddr   string
+	assembler *assembler
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+	udp    net.PacketConn
+	tcp    net.Listener
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+// Open starts the enabled listeners and blocks until the server is closed
+func (s *Server) Open() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+
+	if s.udpAddr != "" {
+		udp, err := net.ListenPacket("udp", s.udpAddr)
+		if err != nil {
+			s.mu.Unlock()
+			return errors.Wrap(err, "failed to listen for gelf on udp")
+		}
+		s.udp = udp
+	}
+
+	if s.tcpAddr != "" {
+		tcp, err := net.Listen("tcp", s.tcpAddr)
+		if err != nil {
+			s.mu.Unlock()
+			if s.udp != nil {
+				s.udp.Close()
+			}
+			return errors.Wrap(err, "failed to listen for gelf on tcp")
+		}
+		s.tcp = tcp
+	}
+
+	if s.udp != nil {
+		s.logger.Info("--- Starting GELF UDP ---", log.String("addr", s.udp.LocalAddr().String()))
+		s.wg.Add(2)
+		go s.serveUDP()
+		go s.expireChunks()
+	}
+
+	if s.tcp != nil {
+		s.logger.Info("--- Starting GELF TCP ---", log.String("addr", s.tcp.Addr().String()))
+		s.wg.Add(1)
+		go s.serveTCP()
+	}
+
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// Close stops the listeners and drops open connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+	close(s.done)
+
+	if s.udp != nil {
+		s.udp.Close()
+	}
+
+	if s.tcp != nil {
+		s.tcp.Close()
+	}
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, _, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+			s.logger.Error("failed to read gelf datagram", log.Error(err))
+			continue
+		}
+
+		payload := buf[:n]
+		if isChunk(payload) {
+			payload, err = s.assembler.add(payload, time.Now())
+			if err != nil {
+				s.logger.Error("failed to reassemble gelf message", log.Error(err))
+				continue
+			}
+
+			// more chunks to come
+			if payload == nil {
+				continue
+			}
+		}
+
+		s.handle(payload)
+	}
+}
+
+// expireChunks drops chunked messages which didn't complete in time
+func (s *Server) expireChunks() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.assembler.timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			if dropped := s.assembler.expire(now); dropped > 0 {
+				s.logger.Error("dropped incomplete gelf messages", log.Int("count", dropped))
+			}
+		}
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+			s.logger.Error("failed to accept gelf connection", log.Error(err))
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn reads null byte delimited messages, GELF over TCP doesn't
+// support compression or chunking
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxMessageSize)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		for ix, c := range data {
+			if c == 0 {
+				return ix + 1, data[:ix], nil
+			}
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	for scanner.Scan() {
+		if frame := scanner.Bytes(); len(frame) > 0 {
+			s.handle(frame)
+		}
+	}
+
+	if err := scanner.Err(); err != nil && !s.isClosed() {
+		s.logger.Error("failed to read gelf message", log.Error(err))
+	}
+}
+
+func (s *Server) handle(payload []byte) {
+	payload, err := decompress(payload)
+	if err != nil {
+		s.logger.Error("failed to decode gelf message", log.Error(err))
+		return
+	}
+
+	entry, err := toEntry(payload, time.Now())
+	if err != nil {
+		s.logger.Error("failed to decode gelf message", log.Error(err))
+		return
+	}
+
+	errs, err := s.service.CreateMany(context.Background(), []*crud.LogEntry{entry})
+	if err == nil && errs[0] != nil && errors.Cause(errs[0]) != crud.ErrQueued {
+		err = errs[0]
+	}
+
+	if err != nil {
+		s.logger.Error("failed to store gelf message", log.Error(err))
+	}
+}
+
+// NewServer returns a GELF server listening on the given addresses, an
+// empty address disables that transport. Chunked messages which are not
+// complete within chunkTimeout are dropped.
+func NewServer(
+	logger log.Logger,
+	service crud.Service,
+	udpAddr string,
+	tcpAddr string,
+	chunkTimeout time.Duration,
+) (*Server, error) {
+	if udpAddr == "" && tcpAddr == "" {
+		return nil, errors.New("either udp or tcp address is required for gelf")
+	}
+
+	if chunkTimeout <= 0 {
+		return nil, errors.New("chunk timeout must be positive")
+	}
+
+	return &Server{
+		logger:    logger,
+		service:   service,
+		udpAddr:   udpAddr,
+		tcpAddr:   tcpAddr,
+		assembler: newAssembler(chunkTimeout),
+		done:      make(chan struct{}),
+		conns:     map[net.Conn]struct{}{},
+	}, nil
+}
@@ -0,0 +1,39 @@
+package loki
+
+import (
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/kit/transport/http"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+// Binder exposes the parts of the Loki HTTP API needed by promtail to
+// push logs and by Grafana to query them
+type Binder struct {
+	logger  log.Logger
+	service crud.Service
+}
+
+func (b *Binder) Bind(ht *http.Transport, opts ...http.HandlerOption) {
+	// Post Call to push streams from promtail
+	ht.POST(
+		"/loki/api/v1/push",
+		NewPushHandler(b.service),
+		append(opts, NewPushHandlerOption()...)...,
+	)
+
+	// Get Call to query streams over a time range
+	ht.GET(
+		"/loki/api/v1/query_range",
+		NewQueryRangeHandler(b.service),
+		append(opts, NewQueryRangeHandlerOption()...)...,
+	)
+}
+
+func NewLokiBinder(logger log.Logger, service crud.Service) (*Binder, error) {
+	if service == nil {
+		return nil, errors.New("service is required for loki binder")
+	}
+
+	return &Binder{logger, service}, nil
+}
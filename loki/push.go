@@ -0,0 +1,226 @@
+package loki
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/bhuvankumar123/klg/utils/pb"
+	"github.com/pkg/errors"
+)
+
+// stream is a set of entries sharing the same labels, as pushed by promtail
+type stream struct {
+	labels  map[string]string
+	entries []streamEntry
+}
+
+type streamEntry struct {
+	timestamp time.Time
+	line      string
+	metadata  map[string]string
+}
+
+// levelLabels are the labels looked up, in order, for the level of an entry
+var levelLabels = []string{"level", "detected_level", "severity", "lvl"}
+
+// level picks the level of a stream from its labels, defaulting to info
+func level(labels map[string]string) string {
+	for _, name := range levelLabels {
+		if lvl := crud.NormalizeLogLevel(labels[name]); lvl != "" {
+			return lvl
+		}
+	}
+
+	return "info"
+}
+
+// eventID derives the event ID of a pushed line from its stream labels,
+// timestamp and text, so that the lines of a push promtail retries are
+// not stored twice. Loki drops the same repeats within a stream.
+func eventID(labels map[string]string, se *streamEntry) string {
+	h := sha256.New()
+	h.Write([]byte(labelsKey(labels)))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.FormatInt(se.timestamp.UnixNano(), 10)))
+	h.Write([]byte{0})
+	h.Write([]byte(se.line))
+	return "loki:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// entries maps every pushed line onto a LogEntry, with the stream labels
+// and any structured metadata stored as metadata
+func entries(streams []stream) []*crud.LogEntry {
+	out := []*crud.LogEntry{}
+
+	for _, st := range streams {
+		for ix := range st.entries {
+			se := &st.entries[ix]
+			labels := make(map[string]string, len(st.labels)+len(se.metadata))
+			for k, v := range st.labels {
+				labels[k] = v
+			}
+			for k, v := range se.metadata {
+				labels[k] = v
+			}
+
+			md := make(map[string]interface{}, len(labels))
+			for k, v := range labels {
+				md[k] = v
+			}
+
+			entry := crud.NewLogEntry(level(labels), se.line, md)
+			entry.Timestamp = se.timestamp.UnixNano()
+			entry.EventID = eventID(st.labels, se)
+			out = append(out, entry)
+		}
+	}
+
+	return out
+}
+
+// decodeProtobuf decodes a logproto.PushRequest
+//
+//	PushRequest      { repeated StreamAdapter streams = 1; }
+//	StreamAdapter    { string labels = 1; repeated EntryAdapter entries = 2; }
+//	EntryAdapter     { Timestamp timestamp = 1; string line = 2;
+//	                   repeated LabelPairAdapter structuredMetadata = 3; }
+//	LabelPairAdapter { string name = 1; string value = 2; }
+func decodeProtobuf(b []byte) ([]stream, error) {
+	streams := []stream{}
+
+	err := pb.Fields(b, func(f *pb.Field) error {
+		if f.Number != 1 {
+			return nil
+		}
+
+		st := stream{}
+		err := pb.Fields(f.Bytes, func(f *pb.Field) error {
+			switch f.Number {
+			case 1:
+				labels, err := parseLabels(f.String())
+				if err != nil {
+					return err
+				}
+				st.labels = labels
+			case 2:
+				se, err := decodeEntry(f.Bytes)
+				if err != nil {
+					return err
+				}
+				st.entries = append(st.entries, se)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		streams = append(streams, st)
+		return nil
+	})
+
+	return streams, errors.Wrap(err, "failed to decode PushRequest")
+}
+
+func decodeEntry(b []byte) (se streamEntry, err error) {
+	err = pb.Fields(b, func(f *pb.Field) error {
+		switch f.Number {
+		case 1: // google.protobuf.Timestamp { int64 seconds = 1; int32 nanos = 2; }
+			var sec, nsec int64
+			err := pb.Fields(f.Bytes, func(f *pb.Field) error {
+				switch f.Number {
+				case 1:
+					sec = f.Int64()
+				case 2:
+					nsec = f.Int64()
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			se.timestamp = time.Unix(sec, nsec)
+		case 2:
+			se.line = f.String()
+		case 3:
+			var name, value string
+			err := pb.Fields(f.Bytes, func(f *pb.Field) error {
+				switch f.Number {
+				case 1:
+					name = f.String()
+				case 2:
+					value = f.String()
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if se.metadata == nil {
+				se.metadata = map[string]string{}
+			}
+			se.metadata[name] = value
+		}
+		return nil
+	})
+
+	return se, err
+}
+
+type jsonPushRequest struct {
+	Streams []struct {
+		Stream map[string]string   `json:"stream"`
+		Values [][]json.RawMessage `json:"values"`
+	} `json:"streams"`
+}
+
+// decodeJSON decodes the JSON push payload, where every value is
+// ["<unix epoch in nanoseconds>", "<log line>", {structured metadata}]
+func decodeJSON(b []byte) ([]stream, error) {
+	var req jsonPushRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, errors.Wrap(err, "failed to decode push request")
+	}
+
+	streams := make([]stream, 0, len(req.Streams))
+	for _, js := range req.Streams {
+		st := stream{labels: js.Stream}
+
+		for _, value := range js.Values {
+			if len(value) < 2 {
+				return nil, errors.New("value must contain a timestamp and a line")
+			}
+
+			var ts, line string
+			if err := json.Unmarshal(value[0], &ts); err != nil {
+				return nil, errors.Wrap(err, "invalid timestamp")
+			}
+
+			ns, err := strconv.ParseInt(ts, 10, 64)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid timestamp")
+			}
+
+			if err := json.Unmarshal(value[1], &line); err != nil {
+				return nil, errors.Wrap(err, "invalid line")
+			}
+
+			se := streamEntry{timestamp: time.Unix(0, ns), line: line}
+			if len(value) > 2 {
+				if err := json.Unmarshal(value[2], &se.metadata); err != nil {
+					return nil, errors.Wrap(err, "invalid structured metadata")
+				}
+			}
+
+			st.entries = append(st.entries, se)
+		}
+
+		streams = append(streams, st)
+	}
+
+	return streams, nil
+}
@@ -0,0 +1,228 @@
+package loki
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	net_http "net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/golang/snappy"
+	"github.com/unbxd/go-base/kit/transport/http"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// embedded and str build protobuf fixtures
+func embedded(num protowire.Number, fields ...[]byte) []byte {
+	var b []byte
+	for _, f := range fields {
+		b = append(b, f...)
+	}
+	return protowire.AppendBytes(protowire.AppendTag(nil, num, protowire.BytesType), b)
+}
+
+func str(num protowire.Number, s string) []byte {
+	return protowire.AppendString(protowire.AppendTag(nil, num, protowire.BytesType), s)
+}
+
+func varint(num protowire.Number, v uint64) []byte {
+	return protowire.AppendVarint(protowire.AppendTag(nil, num, protowire.VarintType), v)
+}
+
+var stamp = time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+
+// pushProtobuf is a PushRequest of a stream of two lines, the second with
+// structured metadata, as promtail sends it
+func pushProtobuf() []byte {
+	return embedded(1,
+		str(1, `{app="api", level="warning"}`),
+		embedded(2,
+			embedded(1, varint(1, uint64(stamp.Unix())), varint(2, 500)),
+			str(2, "slow request"),
+		),
+		embedded(2,
+			embedded(1, varint(1, uint64(stamp.Unix()+1))),
+			str(2, "request failed"),
+			embedded(3, str(1, "trace_id"), str(2, "abc")),
+			embedded(3, str(1, "level"), str(2, "error")),
+		),
+	)
+}
+
+const pushJSON = `{"streams":[{"stream":{"app":"api","level":"warning"},"values":[
+	["1767607200000000500","slow request"],
+	["1767607201000000000","request failed",{"trace_id":"abc","level":"error"}]
+]}]}`
+
+func newPushServer(t *testing.T, svc crud.Service) *httptest.Server {
+	server := httptest.NewServer(http.NewHandler(NewPushHandler(svc), NewPushHandlerOption()...))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func push(t *testing.T, url, contentType string, body []byte) (*net_http.Response, []byte) {
+	res, err := net_http.Post(url, contentType, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to push: %v", err)
+	}
+	defer res.Body.Close()
+
+	bt, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	return res, bt
+}
+
+func TestPush(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        []byte
+	}{
+		{"protobuf", "application/x-protobuf", snappy.Encode(nil, pushProtobuf())},
+		{"json", "application/json", []byte(pushJSON)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, err := crud.NewService(time.Hour)
+			if err != nil {
+				t.Fatalf("failed to create service: %v", err)
+			}
+			server := newPushServer(t, svc)
+
+			// a push retried by promtail isn't stored twice
+			for i := 0; i < 2; i++ {
+				if res, body := push(t, server.URL, tc.contentType, tc.body); res.StatusCode != net_http.StatusNoContent {
+					t.Fatalf("push returned %d %s", res.StatusCode, body)
+				}
+			}
+
+			entries, err := svc.List(context.Background(), map[string]interface{}{})
+			if err != nil {
+				t.Fatalf("List failed: %v", err)
+			}
+
+			if len(entries) != 2 {
+				t.Fatalf("push stored %d entries, expected 2", len(entries))
+			}
+
+			// most recent first, structured metadata overrides the labels
+			want := []struct {
+				level, message string
+				ts             int64
+				metadata       map[string]interface{}
+			}{
+				{"error", "request failed", stamp.Add(time.Second).UnixNano(),
+					map[string]interface{}{"app": "api", "level": "error", "trace_id": "abc"}},
+				{"warn", "slow request", stamp.Add(500).UnixNano(),
+					map[string]interface{}{"app": "api", "level": "warning"}},
+			}
+
+			for ix, entry := range entries {
+				if entry.Level != want[ix].level || entry.Message != want[ix].message ||
+					entry.Timestamp != want[ix].ts || len(entry.Metadata) != len(want[ix].metadata) {
+					t.Errorf("push stored %+v, expected %+v", entry, want[ix])
+				}
+
+				for k, v := range want[ix].metadata {
+					if entry.Metadata[k] != v {
+						t.Errorf("push stored metadata %v, expected %v", entry.Metadata, want[ix].metadata)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPushEventID(t *testing.T) {
+	labels := map[string]string{"app": "api"}
+	se := streamEntry{timestamp: stamp, line: "started"}
+
+	id := eventID(labels, &se)
+	if len(id) > 256 || id != eventID(map[string]string{"app": "api"}, &streamEntry{timestamp: stamp, line: "started"}) {
+		t.Fatalf("eventID returned %q", id)
+	}
+
+	// any of the stream, the time and the line tell lines apart
+	for _, other := range []string{
+		eventID(map[string]string{"app": "web"}, &se),
+		eventID(labels, &streamEntry{timestamp: stamp.Add(1), line: "started"}),
+		eventID(labels, &streamEntry{timestamp: stamp, line: "stopped"}),
+	} {
+		if other == id {
+			t.Errorf("eventID returned %q for different lines", id)
+		}
+	}
+}
+
+// partialService rejects the entries with the message of reject
+type partialService struct {
+	crud.Service
+
+	reject string
+	err    error
+}
+
+func (s *partialService) CreateMany(ctx context.Context, entries []*crud.LogEntry) ([]error, error) {
+	errs := make([]error, len(entries))
+	for ix, entry := range entries {
+		if entry.Message == s.reject {
+			errs[ix] = s.err
+		}
+	}
+	return errs, nil
+}
+
+func TestPushRejected(t *testing.T) {
+	store, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	server := newPushServer(t, &partialService{Service: store, reject: "slow request", err: crud.ErrInvalidLevel})
+	res, body := push(t, server.URL, "application/json", []byte(pushJSON))
+
+	var pr pushResponse
+	if err := json.Unmarshal(body, &pr); err != nil {
+		t.Fatalf("failed to decode response %s: %v", body, err)
+	}
+
+	if res.StatusCode != net_http.StatusOK || pr.Accepted != 1 || pr.Rejected != 1 || len(pr.Errors) != 1 {
+		t.Errorf("push returned %d %s", res.StatusCode, body)
+	}
+
+	server = newPushServer(t, &partialService{Service: store, reject: "slow request", err: crud.ErrQueueFull})
+	if res, body := push(t, server.URL, "application/json", []byte(pushJSON)); res.StatusCode != net_http.StatusTooManyRequests ||
+		res.Header.Get("Retry-After") == "" {
+		t.Errorf("push to a full queue returned %d %s", res.StatusCode, body)
+	}
+}
+
+func TestPushErrors(t *testing.T) {
+	svc, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	server := newPushServer(t, svc)
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        []byte
+	}{
+		{"not snappy", "application/x-protobuf", pushProtobuf()},
+		{"invalid protobuf", "application/x-protobuf", snappy.Encode(nil, []byte{0x0a, 0x05})},
+		{"invalid labels", "application/x-protobuf", snappy.Encode(nil, embedded(1, str(1, `{app=}`)))},
+		{"invalid json", "application/json", []byte(`{"streams":`)},
+		{"value without line", "application/json", []byte(`{"streams":[{"stream":{},"values":[["1"]]}]}`)},
+		{"invalid timestamp", "application/json", []byte(`{"streams":[{"stream":{},"values":[["now","line"]]}]}`)},
+	} {
+		if res, body := push(t, server.URL, tc.contentType, tc.body); res.StatusCode != net_http.StatusBadRequest {
+			t.Errorf("push of %s returned %d %s, expected 400", tc.name, res.StatusCode, body)
+		}
+	}
+}
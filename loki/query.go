@@ -0,0 +1,359 @@
+package loki
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/pkg/errors"
+)
+
+// The subset of LogQL understood by klg is a stream selector followed by
+// any number of line filters, e.g.
+//
+//	{app="api", env=~"prod|staging"} |= "timeout" != "healthcheck"
+//
+// Metric queries, parsers and formatters are not supported.
+
+type matchType string
+
+const (
+	matchEqual     matchType = "="
+	matchNotEqual  matchType = "!="
+	matchRegexp    matchType = "=~"
+	matchNotRegexp matchType = "!~"
+)
+
+type labelMatcher struct {
+	name  string
+	typ   matchType
+	value string
+	re    *regexp.Regexp
+}
+
+func (m *labelMatcher) matches(value string) bool {
+	switch m.typ {
+	case matchEqual:
+		return value == m.value
+	case matchNotEqual:
+		return value != m.value
+	case matchRegexp:
+		return m.re.MatchString(value)
+	case matchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+type lineFilter struct {
+	typ   string // one of |=, !=, |~, !~
+	value string
+	re    *regexp.Regexp
+}
+
+func (f *lineFilter) matches(line string) bool {
+	switch f.typ {
+	case "|=":
+		return strings.Contains(line, f.value)
+	case "!=":
+		return !strings.Contains(line, f.value)
+	case "|~":
+		return f.re.MatchString(line)
+	case "!~":
+		return !f.re.MatchString(line)
+	}
+	return false
+}
+
+type logQuery struct {
+	matchers []labelMatcher
+	filters  []lineFilter
+}
+
+// matches checks an entry against the stream selector and line filters,
+// the level of the entry is visible to the selector as the level label
+func (q *logQuery) matches(entry *crud.LogEntry) bool {
+	labels := entryLabels(entry)
+
+	for ix := range q.matchers {
+		if !q.matchers[ix].matches(labels[q.matchers[ix].name]) {
+			return false
+		}
+	}
+
+	for ix := range q.filters {
+		if !q.filters[ix].matches(entry.Message) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// filter narrows the List filter of crud to the entries the query may
+// match, so that the service pages through fewer of them. Matchers which
+// also match a missing label and negative ones are left to matches.
+func (q *logQuery) filter() map[string]interface{} {
+	var (
+		filter = map[string]interface{}{}
+		levels = []string{}
+	)
+
+	for _, m := range q.matchers {
+		switch {
+		case m.name == "level" && m.typ == matchEqual && m.value != "":
+			// the level label is the level of the entry unless a level
+			// label was stored with it
+			level := crud.NormalizeLogLevel(m.value)
+			if level == "" {
+				level = m.value
+			}
+			levels = append(levels, "(level:"+quote(level)+" OR metadata.level:"+quote(m.value)+")")
+		case m.name == "level":
+		case m.typ == matchEqual && m.value != "":
+			filter["metadata."+m.name] = m.value
+		case m.typ == matchRegexp && !m.re.MatchString(""):
+			filter["metadata."+m.name+"[regex]"] = m.re.String()
+		}
+	}
+
+	if len(levels) > 0 {
+		filter["q"] = strings.Join(levels, " AND ")
+	}
+
+	// the message filter is case insensitive, it only narrows the first
+	// line filter which must match
+	for _, f := range q.filters {
+		if f.typ == "|=" {
+			filter["message"] = regexp.QuoteMeta(f.value)
+			break
+		}
+		if f.typ == "|~" {
+			filter["message"] = f.value
+			break
+		}
+	}
+
+	return filter
+}
+
+// quote writes a value as a phrase of the q filter
+func quote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// entryLabels returns the string metadata of an entry as stream labels
+func entryLabels(entry *crud.LogEntry) map[string]string {
+	labels := make(map[string]string, len(entry.Metadata)+1)
+	for k, v := range entry.Metadata {
+		if str, ok := v.(string); ok {
+			labels[k] = str
+		}
+	}
+
+	if _, ok := labels["level"]; !ok {
+		labels["level"] = strings.ToLower(entry.Level)
+	}
+
+	return labels
+}
+
+// lexer splits a query into identifiers, operators and quoted strings
+type lexer struct {
+	input string
+	pos   int
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return errors.Errorf("parse error at position %d: %s", l.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (l *lexer) skipSpace() {
+	for l.pos < len(l.input) && strings.ContainsRune(" \t\r\n", rune(l.input[l.pos])) {
+		l.pos++
+	}
+}
+
+func (l *lexer) done() bool {
+	l.skipSpace()
+	return l.pos >= len(l.input)
+}
+
+func (l *lexer) accept(token string) bool {
+	l.skipSpace()
+	if strings.HasPrefix(l.input[l.pos:], token) {
+		l.pos += len(token)
+		return true
+	}
+	return false
+}
+
+func (l *lexer) ident() (string, error) {
+	l.skipSpace()
+	start := l.pos
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || l.pos > start && c >= '0' && c <= '9' {
+			l.pos++
+			continue
+		}
+		break
+	}
+
+	if start == l.pos {
+		return "", l.errorf("expected label name")
+	}
+	return l.input[start:l.pos], nil
+}
+
+func (l *lexer) str() (string, error) {
+	l.skipSpace()
+	if l.pos >= len(l.input) {
+		return "", l.errorf("expected string")
+	}
+
+	quote := l.input[l.pos]
+	if quote != '"' && quote != '`' {
+		return "", l.errorf("expected string")
+	}
+
+	end := l.pos + 1
+	for end < len(l.input) && l.input[end] != quote {
+		if quote == '"' && l.input[end] == '\\' {
+			end++
+		}
+		end++
+	}
+
+	if end >= len(l.input) {
+		return "", l.errorf("unterminated string")
+	}
+
+	value, err := strconv.Unquote(l.input[l.pos : end+1])
+	if err != nil {
+		return "", l.errorf("invalid string")
+	}
+
+	l.pos = end + 1
+	return value, nil
+}
+
+// matcherType reads one of the label match operators
+func (l *lexer) matcherType() (matchType, error) {
+	for _, typ := range []matchType{matchRegexp, matchNotRegexp, matchNotEqual, matchEqual} {
+		if l.accept(string(typ)) {
+			return typ, nil
+		}
+	}
+	return "", l.errorf("expected one of =, !=, =~, !~")
+}
+
+func (l *lexer) selector() ([]labelMatcher, error) {
+	if !l.accept("{") {
+		return nil, l.errorf("expected stream selector")
+	}
+
+	matchers := []labelMatcher{}
+	if l.accept("}") {
+		return matchers, nil
+	}
+
+	for {
+		name, err := l.ident()
+		if err != nil {
+			return nil, err
+		}
+
+		typ, err := l.matcherType()
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := l.str()
+		if err != nil {
+			return nil, err
+		}
+
+		m := labelMatcher{name: name, typ: typ, value: value}
+		if typ == matchRegexp || typ == matchNotRegexp {
+			// label regexes are fully anchored, as in Prometheus
+			if m.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+				return nil, l.errorf("invalid regex %q", value)
+			}
+		}
+		matchers = append(matchers, m)
+
+		if l.accept("}") {
+			return matchers, nil
+		}
+
+		if !l.accept(",") {
+			return nil, l.errorf("expected , or }")
+		}
+	}
+}
+
+func parseQuery(query string) (*logQuery, error) {
+	l := &lexer{input: query}
+
+	matchers, err := l.selector()
+	if err != nil {
+		return nil, err
+	}
+
+	q := &logQuery{matchers: matchers}
+	for !l.done() {
+		var typ string
+		for _, op := range []string{"|=", "!=", "|~", "!~"} {
+			if l.accept(op) {
+				typ = op
+				break
+			}
+		}
+
+		if typ == "" {
+			return nil, l.errorf("only line filters are supported after the stream selector")
+		}
+
+		value, err := l.str()
+		if err != nil {
+			return nil, err
+		}
+
+		f := lineFilter{typ: typ, value: value}
+		if typ == "|~" || typ == "!~" {
+			if f.re, err = regexp.Compile(value); err != nil {
+				return nil, l.errorf("invalid regex %q", value)
+			}
+		}
+		q.filters = append(q.filters, f)
+	}
+
+	return q, nil
+}
+
+// parseLabels parses the labels of a pushed stream, e.g. {app="api", env="prod"}
+func parseLabels(labels string) (map[string]string, error) {
+	l := &lexer{input: labels}
+
+	matchers, err := l.selector()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid stream labels")
+	}
+
+	if !l.done() {
+		return nil, errors.Wrap(l.errorf("unexpected input"), "invalid stream labels")
+	}
+
+	out := make(map[string]string, len(matchers))
+	for _, m := range matchers {
+		if m.typ != matchEqual {
+			return nil, errors.Errorf("invalid stream labels: label %s must use =", m.name)
+		}
+		out[m.name] = m.value
+	}
+
+	return out, nil
+}
@@ -0,0 +1,343 @@
+package loki
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"mime"
+	net_http "net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/kit/transport/http"
+)
+
+const (
+	// maxBodySize caps the size of a push request after decompression
+	maxBodySize = 32 << 20
+
+	defaultQueryLimit = 100
+	maxQueryLimit     = 5000
+	defaultQueryRange = time.Hour
+)
+
+// noContent is returned by push, Loki answers successful pushes with 204
+type noContent struct{}
+
+func (noContent) StatusCode() int { return net_http.StatusNoContent }
+
+// pushResponse reports the entries of a push which could not be stored,
+// the others are stored and are not sent again by a retry
+type pushResponse struct {
+	Accepted int      `json:"accepted"`
+	Rejected int      `json:"rejected"`
+	Errors   []string `json:"errors"`
+}
+
+func pushDecoder(
+	ctx context.Context, req *net_http.Request,
+) (interface{}, error) {
+	contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+
+	var body io.Reader = io.LimitReader(req.Body, maxBodySize+1)
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, errors.Wrap(crud.ErrBadRequest, "invalid gzip body")
+		}
+		defer gz.Close()
+		body = io.LimitReader(gz, maxBodySize+1)
+	}
+
+	bt, err := io.ReadAll(body)
+	if err != nil {
+		return nil, errors.Wrap(crud.ErrBadRequest, "failed to read body")
+	}
+
+	if len(bt) > maxBodySize {
+		return nil, errors.Wrap(crud.ErrBadRequest, "request body too large")
+	}
+
+	var streams []stream
+	if contentType == "application/json" {
+		streams, err = decodeJSON(bt)
+	} else {
+		// promtail sends snappy compressed protobuf
+		var raw []byte
+		if raw, err = snappy.Decode(nil, bt); err != nil {
+			return nil, errors.Wrap(crud.ErrBadRequest, "invalid snappy body")
+		}
+		streams, err = decodeProtobuf(raw)
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(crud.ErrBadRequest, err.Error())
+	}
+
+	return streams, nil
+}
+
+func pushEndpoint(svc crud.Service) endpoint.Endpoint {
+	return func(ctx context.Context, req interface{}) (res interface{}, err error) {
+		streams, ok := req.([]stream)
+		if !ok {
+			return nil, errors.Wrap(crud.ErrInternalServer, "failed to cast request")
+		}
+
+		entries := entries(streams)
+		if len(entries) == 0 {
+			return noContent{}, nil
+		}
+
+		errs, err := svc.CreateMany(ctx, entries)
+		if err != nil {
+			return nil, err
+		}
+
+		var (
+			pr   = pushResponse{}
+			full = 0
+		)
+
+		for _, er := range errs {
+			switch errors.Cause(er) {
+			case nil, crud.ErrQueued, crud.ErrDuplicate:
+				pr.Accepted++
+			case crud.ErrQueueFull:
+				full++
+			default:
+				pr.Errors = append(pr.Errors, er.Error())
+			}
+		}
+
+		// promtail retries a push rejected with 429, the entries stored
+		// meanwhile are then dropped as duplicates of their event ID
+		if full > 0 {
+			return nil, errors.Wrapf(crud.ErrQueueFull, "%d of %d entries rejected", full, len(entries))
+		}
+
+		if len(pr.Errors) > 0 {
+			pr.Rejected = len(pr.Errors)
+			return pr, nil
+		}
+
+		return noContent{}, nil
+	}
+}
+
+func NewPushHandler(service crud.Service) http.Handler {
+	return http.Handler(pushEndpoint(service))
+}
+
+func NewPushHandlerOption() []http.HandlerOption {
+	return []http.HandlerOption{
+		http.HandlerWithDecoder(pushDecoder),
+		http.HandlerWithEncoder(http.NewDefaultJSONEncoder()),
+		http.HandlerWithErrorEncoder(crud.ErrorEncoder),
+	}
+}
+
+type queryRangeRequest struct {
+	query   *logQuery
+	start   time.Time
+	end     time.Time
+	limit   int
+	forward bool
+}
+
+// parseTime reads a query timestamp given as unix epoch in nanoseconds
+// or seconds, with an optional fraction, or as RFC3339
+func parseTime(value string) (time.Time, error) {
+	if ns, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if len(value) <= 10 {
+			return time.Unix(ns, 0), nil
+		}
+		return time.Unix(0, ns), nil
+	}
+
+	if sec, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(sec*float64(time.Second))), nil
+	}
+
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+func queryRangeDecoder(
+	ctx context.Context, req *net_http.Request,
+) (interface{}, error) {
+	params := req.URL.Query()
+
+	query, err := parseQuery(params.Get("query"))
+	if err != nil {
+		return nil, errors.Wrap(crud.ErrBadRequest, err.Error())
+	}
+
+	rq := queryRangeRequest{
+		query: query,
+		end:   time.Now(),
+		limit: defaultQueryLimit,
+	}
+
+	if end := params.Get("end"); end != "" {
+		if rq.end, err = parseTime(end); err != nil {
+			return nil, errors.Wrap(crud.ErrBadRequest, "invalid end time")
+		}
+	}
+
+	rq.start = rq.end.Add(-defaultQueryRange)
+	if start := params.Get("start"); start != "" {
+		if rq.start, err = parseTime(start); err != nil {
+			return nil, errors.Wrap(crud.ErrBadRequest, "invalid start time")
+		}
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		if rq.limit, err = strconv.Atoi(limit); err != nil || rq.limit <= 0 {
+			return nil, errors.Wrap(crud.ErrBadRequest, "invalid limit")
+		}
+		if rq.limit > maxQueryLimit {
+			rq.limit = maxQueryLimit
+		}
+	}
+
+	switch strings.ToLower(params.Get("direction")) {
+	case "", "backward":
+	case "forward":
+		rq.forward = true
+	default:
+		return nil, errors.Wrap(crud.ErrBadRequest, "direction must be forward or backward")
+	}
+
+	return rq, nil
+}
+
+type streamResult struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func queryRangeEndpoint(svc crud.Service) endpoint.Endpoint {
+	return func(ctx context.Context, req interface{}) (res interface{}, err error) {
+		rq, ok := req.(queryRangeRequest)
+		if !ok {
+			return nil, errors.Wrap(crud.ErrInternalServer, "failed to cast request")
+		}
+
+		matched, err := queryRange(ctx, svc, rq)
+		if err != nil {
+			return nil, err
+		}
+
+		var (
+			streams = map[string]*streamResult{}
+			result  = []*streamResult{}
+		)
+
+		for ix := range matched {
+			entry := &matched[ix]
+			labels := entryLabels(entry)
+			key := labelsKey(labels)
+
+			sr, ok := streams[key]
+			if !ok {
+				sr = &streamResult{Stream: labels}
+				streams[key] = sr
+				result = append(result, sr)
+			}
+
+			sr.Values = append(sr.Values, [2]string{
+				strconv.FormatInt(entry.Timestamp, 10),
+				entry.Message,
+			})
+		}
+
+		return map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"resultType": "streams",
+				"result":     result,
+				"stats":      map[string]interface{}{},
+			},
+		}, nil
+	}
+}
+
+// queryRange pages through the entries of the range the filter of the
+// query narrows, most recent first, and returns the limit first matches in
+// the direction of the query
+func queryRange(ctx context.Context, svc crud.Service, rq queryRangeRequest) ([]crud.LogEntry, error) {
+	filter := rq.query.filter()
+	filter["starttime"] = rq.start.UTC().Format(time.RFC3339Nano)
+	filter["endtime"] = rq.end.UTC().Format(time.RFC3339Nano)
+	filter["recent"] = strconv.Itoa(rq.limit)
+
+	matched := make([]crud.LogEntry, 0, rq.limit)
+	for {
+		logs, err := svc.List(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		for ix := range logs {
+			if rq.query.matches(&logs[ix]) {
+				matched = append(matched, logs[ix])
+			}
+		}
+
+		switch {
+		case !rq.forward && len(matched) >= rq.limit:
+			return matched[:rq.limit], nil
+		case rq.forward && len(matched) > rq.limit:
+			// a forward query keeps the oldest matches seen so far
+			matched = append(matched[:0], matched[len(matched)-rq.limit:]...)
+		}
+
+		if len(logs) < rq.limit {
+			break
+		}
+		filter["cursor"] = crud.EncodeCursor(&logs[len(logs)-1])
+	}
+
+	if rq.forward {
+		for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+			matched[i], matched[j] = matched[j], matched[i]
+		}
+	}
+	return matched, nil
+}
+
+// labelsKey is a canonical representation of a label set
+func labelsKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(name)
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(labels[name]))
+		sb.WriteByte(',')
+	}
+	return sb.String()
+}
+
+func NewQueryRangeHandler(service crud.Service) http.Handler {
+	return http.Handler(queryRangeEndpoint(service))
+}
+
+func NewQueryRangeHandlerOption() []http.HandlerOption {
+	return []http.HandlerOption{
+		http.HandlerWithDecoder(queryRangeDecoder),
+		http.HandlerWithEncoder(http.NewDefaultJSONEncoder()),
+		http.HandlerWithErrorEncoder(crud.ErrorEncoder),
+	}
+}
@@ -0,0 +1,143 @@
+package loki
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	net_http "net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/unbxd/go-base/kit/transport/http"
+)
+
+type queryRangeResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		Result []streamResult `json:"result"`
+	} `json:"data"`
+}
+
+// TestQueryRange pages through storage until limit lines pass the line
+// filter, which storage can't apply
+func TestQueryRange(t *testing.T) {
+	ctx := context.Background()
+
+	svc, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	// every other line of api is a healthcheck, web has the same lines
+	entries := []*crud.LogEntry{}
+	for i := 0; i < 30; i++ {
+		message := fmt.Sprintf("request %d", i)
+		if i%2 == 1 {
+			message = "healthcheck"
+		}
+
+		for _, app := range []string{"api", "web"} {
+			entries = append(entries, &crud.LogEntry{
+				Timestamp: stamp.Add(time.Duration(i) * time.Second).UnixNano(),
+				Level:     "info",
+				Message:   message,
+				Metadata:  map[string]interface{}{"app": app},
+			})
+		}
+	}
+	if _, err := svc.CreateMany(ctx, entries); err != nil {
+		t.Fatalf("CreateMany failed: %v", err)
+	}
+
+	server := httptest.NewServer(http.NewHandler(NewQueryRangeHandler(svc), NewQueryRangeHandlerOption()...))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		direction string
+		start     time.Time
+		want      []int
+	}{
+		{"backward", stamp, []int{28, 26, 24, 22, 20}},
+		{"forward", stamp, []int{0, 2, 4, 6, 8}},
+		// fewer matches than the limit within the range
+		{"backward", stamp.Add(25 * time.Second), []int{28, 26}},
+		{"forward", stamp.Add(25 * time.Second), []int{26, 28}},
+	} {
+		params := url.Values{
+			"query":     {`{app="api"} != "healthcheck"`},
+			"start":     {strconv.FormatInt(tc.start.UnixNano(), 10)},
+			"end":       {strconv.FormatInt(stamp.Add(time.Hour).UnixNano(), 10)},
+			"limit":     {"5"},
+			"direction": {tc.direction},
+		}
+
+		res, err := net_http.Get(server.URL + "?" + params.Encode())
+		if err != nil {
+			t.Fatalf("failed to query: %v", err)
+		}
+
+		var out queryRangeResponse
+		err = json.NewDecoder(res.Body).Decode(&out)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+
+		if res.StatusCode != net_http.StatusOK || len(out.Data.Result) != 1 {
+			t.Fatalf("query %s returned %d %+v", tc.direction, res.StatusCode, out)
+		}
+
+		result := out.Data.Result[0]
+		if !reflect.DeepEqual(result.Stream, map[string]string{"app": "api", "level": "info"}) {
+			t.Errorf("query %s returned stream %v", tc.direction, result.Stream)
+		}
+
+		got := []int{}
+		for _, value := range result.Values {
+			var i int
+			fmt.Sscanf(value[1], "request %d", &i)
+			got = append(got, i)
+
+			if value[0] != strconv.FormatInt(stamp.Add(time.Duration(i)*time.Second).UnixNano(), 10) {
+				t.Errorf("query %s returned %v", tc.direction, value)
+			}
+		}
+
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("query %s from %v returned lines %v, expected %v", tc.direction, tc.start, got, tc.want)
+		}
+	}
+}
+
+func TestQueryRangeErrors(t *testing.T) {
+	svc, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	server := httptest.NewServer(http.NewHandler(NewQueryRangeHandler(svc), NewQueryRangeHandlerOption()...))
+	defer server.Close()
+
+	for _, query := range []string{
+		"query=" + url.QueryEscape(`{app="api"`),
+		"query=" + url.QueryEscape(`rate({app="api"}[5m])`),
+		"query=" + url.QueryEscape(`{app="api"}`) + "&limit=0",
+		"query=" + url.QueryEscape(`{app="api"}`) + "&direction=sideways",
+		"query=" + url.QueryEscape(`{app="api"}`) + "&start=yesterday",
+	} {
+		res, err := net_http.Get(server.URL + "?" + query)
+		if err != nil {
+			t.Fatalf("failed to query: %v", err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != net_http.StatusBadRequest {
+			t.Errorf("query %s returned %d, expected 400", query, res.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package otlp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// OTLP/JSON follows the protobuf JSON mapping with a few exceptions:
+// trace and span ids are hex encoded, enums are integers and 64 bit
+// integers may be sent either as numbers or as strings.
+
+type jsonInt64 int64
+
+func (i *jsonInt64) UnmarshalJSON(b []byte) error {
+	b = bytes.Trim(b, `"`)
+	if len(b) == 0 || string(b) == "null" {
+		return nil
+	}
+
+	v, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		u, uerr := strconv.ParseUint(string(b), 10, 64)
+		if uerr != nil {
+			return errors.Wrap(err, "invalid integer")
+		}
+		v = int64(u)
+	}
+
+	*i = jsonInt64(v)
+	return nil
+}
+
+type (
+	jsonRequest struct {
+		ResourceLogs []jsonResourceLogs `json:"resourceLogs"`
+	}
+
+	jsonResourceLogs struct {
+		Resource struct {
+			Attributes []jsonKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []jsonScopeLogs `json:"scopeLogs"`
+	}
+
+	jsonScopeLogs struct {
+		Scope struct {
+			Name       string         `json:"name"`
+			Version    string         `json:"version"`
+			Attributes []jsonKeyValue `json:"attributes"`
+		} `json:"scope"`
+		LogRecords []jsonLogRecord `json:"logRecords"`
+	}
+
+	jsonLogRecord struct {
+		TimeUnixNano         jsonInt64      `json:"timeUnixNano"`
+		ObservedTimeUnixNano jsonInt64      `json:"observedTimeUnixNano"`
+		SeverityNumber       jsonInt64      `json:"severityNumber"`
+		SeverityText         string         `json:"severityText"`
+		Body                 *jsonAnyValue  `json:"body"`
+		Attributes           []jsonKeyValue `json:"attributes"`
+		TraceID              string         `json:"traceId"`
+		SpanID               string         `json:"spanId"`
+	}
+
+	jsonKeyValue struct {
+		Key   string        `json:"key"`
+		Value *jsonAnyValue `json:"value"`
+	}
+
+	jsonAnyValue struct {
+		StringValue *string    `json:"stringValue"`
+		BoolValue   *bool      `json:"boolValue"`
+		IntValue    *jsonInt64 `json:"intValue"`
+		DoubleValue *float64   `json:"doubleValue"`
+		ArrayValue  *struct {
+			Values []*jsonAnyValue `json:"values"`
+		} `json:"arrayValue"`
+		KvlistValue *struct {
+			Values []jsonKeyValue `json:"values"`
+		} `json:"kvlistValue"`
+		BytesValue *string `json:"bytesValue"`
+	}
+)
+
+func (v *jsonAnyValue) value() interface{} {
+	switch {
+	case v == nil:
+		return nil
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.ArrayValue != nil:
+		values := make([]interface{}, 0, len(v.ArrayValue.Values))
+		for _, av := range v.ArrayValue.Values {
+			values = append(values, av.value())
+		}
+		return values
+	case v.KvlistValue != nil:
+		return attributes(v.KvlistValue.Values)
+	case v.BytesValue != nil:
+		// bytes are base64 in the protobuf JSON mapping, kept as is
+		return *v.BytesValue
+	}
+	return nil
+}
+
+func attributes(kvs []jsonKeyValue) map[string]interface{} {
+	if len(kvs) == 0 {
+		return nil
+	}
+
+	attrs := make(map[string]interface{}, len(kvs))
+	for _, kv := range kvs {
+		attrs[kv.Key] = kv.Value.value()
+	}
+	return attrs
+}
+
+// decodeJSON decodes a JSON encoded ExportLogsServiceRequest
+func decodeJSON(b []byte) ([]resourceLogs, error) {
+	var req jsonRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, errors.Wrap(err, "failed to decode ExportLogsServiceRequest")
+	}
+
+	out := make([]resourceLogs, 0, len(req.ResourceLogs))
+	for _, jrl := range req.ResourceLogs {
+		rl := resourceLogs{attributes: attributes(jrl.Resource.Attributes)}
+
+		for _, jsl := range jrl.ScopeLogs {
+			sl := scopeLogs{
+				name:       jsl.Scope.Name,
+				version:    jsl.Scope.Version,
+				attributes: attributes(jsl.Scope.Attributes),
+			}
+
+			for _, jr := range jsl.LogRecords {
+				traceID, err := hex.DecodeString(jr.TraceID)
+				if err != nil {
+					return nil, errors.Wrap(err, "invalid traceId")
+				}
+
+				spanID, err := hex.DecodeString(jr.SpanID)
+				if err != nil {
+					return nil, errors.Wrap(err, "invalid spanId")
+				}
+
+				sl.records = append(sl.records, logRecord{
+					timeUnixNano:         uint64(jr.TimeUnixNano),
+					observedTimeUnixNano: uint64(jr.ObservedTimeUnixNano),
+					severityNumber:       int32(jr.SeverityNumber),
+					severityText:         jr.SeverityText,
+					body:                 jr.Body.value(),
+					attributes:           attributes(jr.Attributes),
+					traceID:              traceID,
+					spanID:               spanID,
+				})
+			}
+
+			rl.scopes = append(rl.scopes, sl)
+		}
+
+		out = append(out, rl)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,155 @@
+package otlp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+)
+
+// resourceLogs, scopeLogs and logRecord hold the parts of an OTLP
+// ExportLogsServiceRequest stored by klg, independent of the encoding
+// the request came in.
+type (
+	resourceLogs struct {
+		attributes map[string]interface{}
+		scopes     []scopeLogs
+	}
+
+	scopeLogs struct {
+		name       string
+		version    string
+		attributes map[string]interface{}
+		records    []logRecord
+	}
+
+	logRecord struct {
+		timeUnixNano         uint64
+		observedTimeUnixNano uint64
+		severityNumber       int32
+		severityText         string
+		body                 interface{}
+		attributes           map[string]interface{}
+		traceID              []byte
+		spanID               []byte
+	}
+)
+
+// level maps the OTLP SeverityNumber ranges onto klg levels, falling back
+// to the severity text when the number is unspecified
+func (r *logRecord) level() string {
+	switch {
+	case r.severityNumber >= 21:
+		return "fatal"
+	case r.severityNumber >= 17:
+		return "error"
+	case r.severityNumber >= 13:
+		return "warn"
+	case r.severityNumber >= 9:
+		return "info"
+	case r.severityNumber >= 1:
+		return "debug"
+	}
+
+	if text := strings.ToLower(r.severityText); crud.ValidLogLevels[text] {
+		return text
+	}
+
+	return "info"
+}
+
+// message renders the body of the record, non string bodies are
+// stored as their JSON representation
+func (r *logRecord) message() string {
+	switch body := r.body.(type) {
+	case nil:
+		return ""
+	case string:
+		return body
+	default:
+		bt, err := json.Marshal(body)
+		if err != nil {
+			return ""
+		}
+		return string(bt)
+	}
+}
+
+// timestamp prefers the time of the event, then the time it was
+// observed by the collector, then the time it reached klg
+func (r *logRecord) timestamp(now time.Time) time.Time {
+	switch {
+	case r.timeUnixNano > 0:
+		return time.Unix(0, int64(r.timeUnixNano))
+	case r.observedTimeUnixNano > 0:
+		return time.Unix(0, int64(r.observedTimeUnixNano))
+	default:
+		return now
+	}
+}
+
+// metadataKey makes attribute keys usable as metadata filters, dots
+// would otherwise be read as nested documents
+func metadataKey(key string) string {
+	return strings.ReplaceAll(strings.TrimLeft(key, "$"), ".", "_")
+}
+
+func flatten(dst map[string]interface{}, attributes map[string]interface{}) {
+	for k, v := range attributes {
+		if key := metadataKey(k); key != "" {
+			dst[key] = v
+		}
+	}
+}
+
+// entries flattens resource attributes, the instrumentation scope and
+// record attributes into the metadata of one entry per log record.
+// Record attributes take precedence over scope and resource ones.
+func entries(rls []resourceLogs, now time.Time) []*crud.LogEntry {
+	out := []*crud.LogEntry{}
+
+	for _, rl := range rls {
+		for _, sl := range rl.scopes {
+			for ix := range sl.records {
+				rec := &sl.records[ix]
+				md := map[string]interface{}{}
+
+				flatten(md, rl.attributes)
+				if svc, ok := rl.attributes["service.name"]; ok {
+					md["service"] = svc
+				}
+
+				if sl.name != "" {
+					md["scope_name"] = sl.name
+				}
+				if sl.version != "" {
+					md["scope_version"] = sl.version
+				}
+				flatten(md, sl.attributes)
+
+				flatten(md, rec.attributes)
+
+				if rec.severityNumber > 0 {
+					md["severity_number"] = rec.severityNumber
+				}
+				if rec.severityText != "" {
+					md["severity_text"] = rec.severityText
+				}
+				if len(rec.traceID) > 0 {
+					md["trace_id"] = hex.EncodeToString(rec.traceID)
+				}
+				if len(rec.spanID) > 0 {
+					md["span_id"] = hex.EncodeToString(rec.spanID)
+				}
+
+				entry := crud.NewLogEntry(rec.level(), rec.message(), md)
+				entry.Timestamp = rec.timestamp(now).UnixNano()
+				out = append(out, entry)
+			}
+		}
+	}
+
+	return out
+}
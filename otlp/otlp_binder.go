@@ -0,0 +1,30 @@
+package otlp
+
+import (
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/kit/transport/http"
+)
+
+// Binder exposes the OTLP/HTTP logs receiver, so that OpenTelemetry
+// collectors and SDKs can export logs to klg directly
+type Binder struct {
+	service crud.Service
+}
+
+func (b *Binder) Bind(ht *http.Transport, opts ...http.HandlerOption) {
+	// Post Call to export logs in OTLP protobuf or JSON encoding
+	ht.POST(
+		"/v1/logs",
+		NewExportHandler(b.service),
+		append(opts, NewExportHandlerOption()...)...,
+	)
+}
+
+func NewOTLPBinder(service crud.Service) (*Binder, error) {
+	if service == nil {
+		return nil, errors.New("service is required for otlp binder")
+	}
+
+	return &Binder{service}, nil
+}
@@ -0,0 +1,195 @@
+package otlp
+
+import (
+	"encoding/base64"
+	"math"
+
+	"github.com/bhuvankumar123/klg/utils/pb"
+	"github.com/pkg/errors"
+)
+
+// Field numbers below follow opentelemetry/proto/logs/v1/logs.proto and
+// opentelemetry/proto/common/v1/common.proto
+
+// decodeProtobuf decodes a protobuf encoded ExportLogsServiceRequest
+func decodeProtobuf(b []byte) ([]resourceLogs, error) {
+	out := []resourceLogs{}
+
+	err := pb.Fields(b, func(f *pb.Field) error {
+		if f.Number != 1 {
+			return nil
+		}
+
+		rl, err := decodeResourceLogs(f.Bytes)
+		if err != nil {
+			return err
+		}
+
+		out = append(out, rl)
+		return nil
+	})
+
+	return out, errors.Wrap(err, "failed to decode ExportLogsServiceRequest")
+}
+
+func decodeResourceLogs(b []byte) (rl resourceLogs, err error) {
+	err = pb.Fields(b, func(f *pb.Field) error {
+		switch f.Number {
+		case 1: // resource
+			return pb.Fields(f.Bytes, func(f *pb.Field) error {
+				if f.Number != 1 {
+					return nil
+				}
+				return decodeKeyValue(f.Bytes, &rl.attributes)
+			})
+		case 2, 1000: // scope_logs, deprecated instrumentation_library_logs
+			sl, err := decodeScopeLogs(f.Bytes)
+			if err != nil {
+				return err
+			}
+			rl.scopes = append(rl.scopes, sl)
+		}
+		return nil
+	})
+
+	return rl, err
+}
+
+func decodeScopeLogs(b []byte) (sl scopeLogs, err error) {
+	err = pb.Fields(b, func(f *pb.Field) error {
+		switch f.Number {
+		case 1: // scope
+			return pb.Fields(f.Bytes, func(f *pb.Field) error {
+				switch f.Number {
+				case 1:
+					sl.name = f.String()
+				case 2:
+					sl.version = f.String()
+				case 3:
+					return decodeKeyValue(f.Bytes, &sl.attributes)
+				}
+				return nil
+			})
+		case 2: // log_records
+			rec, err := decodeLogRecord(f.Bytes)
+			if err != nil {
+				return err
+			}
+			sl.records = append(sl.records, rec)
+		}
+		return nil
+	})
+
+	return sl, err
+}
+
+func decodeLogRecord(b []byte) (rec logRecord, err error) {
+	err = pb.Fields(b, func(f *pb.Field) error {
+		switch f.Number {
+		case 1:
+			rec.timeUnixNano = f.Fixed
+		case 11:
+			rec.observedTimeUnixNano = f.Fixed
+		case 2:
+			rec.severityNumber = int32(f.Varint)
+		case 3:
+			rec.severityText = f.String()
+		case 5:
+			body, err := decodeAnyValue(f.Bytes)
+			if err != nil {
+				return err
+			}
+			rec.body = body
+		case 6:
+			return decodeKeyValue(f.Bytes, &rec.attributes)
+		case 9:
+			rec.traceID = f.Bytes
+		case 10:
+			rec.spanID = f.Bytes
+		}
+		return nil
+	})
+
+	return rec, err
+}
+
+// decodeKeyValue decodes a single KeyValue into attrs
+func decodeKeyValue(b []byte, attrs *map[string]interface{}) error {
+	var (
+		key   string
+		value interface{}
+	)
+
+	err := pb.Fields(b, func(f *pb.Field) error {
+		switch f.Number {
+		case 1:
+			key = f.String()
+		case 2:
+			v, err := decodeAnyValue(f.Bytes)
+			if err != nil {
+				return err
+			}
+			value = v
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if *attrs == nil {
+		*attrs = map[string]interface{}{}
+	}
+
+	(*attrs)[key] = value
+	return nil
+}
+
+func decodeAnyValue(b []byte) (value interface{}, err error) {
+	err = pb.Fields(b, func(f *pb.Field) error {
+		switch f.Number {
+		case 1:
+			value = f.String()
+		case 2:
+			value = f.Varint != 0
+		case 3:
+			value = f.Int64()
+		case 4:
+			value = math.Float64frombits(f.Fixed)
+		case 5: // array_value
+			values := []interface{}{}
+			err := pb.Fields(f.Bytes, func(f *pb.Field) error {
+				if f.Number != 1 {
+					return nil
+				}
+				v, err := decodeAnyValue(f.Bytes)
+				if err != nil {
+					return err
+				}
+				values = append(values, v)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			value = values
+		case 6: // kvlist_value
+			kv := map[string]interface{}{}
+			err := pb.Fields(f.Bytes, func(f *pb.Field) error {
+				if f.Number != 1 {
+					return nil
+				}
+				return decodeKeyValue(f.Bytes, &kv)
+			})
+			if err != nil {
+				return err
+			}
+			value = kv
+		case 7:
+			value = base64.StdEncoding.EncodeToString(f.Bytes)
+		}
+		return nil
+	})
+
+	return value, err
+}
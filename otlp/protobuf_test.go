@@ -0,0 +1,209 @@
+package otlp
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// message and the field helpers build protobuf fixtures
+func message(fields ...[]byte) []byte {
+	var b []byte
+	for _, f := range fields {
+		b = append(b, f...)
+	}
+	return b
+}
+
+func embedded(num protowire.Number, fields ...[]byte) []byte {
+	b := protowire.AppendTag(nil, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message(fields...))
+}
+
+func str(num protowire.Number, s string) []byte {
+	b := protowire.AppendTag(nil, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func varint(num protowire.Number, v uint64) []byte {
+	b := protowire.AppendTag(nil, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func fixed64(num protowire.Number, v uint64) []byte {
+	b := protowire.AppendTag(nil, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+// attribute is a KeyValue with a string value
+func attribute(key, value string) []byte {
+	return embedded(1, str(1, key), embedded(2, str(1, value)))
+}
+
+// stamp is the time of the records of the fixtures
+var stamp = time.Date(2026, 1, 5, 10, 0, 0, 500, time.UTC)
+
+// exportProtobuf is an ExportLogsServiceRequest of two records, one with
+// a string body and every kind of attribute value, one with a kvlist body
+// and only an observed time
+func exportProtobuf() []byte {
+	return message(embedded(1,
+		embedded(1, attribute("service.name", "api"), attribute("host.name", "web-1")),
+		embedded(2,
+			embedded(1, str(1, "app.logger"), str(2, "1.2.0")),
+			embedded(2,
+				fixed64(1, uint64(stamp.UnixNano())),
+				varint(2, 17),
+				str(3, "ERROR"),
+				embedded(5, str(1, "request failed")),
+				embedded(6, str(1, "http.status"), embedded(2, varint(3, 502))),
+				embedded(6, str(1, "retry"), embedded(2, varint(2, 1))),
+				embedded(6, str(1, "ratio"), embedded(2, fixed64(4, math.Float64bits(0.5)))),
+				embedded(6, str(1, "tags"), embedded(2, embedded(5,
+					embedded(1, str(1, "a")),
+					embedded(1, varint(3, 2)),
+				))),
+				embedded(6, str(1, "raw"), embedded(2, str(7, "\x01\x02"))),
+				str(9, "\x5b\x8b\xa0\x1d\xcd\x65\x00\x00\x5b\x8b\xa0\x1d\xcd\x65\x00\x01"),
+				str(10, "\x01\x02\x03\x04\x05\x06\x07\x08"),
+				// unknown fields are skipped
+				varint(99, 1),
+			),
+			embedded(2,
+				fixed64(11, uint64(stamp.UnixNano())),
+				str(3, "Warn"),
+				embedded(5, embedded(6, embedded(1, str(1, "user"), embedded(2, str(1, "jane"))))),
+			),
+		),
+	))
+}
+
+// exportJSON is exportProtobuf in the OTLP/JSON encoding
+const exportJSON = `{"resourceLogs":[{
+	"resource":{"attributes":[
+		{"key":"service.name","value":{"stringValue":"api"}},
+		{"key":"host.name","value":{"stringValue":"web-1"}}
+	]},
+	"scopeLogs":[{
+		"scope":{"name":"app.logger","version":"1.2.0"},
+		"logRecords":[{
+			"timeUnixNano":"1767607200000000500",
+			"severityNumber":17,
+			"severityText":"ERROR",
+			"body":{"stringValue":"request failed"},
+			"attributes":[
+				{"key":"http.status","value":{"intValue":"502"}},
+				{"key":"retry","value":{"boolValue":true}},
+				{"key":"ratio","value":{"doubleValue":0.5}},
+				{"key":"tags","value":{"arrayValue":{"values":[{"stringValue":"a"},{"intValue":2}]}}},
+				{"key":"raw","value":{"bytesValue":"AQI="}}
+			],
+			"traceId":"5b8ba01dcd6500005b8ba01dcd650001",
+			"spanId":"0102030405060708"
+		},{
+			"observedTimeUnixNano":1767607200000000500,
+			"severityText":"Warn",
+			"body":{"kvlistValue":{"values":[{"key":"user","value":{"stringValue":"jane"}}]}}
+		}]
+	}]
+}]}`
+
+func TestDecode(t *testing.T) {
+	resource := map[string]interface{}{
+		"service_name":  "api",
+		"service":       "api",
+		"host_name":     "web-1",
+		"scope_name":    "app.logger",
+		"scope_version": "1.2.0",
+	}
+
+	want := []struct {
+		level    string
+		message  string
+		metadata map[string]interface{}
+	}{
+		{"error", "request failed", map[string]interface{}{
+			"http_status":     int64(502),
+			"retry":           true,
+			"ratio":           0.5,
+			"tags":            []interface{}{"a", int64(2)},
+			"raw":             "AQI=",
+			"severity_number": int32(17),
+			"severity_text":   "ERROR",
+			"trace_id":        "5b8ba01dcd6500005b8ba01dcd650001",
+			"span_id":         "0102030405060708",
+		}},
+		{"warn", `{"user":"jane"}`, map[string]interface{}{
+			"severity_text": "Warn",
+		}},
+	}
+
+	for _, tc := range []struct {
+		name   string
+		decode func() ([]resourceLogs, error)
+	}{
+		{"protobuf", func() ([]resourceLogs, error) { return decodeProtobuf(exportProtobuf()) }},
+		{"json", func() ([]resourceLogs, error) { return decodeJSON([]byte(exportJSON)) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rls, err := tc.decode()
+			if err != nil {
+				t.Fatalf("decode failed: %v", err)
+			}
+
+			entries := entries(rls, time.Now())
+			if len(entries) != len(want) {
+				t.Fatalf("decode returned %d entries, expected %d", len(entries), len(want))
+			}
+
+			for ix, entry := range entries {
+				md := map[string]interface{}{}
+				for k, v := range resource {
+					md[k] = v
+				}
+				for k, v := range want[ix].metadata {
+					md[k] = v
+				}
+
+				if entry.Level != want[ix].level || entry.Message != want[ix].message ||
+					entry.Timestamp != stamp.UnixNano() {
+					t.Errorf("entry %d is %s %q at %d", ix, entry.Level, entry.Message, entry.Timestamp)
+				}
+
+				if !reflect.DeepEqual(entry.Metadata, md) {
+					t.Errorf("entry %d has metadata %v, expected %v", ix, entry.Metadata, md)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	valid := exportProtobuf()
+
+	for _, tc := range []struct {
+		name string
+		raw  []byte
+	}{
+		{"truncated", valid[:len(valid)-3]},
+		{"invalid record", embedded(1, embedded(2, embedded(2, []byte{0x80})))},
+		{"invalid attribute", embedded(1, embedded(1, embedded(1, embedded(2, []byte{0x0a, 0x05}))))},
+	} {
+		if _, err := decodeProtobuf(tc.raw); err == nil {
+			t.Errorf("decodeProtobuf of %s succeeded", tc.name)
+		}
+	}
+
+	for _, raw := range []string{
+		`{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"traceId":"xyz"}]}]}]}`,
+		`{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"timeUnixNano":"soon"}]}]}]}`,
+		`{"resourceLogs":`,
+	} {
+		if _, err := decodeJSON([]byte(raw)); err == nil {
+			t.Errorf("decodeJSON of %s succeeded", raw)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package otlp
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	net_http "net/http"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	utils_err "github.com/bhuvankumar123/klg/utils/err"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/kit/transport/http"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	errUnsupportedMediaType = errors.New("unsupported media type")
+	errEmptyBody            = errors.New("log record without a body")
+)
+
+const (
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeJSON     = "application/json"
+
+	// maxBodySize caps the size of an export request after decompression
+	maxBodySize = 32 << 20
+)
+
+type exportRequest struct {
+	contentType string
+	logs        []resourceLogs
+}
+
+// exportResponse is an ExportLogsServiceResponse, encoded in the same
+// content type as the request
+type exportResponse struct {
+	contentType string
+	rejected    int64
+	message     string
+}
+
+// reject counts a rejected record, the message is the reason of the
+// first one
+func (r *exportResponse) reject(err error) {
+	r.rejected++
+	if r.message == "" {
+		r.message = err.Error()
+	}
+}
+
+func readBody(req *net_http.Request) ([]byte, error) {
+	var body io.Reader = req.Body
+
+	switch req.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, errors.Wrap(crud.ErrBadRequest, "invalid gzip body")
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		return nil, errors.Wrap(errUnsupportedMediaType, "unsupported content encoding")
+	}
+
+	bt, err := io.ReadAll(io.LimitReader(body, maxBodySize+1))
+	if err != nil {
+		return nil, errors.Wrap(crud.ErrBadRequest, "failed to read body")
+	}
+
+	if len(bt) > maxBodySize {
+		return nil, errors.Wrap(crud.ErrBadRequest, "request body too large")
+	}
+
+	return bt, nil
+}
+
+func exportDecoder(
+	ctx context.Context, req *net_http.Request,
+) (interface{}, error) {
+	contentType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, errors.Wrap(errUnsupportedMediaType, "content type missing")
+	}
+
+	if contentType != contentTypeProtobuf && contentType != contentTypeJSON {
+		return nil, errors.Wrapf(errUnsupportedMediaType, "content type %s", contentType)
+	}
+
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var logs []resourceLogs
+	if contentType == contentTypeProtobuf {
+		logs, err = decodeProtobuf(body)
+	} else {
+		logs, err = decodeJSON(body)
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(crud.ErrBadRequest, err.Error())
+	}
+
+	return exportRequest{contentType, logs}, nil
+}
+
+func exportEndpoint(svc crud.Service) endpoint.Endpoint {
+	return func(ctx context.Context, req interface{}) (res interface{}, err error) {
+		rq, ok := req.(exportRequest)
+		if !ok {
+			return nil, errors.Wrap(crud.ErrInternalServer, "failed to cast request")
+		}
+
+		var (
+			response = exportResponse{contentType: rq.contentType}
+			stored   = []*crud.LogEntry{}
+		)
+
+		// records without a body have no message to store, they are
+		// reported rather than failing the whole request
+		for _, entry := range entries(rq.logs, time.Now()) {
+			if entry.Message == "" {
+				response.reject(errEmptyBody)
+				continue
+			}
+			stored = append(stored, entry)
+		}
+
+		if len(stored) == 0 {
+			return response, nil
+		}
+
+		errs, err := svc.CreateMany(ctx, stored)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, er := range errs {
+			// a resent record was stored the first time
+			switch errors.Cause(er) {
+			case nil, crud.ErrQueued, crud.ErrDuplicate:
+				continue
+			}
+			response.reject(er)
+		}
+
+		return response, nil
+	}
+}
+
+func exportEncoder(
+	ctx context.Context, w net_http.ResponseWriter, res interface{},
+) error {
+	rs, ok := res.(exportResponse)
+	if !ok {
+		return errors.Wrap(crud.ErrInternalServer, "failed to cast response")
+	}
+
+	var body []byte
+
+	if rs.contentType == contentTypeProtobuf {
+		// ExportLogsServiceResponse { ExportLogsPartialSuccess partial_success = 1; }
+		if rs.rejected > 0 {
+			var partial []byte
+			partial = protowire.AppendTag(partial, 1, protowire.VarintType)
+			partial = protowire.AppendVarint(partial, uint64(rs.rejected))
+			partial = protowire.AppendTag(partial, 2, protowire.BytesType)
+			partial = protowire.AppendString(partial, rs.message)
+
+			body = protowire.AppendTag(body, 1, protowire.BytesType)
+			body = protowire.AppendBytes(body, partial)
+		}
+	} else {
+		response := map[string]interface{}{}
+		if rs.rejected > 0 {
+			response["partialSuccess"] = map[string]interface{}{
+				"rejectedLogRecords": rs.rejected,
+				"errorMessage":       rs.message,
+			}
+		}
+
+		bt, err := json.Marshal(response)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode response")
+		}
+		body = bt
+	}
+
+	w.Header().Set("Content-Type", rs.contentType)
+	w.WriteHeader(net_http.StatusOK)
+	_, err := w.Write(body)
+	return err
+}
+
+func NewExportHandler(service crud.Service) http.Handler {
+	return http.Handler(exportEndpoint(service))
+}
+
+func NewExportHandlerOption() []http.HandlerOption {
+	return []http.HandlerOption{
+		http.HandlerWithDecoder(exportDecoder),
+		http.HandlerWithEncoder(exportEncoder),
+		http.HandlerWithErrorEncoder(errEncoder),
+	}
+}
+
+// errEncoder adds unsupported media types to the errors of crud
+func errEncoder(
+	ctx context.Context,
+	err error,
+	w net_http.ResponseWriter,
+) {
+	if errors.Cause(err) == errUnsupportedMediaType {
+		crud.WriteError(
+			ctx,
+			utils_err.NewError(err, net_http.StatusUnsupportedMediaType, "unsupported media type"),
+			w,
+		)
+		return
+	}
+
+	crud.ErrorEncoder(ctx, err, w)
+}
@@ -0,0 +1,178 @@
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	net_http "net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/bhuvankumar123/klg/utils/pb"
+	"github.com/unbxd/go-base/kit/transport/http"
+)
+
+func newExportServer(t *testing.T) (crud.Service, *httptest.Server) {
+	svc, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	server := httptest.NewServer(http.NewHandler(NewExportHandler(svc), NewExportHandlerOption()...))
+	t.Cleanup(server.Close)
+	return svc, server
+}
+
+func export(t *testing.T, url, contentType, encoding string, body []byte) (*net_http.Response, []byte) {
+	req, err := net_http.NewRequest(net_http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Encoding", encoding)
+
+	res, err := net_http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+	defer res.Body.Close()
+
+	bt, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	return res, bt
+}
+
+func TestExport(t *testing.T) {
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(exportProtobuf())
+	gw.Close()
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		encoding    string
+		body        []byte
+	}{
+		{"protobuf", contentTypeProtobuf, "", exportProtobuf()},
+		{"gzip protobuf", contentTypeProtobuf, "gzip", gz.Bytes()},
+		{"json", contentTypeJSON + "; charset=utf-8", "identity", []byte(exportJSON)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, server := newExportServer(t)
+
+			res, body := export(t, server.URL, tc.contentType, tc.encoding, tc.body)
+			if res.StatusCode != net_http.StatusOK {
+				t.Fatalf("export returned %d %s", res.StatusCode, body)
+			}
+
+			// a full success is an empty ExportLogsServiceResponse
+			if tc.contentType == contentTypeProtobuf && len(body) != 0 ||
+				tc.contentType != contentTypeProtobuf && string(body) != "{}" {
+				t.Errorf("export answered %q", body)
+			}
+
+			entries, err := svc.List(context.Background(), map[string]interface{}{"metadata.service": "api"})
+			if err != nil {
+				t.Fatalf("List failed: %v", err)
+			}
+
+			if len(entries) != 2 {
+				t.Errorf("export stored %d entries, expected 2", len(entries))
+			}
+		})
+	}
+}
+
+func TestExportPartialSuccess(t *testing.T) {
+	svc, server := newExportServer(t)
+
+	// the second record has no body
+	request := exportProtobuf()
+	request = append(request, embedded(1, embedded(2, embedded(2, varint(2, 9))))...)
+
+	res, body := export(t, server.URL, contentTypeProtobuf, "", request)
+	if res.StatusCode != net_http.StatusOK {
+		t.Fatalf("export returned %d %s", res.StatusCode, body)
+	}
+
+	var (
+		rejected uint64
+		message  string
+	)
+	err := pb.Fields(body, func(f *pb.Field) error {
+		return pb.Fields(f.Bytes, func(f *pb.Field) error {
+			switch f.Number {
+			case 1:
+				rejected = f.Varint
+			case 2:
+				message = f.String()
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if rejected != 1 || message != errEmptyBody.Error() {
+		t.Errorf("export rejected %d records with %q", rejected, message)
+	}
+
+	entries, err := svc.List(context.Background(), map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+
+	if len(entries) != 2 {
+		t.Errorf("export stored %d entries, expected the 2 with a body", len(entries))
+	}
+
+	// the JSON response has the same partial success
+	res, body = export(t, server.URL, contentTypeJSON, "",
+		[]byte(`{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"severityNumber":9},{"body":{"stringValue":"ok"}}]}]}]}`))
+
+	var out struct {
+		PartialSuccess struct {
+			RejectedLogRecords int64  `json:"rejectedLogRecords"`
+			ErrorMessage       string `json:"errorMessage"`
+		} `json:"partialSuccess"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		t.Fatalf("failed to decode response %s: %v", body, err)
+	}
+
+	if res.StatusCode != net_http.StatusOK || out.PartialSuccess.RejectedLogRecords != 1 ||
+		out.PartialSuccess.ErrorMessage != errEmptyBody.Error() {
+		t.Errorf("export returned %d %s", res.StatusCode, body)
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	_, server := newExportServer(t)
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		encoding    string
+		body        []byte
+		status      int
+	}{
+		{"no content type", "", "", exportProtobuf(), net_http.StatusUnsupportedMediaType},
+		{"text", "text/plain", "", exportProtobuf(), net_http.StatusUnsupportedMediaType},
+		{"zstd", contentTypeProtobuf, "zstd", exportProtobuf(), net_http.StatusUnsupportedMediaType},
+		{"invalid gzip", contentTypeProtobuf, "gzip", exportProtobuf(), net_http.StatusBadRequest},
+		{"invalid protobuf", contentTypeProtobuf, "", []byte{0x0a, 0x05}, net_http.StatusBadRequest},
+		{"invalid json", contentTypeJSON, "", []byte(`{"resourceLogs":`), net_http.StatusBadRequest},
+	} {
+		if res, body := export(t, server.URL, tc.contentType, tc.encoding, tc.body); res.StatusCode != tc.status {
+			t.Errorf("export with %s returned %d %s, expected %d", tc.name, res.StatusCode, body, tc.status)
+		}
+	}
+}
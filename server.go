@@ -0,0 +1,22 @@
+package app
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Server is a listener that runs alongside the http transport, for example
+// a syslog receiver. Open blocks until the server stops, and returns nil
+// once it has been stopped by Close.
+type Server interface {
+	Open() error
+	Close() error
+}
+
+func WithServer(server Server) Option {
+	fmt.Println(">> Initialising -- ", reflect.TypeOf(server))
+	return func(a *App) (err error) {
+		a.servers = append(a.servers, server)
+		return err
+	}
+}
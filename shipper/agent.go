@@ -0,0 +1,212 @@
+package shipper
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+// Agent follows the files matching a set of globs and ships their lines
+// to a klg server. Offsets are saved only once a batch is accepted, so
+// lines are shipped at least once across restarts.
+type Agent struct {
+	logger    log.Logger
+	patterns  []string
+	client    *client
+	state     *state
+	batchSize int
+	poll      time.Duration
+	fromStart bool
+
+	followers map[string]*follower
+	scanned   bool
+}
+
+// Run ships lines until the context is cancelled
+func (a *Agent) Run(ctx context.Context) error {
+	defer a.close()
+
+	for {
+		if err := a.scan(); err != nil {
+			return err
+		}
+
+		shipped, err := a.ship(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		// keep going while the files have more to read
+		if shipped >= a.batchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(a.poll):
+		}
+	}
+}
+
+// scan starts following files which newly match the globs. Files which
+// exist on the first scan and have no saved position start at their end
+// unless the agent ships from the start.
+func (a *Agent) scan() error {
+	seekEnd := !a.scanned && !a.fromStart
+	a.scanned = true
+
+	for _, pattern := range a.patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return errors.Wrap(err, "invalid glob "+pattern)
+		}
+
+		sort.Strings(paths)
+		for _, path := range paths {
+			if _, ok := a.followers[path]; ok {
+				continue
+			}
+
+			if fi, err := os.Stat(path); err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+
+			f, err := openFollower(path, a.state.Positions[path], seekEnd)
+			if err != nil {
+				a.logger.Error("failed to open file", log.String("path", path), log.Error(err))
+				continue
+			}
+
+			a.logger.Info("following file", log.String("path", path))
+			a.followers[path] = f
+		}
+	}
+
+	return nil
+}
+
+// ship reads a batch from the followed files, ships it and saves the
+// new positions. It returns the number of lines shipped.
+func (a *Agent) ship(ctx context.Context) (int, error) {
+	var (
+		batch = []line{}
+		paths = make([]string, 0, len(a.followers))
+	)
+
+	for path := range a.followers {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if len(batch) >= a.batchSize {
+			break
+		}
+
+		f := a.followers[path]
+		lines, err := f.read(a.batchSize - len(batch))
+		if err != nil {
+			a.logger.Error("failed to read file", log.String("path", path), log.Error(err))
+		}
+		batch = append(batch, lines...)
+	}
+
+	if len(batch) > 0 {
+		if err := a.client.ship(ctx, batch); err != nil {
+			return 0, err
+		}
+	}
+
+	changed := false
+	for _, path := range paths {
+		f := a.followers[path]
+
+		// removed files are dropped once their last line is shipped
+		if f.removed && len(f.partial) == 0 {
+			a.logger.Info("stopped following file", log.String("path", path))
+			f.close()
+			delete(a.followers, path)
+			delete(a.state.Positions, path)
+			changed = true
+			continue
+		}
+
+		if pos := f.position(); a.state.Positions[path] != pos {
+			a.state.Positions[path] = pos
+			changed = true
+		}
+	}
+
+	if changed {
+		if err := a.state.save(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(batch), nil
+}
+
+func (a *Agent) close() {
+	for _, f := range a.followers {
+		f.close()
+	}
+}
+
+// NewAgent returns an agent shipping the files matching patterns to the
+// klg server at the given base url, e.g. http://localhost:6060. Lines
+// are stored with the given level and shipped in batches of batchSize.
+func NewAgent(
+	logger log.Logger,
+	server string,
+	patterns []string,
+	statePath string,
+	level string,
+	batchSize int,
+	poll time.Duration,
+	fromStart bool,
+) (*Agent, error) {
+	if server == "" {
+		return nil, errors.New("server is required")
+	}
+
+	if len(patterns) == 0 {
+		return nil, errors.New("at least one file glob is required")
+	}
+
+	if batchSize <= 0 || poll <= 0 {
+		return nil, errors.New("batch size and poll interval must be positive")
+	}
+
+	lvl := crud.NormalizeLogLevel(level)
+	if lvl == "" {
+		return nil, crud.ErrInvalidLevel
+	}
+
+	st, err := loadState(statePath)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+
+	return &Agent{
+		logger:    logger,
+		patterns:  patterns,
+		client:    newClient(logger, server, lvl, host),
+		state:     st,
+		batchSize: batchSize,
+		poll:      poll,
+		fromStart: fromStart,
+		followers: map[string]*follower{},
+	}, nil
+}
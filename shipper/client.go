@@ -0,0 +1,211 @@
+package shipper
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+const (
+	bulkPath = "/v1.0/logs/_bulk"
+
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// bulkLine is the shape of a line accepted by the bulk endpoint
+type bulkLine struct {
+	Level     string                 `json:"level"`
+	Message   string                 `json:"message"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	Timestamp string                 `json:"timestamp,omitempty"`
+	EventID   string                 `json:"event_id,omitempty"`
+}
+
+type bulkResponse struct {
+	Accepted   int `json:"accepted"`
+	Duplicates int `json:"duplicates"`
+	Rejected   int `json:"rejected"`
+	Results    []struct {
+		Line   int    `json:"line"`
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	} `json:"results"`
+}
+
+// client ships batches of lines to the bulk endpoint of a klg server
+type client struct {
+	logger log.Logger
+	url    string
+	level  string
+	host   string
+	http   *http.Client
+}
+
+// retryable marks failures which may succeed when the batch is resent
+type retryable struct{ error }
+
+// ship sends a batch, retrying with exponential backoff while the server
+// is unreachable, overloaded or failing. Batches the server refuses as
+// malformed are logged and dropped, resending them can't succeed.
+func (c *client) ship(ctx context.Context, lines []line) error {
+	body, err := c.encode(lines)
+	if err != nil {
+		return err
+	}
+
+	backoff := minBackoff
+	for {
+		err := c.send(ctx, body)
+		if err == nil {
+			return nil
+		}
+
+		var retry retryable
+		if !errors.As(err, &retry) {
+			c.logger.Error(
+				"dropping batch refused by server",
+				log.Int("lines", len(lines)),
+				log.Error(err),
+			)
+			return nil
+		}
+
+		// jitter keeps agents restarted together from retrying together
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		c.logger.Error(
+			"failed to ship batch, retrying",
+			log.Int("lines", len(lines)),
+			log.String("retry_in", wait.String()),
+			log.Error(err),
+		)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (c *client) encode(lines []line) ([]byte, error) {
+	var (
+		buf bytes.Buffer
+		enc = json.NewEncoder(&buf)
+	)
+
+	for _, ln := range lines {
+		err := enc.Encode(bulkLine{
+			Level:   c.level,
+			Message: ln.text,
+			Metadata: map[string]interface{}{
+				"file": ln.path,
+				"host": c.host,
+			},
+			Timestamp: ln.read.UTC().Format(time.RFC3339Nano),
+			EventID:   c.eventID(ln),
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to encode batch")
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// eventID identifies a line, so that the server drops it when a retry
+// resends a batch it already stored. The read time keeps a line written
+// at the offset of an earlier one, after truncation, from matching it.
+func (c *client) eventID(ln line) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf(
+		"%s:%s:%d:%d:%d", c.host, ln.path, ln.inode, ln.offset, ln.read.UnixNano(),
+	)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *client) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return retryable{err}
+	}
+	defer res.Body.Close()
+
+	bt, err := io.ReadAll(io.LimitReader(res.Body, 8<<20))
+	if err != nil {
+		return retryable{err}
+	}
+
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return retryable{fmt.Errorf("server responded %d: %s", res.StatusCode, snippet(bt))}
+	case res.StatusCode >= 300:
+		return fmt.Errorf("server responded %d: %s", res.StatusCode, snippet(bt))
+	}
+
+	var result bulkResponse
+	if err := json.Unmarshal(bt, &result); err != nil {
+		return retryable{errors.Wrap(err, "failed to decode bulk response")}
+	}
+
+	if result.Rejected > 0 {
+		var reason string
+		for _, r := range result.Results {
+			if r.Status == "rejected" {
+				reason = r.Error
+				break
+			}
+		}
+
+		c.logger.Error(
+			"server rejected lines",
+			log.Int("rejected", result.Rejected),
+			log.String("reason", reason),
+		)
+	}
+
+	// a retry of a batch the server stored before it failed to respond
+	if result.Duplicates > 0 {
+		c.logger.Info("server dropped resent lines", log.Int("duplicates", result.Duplicates))
+	}
+
+	return nil
+}
+
+func snippet(bt []byte) string {
+	s := strings.TrimSpace(string(bt))
+	if len(s) > 256 {
+		s = s[:256] + "..."
+	}
+	return s
+}
+
+func newClient(logger log.Logger, server, level, host string) *client {
+	return &client{
+		logger: logger,
+		url:    strings.TrimRight(server, "/") + bulkPath,
+		level:  level,
+		host:   host,
+		http:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
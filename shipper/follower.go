@@ -0,0 +1,231 @@
+package shipper
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	// readSize is the size of a single read from a followed file
+	readSize = 64 * 1024
+
+	// maxLineSize caps a shipped line, longer lines are split, so that
+	// they stay under the line limit of the bulk endpoint
+	maxLineSize = 512 * 1024
+)
+
+// line is a single line read from a followed file
+type line struct {
+	path string
+	text string
+
+	// read is when the line was read, it is shipped as its timestamp so
+	// that retries and restarts keep the time of the event
+	read time.Time
+
+	// offset is where the line starts in the file of inode, it makes
+	// the event ID of the line along with path and read
+	inode  uint64
+	offset int64
+}
+
+// follower reads complete lines from a file, following it across
+// rotation, a new file created at the path, and truncation
+type follower struct {
+	path    string
+	file    *os.File
+	inode   uint64
+	offset  int64  // end of the last complete line read
+	partial []byte // bytes read after offset, not yet terminated
+	rotated bool   // a new file exists at path, drain this one first
+	removed bool   // the file is gone and has been drained
+}
+
+func openFollower(path string, pos position, seekEnd bool) (*follower, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	f := &follower{path: path, file: file, inode: inode(fi)}
+
+	switch {
+	case pos.Inode == f.inode && pos.Offset <= fi.Size():
+		// same file as the saved state, continue where shipping stopped
+		f.offset = pos.Offset
+	case pos.Inode == 0 && seekEnd:
+		f.offset = fi.Size()
+	}
+
+	return f, nil
+}
+
+func (f *follower) position() position {
+	return position{Inode: f.inode, Offset: f.offset}
+}
+
+func (f *follower) close() error {
+	return f.file.Close()
+}
+
+// read returns up to max complete lines. Once the end of the file is
+// reached, rotation and truncation are checked so that the next read
+// continues with the right file.
+func (f *follower) read(max int) ([]line, error) {
+	var (
+		lines = []line{}
+		buf   = make([]byte, readSize)
+	)
+
+	for {
+		// lines still buffered are returned before reading any further
+		if lines = f.split(lines, max); len(lines) >= max {
+			return lines, nil
+		}
+
+		n, err := f.file.ReadAt(buf, f.offset+int64(len(f.partial)))
+		if n > 0 {
+			f.partial = append(f.partial, buf[:n]...)
+		}
+
+		if err == nil {
+			continue
+		}
+
+		if err != io.EOF {
+			return lines, err
+		}
+
+		if n > 0 {
+			continue
+		}
+
+		// nothing more to read from this file
+		if f.rotated || f.removed {
+			lines = f.flush(lines)
+			return lines, f.reopen()
+		}
+
+		if err := f.check(); err != nil {
+			return lines, err
+		}
+
+		if !f.rotated && !f.removed {
+			return lines, nil
+		}
+	}
+}
+
+// split moves complete lines out of the partial buffer until lines holds
+// max of them
+func (f *follower) split(lines []line, max int) []line {
+	for len(lines) < max {
+		ix := bytes.IndexByte(f.partial, '\n')
+		if ix < 0 {
+			if len(f.partial) >= maxLineSize {
+				lines = f.emit(lines, maxLineSize, maxLineSize)
+				continue
+			}
+			return lines
+		}
+
+		size := ix + 1
+		if ix > maxLineSize {
+			lines = f.emit(lines, maxLineSize, maxLineSize)
+			continue
+		}
+
+		lines = f.emit(lines, ix, size)
+	}
+	return lines
+}
+
+// emit ships the first n bytes of the partial buffer as a line and
+// consumes size bytes, blank lines are skipped
+func (f *follower) emit(lines []line, n, size int) []line {
+	text := bytes.TrimRight(f.partial[:n], "\r")
+	if len(bytes.TrimSpace(text)) > 0 {
+		lines = append(lines, line{
+			path:   f.path,
+			text:   string(text),
+			read:   time.Now(),
+			inode:  f.inode,
+			offset: f.offset,
+		})
+	}
+
+	f.partial = f.partial[size:]
+	f.offset += int64(size)
+	return lines
+}
+
+// flush ships an unterminated last line of a file which won't grow anymore
+func (f *follower) flush(lines []line) []line {
+	if len(f.partial) == 0 {
+		return lines
+	}
+	return f.emit(lines, len(f.partial), len(f.partial))
+}
+
+// check compares the open file with the one at path
+func (f *follower) check() error {
+	fi, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		f.removed = true
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if ino := inode(fi); ino != f.inode {
+		f.rotated = true
+		return nil
+	}
+
+	if fi.Size() < f.offset+int64(len(f.partial)) {
+		// truncated in place, e.g. copytruncate
+		f.offset = 0
+		f.partial = nil
+	}
+
+	return nil
+}
+
+// reopen switches to the file which replaced a rotated one
+func (f *follower) reopen() error {
+	if f.removed {
+		return nil
+	}
+
+	file, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		// rotated away and not recreated yet
+		f.rotated, f.removed = false, true
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file.Close()
+	f.file, f.inode = file, inode(fi)
+	f.offset, f.partial, f.rotated = 0, nil, false
+	return nil
+}
@@ -0,0 +1,207 @@
+//go:build unix
+
+package shipper
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func write(t *testing.T, path, text string, flag int) {
+	file, err := os.OpenFile(path, flag|os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(text); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+// texts reads up to max lines and returns their text
+func texts(t *testing.T, f *follower, max int) []string {
+	lines, err := f.read(max)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	out := []string{}
+	for _, l := range lines {
+		out = append(out, l.text)
+	}
+	return out
+}
+
+func expect(t *testing.T, got []string, want ...string) {
+	t.Helper()
+
+	if len(want) == 0 {
+		want = []string{}
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("read returned %q, expected %q", got, want)
+	}
+}
+
+func TestFollowerBatchSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	write(t, path, "one\ntwo\n\nthree\nfour\nfive", os.O_TRUNC)
+
+	f, err := openFollower(path, position{}, false)
+	if err != nil {
+		t.Fatalf("openFollower failed: %v", err)
+	}
+	defer f.close()
+
+	expect(t, texts(t, f, 2), "one", "two")
+	if f.offset != int64(len("one\ntwo\n")) {
+		t.Errorf("follower is at %d after two lines", f.offset)
+	}
+
+	expect(t, texts(t, f, 2), "three", "four")
+
+	// the last line is kept until it is terminated
+	expect(t, texts(t, f, 2))
+	write(t, path, "\n", os.O_APPEND)
+	expect(t, texts(t, f, 2), "five")
+}
+
+func TestFollowerRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	write(t, path, "one\n", os.O_TRUNC)
+
+	f, err := openFollower(path, position{}, false)
+	if err != nil {
+		t.Fatalf("openFollower failed: %v", err)
+	}
+	defer f.close()
+
+	expect(t, texts(t, f, 10), "one")
+	first := f.inode
+
+	// the rotated file gets a last line, unterminated, before a new file
+	// is created at the path
+	write(t, path, "two", os.O_APPEND)
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	write(t, path, "three\n", os.O_TRUNC)
+
+	// the rotation is noticed at the end of the rotated file, which is
+	// drained before the new file is read
+	expect(t, texts(t, f, 10), "two")
+
+	if f.inode == first || f.offset != 0 {
+		t.Fatalf("follower is at inode %d offset %d after rotation", f.inode, f.offset)
+	}
+
+	expect(t, texts(t, f, 10), "three")
+}
+
+func TestFollowerTruncation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	write(t, path, "first line\nsecond line\n", os.O_TRUNC)
+
+	f, err := openFollower(path, position{}, false)
+	if err != nil {
+		t.Fatalf("openFollower failed: %v", err)
+	}
+	defer f.close()
+
+	expect(t, texts(t, f, 10), "first line", "second line")
+
+	// copytruncate empties the file in place
+	write(t, path, "new\n", os.O_TRUNC)
+	expect(t, texts(t, f, 10))
+	expect(t, texts(t, f, 10), "new")
+}
+
+func TestFollowerRemoved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	write(t, path, "one\ntwo", os.O_TRUNC)
+
+	f, err := openFollower(path, position{}, false)
+	if err != nil {
+		t.Fatalf("openFollower failed: %v", err)
+	}
+	defer f.close()
+
+	expect(t, texts(t, f, 10), "one")
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("failed to remove: %v", err)
+	}
+
+	expect(t, texts(t, f, 10), "two")
+	if !f.removed || len(f.partial) != 0 {
+		t.Errorf("follower of a removed file is removed=%v with %d bytes left", f.removed, len(f.partial))
+	}
+}
+
+func TestStateRestore(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		path = filepath.Join(dir, "app.log")
+	)
+	write(t, path, "one\ntwo\nthree\n", os.O_TRUNC)
+
+	f, err := openFollower(path, position{}, false)
+	if err != nil {
+		t.Fatalf("openFollower failed: %v", err)
+	}
+
+	expect(t, texts(t, f, 1), "one")
+	f.close()
+
+	st, err := loadState(filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatalf("loadState failed: %v", err)
+	}
+	st.Positions[path] = f.position()
+
+	if err := st.save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	restored, err := loadState(st.path)
+	if err != nil {
+		t.Fatalf("loadState failed: %v", err)
+	}
+
+	if restored.Positions[path] != f.position() {
+		t.Fatalf("state restored %+v, expected %+v", restored.Positions[path], f.position())
+	}
+
+	for _, tc := range []struct {
+		name    string
+		pos     position
+		seekEnd bool
+		want    []string
+	}{
+		{"saved position", restored.Positions[path], true, []string{"two", "three"}},
+		{"new file starts at its end", position{}, true, []string{}},
+		{"new file shipped from the start", position{}, false, []string{"one", "two", "three"}},
+		{"replaced file", position{Inode: f.inode + 1, Offset: 4}, true, []string{"one", "two", "three"}},
+		{"offset past the end", position{Inode: f.inode, Offset: 100}, true, []string{"one", "two", "three"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := openFollower(path, tc.pos, tc.seekEnd)
+			if err != nil {
+				t.Fatalf("openFollower failed: %v", err)
+			}
+			defer f.close()
+
+			expect(t, texts(t, f, 10), tc.want...)
+		})
+	}
+
+	// a state file which can't be decoded is an error rather than a
+	// silent restart from scratch
+	write(t, st.path, "{{{", os.O_TRUNC)
+	if _, err := loadState(st.path); err == nil {
+		t.Errorf("loadState of a corrupt file succeeded")
+	}
+}
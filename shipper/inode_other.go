@@ -0,0 +1,8 @@
+//go:build !unix
+
+package shipper
+
+import "os"
+
+// inode is not available, rotation is only detected by truncation
+func inode(fi os.FileInfo) uint64 { return 0 }
@@ -0,0 +1,17 @@
+//go:build unix
+
+package shipper
+
+import (
+	"os"
+	"syscall"
+)
+
+// inode identifies the file behind a path, so that a rotated file is
+// told apart from the one which replaced it
+func inode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,76 @@
+package shipper
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// position is how far a file has been shipped
+type position struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// state is the set of shipped positions, persisted as JSON so that a
+// restarted agent continues where it stopped
+type state struct {
+	path      string
+	Positions map[string]position `json:"positions"`
+}
+
+func loadState(path string) (*state, error) {
+	st := &state{path: path, Positions: map[string]position{}}
+
+	bt, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read state file")
+	}
+
+	if err := json.Unmarshal(bt, st); err != nil {
+		return nil, errors.Wrap(err, "failed to decode state file")
+	}
+
+	if st.Positions == nil {
+		st.Positions = map[string]position{}
+	}
+
+	return st, nil
+}
+
+// save writes the state to a temporary file and renames it over the
+// previous one, a crash never leaves a partially written state behind
+func (s *state) save() error {
+	bt, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode state")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return errors.Wrap(err, "failed to create state file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(bt); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write state file")
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write state file")
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to write state file")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), s.path), "failed to replace state file")
+}
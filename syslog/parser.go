@@ -0,0 +1,301 @@
+package syslog
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errBadPriority  = errors.New("invalid syslog priority")
+	errBadHeader    = errors.New("invalid syslog header")
+	errBadStructure = errors.New("invalid syslog structured data")
+)
+
+// nilValue is used by RFC 5424 for fields which are not present
+const nilValue = "-"
+
+// defaultPriority is user.notice, used by RFC 3164 for messages without PRI
+const defaultPriority = 13
+
+// Message is a syslog message parsed from either RFC 5424 or RFC 3164
+type Message struct {
+	Facility       int
+	Severity       int
+	Timestamp      time.Time
+	Hostname       string
+	AppName        string
+	ProcID         string
+	MsgID          string
+	StructuredData map[string]map[string]string
+	Message        string
+}
+
+// severityLevels maps syslog severities onto crud.ValidLogLevels
+var severityLevels = [...]string{
+	0: "fatal", // emergency
+	1: "fatal", // alert
+	2: "fatal", // critical
+	3: "error", // error
+	4: "warn",  // warning
+	5: "info",  // notice
+	6: "info",  // informational
+	7: "debug", // debug
+}
+
+// Level returns the klg log level for the severity of the message
+func (m *Message) Level() string { return SeverityLevel(m.Severity) }
+
+// SeverityLevel maps a syslog severity, 0 (emergency) to 7 (debug),
+// onto a klg log level
+func SeverityLevel(severity int) string { return severityLevels[severity&7] }
+
+// Metadata returns the syslog header fields of the message, leaving out
+// the ones which are not present
+func (m *Message) Metadata() map[string]interface{} {
+	md := map[string]interface{}{
+		"facility": m.Facility,
+		"severity": m.Severity,
+	}
+
+	for key, value := range map[string]string{
+		"hostname": m.Hostname,
+		"app_name": m.AppName,
+		"procid":   m.ProcID,
+		"msgid":    m.MsgID,
+	} {
+		if value != "" && value != nilValue {
+			md[key] = value
+		}
+	}
+
+	if len(m.StructuredData) > 0 {
+		sd := make(map[string]interface{}, len(m.StructuredData))
+		for id, params := range m.StructuredData {
+			pm := make(map[string]interface{}, len(params))
+			for k, v := range params {
+				pm[k] = v
+			}
+			sd[id] = pm
+		}
+		md["structured_data"] = sd
+	}
+
+	return md
+}
+
+// Parse parses a single syslog message. Messages with a version after
+// PRI are parsed as RFC 5424, everything else as RFC 3164.
+func Parse(raw []byte) (*Message, error) {
+	raw = bytes.TrimRight(raw, "\r\n\x00")
+
+	if len(raw) == 0 || raw[0] != '<' {
+		// RFC 3164 4.3.3, relays add a PRI to messages without one
+		return parse3164(defaultPriority, raw, time.Now())
+	}
+
+	end := bytes.IndexByte(raw, '>')
+	if end < 2 || end > 4 {
+		return nil, errBadPriority
+	}
+
+	pri, err := strconv.Atoi(string(raw[1:end]))
+	if err != nil || pri > 191 {
+		return nil, errBadPriority
+	}
+
+	rest := raw[end+1:]
+	if len(rest) > 1 && rest[0] >= '1' && rest[0] <= '9' && rest[1] == ' ' {
+		return parse5424(pri, rest[2:])
+	}
+
+	return parse3164(pri, rest, time.Now())
+}
+
+// field pops a space separated field from the front of buf
+func field(buf []byte) (string, []byte) {
+	ix := bytes.IndexByte(buf, ' ')
+	if ix < 0 {
+		return string(buf), nil
+	}
+	return string(buf[:ix]), buf[ix+1:]
+}
+
+func parse5424(pri int, buf []byte) (*Message, error) {
+	msg := &Message{Facility: pri >> 3, Severity: pri & 7}
+
+	var ts string
+	ts, buf = field(buf)
+	if ts != nilValue {
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			return nil, errors.Wrap(errBadHeader, "invalid timestamp")
+		}
+		msg.Timestamp = t
+	}
+
+	msg.Hostname, buf = field(buf)
+	msg.AppName, buf = field(buf)
+	msg.ProcID, buf = field(buf)
+	msg.MsgID, buf = field(buf)
+
+	if len(buf) == 0 {
+		return nil, errors.Wrap(errBadHeader, "structured data missing")
+	}
+
+	if buf[0] == '-' {
+		buf = buf[1:]
+	} else {
+		sd, rest, err := parseStructuredData(buf)
+		if err != nil {
+			return nil, err
+		}
+		msg.StructuredData, buf = sd, rest
+	}
+
+	if len(buf) > 0 && buf[0] == ' ' {
+		buf = buf[1:]
+	}
+
+	// MSG may be prefixed with a UTF-8 BOM
+	buf = bytes.TrimPrefix(buf, []byte("\xEF\xBB\xBF"))
+	msg.Message = string(buf)
+	return msg, nil
+}
+
+// parseStructuredData parses one or more SD-ELEMENTs,
+// e.g. [exampleSDID@32473 iut="3" eventSource="Application"]
+func parseStructuredData(buf []byte) (map[string]map[string]string, []byte, error) {
+	sd := map[string]map[string]string{}
+
+	for len(buf) > 0 && buf[0] == '[' {
+		buf = buf[1:]
+
+		end := bytes.IndexAny(buf, " ]")
+		if end <= 0 {
+			return nil, nil, errBadStructure
+		}
+
+		id := string(buf[:end])
+		params := map[string]string{}
+		buf = buf[end:]
+
+		for len(buf) > 0 && buf[0] == ' ' {
+			buf = buf[1:]
+
+			eq := bytes.IndexByte(buf, '=')
+			if eq <= 0 || len(buf) < eq+2 || buf[eq+1] != '"' {
+				return nil, nil, errBadStructure
+			}
+
+			name := string(buf[:eq])
+			buf = buf[eq+2:]
+
+			var (
+				value   strings.Builder
+				escaped = false
+				closed  = false
+				ix      = 0
+			)
+
+			for ; ix < len(buf); ix++ {
+				c := buf[ix]
+				if escaped {
+					// only ", \ and ] are escaped, anything else keeps the backslash
+					if c != '"' && c != '\\' && c != ']' {
+						value.WriteByte('\\')
+					}
+					value.WriteByte(c)
+					escaped = false
+					continue
+				}
+
+				if c == '\\' {
+					escaped = true
+					continue
+				}
+
+				if c == '"' {
+					closed = true
+					break
+				}
+
+				value.WriteByte(c)
+			}
+
+			if !closed {
+				return nil, nil, errBadStructure
+			}
+
+			params[name] = value.String()
+			buf = buf[ix+1:]
+		}
+
+		if len(buf) == 0 || buf[0] != ']' {
+			return nil, nil, errBadStructure
+		}
+
+		buf = buf[1:]
+		sd[id] = params
+	}
+
+	return sd, buf, nil
+}
+
+// rfc3164Stamp is the timestamp layout of RFC 3164, e.g. "Oct 11 22:14:15"
+const rfc3164Stamp = "Jan _2 15:04:05"
+
+func parse3164(pri int, buf []byte, now time.Time) (*Message, error) {
+	msg := &Message{Facility: pri >> 3, Severity: pri & 7}
+
+	if len(buf) >= len(rfc3164Stamp) {
+		t, err := time.ParseInLocation(rfc3164Stamp, string(buf[:len(rfc3164Stamp)]), now.Location())
+		if err == nil {
+			// the timestamp doesn't carry a year, assume the most recent one
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.Add(24 * time.Hour)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+
+			msg.Timestamp = t
+			buf = bytes.TrimLeft(buf[len(rfc3164Stamp):], " ")
+			msg.Hostname, buf = field(buf)
+		}
+	}
+
+	// TAG is alphanumeric, terminated by "[pid]:", ":" or a space
+	tagEnd := 0
+	for tagEnd < len(buf) && tagEnd < 48 {
+		c := buf[tagEnd]
+		if c == '[' || c == ':' || c == ' ' {
+			break
+		}
+		tagEnd++
+	}
+
+	if tagEnd > 0 && tagEnd < len(buf) && (buf[tagEnd] == '[' || buf[tagEnd] == ':') {
+		msg.AppName = string(buf[:tagEnd])
+		rest := buf[tagEnd:]
+
+		if rest[0] == '[' {
+			if end := bytes.IndexByte(rest, ']'); end > 0 {
+				msg.ProcID = string(rest[1:end])
+				rest = rest[end+1:]
+			}
+		}
+
+		rest = bytes.TrimPrefix(rest, []byte(":"))
+		buf = bytes.TrimPrefix(rest, []byte(" "))
+	}
+
+	if !utf8.Valid(buf) {
+		buf = bytes.ToValidUTF8(buf, []byte("�"))
+	}
+
+	msg.Message = string(buf)
+	return msg, nil
+}
@@ -0,0 +1,206 @@
+package syslog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestParse5424(t *testing.T) {
+	stamp := time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC)
+
+	for _, tc := range []struct {
+		name string
+		raw  string
+		want Message
+	}{
+		{
+			name: "without structured data",
+			raw:  "<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - \xEF\xBB\xBF'su root' failed for lonvick on /dev/pts/8\n",
+			want: Message{
+				Facility: 4, Severity: 2, Timestamp: stamp,
+				Hostname: "mymachine.example.com", AppName: "su", ProcID: "-", MsgID: "ID47",
+				Message: "'su root' failed for lonvick on /dev/pts/8",
+			},
+		},
+		{
+			name: "with structured data",
+			raw:  `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"] An application event log entry`,
+			want: Message{
+				Facility: 20, Severity: 5, Timestamp: stamp,
+				Hostname: "mymachine.example.com", AppName: "evntslog", ProcID: "-", MsgID: "ID47",
+				StructuredData: map[string]map[string]string{
+					"exampleSDID@32473": {"iut": "3", "eventSource": "Application", "eventID": "1011"},
+				},
+				Message: "An application event log entry",
+			},
+		},
+		{
+			name: "several elements without message",
+			raw:  `<165>1 2003-10-11T22:14:15.003Z host app 1234 - [exampleSDID@32473 iut="3"][examplePriority@32473 class="high"]`,
+			want: Message{
+				Facility: 20, Severity: 5, Timestamp: stamp,
+				Hostname: "host", AppName: "app", ProcID: "1234", MsgID: "-",
+				StructuredData: map[string]map[string]string{
+					"exampleSDID@32473":     {"iut": "3"},
+					"examplePriority@32473": {"class": "high"},
+				},
+			},
+		},
+		{
+			name: "escaped values and an element without params",
+			raw:  `<14>1 2003-10-11T22:14:15.003Z host app - - [origin][meta a="x\"y\]z\\w\q"] escaped`,
+			want: Message{
+				Facility: 1, Severity: 6, Timestamp: stamp,
+				Hostname: "host", AppName: "app", ProcID: "-", MsgID: "-",
+				StructuredData: map[string]map[string]string{
+					"origin": {},
+					"meta":   {"a": `x"y]z\w\q`},
+				},
+				Message: "escaped",
+			},
+		},
+		{
+			name: "nil timestamp with a byte order mark only",
+			raw:  "<0>1 - - - - - - \xEF\xBB\xBF",
+			want: Message{
+				Hostname: "-", AppName: "-", ProcID: "-", MsgID: "-",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := Parse([]byte(tc.raw))
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+
+			if !reflect.DeepEqual(*msg, tc.want) {
+				t.Errorf("Parse returned\n%+v\nexpected\n%+v", *msg, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		want error
+	}{
+		{"<>1 - - - - - -", errBadPriority},
+		{"<192>1 - - - - - -", errBadPriority},
+		{"<1x>1 - - - - - -", errBadPriority},
+		{"<12345>1 - - - - - -", errBadPriority},
+		{"<34>1 2003-10-11 host app - - - bad timestamp", errBadHeader},
+		{"<34>1 - host app - -", errBadHeader},
+		{`<34>1 - host app - - [id a="unterminated]`, errBadStructure},
+		{`<34>1 - host app - - [id a=unquoted]`, errBadStructure},
+		{`<34>1 - host app - - [id a="1"`, errBadStructure},
+		{`<34>1 - host app - - [ a="1"]`, errBadStructure},
+	} {
+		if _, err := Parse([]byte(tc.raw)); errors.Cause(err) != tc.want {
+			t.Errorf("Parse(%q) returned %v, expected %v", tc.raw, err, tc.want)
+		}
+	}
+}
+
+func TestParse3164(t *testing.T) {
+	now := time.Date(2026, 1, 5, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name string
+		raw  string
+		want Message
+	}{
+		{
+			name: "timestamp of the previous year",
+			raw:  "Oct 11 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8",
+			want: Message{
+				Timestamp: time.Date(2025, 10, 11, 22, 14, 15, 0, time.UTC),
+				Hostname:  "mymachine", AppName: "su",
+				Message: "'su root' failed for lonvick on /dev/pts/8",
+			},
+		},
+		{
+			name: "space padded day and a pid",
+			raw:  "Jan  5 10:00:00 host sshd[4721]: Accepted publickey",
+			want: Message{
+				Timestamp: time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC),
+				Hostname:  "host", AppName: "sshd", ProcID: "4721",
+				Message: "Accepted publickey",
+			},
+		},
+		{
+			name: "a day ahead of the clock stays in this year",
+			raw:  "Jan  6 08:00:00 host cron: tick",
+			want: Message{
+				Timestamp: time.Date(2026, 1, 6, 8, 0, 0, 0, time.UTC),
+				Hostname:  "host", AppName: "cron", Message: "tick",
+			},
+		},
+		{
+			name: "without tag",
+			raw:  "Oct 11 22:14:15 host just a message",
+			want: Message{
+				Timestamp: time.Date(2025, 10, 11, 22, 14, 15, 0, time.UTC),
+				Hostname:  "host", Message: "just a message",
+			},
+		},
+		{
+			name: "without timestamp there is no hostname",
+			raw:  "app: hello",
+			want: Message{AppName: "app", Message: "hello"},
+		},
+		{
+			name: "invalid timestamp is part of the message",
+			raw:  "Foo 11 22:14:15 host app: hello",
+			want: Message{Message: "Foo 11 22:14:15 host app: hello"},
+		},
+		{
+			name: "invalid utf-8",
+			raw:  "app: caf\xe9",
+			want: Message{AppName: "app", Message: "caf�"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := parse3164(13, []byte(tc.raw), now)
+			if err != nil {
+				t.Fatalf("parse3164 failed: %v", err)
+			}
+
+			tc.want.Facility, tc.want.Severity = 1, 5
+			if !reflect.DeepEqual(*msg, tc.want) {
+				t.Errorf("parse3164 returned\n%+v\nexpected\n%+v", *msg, tc.want)
+			}
+		})
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	for _, tc := range []struct {
+		raw      string
+		facility int
+		severity int
+		level    string
+		message  string
+	}{
+		// RFC 3164 messages without PRI are user.notice
+		{"app: hello", 1, 5, "info", "hello"},
+		{"<0>app: down", 0, 0, "fatal", "down"},
+		{"<11>app: failed", 1, 3, "error", "failed"},
+		{"<191>app: trace", 23, 7, "debug", "trace"},
+		{"<12>1 - - - - - - retrying", 1, 4, "warn", "retrying"},
+	} {
+		msg, err := Parse([]byte(tc.raw))
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", tc.raw, err)
+		}
+
+		if msg.Facility != tc.facility || msg.Severity != tc.severity || msg.Level() != tc.level || msg.Message != tc.message {
+			t.Errorf("Parse(%q) returned %d/%d %s %q, expected %d/%d %s %q",
+				tc.raw, msg.Facility, msg.Severity, msg.Level(), msg.Message,
+				tc.facility, tc.severity, tc.level, tc.message)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package syslog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/pkg/errors"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+// maxMessageSize is the largest message accepted over either transport
+const maxMessageSize = 64 * 1024
+
+// Server receives syslog messages over UDP and TCP and stores them
+// through crud.Service
+type Server struct {
+	logger  log.Logger
+	service crud.Service
+
+	udpAddr string
+	tcpAddr string
+
+	mu     sync.Mutex
+	closed bool
+	udp    net.PacketConn
+	tcp    net.Listener
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+// Open starts the enabled listeners and blocks until the server is closed
+func (s *Server) Open() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+
+	if s.udpAddr != "" {
+		udp, err := net.ListenPacket("udp", s.udpAddr)
+		if err != nil {
+			s.mu.Unlock()
+			return errors.Wrap(err, "failed to listen for syslog on udp")
+		}
+		s.udp = udp
+	}
+
+	if s.tcpAddr != "" {
+		tcp, err := net.Listen("tcp", s.tcpAddr)
+		if err != nil {
+			s.mu.Unlock()
+			if s.udp != nil {
+				s.udp.Close()
+			}
+			return errors.Wrap(err, "failed to listen for syslog on tcp")
+		}
+		s.tcp = tcp
+	}
+
+	if s.udp != nil {
+		s.logger.Info("--- Starting Syslog UDP ---", log.String("addr", s.udp.LocalAddr().String()))
+		s.wg.Add(1)
+		go s.serveUDP()
+	}
+
+	if s.tcp != nil {
+		s.logger.Info("--- Starting Syslog TCP ---", log.String("addr", s.tcp.Addr().String()))
+		s.wg.Add(1)
+		go s.serveTCP()
+	}
+
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// Close stops the listeners and drops open connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	if s.udp != nil {
+		s.udp.Close()
+	}
+
+	if s.tcp != nil {
+		s.tcp.Close()
+	}
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, _, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+			s.logger.Error("failed to read syslog datagram", log.Error(err))
+			continue
+		}
+
+		s.handle(buf[:n])
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+			s.logger.Error("failed to accept syslog connection", log.Error(err))
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		// a connection accepted while Close runs is missed by its loop
+		// over the connections
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn reads messages from a stream, supporting both octet counting
+// and newline delimited framing from RFC 6587
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	rd := bufio.NewReaderSize(conn, maxMessageSize)
+	for {
+		first, err := rd.Peek(1)
+		if err != nil {
+			return
+		}
+
+		var frame []byte
+		if first[0] >= '1' && first[0] <= '9' {
+			frame, err = readOctetCounted(rd)
+		} else {
+			frame, err = rd.ReadSlice('\n')
+			if err == bufio.ErrBufferFull {
+				s.logger.Error("syslog message too long, closing connection")
+				return
+			}
+		}
+
+		if len(frame) > 0 {
+			s.handle(frame)
+		}
+
+		if err != nil {
+			if err != io.EOF && !s.isClosed() {
+				s.logger.Error("failed to read syslog message", log.Error(err))
+			}
+			return
+		}
+	}
+}
+
+func readOctetCounted(rd *bufio.Reader) ([]byte, error) {
+	length, err := rd.ReadString(' ')
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(length[:len(length)-1])
+	if err != nil || n <= 0 || n > maxMessageSize {
+		return nil, errors.New("invalid syslog frame length")
+	}
+
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(rd, frame); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+func (s *Server) handle(raw []byte) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return
+	}
+
+	msg, err := Parse(raw)
+	if err != nil {
+		s.logger.Error("failed to parse syslog message", log.Error(err))
+		return
+	}
+
+	entry := crud.NewLogEntry(msg.Level(), msg.Message, msg.Metadata())
+	if !msg.Timestamp.IsZero() {
+		entry.Timestamp = msg.Timestamp.UnixNano()
+	}
+
+	errs, err := s.service.CreateMany(context.Background(), []*crud.LogEntry{entry})
+	if err == nil && errs[0] != nil && errors.Cause(errs[0]) != crud.ErrQueued {
+		err = errs[0]
+	}
+
+	if err != nil {
+		s.logger.Error("failed to store syslog message", log.Error(err))
+	}
+}
+
+// NewServer returns a syslog server listening on the given addresses,
+// an empty address disables that transport
+func NewServer(
+	logger log.Logger,
+	service crud.Service,
+	udpAddr string,
+	tcpAddr string,
+) (*Server, error) {
+	if udpAddr == "" && tcpAddr == "" {
+		return nil, errors.New("either udp or tcp address is required for syslog")
+	}
+
+	return &Server{
+		logger:  logger,
+		service: service,
+		udpAddr: udpAddr,
+		tcpAddr: tcpAddr,
+		conns:   map[net.Conn]struct{}{},
+	}, nil
+}
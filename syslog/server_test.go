@@ -0,0 +1,74 @@
+package syslog
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bhuvankumar123/klg/crud"
+	"github.com/unbxd/go-base/utils/log"
+)
+
+// TestServerClose closes the server while clients keep their connections
+// open, Open returns once they are dropped
+func TestServerClose(t *testing.T) {
+	logger, err := log.NewZapLogger(log.ZapWithLevel("error"))
+	if err != nil {
+		t.Fatalf("failed to create logger: %v", err)
+	}
+
+	store, err := crud.NewService(time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+
+	s, err := NewServer(logger, store, "", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- s.Open() }()
+
+	var addr net.Addr
+	for deadline := time.Now().Add(5 * time.Second); addr == nil; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("server didn't start")
+		}
+
+		s.mu.Lock()
+		if s.tcp != nil {
+			addr = s.tcp.Addr()
+		}
+		s.mu.Unlock()
+	}
+
+	// clients connecting until the server is closed
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			if conn, err := net.Dial("tcp", addr.String()); err == nil {
+				defer conn.Close()
+			}
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	s.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Open returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Open didn't return after Close")
+	}
+}
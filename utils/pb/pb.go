@@ -0,0 +1,68 @@
+package pb
+
+import (
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field is a single field read from a protobuf encoded message. Depending
+// on the wire type either Varint, Fixed or Bytes is set.
+type Field struct {
+	Number protowire.Number
+	Type   protowire.Type
+
+	Varint uint64
+	Fixed  uint64
+	Bytes  []byte
+}
+
+// String returns the length delimited value as a string
+func (f *Field) String() string { return string(f.Bytes) }
+
+// Int64 returns the varint value as a signed integer
+func (f *Field) Int64() int64 { return int64(f.Varint) }
+
+// Fields walks over the top level fields of a protobuf encoded message,
+// calling fn for every field in the order they were written. Groups are
+// skipped as no message read by klg uses them.
+func Fields(b []byte, fn func(f *Field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errors.Wrap(protowire.ParseError(n), "failed to read field tag")
+		}
+		b = b[n:]
+
+		f := Field{Number: num, Type: typ}
+
+		switch typ {
+		case protowire.VarintType:
+			f.Varint, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.Fixed = uint64(v)
+		case protowire.Fixed64Type:
+			f.Fixed, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			f.Bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n >= 0 {
+				b = b[n:]
+				continue
+			}
+		}
+
+		if n < 0 {
+			return errors.Wrapf(protowire.ParseError(n), "failed to read field %d", num)
+		}
+		b = b[n:]
+
+		if err := fn(&f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package pb
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestFields(t *testing.T) {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, 150)
+	b = protowire.AppendTag(b, 2, protowire.Fixed32Type)
+	b = protowire.AppendFixed32(b, 7)
+	b = protowire.AppendTag(b, 3, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, 1<<40)
+	b = protowire.AppendTag(b, 4, protowire.BytesType)
+	b = protowire.AppendString(b, "klg")
+
+	// groups are skipped
+	b = protowire.AppendTag(b, 5, protowire.StartGroupType)
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, 1)
+	b = protowire.AppendTag(b, 5, protowire.EndGroupType)
+
+	b = protowire.AppendTag(b, 6, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(1<<64-2))
+
+	fields := []Field{}
+	err := Fields(b, func(f *Field) error {
+		fields = append(fields, *f)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Fields failed: %v", err)
+	}
+
+	if len(fields) != 5 {
+		t.Fatalf("Fields read %d fields, expected 5", len(fields))
+	}
+
+	for _, tc := range []struct {
+		field Field
+		ok    bool
+	}{
+		{fields[0], fields[0].Number == 1 && fields[0].Type == protowire.VarintType && fields[0].Varint == 150},
+		{fields[1], fields[1].Number == 2 && fields[1].Fixed == 7},
+		{fields[2], fields[2].Number == 3 && fields[2].Fixed == 1<<40},
+		{fields[3], fields[3].Number == 4 && fields[3].String() == "klg"},
+		{fields[4], fields[4].Number == 6 && fields[4].Int64() == -2},
+	} {
+		if !tc.ok {
+			t.Errorf("Fields read %+v", tc.field)
+		}
+	}
+}
+
+func TestFieldsErrors(t *testing.T) {
+	var valid []byte
+	valid = protowire.AppendTag(valid, 1, protowire.BytesType)
+	valid = protowire.AppendString(valid, "klg")
+
+	for _, tc := range []struct {
+		name string
+		raw  []byte
+	}{
+		{"truncated tag", []byte{0x80}},
+		{"truncated varint", []byte{0x08, 0x96}},
+		{"truncated fixed64", []byte{0x19, 1, 2}},
+		{"truncated bytes", valid[:len(valid)-1]},
+		{"field number zero", []byte{0x00, 0x01}},
+		{"unterminated group", []byte{0x2b}},
+	} {
+		if err := Fields(tc.raw, func(*Field) error { return nil }); err == nil {
+			t.Errorf("Fields of %s succeeded", tc.name)
+		}
+	}
+
+	// errors of fn stop the walk
+	calls := 0
+	stop := errors.New("stop")
+	err := Fields(append(valid, valid...), func(*Field) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("Fields returned %v after %d calls, expected the error of the first call", err, calls)
+	}
+}